@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -14,8 +16,34 @@ import (
 
 var (
 	rootCmd = &cobra.Command{
-		Use:           "datasafed",
-		Short:         "`datasafed` is a command line tool for managing remote storages.",
+		Use:   "datasafed",
+		Short: "`datasafed` is a command line tool for managing remote storages.",
+		Long: strings.TrimSpace(`
+` + "`datasafed`" + ` is a command line tool for managing remote storages.
+
+The metrics of the storage operations, i.e. the number of operations, errors
+and bytes, and the histogram of durations, labeled by the operation and the
+backend type, can be exported in the Prometheus format when the command exits,
+whether it succeeds or fails. They are written to the file specified by the
+DATASAFED_METRICS_TEXTFILE environment variable or the "metrics_textfile" key
+of the "datasafed" section in the config file, e.g. for the textfile collector
+of the node exporter, and pushed to the Pushgateway at the URL specified by
+DATASAFED_METRICS_PUSHGATEWAY or "metrics_pushgateway", with the job name
+DATASAFED_METRICS_JOB or "metrics_job" ("datasafed" by default). The labels in
+DATASAFED_METRICS_LABELS or "metrics_labels", e.g. "backup=b1,namespace=ns1",
+are added to all metrics, and used as the grouping key of the Pushgateway.
+
+The storage operations can be traced with OpenTelemetry, with a span for each
+operation of each layer, i.e. "compressed", "encrypted", "kopia", "sanitized"
+(which prepends DATASAFED_BACKEND_BASE_PATH to the paths) and "rclone",
+carrying the path, the number of bytes and the error. Tracing is enabled if the
+OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment
+variable is set, e.g. to "http://localhost:4318" of a local collector, and the
+spans are exported with OTLP over HTTP, which is configured by the standard
+OTEL_* environment variables. The span of the command is a
+child of the span in the TRACEPARENT environment variable if it's set, e.g. to
+nest under the trace of the backup.
+`),
 		SilenceErrors: true,
 		SilenceUsage:  true,
 	}
@@ -29,6 +57,10 @@ var (
 func init() {
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		appCtx = logging.WithLogger(appCtx, logging.DefaultLoggerFactory)
+		var err error
+		if appCtx, err = app.InitTracing(appCtx, cmd.CommandPath()); err != nil {
+			return err
+		}
 		if !doNotInitStorage {
 			if err := app.InitGlobalStorage(appCtx, configFile); err != nil {
 				return err
@@ -41,6 +73,7 @@ func init() {
 	}
 	rootCmd.PersistentPostRunE = func(cmd *cobra.Command, args []string) error {
 		app.InvokeFinalizers()
+		app.InvokeExitHooks()
 		return nil
 	}
 	rootCmd.PersistentFlags().StringVarP(&configFile, "conf", "c",
@@ -55,10 +88,37 @@ func RootCommand() *cobra.Command {
 	return rootCmd
 }
 
+const (
+	exitCodeError = 1
+	// the content doesn't match the stored digest, or is missing or corrupt
+	exitCodeVerifyFailed = 3
+	// the condition of a conditional push is not met
+	exitCodePreconditionFailed = 4
+	// the lock is held by others
+	exitCodeLocked = 5
+)
+
 func exitIfError(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
-		os.Exit(1)
+		app.RecordCommandError(appCtx, err)
+		app.InvokeExitHooks()
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns a distinct exit code for the errors that scripts may
+// want to handle differently.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrChecksumMismatch), errors.Is(err, storage.ErrVerifyFailed):
+		return exitCodeVerifyFailed
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		return exitCodePreconditionFailed
+	case errors.Is(err, storage.ErrLocked):
+		return exitCodeLocked
+	default:
+		return exitCodeError
 	}
 }
 
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushVerify(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte(strings.Repeat("datasafed", 1000))
+	r := runDatasafed(t, dir, content, nil, "push", "--verify", "-", "a/b.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.FileExists(t, filepath.Join(dir, "a/b.txt.sha256"))
+
+	// the sidecar file is hidden from list
+	r = runDatasafed(t, dir, nil, nil, "list", "-r", "/")
+	require.Equal(t, "a/\na/b.txt\n", r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "list", "-r", "-a", "/")
+	require.Equal(t, "a/\na/b.txt\na/b.txt.sha256\n", r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "stat", "--json", "/")
+	require.JSONEq(t, `{"total_size":9000,"entries":2,"dirs":1,"files":1}`, r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "stat", "-a", "--json", "/")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Contains(t, r.stdout, `"files":2`)
+
+	// a user file ending with the suffix is listed, if there is no file
+	// with its name
+	r = runDatasafed(t, dir, []byte("notes"), nil, "push", "-", "a/c.sha256")
+	require.Zero(t, r.exitCode, r.stderr)
+	r = runDatasafed(t, dir, nil, nil, "list", "-r", "/")
+	require.Equal(t, "a/\na/b.txt\na/c.sha256\n", r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "list", "a/")
+	require.Equal(t, "a/b.txt\na/c.sha256\n", r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "stat", "--json", "a/")
+	require.JSONEq(t, `{"total_size":9005,"entries":2,"dirs":0,"files":2}`, r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "stat", "--json", "a/b.txt")
+	require.JSONEq(t, `{"total_size":9000,"entries":1,"dirs":0,"files":1}`, r.stdout)
+
+	// a failed conditional push keeps the sidecar file
+	r = runDatasafed(t, dir, []byte("new"), nil, "push", "--no-clobber", "-", "a/b.txt")
+	require.Equal(t, exitCodePreconditionFailed, r.exitCode)
+	require.FileExists(t, filepath.Join(dir, "a/b.txt.sha256"))
+
+	// overwriting without --verify removes the stale sidecar file
+	r = runDatasafed(t, dir, []byte("new"), nil, "push", "-", "a/b.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.NoFileExists(t, filepath.Join(dir, "a/b.txt.sha256"))
+}
+
+func TestPullVerify(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte(strings.Repeat("datasafed", 1000))
+	r := runDatasafed(t, dir, content, nil, "push", "--verify", "-", "a.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+
+	r = runDatasafed(t, dir, nil, nil, "pull", "a.txt", "-")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Equal(t, string(content), r.stdout)
+	lpath := filepath.Join(t.TempDir(), "a.txt")
+	r = runDatasafed(t, dir, nil, nil, "pull", "--streams", "2", "--chunk-size", "1000", "a.txt", lpath)
+	require.Zero(t, r.exitCode, r.stderr)
+
+	// corrupt the remote file
+	corrupted := append([]byte{}, content...)
+	corrupted[100] = 'x'
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), corrupted, 0644))
+
+	for _, args := range [][]string{
+		{"pull", "a.txt", "-"},
+		{"pull", "--streams", "2", "--chunk-size", "1000", "a.txt", lpath},
+	} {
+		r = runDatasafed(t, dir, nil, nil, args...)
+		require.Equal(t, exitCodeVerifyFailed, r.exitCode, args)
+		require.Contains(t, r.stderr, "checksum mismatch", args)
+	}
+
+	r = runDatasafed(t, dir, nil, nil, "pull", "--no-verify", "a.txt", "-")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Equal(t, string(corrupted), r.stdout)
+}
+
+func TestExitCode(t *testing.T) {
+	dir := t.TempDir()
+	r := runDatasafed(t, dir, nil, nil, "pull", "missing", "-")
+	require.Equal(t, exitCodeError, r.exitCode)
+}
+
+func TestPushPreconditionFailed(t *testing.T) {
+	dir := t.TempDir()
+	r := runDatasafed(t, dir, []byte("hello"), nil, "push", "--no-clobber", "-", "a.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+
+	for _, args := range [][]string{
+		{"push", "--no-clobber", "-", "a.txt"},
+		{"push", "--if-match", "size=4", "-", "a.txt"},
+		{"push", "--if-match", "size=5", "-", "b.txt"},
+	} {
+		r = runDatasafed(t, dir, []byte("new"), nil, args...)
+		require.Equal(t, exitCodePreconditionFailed, r.exitCode, args)
+		require.Contains(t, r.stderr, "precondition failed", args)
+	}
+
+	// the etag is only supported on S3
+	r = runDatasafed(t, dir, []byte("new"), nil, "push", "--if-match", "etag=0123", "-", "a.txt")
+	require.Equal(t, exitCodeError, r.exitCode)
+	require.Contains(t, r.stderr, "not supported")
+
+	r = runDatasafed(t, dir, []byte("new"), nil, "push", "--if-match", "size=5", "-", "a.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+	data, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
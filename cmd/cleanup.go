@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+type cleanupOptions struct {
+	olderThan time.Duration
+	dryRun    bool
+}
+
+func init() {
+	opts := &cleanupOptions{}
+	cmd := &cobra.Command{
+		Use:   "cleanup [--older-than DURATION] [--dry-run] rpath",
+		Short: "Remove the uploaded parts of abandoned resumable pushes.",
+		Long: strings.TrimSpace(`
+Remove the "<rpath>.partial" directories of resumable pushes in the remote
+path recursively, if no part has been uploaded to them within the duration
+specified by --older-than. The multipart uploads recorded in them are aborted,
+so that the backend removes the uploaded parts. For the directories without a
+valid manifest, the latest modification time of their files is used instead,
+so that a push which has just started is kept.
+`),
+		Example: strings.TrimSpace(`
+# Show the partial uploads which would be removed
+datasafed cleanup --dry-run backups/
+
+# Remove the partial uploads not updated for 3 days
+datasafed cleanup --older-than 72h backups/
+`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doCleanup(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.DurationVar(&opts.olderThan, "older-than", 24*time.Hour, "only remove the partial uploads not updated within the duration")
+	pflags.BoolVar(&opts.dryRun, "dry-run", false, "only print the partial uploads to remove")
+	rootCmd.AddCommand(cmd)
+}
+
+func doCleanup(opts *cleanupOptions, cmd *cobra.Command, args []string) error {
+	uploads, err := storage.ListPartialUploads(appCtx, globalStorage, args[0])
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-opts.olderThan)
+	for _, upload := range uploads {
+		if upload.Updated.After(deadline) {
+			continue
+		}
+		if opts.dryRun {
+			fmt.Printf("Would remove %s\n", upload.Path)
+			continue
+		}
+		if err := storage.RemovePartialUpload(appCtx, globalStorage, upload); err != nil {
+			return fmt.Errorf("remove %q: %w", upload.Path, err)
+		}
+		fmt.Printf("Removed %s\n", upload.Path)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+type transferOptions struct {
+	recursive bool
+}
+
+func init() {
+	opts := &transferOptions{}
+	cmd := &cobra.Command{
+		Use:   "cp [-r] src dst",
+		Short: "Copy one remote file, or all files in a remote directory.",
+		Long: strings.TrimSpace(`
+Copy files inside the remote storage. The files are copied on the server side
+if the backend supports it, otherwise they are streamed through datasafed.
+The destination file is overwritten if it exists.
+`),
+		Example: strings.TrimSpace(`
+# Copy a single file
+datasafed cp some/path/to/file.txt another/path/file.txt
+
+# Recursively copy a directory
+datasafed cp -r staging/backup-1 final/backup-1
+`),
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doTransfer(opts, args[0], args[1], globalStorage.Copy)
+			exitIfError(err)
+		},
+	}
+	cmd.PersistentFlags().BoolVarP(&opts.recursive, "recursive", "r", false, "copy recursively")
+	rootCmd.AddCommand(cmd)
+}
+
+// doTransfer copies or moves src to dst with fn. If recursive is true, src is
+// a directory, and each file in it is transferred to the same relative path
+// in dst.
+func doTransfer(opts *transferOptions, src, dst string,
+	fn func(ctx context.Context, src, dst string) error) error {
+	if !opts.recursive {
+		if err := fn(appCtx, src, dst); err != nil {
+			return err
+		}
+		return transferChecksum(src, dst, fn)
+	}
+	srcDir := cleanDir(src)
+	dstDir := cleanDir(dst)
+	if isSubDir(dstDir, srcDir) {
+		return fmt.Errorf("unable to transfer %q into itself %q", src, dst)
+	}
+	var files []string
+	err := globalStorage.List(appCtx, srcDir+"/", &storage.ListOptions{Recursive: true, FilesOnly: true},
+		func(de storage.DirEntry) error {
+			if !de.IsDir() {
+				files = append(files, de.Path())
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		rel := strings.TrimPrefix(f, srcDir+"/")
+		if err := fn(appCtx, f, path.Join(dstDir, rel)); err != nil {
+			return fmt.Errorf("transfer %q error: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// transferChecksum transfers the sidecar file of src along with it, the files
+// in a directory don't need it since their sidecar files are listed as well.
+func transferChecksum(src, dst string,
+	fn func(ctx context.Context, src, dst string) error) error {
+	err := fn(appCtx, storage.ChecksumPath(src), storage.ChecksumPath(dst))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		// the sidecar file of dst is stale if src doesn't have one
+		return storage.RemoveChecksum(appCtx, globalStorage, dst)
+	}
+	return err
+}
+
+// cleanDir cleans the directory path, the root directory is "".
+func cleanDir(rpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+rpath), "/")
+}
+
+// isSubDir returns true if dir is parent or parent's subdirectory.
+func isSubDir(dir, parent string) bool {
+	return parent == "" || dir == parent || strings.HasPrefix(dir, parent+"/")
+}
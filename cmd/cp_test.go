@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+// useLocalStorage sets globalStorage to a local storage in a temporary
+// directory, and returns the directory.
+func useLocalStorage(t *testing.T) string {
+	dir := t.TempDir()
+	st, err := rclone.New(context.Background(), map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	old := globalStorage
+	globalStorage = st
+	t.Cleanup(func() { globalStorage = old })
+	return dir
+}
+
+func pushContent(t *testing.T, rpath, content string) {
+	require.NoError(t, globalStorage.Push(appCtx, strings.NewReader(content), rpath))
+}
+
+func pullContent(t *testing.T, rpath string) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, globalStorage.Pull(appCtx, rpath, buf))
+	return buf.String()
+}
+
+func TestCopyFile(t *testing.T) {
+	useLocalStorage(t)
+	pushContent(t, "a.txt", "hello")
+	digest := strings.Repeat("ab", 32)
+	require.NoError(t, storage.WriteChecksum(appCtx, globalStorage, "a.txt", digest))
+
+	// the sidecar file is copied along with the file
+	require.NoError(t, doTransfer(&transferOptions{}, "a.txt", "b.txt", globalStorage.Copy))
+	require.Equal(t, "hello", pullContent(t, "b.txt"))
+	got, err := storage.ReadChecksum(appCtx, globalStorage, "b.txt")
+	require.NoError(t, err)
+	require.Equal(t, digest, got)
+
+	// the stale sidecar file of the destination is removed
+	pushContent(t, "c.txt", "world")
+	require.NoError(t, doTransfer(&transferOptions{}, "c.txt", "b.txt", globalStorage.Copy))
+	require.Equal(t, "world", pullContent(t, "b.txt"))
+	_, err = storage.ReadChecksum(appCtx, globalStorage, "b.txt")
+	require.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func TestCopyDir(t *testing.T) {
+	useLocalStorage(t)
+	files := map[string]string{"a": "1", "sub/b": "2", "sub/deep/c": "3"}
+	for name, content := range files {
+		pushContent(t, "src/"+name, content)
+	}
+
+	require.NoError(t, doTransfer(&transferOptions{recursive: true}, "src/", "dst", globalStorage.Copy))
+	for name, content := range files {
+		require.Equal(t, content, pullContent(t, "src/"+name))
+		require.Equal(t, content, pullContent(t, "dst/"+name))
+	}
+
+	err := doTransfer(&transferOptions{recursive: true}, "src", "src/sub/copy", globalStorage.Copy)
+	require.ErrorContains(t, err, "into itself")
+	err = doTransfer(&transferOptions{recursive: true}, "src", "/", globalStorage.Copy)
+	require.NoError(t, err)
+	require.Equal(t, "3", pullContent(t, "sub/deep/c"))
+}
+
+func TestMoveDir(t *testing.T) {
+	dir := useLocalStorage(t)
+	files := map[string]string{"a": "1", "sub/b": "2", "sub/deep/c": "3"}
+	for name, content := range files {
+		pushContent(t, "src/"+name, content)
+	}
+
+	doMv(&transferOptions{recursive: true}, nil, []string{"src", "dst/"})
+	for name, content := range files {
+		require.Equal(t, content, pullContent(t, "dst/"+name))
+	}
+	// the empty directories are removed
+	_, err := os.Stat(filepath.Join(dir, "src"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	doMv(&transferOptions{}, nil, []string{"dst/sub/b", "b"})
+	require.Equal(t, "2", pullContent(t, "b"))
+	err = globalStorage.Pull(appCtx, "dst/sub/b", &bytes.Buffer{})
+	require.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/app"
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+type gcOptions struct {
+	olderThan time.Duration
+	dryRun    bool
+}
+
+func init() {
+	opts := &gcOptions{}
+	cmd := &cobra.Command{
+		Use:   "gc [--older-than DURATION] [--dry-run] [rpath]",
+		Short: "Remove the temporary objects left by crashed atomic pushes.",
+		Long: strings.TrimSpace(`
+If atomic pushes are enabled by the DATASAFED_ATOMIC_PUSH environment variable
+or the "atomic_push" key of the "datasafed" section in the config file, files
+are uploaded to hidden temporary objects, which are verified and then renamed
+to the final names. The temporary objects left by crashed pushes are hidden
+from "list", and this command removes them if they are older than the duration
+specified by --older-than.
+
+The rpath is a path in the backend, without the layers of kopia, encryption
+and compression, e.g. it contains the encrypted names if filenames are
+encrypted. The whole backend is scanned if it's omitted.
+`),
+		Example: strings.TrimSpace(`
+# Show the temporary objects which would be removed
+datasafed gc --dry-run
+
+# Remove the temporary objects older than 1 hour in a directory
+datasafed gc --older-than 1h backups/
+`),
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doGC(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.DurationVar(&opts.olderThan, "older-than", 24*time.Hour, "only remove the temporary objects older than the duration")
+	pflags.BoolVar(&opts.dryRun, "dry-run", false, "only print the temporary objects to remove")
+	rootCmd.AddCommand(cmd)
+}
+
+func doGC(opts *gcOptions, cmd *cobra.Command, args []string) error {
+	st, err := app.GetBaseStorage()
+	if err != nil {
+		return err
+	}
+	rpath := "/"
+	if len(args) > 0 {
+		rpath = args[0]
+	}
+	deadline := time.Now().Add(-opts.olderThan)
+	var temps []storage.DirEntry
+	err = st.List(appCtx, rpath, &storage.ListOptions{FilesOnly: true, Recursive: true, ShowTemp: true}, func(de storage.DirEntry) error {
+		if storage.IsTempObject(de.Name()) && de.MTime().Before(deadline) {
+			temps = append(temps, de)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, de := range temps {
+		if opts.dryRun {
+			fmt.Printf("Would remove %s\n", de.Path())
+			continue
+		}
+		if err := st.Remove(appCtx, de.Path(), false); err != nil {
+			return fmt.Errorf("remove %q: %w", de.Path(), err)
+		}
+		fmt.Printf("Removed %s\n", de.Path())
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{"a", "sub/b", ".datasafed-tmp-0123", "sub/.datasafed-tmp-4567", "sub/.datasafed-tmp-89ab"}
+	old := time.Now().Add(-2 * time.Hour)
+	for i, name := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(name), 0644))
+		// the last temporary object is of a running push
+		if i < len(files)-1 {
+			require.NoError(t, os.Chtimes(p, old, old))
+		}
+	}
+
+	// the temporary objects are hidden from list
+	r := runDatasafed(t, dir, nil, nil, "list", "-r", "-f", "/")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.ElementsMatch(t, []string{"a", "sub/b"}, splitLines(r.stdout))
+
+	r = runDatasafed(t, dir, nil, nil, "gc", "--older-than", "1h", "--dry-run")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.ElementsMatch(t, []string{"Would remove .datasafed-tmp-0123", "Would remove sub/.datasafed-tmp-4567"}, splitLines(r.stdout))
+	for _, name := range files {
+		require.FileExists(t, filepath.Join(dir, name))
+	}
+
+	r = runDatasafed(t, dir, nil, nil, "gc", "--older-than", "1h")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.ElementsMatch(t, []string{"Removed .datasafed-tmp-0123", "Removed sub/.datasafed-tmp-4567"}, splitLines(r.stdout))
+	require.NoFileExists(t, filepath.Join(dir, ".datasafed-tmp-0123"))
+	require.NoFileExists(t, filepath.Join(dir, "sub/.datasafed-tmp-4567"))
+	for _, name := range []string{"a", "sub/b", "sub/.datasafed-tmp-89ab"} {
+		require.FileExists(t, filepath.Join(dir, name))
+	}
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.TrimSpace(s), "\n")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+// hashTypeETag prints the ETags of the stored objects instead of the hashes.
+const hashTypeETag = "etag"
+
+type hashOptions struct {
+	hashType string
+}
+
+func init() {
+	opts := &hashOptions{}
+	validHashTypes := append(storage.SupportedHashTypes(), hashTypeETag)
+	cmd := &cobra.Command{
+		Use:   "hash [--type hashType] rpath",
+		Short: "Print the hashes of a remote file, or all files in a remote directory.",
+		Long: strings.TrimSpace(`
+Print the hashes of files in the same format as sha256sum and md5sum.
+
+The hash provided by the backend is used if available, otherwise it's
+computed by reading the content of the file. The hashes of encrypted or
+compressed files are always computed from the original content.
+
+With --type etag, the ETags of the stored objects are printed instead, which
+are only supported on S3. They can be passed to "push --if-match etag=...",
+which replaces the file only if it's not changed by another writer.
+`),
+		Example: strings.TrimSpace(`
+# Print the sha256 hash of a file
+datasafed hash path/to/file.txt
+
+# Print the md5 hashes of all files in a directory
+datasafed hash --type md5 path/to/dir/
+
+# Print the ETag of a file on S3
+datasafed hash --type etag path/to/file.txt
+`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			doHash(opts, cmd, args)
+		},
+	}
+	cmd.PersistentFlags().Var(util.NewEnumVar(validHashTypes, &opts.hashType).Default(storage.HashSHA256), "type",
+		fmt.Sprintf("hash type, choices: %q", validHashTypes))
+	rootCmd.AddCommand(cmd)
+}
+
+func doHash(opts *hashOptions, cmd *cobra.Command, args []string) {
+	rpath := args[0]
+	lopts := &storage.ListOptions{
+		FilesOnly: true,
+		Recursive: true,
+		Hashes:    true,
+	}
+	err := globalStorage.List(appCtx, rpath, lopts, func(entry storage.DirEntry) error {
+		if entry.IsDir() {
+			return nil
+		}
+		var h string
+		var err error
+		if opts.hashType == hashTypeETag {
+			h, err = storage.FileETag(appCtx, globalStorage, entry.Path())
+		} else {
+			h, err = storage.FileHash(appCtx, globalStorage, entry, opts.hashType)
+		}
+		if err != nil {
+			return fmt.Errorf("hash %q error: %w", entry.Path(), err)
+		}
+		fmt.Printf("%s  %s\n", h, entry.Path())
+		return nil
+	})
+	exitIfError(err)
+}
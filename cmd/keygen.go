@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+)
+
+type keygenOptions struct {
+	output string
+}
+
+func init() {
+	opts := &keygenOptions{}
+	cmd := &cobra.Command{
+		Use:   "keygen [-o identity-file]",
+		Short: "Generate a key pair for public-key encryption.",
+		Long: strings.TrimSpace(`
+Generate a X25519 key pair for public-key encryption. The public key is
+printed to stderr, and can be set to DATASAFED_ENCRYPTION_RECIPIENTS for
+jobs only pushing files. The private key is printed to stdout or written to
+the identity file, and can be set to DATASAFED_ENCRYPTION_IDENTITY or
+DATASAFED_ENCRYPTION_IDENTITY_FILE for jobs pulling files.
+`),
+		Example: strings.TrimSpace(`
+# Generate a key pair and save the private key to a file
+datasafed keygen -o identity.txt
+`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doKeygen(opts, cmd, args)
+			exitIfError(err)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			doNotInitStorage = true
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "write the private key to the file instead of stdout")
+	rootCmd.AddCommand(cmd)
+}
+
+func doKeygen(opts *keygenOptions, cmd *cobra.Command, args []string) error {
+	identity, recipient, err := encryption.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("# public key: %s\n%s\n", recipient, identity)
+	if opts.output == "" {
+		fmt.Print(content)
+	} else {
+		f, err := os.OpenFile(opts.output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Public key: %s\n", recipient)
+	return nil
+}
@@ -34,13 +34,27 @@ type listOptions struct {
 	older       int64
 	namePattern string
 	format      string
+	all         bool
 }
 
 func init() {
 	opts := &listOptions{}
 	cmd := &cobra.Command{
-		Use:   "list [-d|-f] [-r] [--max-depth depth] [-s sortBy] [--reverse] [--newer-than time] [--older-than time] [--name pattern] [-o outputFormat] rpath",
+		Use:   "list [-a] [-d|-f] [-r] [--max-depth depth] [-s sortBy] [--reverse] [--newer-than time] [--older-than time] [--name pattern] [-o outputFormat] rpath",
 		Short: "List contents of a remote directory or file.",
+		Long: strings.TrimSpace(`
+List contents of a remote directory or file.
+
+The sidecar files storing the digests of files pushed with --verify
+("<rpath>.sha256") are hidden unless --all is given, if their files are listed
+as well.
+
+The size of a single listed file is the size of its original content. To
+avoid reading every file, compressed files in a directory listing are listed
+with their stored sizes, which are usually smaller than their original sizes,
+and every stored file ending with ".z" is listed as a compressed file. List a
+single file for its exact size, or its full name if it's not compressed.
+`),
 		Example: strings.TrimSpace(`
 # List the root directory
 datasafed list /
@@ -78,6 +92,7 @@ datasafed list --name "*.txt" /some/dir/
 		"list only entries whose name matches the specified pattern (https://pkg.go.dev/path/filepath#Match)")
 	pflags.VarP(util.NewEnumVar(validOutputFormats, &opts.format).Default("short"), "output-format", "o",
 		fmt.Sprintf("output format, choices: %q", validOutputFormats))
+	pflags.BoolVarP(&opts.all, "all", "a", false, "list the hidden files as well, i.e. the checksum sidecar files and the locks")
 
 	cmd.MarkFlagsMutuallyExclusive("dirs-only", "files-only")
 	cmd.MarkFlagsMutuallyExclusive("recursive", "sort")
@@ -89,22 +104,23 @@ func doList(opts *listOptions, cmd *cobra.Command, args []string) {
 	bufStdout := bufio.NewWriterSize(os.Stdout, 8*1024)
 	filter := getFilterFn(opts)
 	printer := getPrinter(opts, bufStdout)
-	var cb func(storage.DirEntry) error
+	hidden := newHiddenEntries(opts.all)
 	var entries []storage.DirEntry
-	if opts.recursive {
-		cb = func(entry storage.DirEntry) error {
-			if filter(entry) {
-				printer.printItem(entry)
-			}
-			return nil
+	emit := func(entry storage.DirEntry) {
+		if !filter(entry) {
+			return
 		}
-	} else {
-		cb = func(entry storage.DirEntry) error {
-			if filter(entry) {
-				entries = append(entries, entry)
-			}
-			return nil
+		if opts.recursive {
+			printer.printItem(entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	cb := func(entry storage.DirEntry) error {
+		if hidden.visible(entry) {
+			emit(entry)
 		}
+		return nil
 	}
 
 	if opts.recursive {
@@ -116,9 +132,13 @@ func doList(opts *listOptions, cmd *cobra.Command, args []string) {
 		FilesOnly: opts.filesOnly,
 		Recursive: opts.recursive,
 		MaxDepth:  opts.maxDepth,
+		Hashes:    opts.format == "json",
 	}
 	err := globalStorage.List(appCtx, rpath, lopts, cb)
 	exitIfError(err)
+	for _, entry := range hidden.orphans() {
+		emit(entry)
+	}
 	if opts.recursive {
 		printer.printFooter()
 	}
@@ -169,6 +189,66 @@ func getFilterFn(opts *listOptions) func(entry storage.DirEntry) bool {
 	}
 }
 
+// hiddenEntries hides the locks, and the checksum sidecar files of the files
+// listed along with them. The sidecar files of missing files are user files
+// which happen to end with the suffix, they are held until the listing is
+// done, and then returned by orphans().
+type hiddenEntries struct {
+	all      bool
+	files    map[string]bool
+	sidecars map[string]storage.DirEntry // by the paths of their files
+}
+
+func newHiddenEntries(all bool) *hiddenEntries {
+	return &hiddenEntries{
+		all:      all,
+		files:    map[string]bool{},
+		sidecars: map[string]storage.DirEntry{},
+	}
+}
+
+// visible returns false if the entry is hidden, or held until the end.
+func (h *hiddenEntries) visible(entry storage.DirEntry) bool {
+	if h.all {
+		return true
+	}
+	if isLockEntry(entry) {
+		return false
+	}
+	if entry.IsDir() {
+		return true
+	}
+	if storage.IsChecksumFile(entry.Name()) {
+		file := strings.TrimSuffix(entry.Path(), storage.ChecksumSuffix)
+		if !h.files[file] {
+			h.sidecars[file] = entry
+		}
+		return false
+	}
+	h.files[entry.Path()] = true
+	delete(h.sidecars, entry.Path())
+	return true
+}
+
+// orphans returns the held sidecar files whose files are not listed.
+func (h *hiddenEntries) orphans() []storage.DirEntry {
+	var result []storage.DirEntry
+	for _, entry := range h.sidecars {
+		result = append(result, entry)
+	}
+	slices.SortFunc(result, func(a, b storage.DirEntry) int {
+		return cmp.Compare(a.Path(), b.Path())
+	})
+	return result
+}
+
+// isLockEntry returns true if the entry is the directory of the locks, or in
+// it.
+func isLockEntry(entry storage.DirEntry) bool {
+	p := strings.Trim(entry.Path(), "/")
+	return p == storage.LockDir || strings.HasPrefix(p, storage.LockDir+"/")
+}
+
 func printJson(entry storage.DirEntry, enc *json.Encoder) {
 	type jsonEntry struct {
 		Path     string `json:"path"`
@@ -176,6 +256,8 @@ func printJson(entry storage.DirEntry, enc *json.Encoder) {
 		MTime    int64  `json:"mtime"`
 		MTimeStr string `json:"mtime_str"`
 		IsDir    bool   `json:"is_dir"`
+		// hashes provided by the backend, keyed by the hash type
+		Hashes map[string]string `json:"hashes,omitempty"`
 	}
 	_ = enc.Encode(jsonEntry{
 		Path:     entry.Path(),
@@ -183,6 +265,7 @@ func printJson(entry storage.DirEntry, enc *json.Encoder) {
 		MTime:    entry.MTime().Unix(),
 		MTimeStr: entry.MTime().Format(time.RFC3339),
 		IsDir:    entry.IsDir(),
+		Hashes:   entry.Hashes(),
 	})
 }
 
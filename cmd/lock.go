@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/app"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/kopia"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+type lockAcquireOptions struct {
+	shared bool
+	owner  string
+	ttl    time.Duration
+	wait   time.Duration
+}
+
+type lockReleaseOptions struct {
+	all bool
+}
+
+type lockStatusOptions struct {
+	format string
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Manage the advisory locks stored in the remote storage.",
+		Long: strings.TrimSpace(`
+Locks are objects stored in the remote storage, in the ".datasafed-locks"
+directory, or in the "<repo root>.locks" directory of the kopia repository in
+kopia mode. Each holder of a lock writes an object with its owner, hostname and
+an expiring lease, which is refreshed periodically while the lock is in use.
+A lock whose lease is expired is ignored and removed by the next acquirer, so a
+crashed holder never blocks others forever.
+
+An exclusive lock conflicts with all other holders, while shared locks only
+conflict with exclusive ones. In kopia mode, writes hold the "` + kopia.RepoLockName + `" lock
+in shared mode, and maintenance holds it in exclusive mode, so they never run
+at the same time. Maintenance is skipped if the lock is held by others. The
+lock costs several requests for each write, i.e. listing the locks twice, and
+writing, reading and removing the lock object. If maintenance never runs at
+the same time as writes, set the DATASAFED_KOPIA_DISABLE_WRITE_LOCK environment
+variable to true to skip it.
+
+The locks are hidden from "list" unless --all is specified.
+
+The commands exit with code 5 if the lock is held by others.
+`),
+	}
+	cmd.AddCommand(newLockAcquireCommand(), newLockReleaseCommand(), newLockStatusCommand())
+	rootCmd.AddCommand(cmd)
+}
+
+func newLockAcquireCommand() *cobra.Command {
+	opts := &lockAcquireOptions{}
+	cmd := &cobra.Command{
+		Use:   "acquire [--shared] [--owner owner] [--ttl duration] [--wait duration] name [-- command [args...]]",
+		Short: "Acquire a lock.",
+		Long: strings.TrimSpace(`
+Acquire the lock and print its token, which is used to release it. The lease
+of the lock lasts for the duration specified by --ttl, and it's not refreshed
+after the command exits.
+
+If a command is given, it's run while holding the lock, whose lease is
+refreshed until the command exits. Then the lock is released, and the exit
+code of the command is returned.
+`),
+		Example: strings.TrimSpace(`
+# Acquire a lock for 1 hour, and release it later
+token=$(datasafed lock acquire --ttl 1h backup)
+datasafed lock release backup "$token"
+
+# Block kopia writes and maintenance while running a command
+DATASAFED_KOPIA_REPO_ROOT=kopia datasafed lock acquire repository -- ./check.sh
+`),
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doLockAcquire(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVar(&opts.shared, "shared", false, "acquire the lock in shared mode")
+	pflags.StringVar(&opts.owner, "owner", "datasafed", "owner of the lock, shown by \"lock status\"")
+	pflags.DurationVar(&opts.ttl, "ttl", 10*time.Minute, "duration of the lease")
+	pflags.DurationVar(&opts.wait, "wait", 0, "max duration to wait for the lock, fail immediately if it's 0")
+	return cmd
+}
+
+func newLockReleaseCommand() *cobra.Command {
+	opts := &lockReleaseOptions{}
+	cmd := &cobra.Command{
+		Use:   "release name token | release --all name",
+		Short: "Release a lock.",
+		Long: strings.TrimSpace(`
+Release the lock held by the token, as printed by "lock acquire" and "lock
+status". With --all, the lock is released for all holders, e.g. to recover from
+crashed holders without waiting for their leases to expire. Releasing the lock
+of others is unsafe if they are still running.
+`),
+		Example: strings.TrimSpace(`
+# Release a lock by its token
+datasafed lock release backup 1f0e7b4c9a2d3e5f6a7b8c9d0e1f2a3b
+
+# Release the lock for all holders
+datasafed lock release --all backup
+`),
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doLockRelease(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVar(&opts.all, "all", false, "release the lock for all holders")
+	return cmd
+}
+
+func newLockStatusCommand() *cobra.Command {
+	opts := &lockStatusOptions{}
+	validFormats := []string{"short", "json"}
+	cmd := &cobra.Command{
+		Use:   "status [-o outputFormat] [name]",
+		Short: "Show the holders of the locks.",
+		Long: strings.TrimSpace(`
+Show the holders of the lock, or of all locks if the name is omitted. The
+expired holders are marked, and they are removed when the lock is acquired.
+`),
+		Example: strings.TrimSpace(`
+# Show the holders of all locks
+datasafed lock status
+
+# Show the holders of a lock in JSON
+datasafed lock status -o json backup
+`),
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doLockStatus(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	opts.format = "short"
+	pflags := cmd.PersistentFlags()
+	pflags.VarP(util.NewEnumVar(validFormats, &opts.format), "output", "o",
+		fmt.Sprintf("output format, choices: %q", validFormats))
+	return cmd
+}
+
+func doLockAcquire(opts *lockAcquireOptions, cmd *cobra.Command, args []string) error {
+	st, err := app.GetLockStorage()
+	if err != nil {
+		return err
+	}
+	name := args[0]
+	var command []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		if dash != 1 {
+			return fmt.Errorf("expected a single lock name before \"--\", got %q", args[:dash])
+		}
+		command = args[1:]
+		if len(command) == 0 {
+			return fmt.Errorf("the command after \"--\" is empty")
+		}
+	} else if len(args) > 1 {
+		return fmt.Errorf("expected a single lock name, use \"--\" before the command")
+	}
+	mode := storage.LockExclusive
+	if opts.shared {
+		mode = storage.LockShared
+	}
+	lock, err := storage.AcquireLock(appCtx, st, name, storage.LockOptions{
+		Mode:  mode,
+		Owner: opts.owner,
+		TTL:   opts.ttl,
+		Wait:  opts.wait,
+	})
+	if err != nil {
+		return err
+	}
+	if len(command) == 0 {
+		fmt.Println(lock.Info().Token)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(appCtx)
+	defer cancel(nil)
+	lock.KeepAlive(ctx, cancel)
+	c := exec.CommandContext(ctx, command[0], command[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	runErr := c.Run()
+	if err := lock.Release(appCtx); err != nil {
+		return err
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		return fmt.Errorf("command is killed: %w", cause)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		app.InvokeFinalizers()
+		app.InvokeExitHooks()
+		os.Exit(exitErr.ExitCode())
+	}
+	return runErr
+}
+
+func doLockRelease(opts *lockReleaseOptions, cmd *cobra.Command, args []string) error {
+	st, err := app.GetLockStorage()
+	if err != nil {
+		return err
+	}
+	name := args[0]
+	if opts.all == (len(args) == 2) {
+		return fmt.Errorf("either the token or --all should be specified")
+	}
+	if !opts.all {
+		return storage.RemoveLock(appCtx, st, name, args[1])
+	}
+	infos, err := storage.ListLocks(appCtx, st, name)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := storage.RemoveLock(appCtx, st, name, info.Token); err != nil {
+			return err
+		}
+		fmt.Printf("Released %s\n", info.String())
+	}
+	return nil
+}
+
+func doLockStatus(opts *lockStatusOptions, cmd *cobra.Command, args []string) error {
+	st, err := app.GetLockStorage()
+	if err != nil {
+		return err
+	}
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	infos, err := storage.ListLocks(appCtx, st, name)
+	if err != nil {
+		return err
+	}
+	if opts.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, info := range infos {
+			_ = enc.Encode(info)
+		}
+		return nil
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMODE\tOWNER\tHOSTNAME\tPID\tEXPIRES\tTOKEN")
+	for _, info := range infos {
+		expires := info.Expires.Format(time.RFC3339)
+		if info.Expired(now) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			info.Name, info.Mode, info.Owner, info.Hostname, info.PID, expires, info.Token)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockCommands(t *testing.T) {
+	dir := t.TempDir()
+	r := runDatasafed(t, dir, []byte("hello"), nil, "push", "-", "a.txt")
+	require.Zero(t, r.exitCode, r.stderr)
+	r = runDatasafed(t, dir, nil, nil, "lock", "acquire", "--owner", "test", "--ttl", "1h", "backup")
+	require.Zero(t, r.exitCode, r.stderr)
+	token := strings.TrimSpace(r.stdout)
+	require.Len(t, token, 32)
+
+	// the lock is held by others
+	for _, args := range [][]string{
+		{"lock", "acquire", "backup"},
+		{"lock", "acquire", "--shared", "backup"},
+		{"lock", "acquire", "backup", "--", "true"},
+	} {
+		r = runDatasafed(t, dir, nil, nil, args...)
+		require.Equal(t, exitCodeLocked, r.exitCode, args)
+		require.Contains(t, r.stderr, `held by exclusive lock by "test"`, args)
+	}
+
+	r = runDatasafed(t, dir, nil, nil, "lock", "status", "-o", "json", "backup")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Contains(t, r.stdout, token)
+
+	// the locks are hidden from list
+	r = runDatasafed(t, dir, nil, nil, "list", "-r", "/")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Equal(t, "a.txt\n", r.stdout)
+	r = runDatasafed(t, dir, nil, nil, "list", "-r", "-a", "/")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Contains(t, r.stdout, ".datasafed-locks/backup/"+token+".json")
+
+	r = runDatasafed(t, dir, nil, nil, "lock", "release", "backup", token)
+	require.Zero(t, r.exitCode, r.stderr)
+
+	// the exit code of the command is returned, and the lock is released
+	r = runDatasafed(t, dir, nil, nil, "lock", "acquire", "backup", "--", "sh", "-c", "exit 7")
+	require.Equal(t, 7, r.exitCode, r.stderr)
+	r = runDatasafed(t, dir, nil, nil, "lock", "status", "backup")
+	require.Zero(t, r.exitCode, r.stderr)
+	require.NotContains(t, r.stdout, "exclusive")
+}
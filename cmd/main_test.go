@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runArgsEnv carries the arguments of the command run by the test binary
+// itself, see runDatasafed.
+const runArgsEnv = "DATASAFED_TEST_RUN_ARGS"
+
+func TestMain(m *testing.M) {
+	if v := os.Getenv(runArgsEnv); v != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(v), &args); err != nil {
+			panic(err)
+		}
+		rootCmd.SetArgs(args)
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type runResult struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+// runDatasafed runs the command in a new process with the environment
+// variables, which is needed to check the exit code. The storage is the
+// local directory.
+func runDatasafed(t *testing.T, dir string, stdin []byte, env []string, args ...string) runResult {
+	data, err := json.Marshal(args)
+	require.NoError(t, err)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), runArgsEnv+"="+string(data), "DATASAFED_LOCAL_BACKEND_PATH="+dir)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	result := runResult{stdout: stdout.String(), stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.exitCode = exitErr.ExitCode()
+	} else {
+		require.NoError(t, err)
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+func init() {
+	opts := &transferOptions{}
+	cmd := &cobra.Command{
+		Use:   "mv [-r] src dst",
+		Short: "Move one remote file, or all files in a remote directory.",
+		Long: strings.TrimSpace(`
+Move files inside the remote storage. The files are moved on the server side
+if the backend supports it, otherwise they are copied and then removed.
+The destination file is overwritten if it exists.
+`),
+		Example: strings.TrimSpace(`
+# Move a single file
+datasafed mv some/path/to/file.txt another/path/file.txt
+
+# Promote a staging backup to its final path
+datasafed mv -r staging/backup-1 final/backup-1
+`),
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			doMv(opts, cmd, args)
+		},
+	}
+	cmd.PersistentFlags().BoolVarP(&opts.recursive, "recursive", "r", false, "move recursively")
+	rootCmd.AddCommand(cmd)
+}
+
+func doMv(opts *transferOptions, cmd *cobra.Command, args []string) {
+	err := doTransfer(opts, args[0], args[1], globalStorage.Move)
+	exitIfError(err)
+	if opts.recursive {
+		removeEmptyDirs(cleanDir(args[0]))
+	}
+}
+
+// removeEmptyDirs removes the empty directories left by moving files,
+// errors are ignored since the directories may not be empty.
+func removeEmptyDirs(dir string) {
+	dirs := []string{dir}
+	_ = globalStorage.List(appCtx, dir+"/", &storage.ListOptions{Recursive: true, DirsOnly: true},
+		func(de storage.DirEntry) error {
+			if de.IsDir() {
+				dirs = append(dirs, de.Path())
+			}
+			return nil
+		})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i] != "" {
+			_ = globalStorage.Rmdir(appCtx, dirs[i])
+		}
+	}
+}
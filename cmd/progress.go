@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/apecloud/datasafed/pkg/app"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+var validProgressFormats = []string{"json"}
+
+type progressOptions struct {
+	format   string
+	file     string
+	interval time.Duration
+}
+
+func (o *progressOptions) addFlags(pflags *pflag.FlagSet) {
+	pflags.Var(util.NewEnumVar(validProgressFormats, &o.format), "progress",
+		fmt.Sprintf("report the progress periodically in the format, choices: %q", validProgressFormats))
+	pflags.StringVar(&o.file, "progress-file", "", "file to write the progress to, defaults to stderr")
+	pflags.DurationVar(&o.interval, "progress-interval", time.Second, "interval of reporting the progress")
+}
+
+func (o *progressOptions) enabled() bool {
+	return o.format != ""
+}
+
+// start starts reporting the progress of the operation if it's enabled. It
+// returns the context carrying the progress, which is updated by the
+// transfers with their own phases, e.g. resumable pushes, and a nil progress
+// if it's not reported. The progress must be finished by the caller, and by
+// finishIfError if the operation fails.
+func (o *progressOptions) start(ctx context.Context, operation, rpath, phase string, total int64) (context.Context, *storage.Progress, error) {
+	if !o.enabled() {
+		return ctx, nil, nil
+	}
+	if o.interval <= 0 {
+		return ctx, nil, fmt.Errorf("invalid --progress-interval %s", o.interval)
+	}
+	var w io.Writer = os.Stderr
+	if o.file != "" {
+		f, err := os.OpenFile(o.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("open --progress-file: %w", err)
+		}
+		app.OnExit(func() { f.Close() })
+		w = f
+	}
+	p := storage.NewProgress(w, operation, rpath, o.interval, phase, total)
+	return storage.WithProgress(ctx, p), p, nil
+}
+
+// finishIfError finishes the progress with the error, and exits.
+func finishIfError(p *storage.Progress, err error) {
+	if err != nil {
+		p.Finish(err)
+		exitIfError(err)
+	}
+}
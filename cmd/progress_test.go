@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+// readProgress returns the events appended to the progress file.
+func readProgress(t *testing.T, path string) []storage.ProgressEvent {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var events []storage.ProgressEvent
+	for _, line := range splitLines(string(data)) {
+		var ev storage.ProgressEvent
+		require.NoError(t, json.Unmarshal([]byte(line), &ev), line)
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestProgress(t *testing.T) {
+	dir := t.TempDir()
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+	progressArgs := []string{"--progress", "json", "--progress-file", progressFile}
+
+	r := runDatasafed(t, dir, []byte("hello"), nil, append([]string{"push", "--no-clobber", "-", "a.txt"}, progressArgs...)...)
+	require.Zero(t, r.exitCode, r.stderr)
+	events := readProgress(t, progressFile)
+	require.Equal(t, storage.PhaseUploading, events[0].Phase)
+	last := events[len(events)-1]
+	require.Equal(t, storage.PhaseCompleted, last.Phase)
+	require.Equal(t, int64(5), last.Bytes)
+
+	// the progress is finished with the error of the failed command
+	require.NoError(t, os.Remove(progressFile))
+	r = runDatasafed(t, dir, []byte("hello"), nil, append([]string{"push", "--no-clobber", "-", "a.txt"}, progressArgs...)...)
+	require.Equal(t, exitCodePreconditionFailed, r.exitCode)
+	events = readProgress(t, progressFile)
+	last = events[len(events)-1]
+	require.Equal(t, storage.PhaseFailed, last.Phase)
+	require.Contains(t, last.Error, `"a.txt" exists`)
+
+	require.NoError(t, os.Remove(progressFile))
+	r = runDatasafed(t, dir, nil, nil, append([]string{"pull", "a.txt", "-"}, progressArgs...)...)
+	require.Zero(t, r.exitCode, r.stderr)
+	require.Equal(t, "hello", r.stdout)
+	events = readProgress(t, progressFile)
+	require.Equal(t, storage.PhaseDownloading, events[0].Phase)
+	require.Equal(t, int64(5), events[0].TotalBytes)
+	require.Equal(t, storage.PhaseCompleted, events[len(events)-1].Phase)
+
+	r = runDatasafed(t, dir, nil, nil, "pull", "--progress", "json", "--progress-interval", "0s", "a.txt", "-")
+	require.Equal(t, exitCodeError, r.exitCode)
+	require.Contains(t, r.stderr, "invalid --progress-interval")
+}
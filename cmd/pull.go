@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -8,13 +10,20 @@ import (
 	"strings"
 
 	"github.com/kopia/kopia/repo/compression"
+	"github.com/rclone/rclone/fs"
 	"github.com/spf13/cobra"
 
+	"github.com/apecloud/datasafed/pkg/storage"
 	"github.com/apecloud/datasafed/pkg/util"
 )
 
 type pullOptions struct {
 	decompression string
+	noVerify      bool
+	streams       int
+	chunkSize     fs.SizeSuffix
+	resume        bool
+	progress      progressOptions
 }
 
 func init() {
@@ -22,13 +31,49 @@ func init() {
 	cmd := &cobra.Command{
 		Use:   "pull rpath lpath",
 		Short: "Pull remote file",
-		Long:  "The `lpath` parameter can be \"-\" to write to stdout.",
+		Long: strings.TrimSpace(`
+The ` + "`lpath`" + ` parameter can be "-" to write to stdout.
+
+If the file is pushed with --verify, the pulled content is verified against
+the stored sha256 digest, and the command exits with code 3 on mismatch.
+
+With --streams N, ranges of --chunk-size bytes are fetched concurrently by N
+streams. They are written at their offsets if lpath is a file, or in order if
+writing to stdout, in which case at most N chunks are held in memory.
+Compressed storages always pull files with a single stream.
+
+With --resume, if lpath exists, only the rest of the file after its length is
+pulled with a ranged read, so an interrupted pull can be continued. The
+existing content is assumed to be a prefix of the remote file.
+
+If reading from the backend fails with a transient error, e.g. a connection
+reset or an HTTP 5xx response, the read is retried with exponential backoff,
+continuing from the last received byte. The pull fails instead if the file is
+changed meanwhile, which is detected by its ETag, or by its size and
+modification time if the backend has no ETags. Listing, stat and removal are
+retried in the same way. The retries are configured by the "max_retries" (3 by
+default, 0 to disable, or the DATASAFED_MAX_RETRIES environment variable),
+"retry_initial_backoff" (1s) and "retry_max_backoff" (30s) keys of the
+"datasafed" section in the config file.
+
+With --progress json, the progress is reported every --progress-interval as a
+line of JSON to stderr, or appended to --progress-file, with the phase
+("downloading" or "verifying"), the bytes pulled, the size of the remote file,
+the rate in bytes per second and the ETA in seconds. The last line has the
+phase "completed", or "failed" with the error.
+`),
 		Example: strings.TrimSpace(`
 # Pull the file and save it to a local path
 datasafed pull some/path/file.txt /tmp/file.txt
 
 # Pull the file and print it to stdout
 datasafed pull some/path/file.txt - | wc -l
+
+# Continue an interrupted pull
+datasafed pull --resume some/path/backup.tar /tmp/backup.tar
+
+# Pull a large file with 8 streams
+datasafed pull --streams 8 --chunk-size 64M some/path/backup.tar /tmp/backup.tar
 `),
 		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
@@ -38,13 +83,23 @@ datasafed pull some/path/file.txt - | wc -l
 	pflags := cmd.PersistentFlags()
 	pflags.VarP(util.NewEnumVar(validCompressionAlgorithms, &opts.decompression), "decompress", "d",
 		fmt.Sprintf("decompress the pulled file using the specified algorithm, choices: %q", validCompressionAlgorithms))
+	pflags.BoolVar(&opts.noVerify, "no-verify", false, "do not verify the pulled content against the stored sha256 digest")
+	pflags.IntVar(&opts.streams, "streams", 1, "number of streams to fetch ranges of the file concurrently")
+	opts.chunkSize = 64 * fs.Mebi
+	pflags.Var(&opts.chunkSize, "chunk-size", "size of the ranges fetched by each stream")
+	pflags.BoolVar(&opts.resume, "resume", false, "continue pulling from the end of the existing local file")
+	opts.progress.addFlags(pflags)
 	rootCmd.AddCommand(cmd)
 }
 
 func doPull(opts *pullOptions, cmd *cobra.Command, args []string) {
 	rpath := args[0]
 	lpath := args[1]
+	if opts.resume && (lpath == "-" || opts.decompression != "" || opts.streams > 1) {
+		exitIfError(fmt.Errorf("--resume requires a local file, and can't be used with --decompress or --streams"))
+	}
 	var out io.Writer
+	var file *os.File
 	var flush func() error
 	if lpath == "-" {
 		out = os.Stdout
@@ -60,9 +115,14 @@ func doPull(opts *pullOptions, cmd *cobra.Command, args []string) {
 		}
 		err := os.MkdirAll(filepath.Dir(lpath), 0755)
 		exitIfError(err)
-		f, err := os.OpenFile(lpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		flag := os.O_RDWR | os.O_CREATE
+		if !opts.resume {
+			flag |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(lpath, flag, 0644)
 		exitIfError(err)
 		out = f
+		file = f
 		flush = func() error { return f.Close() }
 	}
 	if opts.decompression != "" {
@@ -88,12 +148,62 @@ func doPull(opts *pullOptions, cmd *cobra.Command, args []string) {
 			return originalFlush()
 		}
 	}
-	err := globalStorage.Pull(appCtx, rpath, out)
+	pullOpts := storage.ParallelPullOptions{
+		Streams:   opts.streams,
+		ChunkSize: int64(opts.chunkSize),
+	}
+	// write the ranges at their offsets if possible
+	writeAt := file != nil && opts.decompression == "" && (opts.streams > 1 || opts.resume)
+	var expected string
+	hasher := sha256.New()
+	if !opts.noVerify {
+		var err error
+		expected, err = storage.LookupChecksum(appCtx, globalStorage, rpath)
+		exitIfError(err)
+		if expected != "" && !writeAt {
+			out = io.MultiWriter(out, hasher)
+		}
+	}
+	// the progress counts the bytes of the remote file before decompression
+	var total int64 = -1
+	if opts.progress.enabled() {
+		if result, err := globalStorage.Stat(appCtx, rpath); err == nil {
+			total = result.TotalSize
+		}
+	}
+	ctx, progress, err := opts.progress.start(appCtx, "pull", rpath, storage.PhaseDownloading, total)
+	exitIfError(err)
+	if opts.resume {
+		err = storage.ResumePull(ctx, globalStorage, rpath, file)
+	} else if writeAt {
+		err = storage.ParallelPullTo(ctx, globalStorage, rpath, progress.WriterAt(file), pullOpts)
+	} else {
+		err = storage.ParallelPull(ctx, globalStorage, rpath, progress.Writer(out), pullOpts)
+	}
 	if err != nil {
 		err = fmt.Errorf("pull %q: %w", rpath, err)
 	}
 	if ferr := flush(); err == nil {
 		err = ferr
 	}
-	exitIfError(err)
+	finishIfError(progress, err)
+	if expected != "" && writeAt {
+		// the ranges are written out of order or resumed, hash the file afterwards
+		progress.SetPhase(storage.PhaseVerifying)
+		finishIfError(progress, hashFile(lpath, hasher))
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); expected != "" && actual != expected {
+		finishIfError(progress, fmt.Errorf("%w: %q has sha256 %s, expected %s", storage.ErrChecksumMismatch, rpath, actual, expected))
+	}
+	progress.Finish(nil)
+}
+
+func hashFile(lpath string, w io.Writer) error {
+	f, err := os.Open(lpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
@@ -1,15 +1,20 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
-	"sort"
 	"strings"
 
 	"github.com/kopia/kopia/repo/compression"
+	"github.com/rclone/rclone/fs"
 	"github.com/spf13/cobra"
 
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/compressed"
 	"github.com/apecloud/datasafed/pkg/util"
 )
 
@@ -17,11 +22,20 @@ import (
 const compressionHeaderSize = 4
 
 var (
-	validCompressionAlgorithms = getValidCompressionAlgorithms()
+	validCompressionAlgorithms = compressed.SupportedAlgorithms()
 )
 
 type pushOptions struct {
-	compression string
+	compression  string
+	verify       bool
+	partSize     fs.SizeSuffix
+	concurrency  int
+	memoryLimit  fs.SizeSuffix
+	expectedSize fs.SizeSuffix
+	resumable    bool
+	noClobber    bool
+	ifMatch      map[string]string
+	progress     progressOptions
 }
 
 func init() {
@@ -29,13 +43,91 @@ func init() {
 	cmd := &cobra.Command{
 		Use:   "push lpath rpath",
 		Short: "Push file to remote",
-		Long:  "The `lpath` parameter can be '-' to read from stdin.",
+		Long: strings.TrimSpace(`
+The ` + "`lpath`" + ` parameter can be '-' to read from stdin.
+
+The --compress option only compresses the content, and the algorithm must be
+specified again when pulling it. To compress files transparently, set the
+DATASAFED_COMPRESSION environment variable or the "compression" key of the
+"datasafed" section in the config file to the algorithm, then files are
+decompressed automatically when pulled, and their original sizes are listed.
+
+When pushing from stdin to a backend supporting multipart uploads, e.g. S3,
+the stream is split into parts of --part-size bytes, and --upload-concurrency
+parts are uploaded at the same time without spooling to local disk. The part
+size can't be less than the minimum of the backend, which is 5 MiB on S3. The
+parts are buffered in memory, which is limited by --memory-limit. For very large streams,
+specify an upper bound of the size by --expected-size, so the part size is
+increased if the stream doesn't fit into the max number of parts. The defaults
+can be set by the "upload_part_size", "upload_concurrency" and
+"upload_memory_limit" keys of the "datasafed" section in the config file.
+
+With --resumable, the local file is pushed in parts of --part-size bytes (64 MiB
+by default), which are recorded in a manifest in the directory
+"<rpath>.partial". If the push is interrupted, running it again with the same
+file continues from the uploaded parts. On S3, the parts are uploaded to a
+multipart upload of rpath, and joined on the server side. Otherwise, e.g. on
+other backends or with encryption, the parts are stored in the directory, and
+read back to be joined into rpath, so the file is transferred three times.
+After the parts are joined, the directory is removed. Use the "cleanup" command
+to remove the parts of abandoned pushes.
+
+To avoid leaving a truncated file at rpath if the push crashes, set the
+DATASAFED_ATOMIC_PUSH environment variable or the "atomic_push" key of the
+"datasafed" section in the config file to true. Then the file is uploaded to
+a hidden temporary object, whose size and hash are verified before it's
+renamed to rpath. Only the size is verified if the backend has no hash of the
+object, e.g. the files uploaded in multipart on S3. Use the "gc" command to remove the leftover temporary objects.
+
+With --no-clobber, the push fails if rpath exists. It's checked before
+uploading, and before renaming the temporary object of an atomic push, so
+another writer may still create the file meanwhile. With --if-match, the push
+fails if rpath doesn't exist or doesn't match the given size, mtime (in unix
+seconds or RFC3339) or hashes, as printed by "list -o json" and "hash", which
+are checked before uploading. On S3, the etag printed by "hash --type etag" can
+be given as well. The command exits with code 4 if the condition is not met.
+
+If the "conditional_writes" key of the "storage" section in the config file is
+true, the conditions of --no-clobber and the etag of --if-match are also sent
+as the If-None-Match and If-Match headers of the upload, or the copy of the
+temporary object, so S3 rejects the push atomically if another writer changes
+the file meanwhile. It's true by default only for AWS, since other providers
+may ignore the headers, and it's only supported by S3.
+
+The bandwidth of uploads and downloads is limited by the "bwlimit" key of the
+"storage" section in the config file, or the DATASAFED_BWLIMIT environment
+variable, e.g. "10M", "10M:100M" for different upload and download limits, or
+a timetable like "08:00,10M 19:00,off" as the --bwlimit of rclone. The
+number of HTTP requests per second is limited by "tpslimit" and
+"tpslimit_burst", or DATASAFED_TPSLIMIT and DATASAFED_TPSLIMIT_BURST. The
+limits are shared by all transfers of the process.
+
+With --progress json, the progress is reported every --progress-interval as a
+line of JSON to stderr, or appended to --progress-file, with the phase
+("uploading", "joining" the parts of a resumable push, or "verifying"), the
+bytes transferred and the total bytes of the phase, the rate in bytes per
+second, and the ETA in seconds if the size is known, i.e. pushing a regular
+file. The last line has the phase "completed", or "failed" with the error.
+`),
 		Example: strings.TrimSpace(`
 # Push a file to remote
 datasafed push local/path/a.txt remote/path/a.txt
 
 # Upload data from stdin
 datasafed push - remote/path/somefile.txt
+
+# Push a large file, and continue from the uploaded parts if interrupted
+datasafed push --resumable /data/backup.tar remote/path/backup.tar
+
+# Push only if the file doesn't exist
+datasafed push --no-clobber local/path/a.txt remote/path/a.txt
+
+# Push only if the remote file is not changed since it's read
+datasafed push --if-match size=1024,sha256=9f86d08... local/path/a.txt remote/path/a.txt
+
+# Upload a large stream with 8 parts of 64 MiB in flight
+xtrabackup --backup --stream=xbstream | datasafed push --part-size 64M \
+    --upload-concurrency 8 --expected-size 2T - remote/path/backup.xbstream
 `),
 		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
@@ -45,22 +137,26 @@ datasafed push - remote/path/somefile.txt
 	pflags := cmd.PersistentFlags()
 	pflags.VarP(util.NewEnumVar(validCompressionAlgorithms, &opts.compression), "compress", "z",
 		fmt.Sprintf("compress the file using the specified algorithm before sending it to remote, choices: %q", validCompressionAlgorithms))
+	pflags.BoolVar(&opts.verify, "verify", false,
+		"compute the sha256 digest while pushing, verify it against the remote file after pushing, "+
+			"and store it in the sidecar file \"<rpath>.sha256\", which is checked by pull")
+	pflags.Var(&opts.partSize, "part-size", "size of each part of multipart uploads and resumable pushes (default of the backend if 0)")
+	pflags.IntVar(&opts.concurrency, "upload-concurrency", 0, "number of parts uploaded concurrently (default of the backend if 0)")
+	pflags.Var(&opts.memoryLimit, "memory-limit", "limit of the memory for buffering parts, the concurrency is reduced to fit into it (no limit if 0)")
+	pflags.Var(&opts.expectedSize, "expected-size", "upper bound of the size of the pushed stream, used to choose the part size")
+	pflags.BoolVar(&opts.resumable, "resumable", false, "push the local file in parts, which can be resumed if interrupted")
+	pflags.BoolVar(&opts.noClobber, "no-clobber", false, "fail if the remote file exists")
+	pflags.StringToStringVar(&opts.ifMatch, "if-match", nil,
+		fmt.Sprintf("fail if the remote file doesn't match, keys: \"size\", \"mtime\", \"etag\" and hash types %q", storage.SupportedHashTypes()))
+	opts.progress.addFlags(pflags)
 	rootCmd.AddCommand(cmd)
 }
 
-func getValidCompressionAlgorithms() []string {
-	var names []string
-	for name := range compression.ByName {
-		names = append(names, string(name))
-	}
-	sort.Strings(names)
-	return names
-}
-
 func doPush(opts *pushOptions, cmd *cobra.Command, args []string) {
 	lpath := args[0]
 	rpath := args[1]
 	var in io.Reader
+	var file *os.File
 	if lpath == "-" {
 		in = os.Stdin
 	} else {
@@ -68,11 +164,34 @@ func doPush(opts *pushOptions, cmd *cobra.Command, args []string) {
 		exitIfError(err)
 		defer f.Close()
 		in = f
+		file = f
+	}
+	if opts.resumable && (file == nil || opts.compression != "") {
+		exitIfError(fmt.Errorf("--resumable requires a local file, and can't be used with --compress"))
 	}
+	if opts.noClobber && len(opts.ifMatch) > 0 {
+		exitIfError(fmt.Errorf("--no-clobber and --if-match can't be used together"))
+	}
+	var version storage.FileVersion
+	if len(opts.ifMatch) > 0 {
+		var err error
+		version, err = storage.ParseFileVersion(opts.ifMatch)
+		exitIfError(err)
+		if version.ETag != "" && opts.resumable {
+			exitIfError(fmt.Errorf("--if-match etag can't be used with --resumable"))
+		}
+	}
+	if err := storage.CheckPartSize(globalStorage, int64(opts.partSize)); err != nil {
+		exitIfError(fmt.Errorf("invalid --part-size: %w", err))
+	}
+	// the progress counts the bytes of the local file before compression
+	ctx, progress, err := opts.progress.start(appCtx, "push", rpath, storage.PhaseUploading, localFileSize(file))
+	exitIfError(err)
+	in = progress.Reader(in)
 	if opts.compression != "" {
 		c, ok := compression.ByName[compression.Name(opts.compression)]
 		if !ok {
-			exitIfError(fmt.Errorf("bug: compressor for %s is not found", opts.compression))
+			finishIfError(progress, fmt.Errorf("bug: compressor for %s is not found", opts.compression))
 		}
 		pr, pw := io.Pipe()
 		go func(r io.Reader) {
@@ -82,9 +201,74 @@ func doPush(opts *pushOptions, cmd *cobra.Command, args []string) {
 		}(in)
 		in = pr
 	}
-	err := globalStorage.Push(appCtx, in, rpath)
+	// check the condition before touching the remote file
+	if opts.noClobber {
+		exists, err := storage.FileExists(ctx, globalStorage, rpath)
+		finishIfError(progress, err)
+		if exists {
+			finishIfError(progress, fmt.Errorf("%w: %q exists", storage.ErrPreconditionFailed, rpath))
+		}
+	}
+	if len(opts.ifMatch) > 0 {
+		finishIfError(progress, storage.CheckVersion(ctx, globalStorage, rpath, version))
+	}
+	etag := version.ETag
+	var hasher hash.Hash
+	if opts.verify {
+		hasher = sha256.New()
+		in = io.TeeReader(in, hasher)
+	}
+	ctx = storage.WithUploadOptions(ctx, storage.UploadOptions{
+		PartSize:     int64(opts.partSize),
+		Concurrency:  opts.concurrency,
+		MemoryLimit:  int64(opts.memoryLimit),
+		ExpectedSize: int64(opts.expectedSize),
+	})
+	if opts.resumable {
+		var output io.Writer
+		if hasher != nil {
+			output = hasher
+		}
+		err = storage.ResumablePush(ctx, globalStorage, file, rpath, storage.ResumablePushOptions{
+			PartSize:  int64(opts.partSize),
+			Output:    output,
+			NoClobber: opts.noClobber,
+		})
+	} else if opts.noClobber {
+		err = storage.PushIfNotExists(ctx, globalStorage, in, rpath)
+	} else if etag != "" {
+		err = storage.PushIfMatch(ctx, globalStorage, in, rpath, etag)
+	} else {
+		err = globalStorage.Push(ctx, in, rpath)
+	}
 	if err != nil {
-		err = fmt.Errorf("push to %q: %w", rpath, err)
+		finishIfError(progress, fmt.Errorf("push to %q: %w", rpath, err))
 	}
-	exitIfError(err)
+	if opts.verify {
+		progress.SetPhase(storage.PhaseVerifying)
+		digest := hex.EncodeToString(hasher.Sum(nil))
+		err := storage.VerifyChecksum(ctx, globalStorage, rpath, digest)
+		if err != nil {
+			finishIfError(progress, fmt.Errorf("verify %q: %w", rpath, err))
+		}
+		finishIfError(progress, storage.WriteChecksum(ctx, globalStorage, rpath, digest))
+	} else if !opts.noClobber {
+		// the checksum of the overwritten file is stale, a file pushed with
+		// --no-clobber didn't exist, so it has none
+		finishIfError(progress, storage.RemoveChecksum(ctx, globalStorage, rpath))
+	}
+	progress.Finish(nil)
+}
+
+// localFileSize returns the size of the local file, or stdin if it's nil, or
+// -1 if it's not a regular file, e.g. a pipe.
+func localFileSize(f *os.File) int64 {
+	if f == nil {
+		f = os.Stdin
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
 }
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/app"
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+)
+
+type rekeyOptions struct {
+	dryRun      bool
+	concurrency int
+	tempDir     string
+	json        bool
+}
+
+func init() {
+	opts := &rekeyOptions{}
+	cmd := &cobra.Command{
+		Use:   "rekey [--dry-run] [--concurrency N] [--temp-dir DIR] [--json] rpath",
+		Short: "Move encrypted files to a new key or algorithm.",
+		Long: strings.TrimSpace(`
+Move the encrypted files in the remote path to a new key or algorithm.
+
+The current encryption is configured as usual, and the new encryption is
+configured by the same environment variables with the "DATASAFED_NEW_" prefix,
+e.g. DATASAFED_NEW_ENCRYPTION_ALGORITHM and DATASAFED_NEW_ENCRYPTION_PASS_PHRASE.
+
+Files are re-encrypted, or only their data keys are rewrapped if both the
+current and the new encryption use a key provider. Each file is verified and
+uploaded to a temporary object, which is then moved over the original one.
+Files already encrypted with the new encryption are skipped, so an
+interrupted rekey can be resumed by running it again.
+
+The key check object covers all files, so it's replaced only if the whole
+storage ("/") is rekeyed without failures. Sub-paths can be rekeyed one by one,
+and the current encryption is still used until the whole storage is rekeyed,
+which skips the files rekeyed before.
+`),
+		Example: strings.TrimSpace(`
+# Show files to be rekeyed
+DATASAFED_NEW_ENCRYPTION_ALGORITHM=AES-256-GCM \
+DATASAFED_NEW_ENCRYPTION_PASS_PHRASE=new-secret \
+datasafed rekey --dry-run /
+
+# Rekey a sub-path first, and then all files
+DATASAFED_NEW_ENCRYPTION_ALGORITHM=AES-256-GCM \
+DATASAFED_NEW_ENCRYPTION_PASS_PHRASE=new-secret \
+datasafed rekey --concurrency 4 /some/dir/
+
+DATASAFED_NEW_ENCRYPTION_ALGORITHM=AES-256-GCM \
+DATASAFED_NEW_ENCRYPTION_PASS_PHRASE=new-secret \
+datasafed rekey --concurrency 4 /
+`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doRekey(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVar(&opts.dryRun, "dry-run", false, "only show files to be rekeyed")
+	pflags.IntVar(&opts.concurrency, "concurrency", 1, "number of files rekeyed at the same time")
+	pflags.StringVar(&opts.tempDir, "temp-dir", "", "directory of the temporary files, defaults to the system temp directory")
+	pflags.BoolVar(&opts.json, "json", false, "output the summary in json format")
+	rootCmd.AddCommand(cmd)
+}
+
+func doRekey(opts *rekeyOptions, cmd *cobra.Command, args []string) error {
+	to, err := app.CreateNewEncryptor()
+	if err != nil {
+		return err
+	}
+	rpath := args[0]
+	summary, err := encrypted.Rekey(appCtx, globalStorage, rpath, to, encrypted.RekeyOptions{
+		DryRun:      opts.dryRun,
+		Concurrency: opts.concurrency,
+		TempDir:     opts.tempDir,
+		Progress: func(rpath string, action encryption.RekeyAction, err error) {
+			switch {
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "failed %s: %v\n", rpath, err)
+			case action == encryption.RekeyNone:
+				fmt.Fprintf(os.Stderr, "skipped %s\n", rpath)
+			case opts.dryRun:
+				fmt.Fprintf(os.Stderr, "would %s %s\n", action, rpath)
+			default:
+				fmt.Fprintf(os.Stderr, "%s %s\n", action, rpath)
+			}
+		},
+	})
+	if summary != nil {
+		if opts.json {
+			data, _ := json.Marshal(summary)
+			fmt.Printf("%s\n", string(data))
+		} else {
+			fmt.Printf("Total: %d\n", summary.Total)
+			fmt.Printf("Reencrypted: %d\n", summary.Reencrypted)
+			fmt.Printf("Rewrapped: %d\n", summary.Rewrapped)
+			fmt.Printf("Skipped: %d\n", summary.Skipped)
+			fmt.Printf("Failed: %d\n", len(summary.Failed))
+			for _, f := range summary.Failed {
+				fmt.Printf("  %s: %s\n", f.Path, f.Error)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(summary.Failed) > 0 {
+		return fmt.Errorf("failed to rekey %d of %d files", len(summary.Failed), summary.Total)
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
 )
 
 type rmOptions struct {
@@ -34,4 +36,8 @@ datasafed rm -r some/path/to/dir
 func doRm(opts *rmOptions, cmd *cobra.Command, args []string) {
 	err := globalStorage.Remove(appCtx, args[0], opts.recursive)
 	exitIfError(err)
+	if !opts.recursive {
+		err = storage.RemoveChecksum(appCtx, globalStorage, args[0])
+		exitIfError(err)
+	}
 }
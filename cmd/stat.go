@@ -6,18 +6,26 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
 )
 
 type statOptions struct {
 	json bool
+	all  bool
 }
 
 func init() {
 	opts := &statOptions{}
 	cmd := &cobra.Command{
-		Use:   "stat [--json] rpath",
+		Use:   "stat [-a] [--json] rpath",
 		Short: "Stat a remote path to get the total size and number of entries.",
-		Long:  "It counts files and dirs in the path and calculates the total size recursively.",
+		Long: strings.TrimSpace(`
+It counts files and dirs in the path and calculates the total size recursively.
+
+The files hidden by "list" are not counted unless --all is given, i.e. the
+checksum sidecar files of the listed files and the locks.
+`),
 		Example: strings.TrimSpace(`
 # Stat a file
 datasafed stat path/to/file.txt
@@ -30,13 +38,21 @@ datasafed stat -json path/to/dir/
 			doStat(opts, cmd, args)
 		},
 	}
-	cmd.PersistentFlags().BoolVar(&opts.json, "json", false, "output in json format")
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVar(&opts.json, "json", false, "output in json format")
+	pflags.BoolVarP(&opts.all, "all", "a", false, "count the hidden files as well, i.e. the checksum sidecar files and the locks")
 	rootCmd.AddCommand(cmd)
 }
 
 func doStat(opts *statOptions, cmd *cobra.Command, args []string) {
 	rpath := args[0]
-	result, err := globalStorage.Stat(appCtx, rpath)
+	var result storage.StatResult
+	var err error
+	if opts.all {
+		result, err = globalStorage.Stat(appCtx, rpath)
+	} else {
+		result, err = statVisible(rpath)
+	}
 	exitIfError(err)
 	if !opts.json {
 		fmt.Printf("TotalSize: %d\n", result.TotalSize)
@@ -54,3 +70,31 @@ func doStat(opts *statOptions, cmd *cobra.Command, args []string) {
 		fmt.Printf("%s\n", string(data))
 	}
 }
+
+// statVisible counts the entries listed by "list", see hiddenEntries.
+func statVisible(rpath string) (storage.StatResult, error) {
+	var result storage.StatResult
+	count := func(entry storage.DirEntry) {
+		if entry.IsDir() {
+			result.Dirs++
+		} else {
+			result.Files++
+			result.TotalSize += entry.Size()
+		}
+	}
+	hidden := newHiddenEntries(false)
+	err := globalStorage.List(appCtx, rpath, &storage.ListOptions{Recursive: true}, func(entry storage.DirEntry) error {
+		if hidden.visible(entry) {
+			count(entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range hidden.orphans() {
+		count(entry)
+	}
+	result.Entries = result.Dirs + result.Files
+	return result, nil
+}
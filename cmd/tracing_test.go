@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is a stand-in of the OTLP/HTTP collector, which records the
+// exported spans.
+type otlpCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err == nil {
+		err = proto.Unmarshal(body, req)
+	}
+	if r.URL.Path != "/v1/traces" || err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// span returns the span with the name and the path attribute.
+func (c *otlpCollector) span(t *testing.T, name, path string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name != name {
+			continue
+		}
+		if path == "" {
+			return span
+		}
+		for _, kv := range span.Attributes {
+			if kv.Key == "datasafed.path" && kv.Value.GetStringValue() == path {
+				return span
+			}
+		}
+	}
+	require.Fail(t, "span not found", "%s %s", name, path)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	collector := &otlpCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	env := []string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT=" + srv.URL,
+		"TRACEPARENT=00-" + traceID + "-" + parentID + "-01",
+		"DATASAFED_BACKEND_BASE_PATH=base",
+	}
+	result := runDatasafed(t, t.TempDir(), []byte("hello"), env, "push", "-", "a.txt")
+	require.Zero(t, result.exitCode, result.stderr)
+
+	// the span of the command is nested in the span of TRACEPARENT, and the
+	// spans of the layers are nested in it
+	command := collector.span(t, "datasafed push", "")
+	require.Equal(t, traceID, hex.EncodeToString(command.TraceId))
+	require.Equal(t, parentID, hex.EncodeToString(command.ParentSpanId))
+	sanitized := collector.span(t, "sanitized.Push", "a.txt")
+	require.Equal(t, traceID, hex.EncodeToString(sanitized.TraceId))
+	// the base path is prepended by the sanitized layer
+	rclone := collector.span(t, "rclone.Push", "base/a.txt")
+	require.Equal(t, sanitized.SpanId, rclone.ParentSpanId)
+}
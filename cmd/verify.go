@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+type verifyOptions struct {
+	concurrency int
+	json        bool
+}
+
+func init() {
+	opts := &verifyOptions{}
+	cmd := &cobra.Command{
+		Use:   "verify [--concurrency N] [--json] rpath",
+		Short: "Verify that all files in a remote directory are complete and uncorrupted.",
+		Long: strings.TrimSpace(`
+Verify that all files in the remote path are complete and uncorrupted.
+
+Every file is read completely, so that encrypted files are authenticated,
+compressed files are decompressed, and files in kopia repositories are read
+from their snapshots. The size of each file is checked against the listed
+one, and the sha256 digest is checked against the checksum file written by
+"push --verify" if it exists.
+
+The report lists missing files (e.g. kopia meta files pointing to snapshots
+that don't exist), corrupt files, and orphaned checksum files. The command
+exits with code 3 if any file is missing or corrupt.
+`),
+		Example: strings.TrimSpace(`
+# Verify all files in a directory, and output the report in json format
+datasafed verify --json --concurrency 4 backups/
+`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := doVerify(opts, cmd, args)
+			exitIfError(err)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.IntVar(&opts.concurrency, "concurrency", 1, "number of files verified at the same time")
+	pflags.BoolVar(&opts.json, "json", false, "output the report in json format")
+	rootCmd.AddCommand(cmd)
+}
+
+func doVerify(opts *verifyOptions, cmd *cobra.Command, args []string) error {
+	rpath := args[0]
+	report, err := storage.Verify(appCtx, globalStorage, rpath, storage.VerifyOptions{
+		Concurrency: opts.concurrency,
+		Progress: func(rpath string, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed %s: %v\n", rpath, err)
+			}
+		},
+	})
+	if report != nil {
+		if opts.json {
+			data, _ := json.Marshal(report)
+			fmt.Printf("%s\n", string(data))
+		} else {
+			fmt.Printf("Total: %d\n", report.Total)
+			fmt.Printf("Verified: %d\n", report.Verified)
+			printIssues("Missing", report.Missing)
+			printIssues("Corrupt", report.Corrupt)
+			printIssues("Orphaned", report.Orphaned)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if report.Failed() {
+		return fmt.Errorf("%w: %d missing and %d corrupt of %d files",
+			storage.ErrVerifyFailed, len(report.Missing), len(report.Corrupt), report.Total)
+	}
+	return nil
+}
+
+func printIssues(title string, issues []storage.VerifyIssue) {
+	fmt.Printf("%s: %d\n", title, len(issues))
+	for _, issue := range issues {
+		fmt.Printf("  %s: %s\n", issue.Path, issue.Error)
+	}
+}
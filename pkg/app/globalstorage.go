@@ -10,23 +10,48 @@ import (
 	"github.com/apecloud/datasafed/pkg/config"
 	"github.com/apecloud/datasafed/pkg/encryption"
 	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/compressed"
 	"github.com/apecloud/datasafed/pkg/storage/encrypted"
 	"github.com/apecloud/datasafed/pkg/storage/kopia"
 	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/retry"
+	"github.com/apecloud/datasafed/pkg/storage/sanitized"
 )
 
 const (
 	backendBasePathEnv   = "DATASAFED_BACKEND_BASE_PATH"
 	encryptionAlgorithm  = "DATASAFED_ENCRYPTION_ALGORITHM"
 	encryptionPassPhrase = "DATASAFED_ENCRYPTION_PASS_PHRASE"
-	kopiaRepoRootEnv     = "DATASAFED_KOPIA_REPO_ROOT"
-	kopiaPasswordEnv     = "DATASAFED_KOPIA_PASSWORD"
-	kopiaDisableCacheEnv = "DATASAFED_KOPIA_DISABLE_CACHE"
-	kopiaMaintenanceEnv  = "DATASAFED_KOPIA_MAINTENANCE"
-	kopiaSafetyEnv       = "DATASAFED_KOPIA_SAFETY"
+	encryptionKDF        = "DATASAFED_ENCRYPTION_KDF"
+	encryptionKDFParams  = "DATASAFED_ENCRYPTION_KDF_PARAMS"
+	encryptionFilenames  = "DATASAFED_ENCRYPTION_FILENAMES"
+	// public keys for encrypting, and private keys for decrypting
+	encryptionRecipients   = "DATASAFED_ENCRYPTION_RECIPIENTS"
+	encryptionIdentity     = "DATASAFED_ENCRYPTION_IDENTITY"
+	encryptionIdentityFile = "DATASAFED_ENCRYPTION_IDENTITY_FILE"
+	// e.g. "file:/path/to/keys", "env:VAR_NAME" or "https://kms.example.com/v1"
+	encryptionKeyProvider = "DATASAFED_ENCRYPTION_KEY_PROVIDER"
+	compressionEnv        = "DATASAFED_COMPRESSION"
+	atomicPushEnv         = "DATASAFED_ATOMIC_PUSH"
+	maxRetriesEnv         = "DATASAFED_MAX_RETRIES"
+	bwLimitEnv            = "DATASAFED_BWLIMIT"
+	tpsLimitEnv           = "DATASAFED_TPSLIMIT"
+	tpsLimitBurstEnv      = "DATASAFED_TPSLIMIT_BURST"
+	kopiaRepoRootEnv      = "DATASAFED_KOPIA_REPO_ROOT"
+	kopiaPasswordEnv      = "DATASAFED_KOPIA_PASSWORD"
+	kopiaDisableCacheEnv  = "DATASAFED_KOPIA_DISABLE_CACHE"
+	kopiaDisableLockEnv   = "DATASAFED_KOPIA_DISABLE_WRITE_LOCK"
+	kopiaMaintenanceEnv   = "DATASAFED_KOPIA_MAINTENANCE"
+	kopiaSafetyEnv        = "DATASAFED_KOPIA_SAFETY"
 )
 
-var globalStorage storage.Storage
+var (
+	globalStorage storage.Storage
+	// baseStorage is the storage of the backend, without other layers
+	baseStorage storage.Storage
+	// lockStorage is the storage of the locks
+	lockStorage storage.Storage
+)
 
 func InitGlobalStorage(ctx context.Context, configFile string) error {
 	if globalStorage != nil {
@@ -50,29 +75,133 @@ func InitGlobalStorage(ctx context.Context, configFile string) error {
 			return err
 		}
 		globalStorage = st
+		lockStorage, err = sanitized.New(ctx, storage.LockDir, baseStorage)
+		if err != nil {
+			return err
+		}
 	}
 
 	// wrap with encryptedStorage
-	encAlgo := os.Getenv(encryptionAlgorithm)
-	if encAlgo != "" {
-		encPass := os.Getenv(encryptionPassPhrase)
-		if encPass == "" {
-			return fmt.Errorf("encryption pass phrase should not be empty")
+	enc, err := createEncryptor(os.Getenv)
+	if err != nil {
+		return err
+	}
+	if enc != nil {
+		opts := encrypted.Options{}
+		if v := strings.TrimSpace(os.Getenv(encryptionFilenames)); v != "" {
+			if opts.EncryptFilenames, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("invalid value of %s: %w", encryptionFilenames, err)
+			}
 		}
-		enc, err := encryption.CreateEncryptor(encAlgo, []byte(encPass))
+		encSt, err := encrypted.NewWithOptions(ctx, enc, globalStorage, opts)
 		if err != nil {
 			return err
 		}
-		encSt, err := encrypted.New(ctx, enc, globalStorage)
+		if globalStorage, err = withTracing(ctx, encSt, "encrypted"); err != nil {
+			return err
+		}
+	}
+
+	// wrap with compressedStorage, data is compressed before it's encrypted
+	if algo := compressionAlgorithm(); algo != "" {
+		compSt, err := compressed.New(ctx, algo, globalStorage)
 		if err != nil {
 			return err
 		}
-		globalStorage = encSt
+		if globalStorage, err = withTracing(ctx, compSt, "compressed"); err != nil {
+			return err
+		}
+	}
+
+	// wrap with metricsStorage, to record the operations seen by users
+	st, err := wrapWithMetrics(ctx, globalStorage, storageConf["type"])
+	if err != nil {
+		return err
 	}
+	globalStorage = st
 
 	return nil
 }
 
+// compressionAlgorithm returns the compression algorithm specified by the
+// environment variable, or by the "compression" key of the "datasafed"
+// section in the config file.
+func compressionAlgorithm() string {
+	return datasafedOption(compressionEnv, "compression")
+}
+
+// datasafedOption returns the value of the environment variable, or of the
+// key in the "datasafed" section in the config file if it's not set.
+func datasafedOption(env, key string) string {
+	if v := strings.TrimSpace(os.Getenv(env)); v != "" {
+		return v
+	}
+	v, _ := config.GetGlobal().Get(config.DatasafedSection, key)
+	return strings.TrimSpace(v)
+}
+
+// CreateNewEncryptor creates the encryptor for rekeying, from the same
+// environment variables as the current one, with the "DATASAFED_" prefix
+// replaced by "DATASAFED_NEW_", e.g. DATASAFED_NEW_ENCRYPTION_PASS_PHRASE.
+func CreateNewEncryptor() (encryption.StreamEncryptor, error) {
+	enc, err := createEncryptor(func(key string) string {
+		return os.Getenv(strings.Replace(key, "DATASAFED_", "DATASAFED_NEW_", 1))
+	})
+	if err == nil && enc == nil {
+		err = fmt.Errorf("the new encryption is not configured")
+	}
+	return enc, err
+}
+
+// createEncryptor creates the encryptor from the environment variables.
+// It returns nil if encryption is not enabled.
+func createEncryptor(getenv func(key string) string) (encryption.StreamEncryptor, error) {
+	encAlgo := getenv(encryptionAlgorithm)
+	if uri := strings.TrimSpace(getenv(encryptionKeyProvider)); uri != "" {
+		provider, err := encryption.CreateKeyProvider(uri)
+		if err != nil {
+			return nil, err
+		}
+		return encryption.CreateEnvelopeEncryptor(encAlgo, provider)
+	}
+	recipients := splitList(getenv(encryptionRecipients))
+	identities := splitList(getenv(encryptionIdentity))
+	if file := strings.TrimSpace(getenv(encryptionIdentityFile)); file != "" {
+		ids, err := encryption.ReadIdentityFile(file)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	if len(recipients) > 0 || len(identities) > 0 {
+		return encryption.CreateRecipientEncryptor(encAlgo, recipients, identities)
+	}
+
+	if encAlgo == "" {
+		return nil, nil
+	}
+	encPass := getenv(encryptionPassPhrase)
+	if encPass == "" {
+		return nil, fmt.Errorf("encryption pass phrase should not be empty")
+	}
+	kdf, err := encryption.ParseKDFOptions(getenv(encryptionKDF), getenv(encryptionKDFParams))
+	if err != nil {
+		return nil, err
+	}
+	return encryption.CreateEncryptorWithKDF(encAlgo, []byte(encPass), kdf)
+}
+
+// splitList splits a comma-separated list, and removes empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func GetGlobalStorage() (storage.Storage, error) {
 	if globalStorage == nil {
 		return nil, fmt.Errorf("not inited, call InitGlobalStorage() first")
@@ -80,6 +209,24 @@ func GetGlobalStorage() (storage.Storage, error) {
 	return globalStorage, nil
 }
 
+// GetBaseStorage returns the storage of the backend, without the layers of
+// kopia, encryption and compression.
+func GetBaseStorage() (storage.Storage, error) {
+	if baseStorage == nil {
+		return nil, fmt.Errorf("not inited, call InitGlobalStorage() first")
+	}
+	return baseStorage, nil
+}
+
+// GetLockStorage returns the storage of the locks, which is in the directory
+// of the kopia repository in kopia mode.
+func GetLockStorage() (storage.Storage, error) {
+	if lockStorage == nil {
+		return nil, fmt.Errorf("not inited, call InitGlobalStorage() first")
+	}
+	return lockStorage, nil
+}
+
 func initKopiaStorage(ctx context.Context, storageConf map[string]string, basePath, kopiaRoot string) error {
 	underlying, err := createStorage(ctx, storageConf, "")
 	if err != nil {
@@ -89,11 +236,20 @@ func initKopiaStorage(ctx context.Context, storageConf map[string]string, basePa
 	storageConf[kopia.RepoRootKey] = kopiaRoot
 	storageConf[kopia.PasswordKey] = strings.TrimSpace(os.Getenv(kopiaPasswordEnv))
 	storageConf[kopia.DisableCacheKey] = strings.TrimSpace(os.Getenv(kopiaDisableCacheEnv))
+	// only set if specified, since the config is hashed into the cache ID
+	if v := strings.TrimSpace(os.Getenv(kopiaDisableLockEnv)); v != "" {
+		storageConf[kopia.DisableWriteLockKey] = v
+	}
 	st, err := kopia.New(ctx, storageConf, basePath)
 	if err != nil {
 		return err
 	}
-	globalStorage = st
+	if globalStorage, err = withTracing(ctx, st, "kopia"); err != nil {
+		return err
+	}
+	if lockStorage, err = kopia.LockStorage(st); err != nil {
+		return err
+	}
 
 	maintenance := os.Getenv(kopiaMaintenanceEnv)
 	if ok, _ := strconv.ParseBool(maintenance); ok {
@@ -107,10 +263,74 @@ func initKopiaStorage(ctx context.Context, storageConf map[string]string, basePa
 	return nil
 }
 
+// retryOptions returns the options of retries in the "datasafed" section of
+// the config file, the max number of retries can be overridden by the
+// environment variable.
+func retryOptions() (retry.Options, error) {
+	conf := config.GetGlobal().GetAll(config.DatasafedSection)
+	if conf == nil {
+		conf = map[string]string{}
+	}
+	if v := strings.TrimSpace(os.Getenv(maxRetriesEnv)); v != "" {
+		conf[retry.MaxRetriesKey] = v
+	}
+	return retry.ParseOptions(conf)
+}
+
 func createStorage(ctx context.Context, conf map[string]string, basePath string) (storage.Storage, error) {
 	cloneConf := make(map[string]string, len(conf))
 	for k, v := range conf {
 		cloneConf[k] = v
 	}
-	return rclone.New(ctx, cloneConf, basePath)
+	// options of pushes in the "datasafed" section
+	for key, cfgKey := range map[string]string{
+		"upload_part_size":    rclone.UploadPartSizeKey,
+		"upload_concurrency":  rclone.UploadConcurrencyKey,
+		"upload_memory_limit": rclone.UploadMemoryLimitKey,
+		"atomic_push":         rclone.AtomicPushKey,
+	} {
+		if v, ok := config.GetGlobal().Get(config.DatasafedSection, key); ok {
+			cloneConf[cfgKey] = v
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv(atomicPushEnv)); v != "" {
+		cloneConf[rclone.AtomicPushKey] = v
+	}
+	// limits in the "storage" section can be overridden by the environment
+	for env, cfgKey := range map[string]string{
+		bwLimitEnv:       rclone.BwLimitKey,
+		tpsLimitEnv:      rclone.TPSLimitKey,
+		tpsLimitBurstEnv: rclone.TPSLimitBurstKey,
+	} {
+		if v := strings.TrimSpace(os.Getenv(env)); v != "" {
+			cloneConf[cfgKey] = v
+		}
+	}
+	st, err := rclone.New(ctx, cloneConf, "")
+	if err != nil {
+		return nil, err
+	}
+	// retry the transient errors of the backend
+	retryOpts, err := retryOptions()
+	if err != nil {
+		return nil, err
+	}
+	if retryOpts.MaxRetries > 0 {
+		if st, err = retry.New(ctx, st, retryOpts); err != nil {
+			return nil, err
+		}
+	}
+	if st, err = withTracing(ctx, st, "rclone"); err != nil {
+		return nil, err
+	}
+	// the base path is prepended by its own layer, so that the spans of
+	// rclone have the full paths in the backend
+	if st, err = sanitized.New(ctx, basePath, st); err != nil {
+		return nil, err
+	}
+	if st, err = withTracing(ctx, st, "sanitized"); err != nil {
+		return nil, err
+	}
+	baseStorage = st
+	return st, nil
 }
@@ -20,3 +20,26 @@ func InvokeFinalizers() {
 		f()
 	}
 }
+
+var (
+	exitHooks      []func()
+	exitHooksMutex sync.Mutex
+)
+
+// OnExit registers a function called when the process exits, no matter if
+// the command succeeds or fails, e.g. to export the metrics.
+func OnExit(f func()) {
+	exitHooksMutex.Lock()
+	defer exitHooksMutex.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// InvokeExitHooks calls the registered functions once.
+func InvokeExitHooks() {
+	exitHooksMutex.Lock()
+	defer exitHooksMutex.Unlock()
+	for _, f := range exitHooks {
+		f()
+	}
+	exitHooks = nil
+}
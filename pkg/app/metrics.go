@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/metrics"
+)
+
+const (
+	metricsTextfileEnv    = "DATASAFED_METRICS_TEXTFILE"
+	metricsPushgatewayEnv = "DATASAFED_METRICS_PUSHGATEWAY"
+	metricsJobEnv         = "DATASAFED_METRICS_JOB"
+	metricsLabelsEnv      = "DATASAFED_METRICS_LABELS"
+
+	defaultMetricsJob  = "datasafed"
+	metricsPushTimeout = 30 * time.Second
+)
+
+// wrapWithMetrics records the metrics of the operations of st, if they are
+// exported to a textfile or a Pushgateway when the process exits.
+func wrapWithMetrics(ctx context.Context, st storage.Storage, backend string) (storage.Storage, error) {
+	textfile := datasafedOption(metricsTextfileEnv, "metrics_textfile")
+	pushgateway := datasafedOption(metricsPushgatewayEnv, "metrics_pushgateway")
+	if textfile == "" && pushgateway == "" {
+		return st, nil
+	}
+	labels, err := metrics.ParseLabels(datasafedOption(metricsLabelsEnv, "metrics_labels"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics labels: %w", err)
+	}
+	m, err := metrics.NewMetrics(labels)
+	if err != nil {
+		return nil, err
+	}
+	job := datasafedOption(metricsJobEnv, "metrics_job")
+	if job == "" {
+		job = defaultMetricsJob
+	}
+	OnExit(func() {
+		if textfile != "" {
+			if err := m.WriteTextfile(textfile); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+		if pushgateway != "" {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsPushTimeout)
+			defer cancel()
+			if err := m.Push(ctx, pushgateway, job, labels); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	})
+	return metrics.New(ctx, st, m, backend)
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/traced"
+	"github.com/apecloud/datasafed/version"
+)
+
+const (
+	// standard environment variables of OpenTelemetry
+	otlpEndpointEnv       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	otelSDKDisabledEnv    = "OTEL_SDK_DISABLED"
+	// the trace context of the parent span, e.g. the backup of the controller
+	traceParentEnv = "TRACEPARENT"
+	traceStateEnv  = "TRACESTATE"
+
+	tracingShutdownTimeout = 10 * time.Second
+)
+
+var tracingEnabled bool
+
+// InitTracing exports the traces to the OTLP/HTTP endpoint specified by the
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment
+// variable, and starts the span of the command, which is a child of the span
+// in TRACEPARENT if it's set. It does nothing if the endpoint is not set.
+func InitTracing(ctx context.Context, command string) (context.Context, error) {
+	if os.Getenv(otlpEndpointEnv) == "" && os.Getenv(otlpTracesEndpointEnv) == "" {
+		return ctx, nil
+	}
+	if disabled, _ := strconv.ParseBool(os.Getenv(otelSDKDisabledEnv)); disabled {
+		return ctx, nil
+	}
+	// the exporter is configured by the standard environment variables,
+	// e.g. OTEL_EXPORTER_OTLP_HEADERS
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return ctx, fmt.Errorf("create OTLP exporter error: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "datasafed"),
+		attribute.String("service.version", version.GetVersion()),
+	))
+	if err != nil {
+		return ctx, fmt.Errorf("create resource error: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	if res, err = resource.Merge(res, resource.Environment()); err != nil {
+		return ctx, fmt.Errorf("create resource error: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	propagator := propagation.TraceContext{}
+	otel.SetTextMapPropagator(propagator)
+	tracingEnabled = true
+
+	ctx = propagator.Extract(ctx, propagation.MapCarrier{
+		"traceparent": strings.TrimSpace(os.Getenv(traceParentEnv)),
+		"tracestate":  strings.TrimSpace(os.Getenv(traceStateEnv)),
+	})
+	ctx, span := tp.Tracer("github.com/apecloud/datasafed").Start(ctx, command)
+	OnExit(func() {
+		span.End()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tracingShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: export traces error: %v\n", err)
+		}
+	})
+	return ctx, nil
+}
+
+// RecordCommandError marks the span of the command as failed.
+func RecordCommandError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// withTracing wraps the storage of the layer with tracing if it's enabled.
+func withTracing(ctx context.Context, st storage.Storage, layer string) (storage.Storage, error) {
+	if !tracingEnabled {
+		return st, nil
+	}
+	return traced.New(ctx, st, layer)
+}
@@ -8,6 +8,8 @@ import (
 
 const (
 	StorageSection = "storage"
+	// DatasafedSection contains the options of datasafed itself
+	DatasafedSection = "datasafed"
 
 	localBackendPathEnv = "DATASAFED_LOCAL_BACKEND_PATH"
 )
@@ -0,0 +1,296 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// aeadChunkSize is the size of the plaintext sealed in each chunk.
+	aeadChunkSize = 64 * 1024
+	// aeadNoncePrefixSize is the size of the random nonce prefix written at
+	// the beginning of the ciphertext. The rest of the 12-byte nonce is made
+	// up of a 4-byte chunk counter and a 1-byte final chunk flag.
+	aeadNoncePrefixSize = 7
+
+	purposeChunkedEncryptionKey = "chunked-encryption"
+)
+
+var (
+	errChunkAuthFailed = errors.New("message authentication failed")
+	errTruncated       = errors.New("ciphertext is truncated")
+	errTrailingData    = errors.New("unexpected data after the final chunk")
+)
+
+// aeadEncryptor encrypts the stream in fixed-size chunks, each of them sealed
+// by an AEAD cipher with its own nonce and tag. The nonce of a chunk is built
+// from a random prefix, the index of the chunk and a flag marking the final
+// chunk, so reordered, truncated or tampered chunks fail to authenticate.
+//
+// The layout of the ciphertext is:
+//
+//	noncePrefix | chunk_0 | chunk_1 | ... | chunk_n (final)
+//
+// where every chunk except the final one holds exactly aeadChunkSize bytes of
+// plaintext. An empty plaintext is encrypted as a single empty final chunk.
+type aeadEncryptor struct {
+	aead cipher.AEAD
+}
+
+func (e *aeadEncryptor) EncryptStream(plainText io.Reader, output io.Writer) error {
+	prefix := make([]byte, aeadNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return fmt.Errorf("rand.Read() error: %w", err)
+	}
+	if err := writeFull(output, prefix, "nonce prefix"); err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(plainText)
+	buf := make([]byte, aeadChunkSize, aeadChunkSize+e.aead.Overhead())
+	nonce := make([]byte, e.aead.NonceSize())
+	for counter := uint64(0); ; counter++ {
+		if counter > math.MaxUint32 {
+			return fmt.Errorf("plainText is too large, exceeds %d chunks", uint64(math.MaxUint32)+1)
+		}
+		n, err := io.ReadFull(in, buf[:aeadChunkSize])
+		last := false
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			last = true
+		case err != nil:
+			return fmt.Errorf("read from plainText error: %w", err)
+		default:
+			// a full chunk, check whether there is more data
+			if _, err := in.Peek(1); err != nil {
+				if !errors.Is(err, io.EOF) {
+					return fmt.Errorf("read from plainText error: %w", err)
+				}
+				last = true
+			}
+		}
+		setChunkNonce(nonce, prefix, counter, last)
+		sealed := e.aead.Seal(buf[:0], nonce, buf[:n], nil)
+		if err := writeFull(output, sealed, "cipherText"); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (e *aeadEncryptor) DecryptStream(cipherText io.Reader, output io.Writer) error {
+	prefix := make([]byte, aeadNoncePrefixSize)
+	if _, err := io.ReadFull(cipherText, prefix); err != nil {
+		return fmt.Errorf("unable to read nonce prefix from cipherText, error: %w", err)
+	}
+	r := e.newChunkReader(cipherText, prefix, 0, false)
+	_, err := io.Copy(output, r)
+	return err
+}
+
+func (e *aeadEncryptor) Overhead() int {
+	return aeadNoncePrefixSize + e.aead.Overhead()
+}
+
+func (e *aeadEncryptor) PlainTextSize(cipherTextSize int64) int64 {
+	sealedChunkSize := int64(aeadChunkSize + e.aead.Overhead())
+	size := cipherTextSize - aeadNoncePrefixSize
+	if size <= 0 {
+		return 0
+	}
+	chunks := size / sealedChunkSize
+	rest := size % sealedChunkSize
+	plainTextSize := chunks * aeadChunkSize
+	if rest > int64(e.aead.Overhead()) {
+		plainTextSize += rest - int64(e.aead.Overhead())
+	}
+	return plainTextSize
+}
+
+// DecryptRange implements RangeDecryptor. Only the nonce prefix and the
+// chunks covering the requested range are read from the ciphertext.
+func (e *aeadEncryptor) DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error) {
+	prefix, err := readRange(open, 0, aeadNoncePrefixSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read nonce prefix, %w", err)
+	}
+	sealedChunkSize := int64(aeadChunkSize + e.aead.Overhead())
+	first := offset / aeadChunkSize
+	cipherOffset := aeadNoncePrefixSize + first*sealedChunkSize
+	cipherLength := int64(-1)
+	if length > 0 {
+		last := (offset + length - 1) / aeadChunkSize
+		cipherLength = (last - first + 1) * sealedChunkSize
+	}
+	rc, err := open(cipherOffset, cipherLength)
+	if err != nil {
+		return nil, err
+	}
+	r := e.newChunkReader(rc, prefix, uint64(first), length > 0)
+	return newRangeReadCloser(r, rc, offset-first*aeadChunkSize, length), nil
+}
+
+func (e *aeadEncryptor) newChunkReader(in io.Reader, prefix []byte, counter uint64, bounded bool) *aeadChunkReader {
+	return &aeadChunkReader{
+		aead:    e.aead,
+		in:      bufio.NewReader(in),
+		prefix:  prefix,
+		counter: counter,
+		bounded: bounded,
+		nonce:   make([]byte, e.aead.NonceSize()),
+		sealed:  make([]byte, aeadChunkSize+e.aead.Overhead()),
+		opened:  make([]byte, 0, aeadChunkSize),
+	}
+}
+
+// aeadChunkReader reads sealed chunks from the underlying reader and returns
+// the authenticated plaintext.
+type aeadChunkReader struct {
+	aead    cipher.AEAD
+	in      *bufio.Reader
+	prefix  []byte
+	counter uint64
+	// bounded is true if the underlying reader may stop at a chunk boundary
+	// before the end of the ciphertext, which happens in range reads.
+	bounded bool
+
+	nonce  []byte
+	sealed []byte
+	opened []byte
+	plain  []byte // authenticated plaintext not consumed yet
+	final  bool   // the final chunk has been read
+	err    error
+}
+
+func (r *aeadChunkReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextChunk()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *aeadChunkReader) nextChunk() error {
+	if r.final {
+		if _, err := r.in.Peek(1); err == nil {
+			return errTrailingData
+		} else if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read from cipherText error: %w", err)
+		}
+		return io.EOF
+	}
+
+	n, err := io.ReadFull(r.in, r.sealed)
+	var candidates []bool // possible values of the final chunk flag
+	switch {
+	case errors.Is(err, io.EOF):
+		if r.bounded {
+			return io.EOF
+		}
+		return errTruncated
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// only the final chunk can be shorter than the others
+		candidates = []bool{true}
+	case err != nil:
+		return fmt.Errorf("read from cipherText error: %w", err)
+	default:
+		if _, err := r.in.Peek(1); err == nil {
+			candidates = []bool{false}
+		} else if errors.Is(err, io.EOF) {
+			if r.bounded {
+				candidates = []bool{false, true}
+			} else {
+				candidates = []bool{true}
+			}
+		} else {
+			return fmt.Errorf("read from cipherText error: %w", err)
+		}
+	}
+
+	if r.counter > math.MaxUint32 {
+		return fmt.Errorf("cipherText is too large, exceeds %d chunks", uint64(math.MaxUint32)+1)
+	}
+	for _, last := range candidates {
+		setChunkNonce(r.nonce, r.prefix, r.counter, last)
+		opened, err := r.aead.Open(r.opened[:0], r.nonce, r.sealed[:n], nil)
+		if err == nil {
+			r.plain = opened
+			r.final = last
+			r.counter++
+			return nil
+		}
+	}
+	return fmt.Errorf("chunk %d: %w", r.counter, errChunkAuthFailed)
+}
+
+func setChunkNonce(nonce, prefix []byte, counter uint64, last bool) {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[aeadNoncePrefixSize:], uint32(counter))
+	if last {
+		nonce[len(nonce)-1] = 1
+	} else {
+		nonce[len(nonce)-1] = 0
+	}
+}
+
+func newChunkedAEAD(passPhrase []byte, keyLength int, newAEAD func(key []byte) (cipher.AEAD, error)) (StreamEncryptor, error) {
+	deriveLength := keyLength
+	if deriveLength < minDerivedKeyLength {
+		deriveLength = minDerivedKeyLength
+	}
+	key, err := deriveKey(passPhrase, []byte(purposeChunkedEncryptionKey), deriveLength)
+	if err != nil {
+		return nil, fmt.Errorf("deriveKey() error: %w", err)
+	}
+	aead, err := newAEAD(key[:keyLength])
+	if err != nil {
+		return nil, err
+	}
+	return &aeadEncryptor{aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher() error: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func NewAES128GCM(passPhrase []byte) (StreamEncryptor, error) {
+	return newChunkedAEAD(passPhrase, 16, newGCM)
+}
+
+func NewAES192GCM(passPhrase []byte) (StreamEncryptor, error) {
+	return newChunkedAEAD(passPhrase, 24, newGCM)
+}
+
+func NewAES256GCM(passPhrase []byte) (StreamEncryptor, error) {
+	return newChunkedAEAD(passPhrase, 32, newGCM)
+}
+
+func NewChaCha20Poly1305(passPhrase []byte) (StreamEncryptor, error) {
+	return newChunkedAEAD(passPhrase, chacha20poly1305.KeySize, chacha20poly1305.New)
+}
+
+func init() {
+	Register("AES-128-GCM", "AES-128 with GCM mode in authenticated chunks", NewAES128GCM)
+	Register("AES-192-GCM", "AES-192 with GCM mode in authenticated chunks", NewAES192GCM)
+	Register("AES-256-GCM", "AES-256 with GCM mode in authenticated chunks", NewAES256GCM)
+	Register("CHACHA20-POLY1305", "ChaCha20-Poly1305 in authenticated chunks", NewChaCha20Poly1305)
+}
@@ -56,6 +56,36 @@ func (e *aesEncryptor) DecryptStream(cipherText io.Reader, output io.Writer) err
 	})
 }
 
+// DecryptRange implements RangeDecryptor. In CFB mode, a block of plaintext
+// only depends on the corresponding block of ciphertext and the one before it,
+// so the decryption can start from any block by using the preceding ciphertext
+// block (or the IV for the first block) as the IV.
+func (e *aesEncryptor) DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error) {
+	// the ciphertext is IV | C_0 | C_1 | ..., so C_(i-1) starts at i * BlockSize
+	cipherOffset := (offset / aes.BlockSize) * aes.BlockSize
+	skip := offset - cipherOffset
+	cipherLength := int64(-1)
+	if length > 0 {
+		cipherLength = aes.BlockSize + skip + length
+	}
+	rc, err := open(cipherOffset, cipherLength)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rc, iv); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("unable to read iv from cipherText, error: %w", err)
+	}
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("aes.NewCipher() error: %w", err)
+	}
+	rd := &cipher.StreamReader{S: e.newDecryptor(block, iv), R: rc}
+	return newRangeReadCloser(rd, rc, skip, length), nil
+}
+
 func (e *aesEncryptor) Overhead() int {
 	return aes.BlockSize
 }
@@ -7,6 +7,8 @@ import (
 	"io"
 
 	"golang.org/x/crypto/hkdf"
+
+	"github.com/apecloud/datasafed/pkg/util"
 )
 
 const minDerivedKeyLength = 32
@@ -38,6 +40,49 @@ func pipeStream(in io.Reader, inName string,
 	}
 }
 
+func writeFull(out io.Writer, data []byte, outName string) error {
+	n, err := out.Write(data)
+	if err != nil {
+		return fmt.Errorf("write %s error: %w", outName, err)
+	}
+	if n != len(data) {
+		return fmt.Errorf("partially write %s, len: %d, written: %d", outName, len(data), n)
+	}
+	return nil
+}
+
+// readRange reads exactly `length` bytes of the ciphertext at `offset`.
+func readRange(open RangeOpener, offset, length int64) ([]byte, error) {
+	rc, err := open(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return nil, fmt.Errorf("unable to read %d bytes at offset %d from cipherText, error: %w", length, offset, err)
+	}
+	return buf, nil
+}
+
+// newRangeReadCloser skips the first `skip` bytes of the reader, and limits
+// the rest to `length` bytes if `length` is positive.
+func newRangeReadCloser(rd io.Reader, closer io.Closer, skip, length int64) io.ReadCloser {
+	if skip > 0 {
+		rd = util.DiscardNReader(rd, int(skip))
+	}
+	if length > 0 {
+		rd = io.LimitReader(rd, length)
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: rd,
+		Closer: closer,
+	}
+}
+
 // deriveKey uses HKDF to derive a key of a given length and a given purpose from parameters.
 func deriveKey(passPhrase []byte, purpose []byte, length int) ([]byte, error) {
 	if length < minDerivedKeyLength {
@@ -12,9 +12,29 @@ const (
 	purposeEncryptionKey = "encryption"
 )
 
+// ErrWrongKey is returned when an object was encrypted with a different key,
+// e.g. a different pass phrase.
+var ErrWrongKey = errors.New("wrong encryption key")
+
 // CreateEncryptor creates an StreamEncryptor for given parameters.
+// The encryptor writes a self-describing header before the ciphertext,
+// and is able to decrypt objects produced by any registered algorithm,
+// as well as legacy header-less objects produced by the given algorithm.
 func CreateEncryptor(algorithm string, passPhrase []byte) (StreamEncryptor, error) {
-	algorithm = strings.ToUpper(algorithm)
+	return CreateEncryptorWithKDF(algorithm, passPhrase, nil)
+}
+
+// CreateEncryptorWithKDF is like CreateEncryptor, but the keys of new objects
+// are derived from the pass phrase with the given KDF options. The KDF
+// parameters and a random salt are recorded in the header of the objects.
+// If kdf is nil, HKDF-SHA256 without salt is used.
+func CreateEncryptorWithKDF(algorithm string, passPhrase []byte, kdf *KDFOptions) (StreamEncryptor, error) {
+	return newHeaderEncryptor(strings.ToUpper(algorithm), passPhrase, kdf)
+}
+
+// createRawEncryptor creates the StreamEncryptor registered for the algorithm,
+// which doesn't write any header.
+func createRawEncryptor(algorithm string, passPhrase []byte) (StreamEncryptor, error) {
 	e := encryptors[algorithm]
 	if e == nil {
 		return nil, errors.Errorf("unknown encryption algorithm: %v", algorithm)
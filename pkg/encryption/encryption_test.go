@@ -4,12 +4,27 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/apecloud/datasafed/pkg/encryption"
 	"github.com/stretchr/testify/require"
 )
 
+// authenticatedAlgorithms are the algorithms which detect tampered ciphertexts.
+var authenticatedAlgorithms = map[string]bool{
+	"AES-128-GCM":       true,
+	"AES-192-GCM":       true,
+	"AES-256-GCM":       true,
+	"CHACHA20-POLY1305": true,
+}
+
 func TestRoundTrip(t *testing.T) {
 	data := make([]byte, 100)
 	rand.Read(data)
@@ -51,17 +66,651 @@ func TestRoundTrip(t *testing.T) {
 				t.Errorf("EncryptStream()/DecryptStream() does not round-trip: %x %x", v, data)
 			}
 
-			// TODO: enable the following logic if the algorithm is AEAD
-			// // flip some bits in the cipherText
-			// b := cipherText2.Bytes()
-			// b[mathrand.Intn(len(b))] ^= byte(1 + mathrand.Intn(254))
+			if !authenticatedAlgorithms[encryptionAlgo] {
+				return
+			}
+
+			// flip some bits in the cipherText after the header, json field
+			// names in the header are case-insensitive
+			b := cipherText2.Bytes()
+			b[len(b)/2+mathrand.Intn(len(b)/2)] ^= byte(1 + mathrand.Intn(254))
+
+			plainText2.Reset()
+			require.Error(t, e.DecryptStream(bytes.NewBuffer(cipherText2.Bytes()), &plainText2))
+		})
+	}
+}
+
+func TestAuthenticatedChunks(t *testing.T) {
+	const (
+		chunkSize       = 64 * 1024
+		tagSize         = 16
+		sealedChunkSize = chunkSize + tagSize
+	)
+
+	passPhrase := make([]byte, 32)
+	rand.Read(passPhrase)
+
+	for _, size := range []int{0, 1, chunkSize, 3*chunkSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		for encryptionAlgo := range authenticatedAlgorithms {
+			t.Run(fmt.Sprintf("%s/%d", encryptionAlgo, size), func(t *testing.T) {
+				e, err := encryption.CreateEncryptor(encryptionAlgo, passPhrase)
+				require.NoError(t, err)
+
+				var cipherText bytes.Buffer
+				require.NoError(t, e.EncryptStream(bytes.NewBuffer(data), &cipherText))
+				ct := cipherText.Bytes()
+				require.Equal(t, int64(size), encryption.PlainTextSize(e, int64(len(ct))))
+
+				// the sealed chunks start after the header and the nonce prefix
+				var empty bytes.Buffer
+				require.NoError(t, e.EncryptStream(bytes.NewReader(nil), &empty))
+				dataStart := empty.Len() - tagSize
+
+				decrypt := func(b []byte) ([]byte, error) {
+					var out bytes.Buffer
+					err := e.DecryptStream(bytes.NewReader(b), &out)
+					return out.Bytes(), err
+				}
+
+				plainText, err := decrypt(ct)
+				require.NoError(t, err)
+				require.Equal(t, data, plainText)
+
+				// truncated at every chunk boundary and in the middle of the last chunk
+				for end := len(ct) - 1; end > 0; end -= sealedChunkSize {
+					_, err := decrypt(ct[:end])
+					require.Error(t, err, "truncated at %d", end)
+				}
+
+				// trailing data
+				_, err = decrypt(append(bytes.Clone(ct), 0))
+				require.Error(t, err)
+
+				if size > chunkSize {
+					// swap the first two chunks
+					swapped := bytes.Clone(ct)
+					first := ct[dataStart : dataStart+sealedChunkSize]
+					second := ct[dataStart+sealedChunkSize : dataStart+2*sealedChunkSize]
+					copy(swapped[dataStart:], second)
+					copy(swapped[dataStart+sealedChunkSize:], first)
+					_, err := decrypt(swapped)
+					require.Error(t, err)
+
+					// drop the second chunk
+					dropped := append(bytes.Clone(ct[:dataStart+sealedChunkSize]), ct[dataStart+2*sealedChunkSize:]...)
+					_, err = decrypt(dropped)
+					require.Error(t, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	const chunkSize = 64 * 1024
+
+	data := make([]byte, 3*chunkSize+100)
+	rand.Read(data)
+
+	passPhrase := make([]byte, 32)
+	rand.Read(passPhrase)
+
+	ranges := []struct {
+		offset int64
+		length int64
+	}{
+		{0, -1},
+		{0, 1},
+		{1, 15},
+		{15, 2},
+		{100, 0},
+		{chunkSize - 1, 2},
+		{chunkSize, chunkSize},
+		{chunkSize + 7, 2*chunkSize + 93},
+		{3 * chunkSize, 100},
+		{3*chunkSize + 50, -1},
+		{3*chunkSize + 50, 1000},
+	}
+
+	for _, encryptionAlgo := range encryption.SupportedAlgorithms() {
+		t.Run(encryptionAlgo, func(t *testing.T) {
+			e, err := encryption.CreateEncryptor(encryptionAlgo, passPhrase)
+			require.NoError(t, err)
+			rd, ok := e.(encryption.RangeDecryptor)
+			if !ok {
+				t.Skipf("%s doesn't support range decryption", encryptionAlgo)
+			}
+
+			var cipherText bytes.Buffer
+			require.NoError(t, e.EncryptStream(bytes.NewBuffer(data), &cipherText))
+			ct := cipherText.Bytes()
+
+			var bytesRead int64
+			open := func(offset, length int64) (io.ReadCloser, error) {
+				b := ct[offset:]
+				if length > 0 && int64(len(b)) > length {
+					b = b[:length]
+				}
+				bytesRead += int64(len(b))
+				return io.NopCloser(bytes.NewReader(b)), nil
+			}
+
+			for _, r := range ranges {
+				bytesRead = 0
+				rc, err := rd.DecryptRange(open, r.offset, r.length)
+				require.NoError(t, err)
+				plainText, err := io.ReadAll(rc)
+				require.NoError(t, err, "offset %d, length %d", r.offset, r.length)
+				require.NoError(t, rc.Close())
+
+				expected := data[r.offset:]
+				if r.length > 0 && int64(len(expected)) > r.length {
+					expected = expected[:r.length]
+				}
+				require.Equal(t, expected, plainText, "offset %d, length %d", r.offset, r.length)
+				if r.length > 0 && r.length < chunkSize {
+					// at most two chunks and the headers are read
+					require.Less(t, bytesRead, int64(2*chunkSize+8192), "offset %d, length %d", r.offset, r.length)
+				}
+			}
 
-			// plainText2.Reset()
-			// require.Error(t, e.DecryptStream(bytes.NewBuffer(cipherText2.Bytes()), &plainText2))
+			if authenticatedAlgorithms[encryptionAlgo] {
+				// tamper the second chunk
+				ct[len(ct)/2] ^= 1
+				rc, err := rd.DecryptRange(open, chunkSize+10, 10)
+				require.NoError(t, err)
+				_, err = io.ReadAll(rc)
+				require.Error(t, err)
+			}
 		})
 	}
 }
 
+func TestAlgorithmFromHeader(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	passPhrase := make([]byte, 32)
+	rand.Read(passPhrase)
+
+	for _, encAlgo := range encryption.SupportedAlgorithms() {
+		enc, err := encryption.CreateEncryptor(encAlgo, passPhrase)
+		require.NoError(t, err)
+
+		var cipherText bytes.Buffer
+		require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+
+		// the object can be decrypted no matter which algorithm is configured
+		for _, decAlgo := range encryption.SupportedAlgorithms() {
+			dec, err := encryption.CreateEncryptor(decAlgo, passPhrase)
+			require.NoError(t, err)
+
+			var plainText bytes.Buffer
+			require.NoError(t, dec.DecryptStream(bytes.NewReader(cipherText.Bytes()), &plainText),
+				"encrypted by %s, decrypted by %s", encAlgo, decAlgo)
+			require.Equal(t, data, plainText.Bytes())
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	for _, encryptionAlgo := range encryption.SupportedAlgorithms() {
+		enc, err := encryption.CreateEncryptor(encryptionAlgo, []byte("right pass phrase"))
+		require.NoError(t, err)
+		dec, err := encryption.CreateEncryptor(encryptionAlgo, []byte("wrong pass phrase"))
+		require.NoError(t, err)
+
+		var cipherText bytes.Buffer
+		require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+		ct := cipherText.Bytes()
+
+		var plainText bytes.Buffer
+		err = dec.DecryptStream(bytes.NewReader(ct), &plainText)
+		require.ErrorIs(t, err, encryption.ErrWrongKey)
+		require.Zero(t, plainText.Len(), "no data should be written with a wrong key")
+
+		open := func(offset, length int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(ct[offset:])), nil
+		}
+		_, err = dec.(encryption.RangeDecryptor).DecryptRange(open, 10, 10)
+		require.ErrorIs(t, err, encryption.ErrWrongKey)
+	}
+}
+
+func TestKDF(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	for _, tc := range []struct{ kdf, params string }{
+		{"scrypt", "N=1024,r=8,p=1"},
+		{"argon2id", "t=1,m=64,p=1"},
+	} {
+		kdf, err := encryption.ParseKDFOptions(tc.kdf, tc.params)
+		require.NoError(t, err)
+		enc, err := encryption.CreateEncryptorWithKDF("AES-256-GCM", []byte("pass phrase"), kdf)
+		require.NoError(t, err)
+
+		var cipherText bytes.Buffer
+		require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+		ct := cipherText.Bytes()
+		require.EqualValues(t, len(data), enc.(encryption.PlainTextSizer).PlainTextSize(int64(len(ct))))
+
+		// the KDF parameters are read from the header, the configured KDF doesn't matter
+		dec, err := encryption.CreateEncryptor("AES-256-GCM", []byte("pass phrase"))
+		require.NoError(t, err)
+		var plainText bytes.Buffer
+		require.NoError(t, dec.DecryptStream(bytes.NewReader(ct), &plainText), tc.kdf)
+		require.Equal(t, data, plainText.Bytes())
+
+		wrong, err := encryption.CreateEncryptorWithKDF("AES-256-GCM", []byte("wrong pass phrase"), kdf)
+		require.NoError(t, err)
+		err = wrong.DecryptStream(bytes.NewReader(ct), io.Discard)
+		require.ErrorIs(t, err, encryption.ErrWrongKey)
+	}
+}
+
+func TestParseKDFOptions(t *testing.T) {
+	opts, err := encryption.ParseKDFOptions("", "")
+	require.NoError(t, err)
+	require.Equal(t, encryption.KDFHKDFSHA256, opts.Algorithm)
+
+	opts, err = encryption.ParseKDFOptions("scrypt", "N=65536")
+	require.NoError(t, err)
+	require.Equal(t, encryption.KDFScrypt, opts.Algorithm)
+	require.Equal(t, 65536, opts.ScryptN)
+	require.Equal(t, 8, opts.ScryptR)
+
+	opts, err = encryption.ParseKDFOptions("Argon2id", "t=2, m=131072, p=2")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, opts.Argon2Time)
+	require.EqualValues(t, 131072, opts.Argon2Memory)
+	require.EqualValues(t, 2, opts.Argon2Threads)
+
+	for _, tc := range []struct{ kdf, params string }{
+		{"pbkdf2", ""},
+		{"scrypt", "N=1000"},
+		{"scrypt", "t=3"},
+		{"argon2id", "t=0"},
+		{"argon2id", "m"},
+	} {
+		_, err := encryption.ParseKDFOptions(tc.kdf, tc.params)
+		require.Error(t, err, "%s %s", tc.kdf, tc.params)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+
+	identity1, recipient1, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+	identity2, recipient2, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+	identity3, _, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	// push-only encryptor
+	enc, err := encryption.CreateRecipientEncryptor("", []string{recipient1, recipient2}, nil)
+	require.NoError(t, err)
+	var cipherText bytes.Buffer
+	require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+	ct := cipherText.Bytes()
+	require.EqualValues(t, len(data), enc.(encryption.PlainTextSizer).PlainTextSize(int64(len(ct))))
+	require.ErrorIs(t, enc.DecryptStream(bytes.NewReader(ct), io.Discard), encryption.ErrNoIdentity)
+
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(ct[offset:])), nil
+	}
+	for _, identity := range []string{identity1, identity2} {
+		dec, err := encryption.CreateRecipientEncryptor("", nil, []string{identity})
+		require.NoError(t, err)
+		var plainText bytes.Buffer
+		require.NoError(t, dec.DecryptStream(bytes.NewReader(ct), &plainText))
+		require.Equal(t, data, plainText.Bytes())
+
+		rc, err := dec.(encryption.RangeDecryptor).DecryptRange(open, 100000, 1000)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, data[100000:101000], got)
+	}
+
+	dec, err := encryption.CreateRecipientEncryptor("", nil, []string{identity3})
+	require.NoError(t, err)
+	require.ErrorIs(t, dec.DecryptStream(bytes.NewReader(ct), io.Discard), encryption.ErrWrongKey)
+
+	// the pass phrase can't decrypt the object, and vice versa
+	passEnc, err := encryption.CreateEncryptor("AES-256-GCM", []byte("pass phrase"))
+	require.NoError(t, err)
+	require.ErrorIs(t, passEnc.DecryptStream(bytes.NewReader(ct), io.Discard), encryption.ErrWrongKey)
+	cipherText.Reset()
+	require.NoError(t, passEnc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+	require.ErrorIs(t, dec.DecryptStream(bytes.NewReader(cipherText.Bytes()), io.Discard), encryption.ErrWrongKey)
+
+	_, err = encryption.CreateRecipientEncryptor("", []string{identity1}, nil)
+	require.Error(t, err)
+	_, err = encryption.CreateRecipientEncryptor("", nil, []string{recipient1})
+	require.Error(t, err)
+}
+
+// fakeKMS serves the HTTP KMS API with local master keys.
+func fakeKMS(t *testing.T, provider encryption.KeyProvider) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			KeyID      string `json:"key_id"`
+			Plaintext  []byte `json:"plaintext"`
+			Ciphertext []byte `json:"ciphertext"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch r.URL.Path {
+		case "/v1/wrap":
+			keyID, wrapped, err := provider.WrapKey(req.Plaintext)
+			require.NoError(t, err)
+			req.KeyID, req.Ciphertext, req.Plaintext = keyID, wrapped, nil
+		case "/v1/unwrap":
+			dataKey, err := provider.UnwrapKey(req.KeyID, req.Ciphertext)
+			if err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			req.Plaintext, req.Ciphertext = dataKey, nil
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(&req))
+	}))
+}
+
+func TestEnvelope(t *testing.T) {
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+
+	oldKey, err := encryption.GenerateMasterKey("old")
+	require.NoError(t, err)
+	newKey, err := encryption.GenerateMasterKey("new")
+	require.NoError(t, err)
+	oldProvider, err := encryption.ParseMasterKeys(oldKey)
+	require.NoError(t, err)
+	// the master key is rotated, and the old one is kept for decrypting
+	rotatedProvider, err := encryption.ParseMasterKeys(newKey + "\n" + oldKey)
+	require.NoError(t, err)
+	newProvider, err := encryption.ParseMasterKeys(newKey)
+	require.NoError(t, err)
+
+	kms := fakeKMS(t, rotatedProvider)
+	defer kms.Close()
+	t.Setenv(encryption.KMSTokenEnv, "token")
+	httpProvider, err := encryption.CreateKeyProvider(kms.URL + "/v1")
+	require.NoError(t, err)
+
+	encrypt := func(provider encryption.KeyProvider) []byte {
+		enc, err := encryption.CreateEnvelopeEncryptor("CHACHA20-POLY1305", provider)
+		require.NoError(t, err)
+		var cipherText bytes.Buffer
+		require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+		require.EqualValues(t, len(data), enc.(encryption.PlainTextSizer).PlainTextSize(int64(cipherText.Len())))
+		return cipherText.Bytes()
+	}
+	decrypt := func(provider encryption.KeyProvider, ct []byte) error {
+		dec, err := encryption.CreateEnvelopeEncryptor("", provider)
+		require.NoError(t, err)
+		var plainText bytes.Buffer
+		if err := dec.DecryptStream(bytes.NewReader(ct), &plainText); err != nil {
+			return err
+		}
+		require.Equal(t, data, plainText.Bytes())
+
+		open := func(offset, length int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(ct[offset:])), nil
+		}
+		rc, err := dec.(encryption.RangeDecryptor).DecryptRange(open, 70000, 100)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, data[70000:70100], got)
+		return nil
+	}
+
+	oldCT := encrypt(oldProvider)
+	require.NoError(t, decrypt(oldProvider, oldCT))
+	require.NoError(t, decrypt(rotatedProvider, oldCT))
+	require.NoError(t, decrypt(httpProvider, oldCT))
+	require.ErrorIs(t, decrypt(newProvider, oldCT), encryption.ErrWrongKey)
+
+	httpCT := encrypt(httpProvider)
+	require.NoError(t, decrypt(newProvider, httpCT))
+	require.ErrorIs(t, decrypt(oldProvider, httpCT), encryption.ErrWrongKey)
+
+	passEnc, err := encryption.CreateEncryptor("AES-256-GCM", []byte("pass phrase"))
+	require.NoError(t, err)
+	require.ErrorIs(t, passEnc.DecryptStream(bytes.NewReader(httpCT), io.Discard), encryption.ErrWrongKey)
+
+	// the provider is not called until an object is encrypted
+	t.Setenv(encryption.KMSTokenEnv, "wrong")
+	httpProvider, err = encryption.CreateKeyProvider(kms.URL + "/v1")
+	require.NoError(t, err)
+	enc, err := encryption.CreateEnvelopeEncryptor("", httpProvider)
+	require.NoError(t, err)
+	require.Error(t, enc.EncryptStream(bytes.NewReader(data), io.Discard))
+}
+
+// countingProvider counts the calls to the underlying provider.
+type countingProvider struct {
+	encryption.KeyProvider
+	calls int
+}
+
+func (p *countingProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	p.calls++
+	return p.KeyProvider.WrapKey(dataKey)
+}
+
+func (p *countingProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	p.calls++
+	return p.KeyProvider.UnwrapKey(keyID, wrapped)
+}
+
+func TestObjectPlainTextSize(t *testing.T) {
+	data := make([]byte, 70000)
+	rand.Read(data)
+	passPhrase := []byte("pass phrase")
+
+	objectSize := func(e encryption.StreamEncryptor, ct []byte) int64 {
+		open := func(offset, length int64) (io.ReadCloser, error) {
+			end := int64(len(ct))
+			if length > 0 && offset+length < end {
+				end = offset + length
+			}
+			return io.NopCloser(bytes.NewReader(ct[offset:end])), nil
+		}
+		size, err := encryption.ObjectPlainTextSize(e, open, int64(len(ct)))
+		require.NoError(t, err)
+		return size
+	}
+	encrypt := func(e encryption.StreamEncryptor) []byte {
+		var cipherText bytes.Buffer
+		require.NoError(t, e.EncryptStream(bytes.NewReader(data), &cipherText))
+		return cipherText.Bytes()
+	}
+
+	// a legacy header-less object, from TestCiphertextSamples
+	legacy, err := hex.DecodeString("9456421484adb715d7f6b52663908dd1acf16848077df01942847cc0e835a627c8b5c704b465ea86f47afd4e359c097582e81a544fdbd1")
+	require.NoError(t, err)
+	cfb, err := encryption.CreateEncryptor("AES-256-CFB", []byte("abcdefghijklmnopqrstuvwxyzabcdef"))
+	require.NoError(t, err)
+	payload := "quick brown fox jumps over the lazy dog"
+	require.EqualValues(t, len(payload), objectSize(cfb, legacy))
+	// the estimate assumes a header, which the legacy object doesn't have
+	require.NotEqualValues(t, len(payload), encryption.PlainTextSize(cfb, int64(len(legacy))))
+
+	// objects written with a different algorithm or KDF
+	current, err := encryption.CreateEncryptor("AES-256-GCM", passPhrase)
+	require.NoError(t, err)
+	kdf, err := encryption.ParseKDFOptions("scrypt", "N=1024,r=8,p=1")
+	require.NoError(t, err)
+	for _, algo := range []string{"AES-256-CFB", "CHACHA20-POLY1305"} {
+		other, err := encryption.CreateEncryptorWithKDF(algo, passPhrase, kdf)
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), objectSize(current, encrypt(other)), algo)
+	}
+
+	// envelope objects written before the master key is changed
+	oldKey, err := encryption.GenerateMasterKey("old")
+	require.NoError(t, err)
+	newKey, err := encryption.GenerateMasterKey("a-much-longer-master-key-id")
+	require.NoError(t, err)
+	oldProvider, err := encryption.ParseMasterKeys(oldKey)
+	require.NoError(t, err)
+	rotatedProvider, err := encryption.ParseMasterKeys(newKey + "\n" + oldKey)
+	require.NoError(t, err)
+	oldEnc, err := encryption.CreateEnvelopeEncryptor("", oldProvider)
+	require.NoError(t, err)
+	oldCT := encrypt(oldEnc)
+	provider := &countingProvider{KeyProvider: rotatedProvider}
+	rotated, err := encryption.CreateEnvelopeEncryptor("", provider)
+	require.NoError(t, err)
+	require.Zero(t, provider.calls, "the provider is called when creating the encryptor")
+	encrypt(rotated)
+	require.EqualValues(t, len(data), objectSize(rotated, oldCT))
+	require.NotEqualValues(t, len(data), encryption.PlainTextSize(rotated, int64(len(oldCT))))
+}
+
+func TestRekey(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+
+	encrypt := func(enc encryption.StreamEncryptor) []byte {
+		var cipherText bytes.Buffer
+		require.NoError(t, enc.EncryptStream(bytes.NewBuffer(data), &cipherText))
+		return cipherText.Bytes()
+	}
+	plan := func(from, to encryption.StreamEncryptor, ct []byte) encryption.RekeyAction {
+		open := func(offset, length int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(ct[offset:])), nil
+		}
+		action, err := encryption.PlanRekey(from, to, open)
+		require.NoError(t, err)
+		return action
+	}
+
+	oldPass, err := encryption.CreateEncryptor("AES-256-GCM", []byte("old"))
+	require.NoError(t, err)
+	newPass, err := encryption.CreateEncryptor("AES-256-GCM", []byte("new"))
+	require.NoError(t, err)
+	newAlgo, err := encryption.CreateEncryptor("CHACHA20-POLY1305", []byte("old"))
+	require.NoError(t, err)
+	ct := encrypt(oldPass)
+	require.Equal(t, encryption.RekeyNone, plan(oldPass, oldPass, ct))
+	require.Equal(t, encryption.RekeyReencrypt, plan(oldPass, newPass, ct))
+	require.Equal(t, encryption.RekeyReencrypt, plan(oldPass, newAlgo, ct))
+	require.Equal(t, encryption.RekeyNone, plan(newPass, newPass, encrypt(newPass)))
+
+	_, recipient1, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+	_, recipient2, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients1, err := encryption.CreateRecipientEncryptor("", []string{recipient1}, nil)
+	require.NoError(t, err)
+	recipients12, err := encryption.CreateRecipientEncryptor("", []string{recipient1, recipient2}, nil)
+	require.NoError(t, err)
+	require.Equal(t, encryption.RekeyNone, plan(oldPass, recipients1, encrypt(recipients1)))
+	require.Equal(t, encryption.RekeyReencrypt, plan(oldPass, recipients12, encrypt(recipients1)))
+
+	oldKey, err := encryption.GenerateMasterKey("old")
+	require.NoError(t, err)
+	newKey, err := encryption.GenerateMasterKey("new")
+	require.NoError(t, err)
+	oldProvider, err := encryption.ParseMasterKeys(oldKey)
+	require.NoError(t, err)
+	newProvider, err := encryption.ParseMasterKeys(newKey)
+	require.NoError(t, err)
+	oldEnvelope, err := encryption.CreateEnvelopeEncryptor("", oldProvider)
+	require.NoError(t, err)
+	newEnvelope, err := encryption.CreateEnvelopeEncryptor("", newProvider)
+	require.NoError(t, err)
+
+	ct = encrypt(oldEnvelope)
+	require.Equal(t, encryption.RekeyNone, plan(oldEnvelope, oldEnvelope, ct))
+	require.Equal(t, encryption.RekeyRewrap, plan(oldEnvelope, newEnvelope, ct))
+	require.Equal(t, encryption.RekeyReencrypt, plan(oldEnvelope, newPass, ct))
+
+	var rewrapped bytes.Buffer
+	require.NoError(t, encryption.Rewrap(oldEnvelope, newEnvelope, bytes.NewReader(ct), &rewrapped))
+	require.Equal(t, len(ct), rewrapped.Len())
+	require.Equal(t, encryption.RekeyNone, plan(oldEnvelope, newEnvelope, rewrapped.Bytes()))
+	var plainText bytes.Buffer
+	require.NoError(t, newEnvelope.DecryptStream(bytes.NewReader(rewrapped.Bytes()), &plainText))
+	require.Equal(t, data, plainText.Bytes())
+	require.ErrorIs(t, oldEnvelope.DecryptStream(bytes.NewReader(rewrapped.Bytes()), io.Discard), encryption.ErrWrongKey)
+
+	// the master key is compared without wrapping a data key
+	provider := &countingProvider{KeyProvider: newProvider}
+	counted, err := encryption.CreateEnvelopeEncryptor("", provider)
+	require.NoError(t, err)
+	fresh, err := encryption.CreateEnvelopeEncryptor("", newProvider)
+	require.NoError(t, err)
+	require.Equal(t, encryption.RekeyNone, plan(oldEnvelope, fresh, rewrapped.Bytes()))
+	// the current master key is unknown until the provider wraps a data key
+	require.Equal(t, encryption.RekeyRewrap, plan(oldEnvelope, counted, rewrapped.Bytes()))
+	require.Zero(t, provider.calls)
+	encrypt(counted)
+	require.Equal(t, encryption.RekeyNone, plan(oldEnvelope, counted, rewrapped.Bytes()))
+
+	require.Error(t, encryption.Rewrap(oldPass, newPass, bytes.NewReader(encrypt(oldPass)), io.Discard))
+}
+
+func TestNameEncryptor(t *testing.T) {
+	enc, err := encryption.CreateEncryptor("AES-256-GCM", []byte("pass phrase"))
+	require.NoError(t, err)
+	names, err := encryption.CreateNameEncryptor(enc)
+	require.NoError(t, err)
+
+	encrypted, err := names.EncryptName("prod-customer-db")
+	require.NoError(t, err)
+	require.NotContains(t, encrypted, "customer")
+	again, err := names.EncryptName("prod-customer-db")
+	require.NoError(t, err)
+	require.Equal(t, encrypted, again, "names should be encrypted deterministically")
+	require.Regexp(t, "^[0-9a-v]+$", encrypted)
+
+	name, err := names.DecryptName(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "prod-customer-db", name)
+
+	other, err := encryption.CreateEncryptor("AES-256-GCM", []byte("other pass phrase"))
+	require.NoError(t, err)
+	otherNames, err := encryption.CreateNameEncryptor(other)
+	require.NoError(t, err)
+	_, err = otherNames.DecryptName(encrypted)
+	require.Error(t, err)
+
+	for _, invalid := range []string{"", ".", "..", "a/b", strings.Repeat("x", 200)} {
+		_, err := names.EncryptName(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	_, recipient, err := encryption.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients, err := encryption.CreateRecipientEncryptor("", []string{recipient}, nil)
+	require.NoError(t, err)
+	_, err = encryption.CreateNameEncryptor(recipients)
+	require.Error(t, err)
+}
+
+// TestCiphertextSamples verifies that legacy header-less ciphertexts are
+// still decryptable by the configured algorithm.
 func TestCiphertextSamples(t *testing.T) {
 	cases := []struct {
 		passPhrase []byte
@@ -77,6 +726,11 @@ func TestCiphertextSamples(t *testing.T) {
 				"AES-128-CFB": "3f531b215a8b0774edeb5f07f451f811c6ba0b",
 				"AES-192-CFB": "65cce058982cde6dec94ee7965c737bd2e9044",
 				"AES-256-CFB": "cd68a8ba7e886f00326ebd9da560bfca0ad5c4",
+
+				"AES-128-GCM":       "2c8630c3d87565106c6230cea4eecb137a26190c6a7fea7de528",
+				"AES-192-GCM":       "99edd3dd61432ec35626428ee0b291618fc41736b0cfcb26fde0",
+				"AES-256-GCM":       "7bab01809862de5df93c4a93b065eac7e02f529a047b7c96c916",
+				"CHACHA20-POLY1305": "bf9abe886337a471450d2f264cad36e70e46af5d75d09f2f17b3",
 			},
 		},
 		{
@@ -88,6 +742,11 @@ func TestCiphertextSamples(t *testing.T) {
 				"AES-128-CFB": "a4fd5ed9b98b780f09c3253dadd81e9b96b52f3fbe215ab0b43e88df82457b5eb4209bdabe4d8edf045763d17807ea559f4d1e316edc9b",
 				"AES-192-CFB": "6d9cfd25a3b5f2299534c87cd6f61f16c153178e74496d9b6b67f351d9c2a4a7c1514a5a4b42efe945ac56baea71f1dff51df9dc40a8a4",
 				"AES-256-CFB": "9456421484adb715d7f6b52663908dd1acf16848077df01942847cc0e835a627c8b5c704b465ea86f47afd4e359c097582e81a544fdbd1",
+
+				"AES-128-GCM":       "ab64ac8d50e4f5b124abc40f9f96c82e5aad1633f42b9e8835fd1bcf6d9ce49ff5ee7350d622616884be5a8bb48fef86fa658594f353417379330adc6dd9",
+				"AES-192-GCM":       "70ba331c54edb376f3c2701a01bd3708573adb296cef2ef81c25fdbb8e37a7eb37e3fe4fdaadacb27280c2dc876f17289cbf67ad7262ceb2e81e9ba9c23f",
+				"AES-256-GCM":       "42f3d7f61d0ceb6752a64ef50e3fcf0dad23a538e76416928b48f89ebd07a41e124d11b9c7f66221214257010ffa2dc7cc34ffda9d6d48dbc402bbdd26c9",
+				"CHACHA20-POLY1305": "c383c84d99f61ae7bafdbdc834fd47c1c07bf98522589f0bee1810fb0d1614cc46b4c36b731bd4cdbe6c894fb95574317fc0bfcab59097c3a60179419ec7",
 			},
 		},
 	}
@@ -12,6 +12,57 @@ type StreamEncryptor interface {
 	// DecryptStream appends the unencrypted bytes corresponding to the given ciphertext to a given writer.
 	DecryptStream(cipherText io.Reader, output io.Writer) error
 
-	// Overhead is the number of bytes of overhead added by EncryptStream()
+	// Overhead is the number of bytes of overhead added by EncryptStream().
+	// For encryptors implementing PlainTextSizer, it's the minimum overhead.
 	Overhead() int
 }
+
+// PlainTextSizer is implemented by encryptors whose overhead depends on
+// the length of the plaintext.
+type PlainTextSizer interface {
+	// PlainTextSize returns the size of the plaintext corresponding to
+	// a ciphertext of the given size.
+	PlainTextSize(cipherTextSize int64) int64
+}
+
+// PlainTextSize returns the size of the plaintext corresponding to
+// a ciphertext of the given size produced by the encryptor.
+func PlainTextSize(e StreamEncryptor, cipherTextSize int64) int64 {
+	if s, ok := e.(PlainTextSizer); ok {
+		return s.PlainTextSize(cipherTextSize)
+	}
+	return max(0, cipherTextSize-int64(e.Overhead()))
+}
+
+// ObjectSizer is implemented by encryptors writing a header, whose size
+// depends on how the object was encrypted, e.g. the KDF, the recipients or
+// the master key, and legacy objects have no header at all. So PlainTextSize
+// is only an estimate, assuming the object is written with the current
+// configuration.
+type ObjectSizer interface {
+	// ObjectPlainTextSize reads the header of the object through `open`, and
+	// returns the exact size of its plaintext.
+	ObjectPlainTextSize(open RangeOpener, cipherTextSize int64) (int64, error)
+}
+
+// ObjectPlainTextSize returns the size of the plaintext of the object, whose
+// header is read through `open` if the encryptor implements ObjectSizer.
+func ObjectPlainTextSize(e StreamEncryptor, open RangeOpener, cipherTextSize int64) (int64, error) {
+	if s, ok := e.(ObjectSizer); ok {
+		return s.ObjectPlainTextSize(open, cipherTextSize)
+	}
+	return PlainTextSize(e, cipherTextSize), nil
+}
+
+// RangeOpener opens a reader of the ciphertext starting at the given offset.
+// If length is not positive, the reader returns the rest of the ciphertext.
+type RangeOpener func(offset, length int64) (io.ReadCloser, error)
+
+// RangeDecryptor is implemented by encryptors that are able to decrypt a part
+// of the plaintext without processing the whole ciphertext.
+type RangeDecryptor interface {
+	// DecryptRange returns a reader of the plaintext in the range [offset, offset+length).
+	// If length is not positive, the plaintext is read to the end.
+	// Only the parts of the ciphertext needed are read through `open`.
+	DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error)
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// envelopeStanza is the data key wrapped by a KeyProvider.
+type envelopeStanza struct {
+	// MasterKeyID identifies the master key wrapping the data key.
+	MasterKeyID string `json:"mkid"`
+	WrappedKey  []byte `json:"key"`
+}
+
+// envelopeEncryptor encrypts every object with a random data key, which is
+// wrapped by the master key of a KeyProvider and recorded in the header.
+// Rotating the master key doesn't require rewriting existing objects, as
+// long as the provider still knows the old master keys.
+type envelopeEncryptor struct {
+	algorithm string
+	provider  KeyProvider
+	// sizer is used to calculate sizes, which don't depend on the key
+	sizer StreamEncryptor
+	// minHeaderSize is the size of the header without the wrapped key
+	minHeaderSize int
+
+	mu sync.Mutex
+	// currentKeyID is the ID of the master key which wrapped the last data key
+	currentKeyID string
+	// headerSize is the size of the header of the last encrypted object, 0
+	// if no object is encrypted yet
+	headerSize int
+	// unwrapped caches the unwrapped data keys, to avoid calling the
+	// provider for every range read of the same object
+	unwrapped map[string][]byte
+}
+
+var _ RangeDecryptor = (*envelopeEncryptor)(nil)
+var _ PlainTextSizer = (*envelopeEncryptor)(nil)
+var _ ObjectSizer = (*envelopeEncryptor)(nil)
+
+// CreateEnvelopeEncryptor creates an encryptor encrypting objects with
+// per-object data keys wrapped by the provider. The data is encrypted by the
+// registered algorithm. The provider is not called until an object is
+// encrypted or decrypted.
+func CreateEnvelopeEncryptor(algorithm string, provider KeyProvider) (StreamEncryptor, error) {
+	if algorithm == "" {
+		algorithm = defaultDataKeyAlgorithm
+	}
+	e := &envelopeEncryptor{
+		algorithm: strings.ToUpper(algorithm),
+		provider:  provider,
+		unwrapped: map[string][]byte{},
+	}
+	var err error
+	if e.sizer, err = sizerOf(e.algorithm); err != nil {
+		return nil, err
+	}
+	hdr := &objectHeader{Algorithm: e.algorithm, Envelope: &envelopeStanza{}}
+	header, err := hdr.marshal()
+	if err != nil {
+		return nil, err
+	}
+	e.minHeaderSize = len(header)
+	return e, nil
+}
+
+// newObjectKey generates a data key and the header recording it.
+func (e *envelopeEncryptor) newObjectKey() ([]byte, []byte, error) {
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("rand.Read() error: %w", err)
+	}
+	keyID, wrapped, err := e.provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrap data key error: %w", err)
+	}
+	hdr := &objectHeader{
+		Algorithm: e.algorithm,
+		Envelope:  &envelopeStanza{MasterKeyID: keyID, WrappedKey: wrapped},
+	}
+	header, err := hdr.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	e.wrapped(keyID, len(header))
+	return dataKey, header, nil
+}
+
+func (e *envelopeEncryptor) decryptorOf(hdr *objectHeader) (StreamEncryptor, error) {
+	dataKey, err := e.unwrapDataKey(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return createRawEncryptor(hdr.Algorithm, dataKey)
+}
+
+func (e *envelopeEncryptor) unwrapDataKey(hdr *objectHeader) ([]byte, error) {
+	if hdr == nil || hdr.Envelope == nil {
+		return nil, fmt.Errorf("%w: the object is not encrypted with a key provider", ErrWrongKey)
+	}
+	cacheKey := hdr.Envelope.MasterKeyID + "/" + string(hdr.Envelope.WrappedKey)
+	e.mu.Lock()
+	dataKey, ok := e.unwrapped[cacheKey]
+	e.mu.Unlock()
+	if !ok {
+		var err error
+		dataKey, err = e.provider.UnwrapKey(hdr.Envelope.MasterKeyID, hdr.Envelope.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(dataKey) != dataKeyLength {
+			return nil, fmt.Errorf("%w: invalid data key length %d", ErrWrongKey, len(dataKey))
+		}
+		e.mu.Lock()
+		e.unwrapped[cacheKey] = dataKey
+		e.mu.Unlock()
+	}
+	return dataKey, nil
+}
+
+// isCurrent compares the master key of the header with the current one of
+// the provider, without wrapping a data key. If the provider doesn't tell
+// its current master key, the one of the last wrapped data key is used, and
+// the object isn't current until a data key is wrapped.
+func (e *envelopeEncryptor) isCurrent(hdr *objectHeader) bool {
+	if hdr == nil || hdr.Envelope == nil || hdr.Algorithm != e.algorithm {
+		return false
+	}
+	currentKeyID := e.currentKey()
+	return currentKeyID != "" && hdr.Envelope.MasterKeyID == currentKeyID
+}
+
+// currentKey returns the ID of the current master key, or "" if it's unknown.
+func (e *envelopeEncryptor) currentKey() string {
+	if p, ok := e.provider.(CurrentKeyIDProvider); ok {
+		return p.CurrentKeyID()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.currentKeyID
+}
+
+// wrapped records the master key wrapping the last data key, and the size
+// of the header recording it.
+func (e *envelopeEncryptor) wrapped(keyID string, headerSize int) {
+	e.mu.Lock()
+	e.currentKeyID = keyID
+	e.headerSize = headerSize
+	e.mu.Unlock()
+}
+
+func (e *envelopeEncryptor) EncryptStream(plainText io.Reader, output io.Writer) error {
+	dataKey, header, err := e.newObjectKey()
+	if err != nil {
+		return err
+	}
+	enc, err := createRawEncryptor(e.algorithm, dataKey)
+	if err != nil {
+		return err
+	}
+	if err := writeFull(output, header, "header"); err != nil {
+		return err
+	}
+	return enc.EncryptStream(plainText, output)
+}
+
+func (e *envelopeEncryptor) DecryptStream(cipherText io.Reader, output io.Writer) error {
+	return decryptStreamWithHeader(cipherText, output, e.decryptorOf)
+}
+
+func (e *envelopeEncryptor) DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error) {
+	return decryptRangeWithHeader(open, offset, length, e.decryptorOf)
+}
+
+func (e *envelopeEncryptor) Overhead() int {
+	return e.minHeaderSize + e.sizer.Overhead()
+}
+
+// PlainTextSize implements PlainTextSizer. It assumes the object has the
+// header of the last encrypted object, or the header without the wrapped
+// key if none is encrypted yet, use ObjectPlainTextSize for the exact size.
+func (e *envelopeEncryptor) PlainTextSize(cipherTextSize int64) int64 {
+	e.mu.Lock()
+	headerSize := e.headerSize
+	e.mu.Unlock()
+	if headerSize == 0 {
+		headerSize = e.minHeaderSize
+	}
+	return PlainTextSize(e.sizer, cipherTextSize-int64(headerSize))
+}
+
+// ObjectPlainTextSize implements ObjectSizer.
+func (e *envelopeEncryptor) ObjectPlainTextSize(open RangeOpener, cipherTextSize int64) (int64, error) {
+	return objectPlainTextSize(open, cipherTextSize, "")
+}
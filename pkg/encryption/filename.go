@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	purposeFilenameKey = "filename-encryption"
+	filenameKeyLength  = 64 // AES-256-SIV
+	// maxEncryptedNameLength is the max length of an encrypted name. Most
+	// file systems and object storages limit the length of a name to 255,
+	// and some room is left for a suffix.
+	maxEncryptedNameLength = 240
+)
+
+// filenameEncoding is the lower case base32hex without padding, which is
+// safe for case-insensitive storages.
+var filenameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// NameEncryptor encrypts names deterministically, so that an encrypted name
+// can be found by encrypting the plaintext name again.
+type NameEncryptor interface {
+	// EncryptName encrypts a single path component.
+	EncryptName(name string) (string, error)
+	// DecryptName decrypts a name returned by EncryptName.
+	DecryptName(encrypted string) (string, error)
+}
+
+type sivNameEncryptor struct {
+	siv *aesSIV
+}
+
+// CreateNameEncryptor creates a NameEncryptor with AES-SIV and base32
+// encoding. The key is derived from the pass phrase of the encryptor created
+// by CreateEncryptor or CreateEncryptorWithKDF. If a salted KDF is used, the
+// salt shared by the objects in the repository is used, so names must be
+// encrypted after the key check object is decrypted or created.
+//
+// It's not supported for encryptors with public keys or key providers, since
+// there is no secret shared by all writers and readers.
+func CreateNameEncryptor(enc StreamEncryptor) (NameEncryptor, error) {
+	he, ok := enc.(*headerEncryptor)
+	if !ok {
+		return nil, errors.New("filename encryption requires a pass phrase")
+	}
+	k, _, err := he.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(k.ikm, []byte(purposeFilenameKey), filenameKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("deriveKey() error: %w", err)
+	}
+	siv, err := newAESSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sivNameEncryptor{siv: siv}, nil
+}
+
+func (e *sivNameEncryptor) EncryptName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	encrypted := filenameEncoding.EncodeToString(e.siv.Seal([]byte(name)))
+	if len(encrypted) > maxEncryptedNameLength {
+		return "", fmt.Errorf("name %q is too long to be encrypted", name)
+	}
+	return encrypted, nil
+}
+
+func (e *sivNameEncryptor) DecryptName(encrypted string) (string, error) {
+	data, err := filenameEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted name %q: %w", encrypted, err)
+	}
+	name, err := e.siv.Open(data)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt name %q: %w", encrypted, err)
+	}
+	return string(name), nil
+}
@@ -0,0 +1,480 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+const (
+	// headerMagic identifies an object written with a header. Objects without
+	// it are treated as legacy header-less objects.
+	headerMagic   = "DSFDENC"
+	headerVersion = 1
+	// headerPrefixSize is the size of magic | version | body length (uint32).
+	headerPrefixSize = len(headerMagic) + 1 + 4
+	// headerProbeSize is the number of bytes read at once to parse the header
+	// in range reads, which is enough for most headers.
+	headerProbeSize   = 4096
+	maxHeaderBodySize = 1024 * 1024
+
+	purposeKeyID = "key-id"
+	keyIDLength  = 8
+)
+
+// objectHeader is written at the beginning of every encrypted object,
+// so that the object can be decrypted without knowing how it was produced.
+// It's encoded as:
+//
+//	magic | version (1 byte) | body length (4 bytes, big endian) | body (json)
+type objectHeader struct {
+	// Algorithm is the name of the registered algorithm encrypting the content.
+	Algorithm string `json:"alg"`
+	// KDF describes how the key is derived from the pass phrase.
+	KDF *kdfParams `json:"kdf,omitempty"`
+	// KeyID identifies the key without revealing it.
+	KeyID string `json:"kid,omitempty"`
+	// Recipients holds the data key of the object wrapped for each recipient,
+	// if the object is encrypted with public keys.
+	Recipients []*recipientStanza `json:"recipients,omitempty"`
+	// Envelope holds the data key of the object wrapped by a KeyProvider.
+	Envelope *envelopeStanza `json:"envelope,omitempty"`
+}
+
+func (h *objectHeader) marshal() ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("marshal header error: %w", err)
+	}
+	buf := make([]byte, headerPrefixSize, headerPrefixSize+len(body))
+	copy(buf, headerMagic)
+	buf[len(headerMagic)] = headerVersion
+	binary.BigEndian.PutUint32(buf[len(headerMagic)+1:], uint32(len(body)))
+	return append(buf, body...), nil
+}
+
+// parseHeaderPrefix parses the fixed-size prefix of the header and returns
+// the length of the body. If the prefix doesn't start with the magic, the
+// object is a legacy one and ok is false.
+func parseHeaderPrefix(prefix []byte) (bodyLength int, ok bool, err error) {
+	if len(prefix) < headerPrefixSize || !bytes.Equal(prefix[:len(headerMagic)], []byte(headerMagic)) {
+		return 0, false, nil
+	}
+	if v := prefix[len(headerMagic)]; v != headerVersion {
+		return 0, false, fmt.Errorf("unsupported header version %d", v)
+	}
+	bodyLength = int(binary.BigEndian.Uint32(prefix[len(headerMagic)+1:]))
+	if bodyLength > maxHeaderBodySize {
+		return 0, false, fmt.Errorf("header is too large, length: %d", bodyLength)
+	}
+	return bodyLength, true, nil
+}
+
+func unmarshalHeaderBody(body []byte) (*objectHeader, error) {
+	hdr := &objectHeader{}
+	if err := json.Unmarshal(body, hdr); err != nil {
+		return nil, fmt.Errorf("unmarshal header error: %w", err)
+	}
+	if hdr.Algorithm == "" {
+		return nil, errors.New("invalid header: missing algorithm")
+	}
+	return hdr, nil
+}
+
+// readHeader reads the header from the beginning of the ciphertext.
+// For legacy objects, it returns a nil header, and the returned reader
+// yields the whole ciphertext.
+func readHeader(cipherText io.Reader) (*objectHeader, io.Reader, error) {
+	prefix := make([]byte, headerPrefixSize)
+	n, err := io.ReadFull(cipherText, prefix)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, fmt.Errorf("unable to read header from cipherText, error: %w", err)
+	}
+	prefix = prefix[:n]
+	bodyLength, ok, err := parseHeaderPrefix(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, io.MultiReader(bytes.NewReader(prefix), cipherText), nil
+	}
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(cipherText, body); err != nil {
+		return nil, nil, fmt.Errorf("unable to read header from cipherText, error: %w", err)
+	}
+	hdr, err := unmarshalHeaderBody(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, cipherText, nil
+}
+
+// readHeaderRange reads the header with `open`, and returns the header
+// and its size. For legacy objects, it returns a nil header.
+func readHeaderRange(open RangeOpener) (*objectHeader, int64, error) {
+	rc, err := open(0, headerProbeSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	probe, err := io.ReadAll(io.LimitReader(rc, headerProbeSize))
+	rc.Close()
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read header from cipherText, error: %w", err)
+	}
+	bodyLength, ok, err := parseHeaderPrefix(probe)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, nil
+	}
+	size := headerPrefixSize + bodyLength
+	if size > len(probe) {
+		rest, err := readRange(open, int64(len(probe)), int64(size-len(probe)))
+		if err != nil {
+			return nil, 0, err
+		}
+		probe = append(probe, rest...)
+	}
+	hdr, err := unmarshalHeaderBody(probe[headerPrefixSize:size])
+	if err != nil {
+		return nil, 0, err
+	}
+	return hdr, int64(size), nil
+}
+
+var sizers sync.Map // algorithm => StreamEncryptor
+
+// sizerOf returns an encryptor of the algorithm for calculating sizes, which
+// don't depend on the key.
+func sizerOf(algorithm string) (StreamEncryptor, error) {
+	if e, ok := sizers.Load(algorithm); ok {
+		return e.(StreamEncryptor), nil
+	}
+	e, err := createRawEncryptor(algorithm, make([]byte, minDerivedKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	sizers.Store(algorithm, e)
+	return e, nil
+}
+
+// objectPlainTextSize reads the header of the object, and returns the size
+// of the plaintext according to the size of the header and the algorithm
+// recorded in it. Legacy header-less objects are assumed to be encrypted by
+// legacyAlgorithm, and they are rejected if it's empty.
+func objectPlainTextSize(open RangeOpener, cipherTextSize int64, legacyAlgorithm string) (int64, error) {
+	hdr, headerSize, err := readHeaderRange(open)
+	if err != nil {
+		return 0, err
+	}
+	algorithm := legacyAlgorithm
+	if hdr != nil {
+		algorithm = hdr.Algorithm
+	} else if algorithm == "" {
+		return 0, fmt.Errorf("%w: the object has no header", ErrWrongKey)
+	}
+	sizer, err := sizerOf(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	return PlainTextSize(sizer, cipherTextSize-headerSize), nil
+}
+
+// keyContext holds the key derived with a set of KDF parameters, and the
+// encryptors created with it.
+type keyContext struct {
+	kdf   *kdfParams
+	keyID string
+	ikm   []byte // input key material of the registered algorithms
+
+	mu         sync.Mutex
+	encryptors map[string]StreamEncryptor
+}
+
+func newKeyContext(kdf *kdfParams, passPhrase []byte) (*keyContext, error) {
+	ikm, err := kdf.stretch(passPhrase)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := deriveKey(ikm, []byte(purposeKeyID), minDerivedKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("deriveKey() error: %w", err)
+	}
+	return &keyContext{
+		kdf:        kdf,
+		keyID:      hex.EncodeToString(keyID[:keyIDLength]),
+		ikm:        ikm,
+		encryptors: map[string]StreamEncryptor{},
+	}, nil
+}
+
+func (k *keyContext) encryptorOf(algorithm string) (StreamEncryptor, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if enc, ok := k.encryptors[algorithm]; ok {
+		return enc, nil
+	}
+	enc, err := createRawEncryptor(algorithm, k.ikm)
+	if err != nil {
+		return nil, err
+	}
+	k.encryptors[algorithm] = enc
+	return enc, nil
+}
+
+// headerEncryptor writes a header before the ciphertext produced by the
+// configured algorithm. When decrypting, it picks the algorithm and the key
+// derivation recorded in the header, and falls back to the configured
+// algorithm for legacy objects.
+type headerEncryptor struct {
+	algorithm  string
+	passPhrase []byte
+	kdf        *KDFOptions
+	// sizer is used to calculate sizes, which don't depend on the key
+	sizer      StreamEncryptor
+	headerSize int
+
+	mu      sync.Mutex
+	keys    map[string]*keyContext // by KDF parameters
+	current *keyContext            // for encrypting new objects
+	header  []byte                 // of new objects
+}
+
+var _ RangeDecryptor = (*headerEncryptor)(nil)
+var _ PlainTextSizer = (*headerEncryptor)(nil)
+var _ ObjectSizer = (*headerEncryptor)(nil)
+
+func newHeaderEncryptor(algorithm string, passPhrase []byte, kdf *KDFOptions) (*headerEncryptor, error) {
+	if kdf == nil {
+		kdf = &KDFOptions{Algorithm: KDFHKDFSHA256}
+	}
+	e := &headerEncryptor{
+		algorithm:  algorithm,
+		passPhrase: passPhrase,
+		kdf:        kdf,
+		keys:       map[string]*keyContext{},
+	}
+	// fail early if the algorithm can't be created
+	var err error
+	if e.sizer, err = sizerOf(algorithm); err != nil {
+		return nil, err
+	}
+	// the size of the header doesn't depend on the salt and the key
+	hdr := &objectHeader{
+		Algorithm: algorithm,
+		KDF:       kdf.params(make([]byte, kdfSaltLength)),
+		KeyID:     strings.Repeat("0", 2*keyIDLength),
+	}
+	if hdr.KDF.Name == KDFHKDFSHA256 {
+		hdr.KDF.Salt = nil
+	}
+	data, err := hdr.marshal()
+	if err != nil {
+		return nil, err
+	}
+	e.headerSize = len(data)
+	return e, nil
+}
+
+// keyOf returns the key derived with the KDF parameters.
+func (e *headerEncryptor) keyOf(kdf *kdfParams) (*keyContext, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.keyOfLocked(kdf)
+}
+
+func (e *headerEncryptor) keyOfLocked(kdf *kdfParams) (*keyContext, error) {
+	cacheKey := kdf.cacheKey()
+	if k, ok := e.keys[cacheKey]; ok {
+		return k, nil
+	}
+	k, err := newKeyContext(kdf, e.passPhrase)
+	if err != nil {
+		return nil, err
+	}
+	e.keys[cacheKey] = k
+	return k, nil
+}
+
+// currentKey returns the key and the header for encrypting new objects.
+func (e *headerEncryptor) currentKey() (*keyContext, []byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current != nil {
+		return e.current, e.header, nil
+	}
+	// Reuse the salt of a key derived with the same cost parameters (e.g. when
+	// decrypting the key check object), so that the objects in a repository
+	// share the same salt, and the expensive derivation is done only once.
+	var current *keyContext
+	template := e.kdf.params(nil)
+	for _, k := range e.keys {
+		if k.kdf.sameCost(template) {
+			current = k
+			break
+		}
+	}
+	if current == nil {
+		params, err := e.kdf.newParams()
+		if err != nil {
+			return nil, nil, err
+		}
+		if current, err = e.keyOfLocked(params); err != nil {
+			return nil, nil, err
+		}
+	}
+	hdr := &objectHeader{
+		Algorithm: e.algorithm,
+		KDF:       current.kdf,
+		KeyID:     current.keyID,
+	}
+	header, err := hdr.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	e.current, e.header = current, header
+	return e.current, e.header, nil
+}
+
+// decryptorOf returns the encryptor for decrypting the object with the header.
+// It returns ErrWrongKey if the object was encrypted with a different key.
+func (e *headerEncryptor) decryptorOf(hdr *objectHeader) (StreamEncryptor, error) {
+	if hdr == nil {
+		// legacy header-less object
+		k, err := e.keyOf(&kdfParams{Name: KDFHKDFSHA256})
+		if err != nil {
+			return nil, err
+		}
+		return k.encryptorOf(e.algorithm)
+	}
+	if len(hdr.Recipients) > 0 {
+		return nil, fmt.Errorf("%w: the object is encrypted with public keys, an identity is required", ErrWrongKey)
+	}
+	if hdr.Envelope != nil {
+		return nil, fmt.Errorf("%w: the object is encrypted with a key provider", ErrWrongKey)
+	}
+	kdf := hdr.KDF
+	if kdf == nil {
+		kdf = &kdfParams{Name: KDFHKDFSHA256}
+	}
+	k, err := e.keyOf(kdf)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.KeyID != "" && hdr.KeyID != k.keyID {
+		return nil, fmt.Errorf("%w: the object was encrypted with key %s, but the key in use is %s",
+			ErrWrongKey, hdr.KeyID, k.keyID)
+	}
+	return k.encryptorOf(hdr.Algorithm)
+}
+
+func (e *headerEncryptor) isCurrent(hdr *objectHeader) bool {
+	if hdr == nil || hdr.Algorithm != e.algorithm || len(hdr.Recipients) > 0 || hdr.Envelope != nil {
+		return false
+	}
+	kdf := hdr.KDF
+	if kdf == nil {
+		kdf = &kdfParams{Name: KDFHKDFSHA256}
+	}
+	if !kdf.sameCost(e.kdf.params(nil)) {
+		return false
+	}
+	k, err := e.keyOf(kdf)
+	return err == nil && hdr.KeyID == k.keyID
+}
+
+func (e *headerEncryptor) EncryptStream(plainText io.Reader, output io.Writer) error {
+	k, header, err := e.currentKey()
+	if err != nil {
+		return err
+	}
+	enc, err := k.encryptorOf(e.algorithm)
+	if err != nil {
+		return err
+	}
+	if err := writeFull(output, header, "header"); err != nil {
+		return err
+	}
+	return enc.EncryptStream(plainText, output)
+}
+
+func (e *headerEncryptor) DecryptStream(cipherText io.Reader, output io.Writer) error {
+	return decryptStreamWithHeader(cipherText, output, e.decryptorOf)
+}
+
+func (e *headerEncryptor) DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error) {
+	return decryptRangeWithHeader(open, offset, length, e.decryptorOf)
+}
+
+// decryptStreamWithHeader reads the header, and decrypts the rest of the
+// ciphertext with the encryptor returned by decryptorOf.
+func decryptStreamWithHeader(cipherText io.Reader, output io.Writer,
+	decryptorOf func(*objectHeader) (StreamEncryptor, error)) error {
+	hdr, rd, err := readHeader(cipherText)
+	if err != nil {
+		return err
+	}
+	dec, err := decryptorOf(hdr)
+	if err != nil {
+		return err
+	}
+	return dec.DecryptStream(rd, output)
+}
+
+// decryptRangeWithHeader is the range version of decryptStreamWithHeader.
+func decryptRangeWithHeader(open RangeOpener, offset, length int64,
+	decryptorOf func(*objectHeader) (StreamEncryptor, error)) (io.ReadCloser, error) {
+	hdr, headerSize, err := readHeaderRange(open)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := decryptorOf(hdr)
+	if err != nil {
+		return nil, err
+	}
+	shiftedOpen := func(offset, length int64) (io.ReadCloser, error) {
+		return open(offset+headerSize, length)
+	}
+	if rd, ok := dec.(RangeDecryptor); ok {
+		return rd.DecryptRange(shiftedOpen, offset, length)
+	}
+
+	// decrypt from the beginning and discard the bytes before offset
+	rc, err := shiftedOpen(0, -1)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(dec.DecryptStream(rc, pw))
+	}()
+	return newRangeReadCloser(pr, util.CloserFunc(func() error {
+		pr.Close()
+		return rc.Close()
+	}), offset, length), nil
+}
+
+func (e *headerEncryptor) Overhead() int {
+	return e.headerSize + e.sizer.Overhead()
+}
+
+// PlainTextSize implements PlainTextSizer. It assumes the object is written
+// with the current configuration, use ObjectPlainTextSize for the exact size.
+func (e *headerEncryptor) PlainTextSize(cipherTextSize int64) int64 {
+	return PlainTextSize(e.sizer, cipherTextSize-int64(e.headerSize))
+}
+
+// ObjectPlainTextSize implements ObjectSizer. Legacy header-less objects are
+// assumed to be encrypted by the configured algorithm.
+func (e *headerEncryptor) ObjectPlainTextSize(open RangeOpener, cipherTextSize int64) (int64, error) {
+	return objectPlainTextSize(open, cipherTextSize, e.algorithm)
+}
@@ -0,0 +1,206 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KDFHKDFSHA256 = "HKDF-SHA256"
+	KDFScrypt     = "SCRYPT"
+	KDFArgon2ID   = "ARGON2ID"
+
+	kdfSaltLength      = 16
+	stretchedKeyLength = 32
+
+	defaultScryptN       = 1 << 15
+	defaultScryptR       = 8
+	defaultScryptP       = 1
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 64 * 1024 // in KiB
+	defaultArgon2Threads = 4
+	maxScryptN           = 1 << 22
+	maxScryptRP          = 1 << 10
+	maxArgon2Time        = 100
+	maxArgon2Memory      = 4 * 1024 * 1024 // in KiB
+)
+
+// KDFOptions specifies how the keys of new objects are derived from the pass phrase.
+type KDFOptions struct {
+	// Algorithm is one of KDFHKDFSHA256 (default), KDFScrypt and KDFArgon2ID.
+	Algorithm string
+
+	// Cost parameters of scrypt.
+	ScryptN int
+	ScryptR int
+	ScryptP int
+
+	// Cost parameters of Argon2id, the memory is in KiB.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// ParseKDFOptions parses the KDF algorithm and its cost parameters.
+// The parameters are comma-separated key-value pairs, e.g. "N=32768,r=8,p=1"
+// for scrypt, and "t=3,m=65536,p=4" for Argon2id. Missing parameters are
+// set to the default values.
+func ParseKDFOptions(algorithm string, params string) (*KDFOptions, error) {
+	opts := &KDFOptions{Algorithm: strings.ToUpper(strings.TrimSpace(algorithm))}
+	switch opts.Algorithm {
+	case "", "HKDF", KDFHKDFSHA256:
+		opts.Algorithm = KDFHKDFSHA256
+	case KDFScrypt:
+		opts.ScryptN, opts.ScryptR, opts.ScryptP = defaultScryptN, defaultScryptR, defaultScryptP
+	case KDFArgon2ID:
+		opts.Argon2Time, opts.Argon2Memory, opts.Argon2Threads = defaultArgon2Time, defaultArgon2Memory, defaultArgon2Threads
+	default:
+		return nil, fmt.Errorf("unknown key derivation function: %v", algorithm)
+	}
+
+	for _, kv := range strings.Split(params, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid KDF parameter %q", kv)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KDF parameter %q: %w", kv, err)
+		}
+		switch k = strings.TrimSpace(k); {
+		case opts.Algorithm == KDFScrypt && k == "N":
+			opts.ScryptN = int(n)
+		case opts.Algorithm == KDFScrypt && k == "r":
+			opts.ScryptR = int(n)
+		case opts.Algorithm == KDFScrypt && k == "p":
+			opts.ScryptP = int(n)
+		case opts.Algorithm == KDFArgon2ID && k == "t":
+			opts.Argon2Time = uint32(n)
+		case opts.Algorithm == KDFArgon2ID && k == "m":
+			opts.Argon2Memory = uint32(n)
+		case opts.Algorithm == KDFArgon2ID && k == "p" && n <= 255:
+			opts.Argon2Threads = uint8(n)
+		default:
+			return nil, fmt.Errorf("unknown KDF parameter %q for %s", kv, opts.Algorithm)
+		}
+	}
+	if err := opts.params(make([]byte, kdfSaltLength)).validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// params returns the KDF parameters recorded in the header.
+func (o *KDFOptions) params(salt []byte) *kdfParams {
+	switch o.Algorithm {
+	case KDFScrypt:
+		return &kdfParams{Name: KDFScrypt, Salt: salt, N: o.ScryptN, R: o.ScryptR, P: o.ScryptP}
+	case KDFArgon2ID:
+		return &kdfParams{Name: KDFArgon2ID, Salt: salt,
+			Time: o.Argon2Time, Memory: o.Argon2Memory, Threads: o.Argon2Threads}
+	default:
+		return &kdfParams{Name: KDFHKDFSHA256}
+	}
+}
+
+// newParams returns the KDF parameters with a new random salt.
+func (o *KDFOptions) newParams() (*kdfParams, error) {
+	if o.Algorithm == KDFHKDFSHA256 {
+		return o.params(nil), nil
+	}
+	salt := make([]byte, kdfSaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("rand.Read() error: %w", err)
+	}
+	return o.params(salt), nil
+}
+
+// kdfParams describes how the key is derived from the pass phrase.
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt,omitempty"`
+
+	// scrypt
+	N int `json:"N,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+
+	// Argon2id
+	Time    uint32 `json:"t,omitempty"`
+	Memory  uint32 `json:"m,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+func (p *kdfParams) validate() error {
+	switch p.Name {
+	case KDFHKDFSHA256:
+		return nil
+	case KDFScrypt:
+		if p.N <= 1 || p.N > maxScryptN || p.N&(p.N-1) != 0 {
+			return fmt.Errorf("scrypt N must be a power of 2 in (1, %d], got %d", maxScryptN, p.N)
+		}
+		if p.R <= 0 || p.P <= 0 || p.R*p.P > maxScryptRP {
+			return fmt.Errorf("scrypt r and p must be positive and r*p <= %d, got r=%d, p=%d", maxScryptRP, p.R, p.P)
+		}
+	case KDFArgon2ID:
+		if p.Time == 0 || p.Time > maxArgon2Time {
+			return fmt.Errorf("argon2id t must be in [1, %d], got %d", maxArgon2Time, p.Time)
+		}
+		if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("argon2id m must be in [8*p, %d] KiB, got %d", maxArgon2Memory, p.Memory)
+		}
+		if p.Threads == 0 {
+			return fmt.Errorf("argon2id p must be positive")
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation function %q", p.Name)
+	}
+	if len(p.Salt) < kdfSaltLength {
+		return fmt.Errorf("salt of %s must be at least %d bytes", p.Name, kdfSaltLength)
+	}
+	return nil
+}
+
+// sameCost reports whether the parameters only differ in the salt.
+func (p *kdfParams) sameCost(o *kdfParams) bool {
+	return p.Name == o.Name && p.N == o.N && p.R == o.R && p.P == o.P &&
+		p.Time == o.Time && p.Memory == o.Memory && p.Threads == o.Threads
+}
+
+func (p *kdfParams) cacheKey() string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// stretch derives the input key material for the registered algorithms from
+// the pass phrase. The registered algorithms further derive their keys from it
+// by HKDF, so for HKDF-SHA256 the pass phrase itself is returned, which keeps
+// the keys of existing objects unchanged.
+func (p *kdfParams) stretch(passPhrase []byte) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	switch p.Name {
+	case KDFScrypt:
+		key, err := scrypt.Key(passPhrase, p.Salt, p.N, p.R, p.P, stretchedKeyLength)
+		if err != nil {
+			return nil, fmt.Errorf("scrypt.Key() error: %w", err)
+		}
+		return key, nil
+	case KDFArgon2ID:
+		return argon2.IDKey(passPhrase, p.Salt, p.Time, p.Memory, p.Threads, stretchedKeyLength), nil
+	default:
+		return passPhrase, nil
+	}
+}
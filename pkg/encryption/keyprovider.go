@@ -0,0 +1,284 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMasterKeyEnv is the environment variable read by the "env" key
+	// provider if no variable is specified.
+	DefaultMasterKeyEnv = "DATASAFED_ENCRYPTION_MASTER_KEY"
+	// KMSTokenEnv is the environment variable holding the bearer token sent
+	// to the HTTP KMS.
+	KMSTokenEnv = "DATASAFED_ENCRYPTION_KMS_TOKEN"
+
+	masterKeyLength    = 32
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// KeyProvider wraps the data keys of objects with a master key.
+//
+// A provider may know several master keys, e.g. after the master key is
+// rotated. New data keys are wrapped with the current master key, and the
+// wrapped keys are unwrapped with the master key they were wrapped with.
+type KeyProvider interface {
+	// WrapKey wraps the data key with the current master key, and returns
+	// the ID of the master key and the wrapped key.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey unwraps the data key with the master key identified by keyID.
+	// It returns ErrWrongKey if the master key is unknown or doesn't match.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// CurrentKeyIDProvider is implemented by the KeyProviders knowing the ID of
+// their current master key without wrapping a data key.
+type CurrentKeyIDProvider interface {
+	// CurrentKeyID returns the ID of the master key wrapping new data keys.
+	CurrentKeyID() string
+}
+
+// KeyProviderFactory creates a KeyProvider from the spec, which is the part
+// after the scheme, e.g. the path of "file:/path/to/keys".
+type KeyProviderFactory func(spec string) (KeyProvider, error)
+
+type keyProviderInfo struct {
+	description string
+	newProvider KeyProviderFactory
+}
+
+var keyProviders = map[string]*keyProviderInfo{}
+
+// RegisterKeyProvider registers a key provider for the scheme.
+func RegisterKeyProvider(scheme, description string, newProvider KeyProviderFactory) {
+	keyProviders[strings.ToLower(scheme)] = &keyProviderInfo{description, newProvider}
+}
+
+// SupportedKeyProviders returns the schemes of the registered key providers.
+func SupportedKeyProviders() []string {
+	var result []string
+	for k := range keyProviders {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// CreateKeyProvider creates a KeyProvider from the URI, whose scheme selects
+// the registered provider, e.g. "file:/path/to/keys", "env:VAR_NAME" or
+// "https://kms.example.com/v1".
+func CreateKeyProvider(uri string) (KeyProvider, error) {
+	scheme, spec, ok := strings.Cut(strings.TrimSpace(uri), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid key provider %q, should be <scheme>:<spec>", uri)
+	}
+	info := keyProviders[strings.ToLower(scheme)]
+	if info == nil {
+		return nil, fmt.Errorf("unknown key provider: %v", scheme)
+	}
+	if scheme == "http" || scheme == "https" {
+		// the URL itself is the spec
+		spec = uri
+	}
+	return info.newProvider(spec)
+}
+
+// staticKeyProvider wraps data keys locally with AES-256-GCM, using master
+// keys known in advance. The first key is the current one.
+type staticKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+var _ CurrentKeyIDProvider = (*staticKeyProvider)(nil)
+
+// ParseMasterKeys parses master keys in the format of "<key-id>:<base64 key>",
+// separated by newlines or commas. Empty lines and lines starting with '#'
+// are ignored. The first key is used for wrapping new data keys.
+func ParseMasterKeys(s string) (KeyProvider, error) {
+	p := &staticKeyProvider{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, errors.New("invalid master key, should be <key-id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != masterKeyLength {
+			return nil, fmt.Errorf("invalid master key %q, should be %d bytes encoded in base64", id, masterKeyLength)
+		}
+		if _, ok := p.keys[id]; ok {
+			return nil, fmt.Errorf("duplicated master key %q", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		p.keys[id] = aead
+		if p.current == "" {
+			p.current = id
+		}
+	}
+	if p.current == "" {
+		return nil, errors.New("no master key is found")
+	}
+	return p, nil
+}
+
+// GenerateMasterKey generates a new master key for ParseMasterKeys.
+func GenerateMasterKey(keyID string) (string, error) {
+	key := make([]byte, masterKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", fmt.Errorf("rand.Read() error: %w", err)
+	}
+	return keyID + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (p *staticKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *staticKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	aead := p.keys[p.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, fmt.Errorf("rand.Read() error: %w", err)
+	}
+	return p.current, aead.Seal(nonce, nonce, dataKey, []byte(p.current)), nil
+}
+
+func (p *staticKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown master key %q", ErrWrongKey, keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to unwrap the data key with master key %q", ErrWrongKey, keyID)
+	}
+	return dataKey, nil
+}
+
+// HTTPKeyProvider wraps data keys with a KMS-style HTTP endpoint.
+// It sends JSON requests to:
+//
+//	POST <endpoint>/wrap    {"plaintext": <base64>}
+//	                     => {"key_id": <id>, "ciphertext": <base64>}
+//	POST <endpoint>/unwrap  {"key_id": <id>, "ciphertext": <base64>}
+//	                     => {"plaintext": <base64>}
+//
+// A 404 or 403 response to unwrap is reported as ErrWrongKey.
+type HTTPKeyProvider struct {
+	Endpoint string
+	// Token is sent as a bearer token if it's not empty.
+	Token  string
+	Client *http.Client
+}
+
+type kmsRequest struct {
+	KeyID      string `json:"key_id,omitempty"`
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+type kmsResponse = kmsRequest
+
+func (p *HTTPKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	resp, err := p.call("wrap", &kmsRequest{Plaintext: dataKey})
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.KeyID == "" || len(resp.Ciphertext) == 0 {
+		return "", nil, errors.New("invalid response of KMS wrap: missing key_id or ciphertext")
+	}
+	return resp.KeyID, resp.Ciphertext, nil
+}
+
+func (p *HTTPKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	resp, err := p.call("unwrap", &kmsRequest{KeyID: keyID, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (p *HTTPKeyProvider) call(op string, req *kmsRequest) (*kmsResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(p.Endpoint, "/") + "/" + op
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("KMS %s error: %w", op, err)
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxHeaderBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("KMS %s error: %w", op, err)
+	}
+	switch {
+	case httpResp.StatusCode == http.StatusOK:
+	case op == "unwrap" && (httpResp.StatusCode == http.StatusNotFound || httpResp.StatusCode == http.StatusForbidden):
+		return nil, fmt.Errorf("%w: KMS unwrap of master key %q failed: %s", ErrWrongKey, req.KeyID, httpResp.Status)
+	default:
+		return nil, fmt.Errorf("KMS %s failed: %s: %s", op, httpResp.Status, strings.TrimSpace(string(data)))
+	}
+	resp := &kmsResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("invalid response of KMS %s: %w", op, err)
+	}
+	return resp, nil
+}
+
+func init() {
+	RegisterKeyProvider("file", "master keys in a local file", func(spec string) (KeyProvider, error) {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("read master key file error: %w", err)
+		}
+		return ParseMasterKeys(string(data))
+	})
+	RegisterKeyProvider("env", "master keys in an environment variable", func(spec string) (KeyProvider, error) {
+		if spec == "" {
+			spec = DefaultMasterKeyEnv
+		}
+		return ParseMasterKeys(os.Getenv(spec))
+	})
+	newHTTP := func(spec string) (KeyProvider, error) {
+		return &HTTPKeyProvider{Endpoint: spec, Token: os.Getenv(KMSTokenEnv)}, nil
+	}
+	RegisterKeyProvider("http", "KMS-style HTTP endpoint", newHTTP)
+	RegisterKeyProvider("https", "KMS-style HTTPS endpoint", newHTTP)
+}
@@ -0,0 +1,338 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// X25519RecipientPrefix and X25519IdentityPrefix are the prefixes of the
+	// encoded public and private keys.
+	X25519RecipientPrefix = "dsfd-pub-"
+	X25519IdentityPrefix  = "DSFD-SECRET-KEY-"
+
+	stanzaTypeX25519        = "X25519"
+	recipientTagLength      = 4
+	dataKeyLength           = 32
+	purposeX25519Wrap       = "datasafed-x25519-wrap"
+	defaultDataKeyAlgorithm = "AES-256-GCM"
+)
+
+// ErrNoIdentity is returned when decrypting an object encrypted with public
+// keys, while no private key is configured.
+var ErrNoIdentity = errors.New("no identity to decrypt the object")
+
+// recipientStanza is the data key wrapped for a recipient.
+type recipientStanza struct {
+	Type string `json:"type"`
+	// Tag is a short fingerprint of the recipient, to tell whether an object
+	// is encrypted for the configured recipients.
+	Tag string `json:"tag,omitempty"`
+	// EphemeralKey is the public key of the ephemeral key pair.
+	EphemeralKey []byte `json:"epk"`
+	// WrappedKey is the data key sealed by the key agreed between the
+	// ephemeral key and the recipient.
+	WrappedKey []byte `json:"key"`
+}
+
+// GenerateX25519Identity generates a new key pair, and returns the encoded
+// private key (identity) and public key (recipient).
+func GenerateX25519Identity() (identity string, recipient string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate X25519 key error: %w", err)
+	}
+	return encodeIdentity(key), encodeRecipient(key.PublicKey()), nil
+}
+
+func encodeIdentity(key *ecdh.PrivateKey) string {
+	return X25519IdentityPrefix + base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+func encodeRecipient(key *ecdh.PublicKey) string {
+	return X25519RecipientPrefix + base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+// ParseX25519Recipient parses a public key encoded by GenerateX25519Identity.
+func ParseX25519Recipient(s string) (*ecdh.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, X25519RecipientPrefix) {
+		return nil, fmt.Errorf("invalid recipient %q, should start with %q", s, X25519RecipientPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, X25519RecipientPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+	return key, nil
+}
+
+// ParseX25519Identity parses a private key encoded by GenerateX25519Identity.
+func ParseX25519Identity(s string) (*ecdh.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, X25519IdentityPrefix) {
+		// don't print the key
+		return nil, fmt.Errorf("invalid identity, should start with %q", X25519IdentityPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, X25519IdentityPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	return key, nil
+}
+
+// ReadIdentityFile reads identities from a file, one per line.
+// Empty lines and lines starting with '#' are ignored.
+func ReadIdentityFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read identity file error: %w", err)
+	}
+	var identities []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identities = append(identities, line)
+	}
+	return identities, sc.Err()
+}
+
+// recipientEncryptor encrypts every object with a random data key, which is
+// wrapped for each recipient with X25519 and recorded in the header. Only
+// the public keys are required for encrypting, and one of the private keys
+// is required for decrypting.
+type recipientEncryptor struct {
+	algorithm  string
+	recipients []*ecdh.PublicKey
+	identities []*ecdh.PrivateKey
+	// sizer is used to calculate sizes, which don't depend on the key
+	sizer      StreamEncryptor
+	headerSize int
+}
+
+var _ RangeDecryptor = (*recipientEncryptor)(nil)
+var _ PlainTextSizer = (*recipientEncryptor)(nil)
+var _ ObjectSizer = (*recipientEncryptor)(nil)
+
+// CreateRecipientEncryptor creates an encryptor encrypting objects for the
+// recipients (public keys), and decrypting them with the identities (private
+// keys). If no recipient is given, the objects are encrypted for the
+// identities. If no identity is given, decrypting fails with ErrNoIdentity.
+func CreateRecipientEncryptor(algorithm string, recipients []string, identities []string) (StreamEncryptor, error) {
+	if algorithm == "" {
+		algorithm = defaultDataKeyAlgorithm
+	}
+	e := &recipientEncryptor{algorithm: strings.ToUpper(algorithm)}
+	for _, s := range identities {
+		key, err := ParseX25519Identity(s)
+		if err != nil {
+			return nil, err
+		}
+		e.identities = append(e.identities, key)
+	}
+	for _, s := range recipients {
+		key, err := ParseX25519Recipient(s)
+		if err != nil {
+			return nil, err
+		}
+		e.recipients = append(e.recipients, key)
+	}
+	if len(e.recipients) == 0 {
+		for _, id := range e.identities {
+			e.recipients = append(e.recipients, id.PublicKey())
+		}
+	}
+	if len(e.recipients) == 0 {
+		return nil, errors.New("no recipient or identity is specified")
+	}
+
+	var err error
+	if e.sizer, err = sizerOf(e.algorithm); err != nil {
+		return nil, err
+	}
+	// the size of the header doesn't depend on the keys
+	_, header, err := e.newObjectKey()
+	if err != nil {
+		return nil, err
+	}
+	e.headerSize = len(header)
+	return e, nil
+}
+
+// newObjectKey generates a data key and the header recording it.
+func (e *recipientEncryptor) newObjectKey() ([]byte, []byte, error) {
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("rand.Read() error: %w", err)
+	}
+	hdr := &objectHeader{Algorithm: e.algorithm}
+	for _, r := range e.recipients {
+		stanza, err := wrapX25519(dataKey, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		hdr.Recipients = append(hdr.Recipients, stanza)
+	}
+	header, err := hdr.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, header, nil
+}
+
+func (e *recipientEncryptor) decryptorOf(hdr *objectHeader) (StreamEncryptor, error) {
+	if len(e.identities) == 0 {
+		return nil, ErrNoIdentity
+	}
+	if hdr == nil || len(hdr.Recipients) == 0 {
+		return nil, fmt.Errorf("%w: the object is not encrypted with public keys", ErrWrongKey)
+	}
+	for _, stanza := range hdr.Recipients {
+		if stanza.Type != stanzaTypeX25519 {
+			continue
+		}
+		for _, id := range e.identities {
+			dataKey, err := unwrapX25519(stanza, id)
+			if err == nil {
+				return createRawEncryptor(hdr.Algorithm, dataKey)
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: the object is not encrypted for any of the identities", ErrWrongKey)
+}
+
+func (e *recipientEncryptor) isCurrent(hdr *objectHeader) bool {
+	if hdr == nil || hdr.Algorithm != e.algorithm || len(hdr.Recipients) != len(e.recipients) {
+		return false
+	}
+	tags := map[string]bool{}
+	for _, r := range e.recipients {
+		tags[recipientTag(r)] = true
+	}
+	for _, stanza := range hdr.Recipients {
+		if !tags[stanza.Tag] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *recipientEncryptor) EncryptStream(plainText io.Reader, output io.Writer) error {
+	dataKey, header, err := e.newObjectKey()
+	if err != nil {
+		return err
+	}
+	enc, err := createRawEncryptor(e.algorithm, dataKey)
+	if err != nil {
+		return err
+	}
+	if err := writeFull(output, header, "header"); err != nil {
+		return err
+	}
+	return enc.EncryptStream(plainText, output)
+}
+
+func (e *recipientEncryptor) DecryptStream(cipherText io.Reader, output io.Writer) error {
+	return decryptStreamWithHeader(cipherText, output, e.decryptorOf)
+}
+
+func (e *recipientEncryptor) DecryptRange(open RangeOpener, offset, length int64) (io.ReadCloser, error) {
+	return decryptRangeWithHeader(open, offset, length, e.decryptorOf)
+}
+
+func (e *recipientEncryptor) Overhead() int {
+	return e.headerSize + e.sizer.Overhead()
+}
+
+// PlainTextSize implements PlainTextSizer. It assumes the object is written
+// for the current recipients, use ObjectPlainTextSize for the exact size.
+func (e *recipientEncryptor) PlainTextSize(cipherTextSize int64) int64 {
+	return PlainTextSize(e.sizer, cipherTextSize-int64(e.headerSize))
+}
+
+// ObjectPlainTextSize implements ObjectSizer.
+func (e *recipientEncryptor) ObjectPlainTextSize(open RangeOpener, cipherTextSize int64) (int64, error) {
+	return objectPlainTextSize(open, cipherTextSize, "")
+}
+
+func recipientTag(recipient *ecdh.PublicKey) string {
+	sum := sha256.Sum256(recipient.Bytes())
+	return hex.EncodeToString(sum[:recipientTagLength])
+}
+
+func wrapX25519(dataKey []byte, recipient *ecdh.PublicKey) (*recipientStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate X25519 key error: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("X25519 error: %w", err)
+	}
+	epk := ephemeral.PublicKey().Bytes()
+	aead, err := x25519WrapAEAD(shared, epk, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize()) // the wrapping key is used only once
+	return &recipientStanza{
+		Type:         stanzaTypeX25519,
+		Tag:          recipientTag(recipient),
+		EphemeralKey: epk,
+		WrappedKey:   aead.Seal(nil, nonce, dataKey, nil),
+	}, nil
+}
+
+func unwrapX25519(stanza *recipientStanza, identity *ecdh.PrivateKey) ([]byte, error) {
+	epk, err := ecdh.X25519().NewPublicKey(stanza.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	shared, err := identity.ECDH(epk)
+	if err != nil {
+		return nil, fmt.Errorf("X25519 error: %w", err)
+	}
+	aead, err := x25519WrapAEAD(shared, stanza.EphemeralKey, identity.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	dataKey, err := aead.Open(nil, nonce, stanza.WrappedKey, nil)
+	if err != nil {
+		return nil, errChunkAuthFailed
+	}
+	return dataKey, nil
+}
+
+func x25519WrapAEAD(shared, epk, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, epk...), recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(purposeX25519Wrap)), key); err != nil {
+		return nil, fmt.Errorf("hkdf error: %w", err)
+	}
+	return chacha20poly1305.New(key)
+}
@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"fmt"
+	"io"
+)
+
+// RekeyAction tells how an object is moved to a new encryptor.
+type RekeyAction int
+
+const (
+	// RekeyNone means the object is already encrypted with the new encryptor.
+	RekeyNone RekeyAction = iota
+	// RekeyRewrap means only the data key in the header needs to be rewrapped.
+	RekeyRewrap
+	// RekeyReencrypt means the object needs to be decrypted and encrypted again.
+	RekeyReencrypt
+)
+
+func (a RekeyAction) String() string {
+	switch a {
+	case RekeyNone:
+		return "none"
+	case RekeyRewrap:
+		return "rewrap"
+	case RekeyReencrypt:
+		return "re-encrypt"
+	default:
+		return fmt.Sprintf("RekeyAction(%d)", int(a))
+	}
+}
+
+// headerInspector is implemented by the encryptors writing headers.
+type headerInspector interface {
+	// isCurrent reports whether the object with the header is encrypted
+	// with the current configuration of the encryptor.
+	isCurrent(hdr *objectHeader) bool
+}
+
+// PlanRekey reads the header of the object, and tells how to move it from
+// the encryptor `from` to `to`.
+func PlanRekey(from, to StreamEncryptor, open RangeOpener) (RekeyAction, error) {
+	hdr, _, err := readHeaderRange(open)
+	if err != nil {
+		return RekeyNone, err
+	}
+	if hi, ok := to.(headerInspector); ok && hi.isCurrent(hdr) {
+		return RekeyNone, nil
+	}
+	if canRewrap(from, to, hdr) {
+		return RekeyRewrap, nil
+	}
+	return RekeyReencrypt, nil
+}
+
+func canRewrap(from, to StreamEncryptor, hdr *objectHeader) bool {
+	_, fromEnvelope := from.(*envelopeEncryptor)
+	toEnvelope, ok := to.(*envelopeEncryptor)
+	return fromEnvelope && ok && hdr != nil && hdr.Envelope != nil && hdr.Algorithm == toEnvelope.algorithm
+}
+
+// Rewrap copies the object encrypted with envelope encryption, with its data
+// key unwrapped by `from` and wrapped again by `to`. The content is copied
+// as is. It fails if PlanRekey doesn't return RekeyRewrap for the object.
+func Rewrap(from, to StreamEncryptor, cipherText io.Reader, output io.Writer) error {
+	hdr, rd, err := readHeader(cipherText)
+	if err != nil {
+		return err
+	}
+	if !canRewrap(from, to, hdr) {
+		return fmt.Errorf("the object can't be rewrapped")
+	}
+	dataKey, err := from.(*envelopeEncryptor).unwrapDataKey(hdr)
+	if err != nil {
+		return err
+	}
+	toEnvelope := to.(*envelopeEncryptor)
+	keyID, wrapped, err := toEnvelope.provider.WrapKey(dataKey)
+	if err != nil {
+		return fmt.Errorf("wrap data key error: %w", err)
+	}
+	hdr.Envelope = &envelopeStanza{MasterKeyID: keyID, WrappedKey: wrapped}
+	header, err := hdr.marshal()
+	if err != nil {
+		return err
+	}
+	toEnvelope.wrapped(keyID, len(header))
+	if err := writeFull(output, header, "header"); err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, rd); err != nil {
+		return fmt.Errorf("copy cipherText error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+var errSIVAuthFailed = errors.New("SIV authentication failed")
+
+// aesSIV implements the deterministic authenticated encryption AES-SIV
+// defined in RFC 5297. The same plaintext and associated data always produce
+// the same ciphertext, which is what filename encryption needs.
+type aesSIV struct {
+	mac cipher.Block // for S2V, the first half of the key
+	ctr cipher.Block // for CTR, the second half of the key
+}
+
+// newAESSIV creates an aesSIV with a key of 32, 48 or 64 bytes,
+// for AES-128, AES-192 and AES-256 respectively.
+func newAESSIV(key []byte) (*aesSIV, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, fmt.Errorf("invalid AES-SIV key length %d", len(key))
+	}
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher() error: %w", err)
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher() error: %w", err)
+	}
+	return &aesSIV{mac: mac, ctr: ctr}, nil
+}
+
+// Seal returns the synthetic IV followed by the ciphertext.
+func (s *aesSIV) Seal(plainText []byte, ad ...[]byte) []byte {
+	v := s.s2v(plainText, ad)
+	out := make([]byte, aes.BlockSize+len(plainText))
+	copy(out, v)
+	s.xorCTR(out[aes.BlockSize:], plainText, v)
+	return out
+}
+
+// Open authenticates and decrypts the output of Seal.
+func (s *aesSIV) Open(cipherText []byte, ad ...[]byte) ([]byte, error) {
+	if len(cipherText) < aes.BlockSize {
+		return nil, errSIVAuthFailed
+	}
+	v := cipherText[:aes.BlockSize]
+	plainText := make([]byte, len(cipherText)-aes.BlockSize)
+	s.xorCTR(plainText, cipherText[aes.BlockSize:], v)
+	if subtle.ConstantTimeCompare(v, s.s2v(plainText, ad)) != 1 {
+		return nil, errSIVAuthFailed
+	}
+	return plainText, nil
+}
+
+func (s *aesSIV) xorCTR(dst, src, v []byte) {
+	q := make([]byte, aes.BlockSize)
+	copy(q, v)
+	// clear the 31st and 63rd bits (counting from the right)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(s.ctr, q).XORKeyStream(dst, src)
+}
+
+// s2v is the S2V construction with the associated data and the plaintext.
+func (s *aesSIV) s2v(plainText []byte, ad [][]byte) []byte {
+	d := s.cmac(make([]byte, aes.BlockSize))
+	for _, a := range ad {
+		d = dbl(d)
+		xorBytes(d, s.cmac(a))
+	}
+	var t []byte
+	if len(plainText) >= aes.BlockSize {
+		t = make([]byte, len(plainText))
+		copy(t, plainText)
+		xorBytes(t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = dbl(d)
+		padded := make([]byte, aes.BlockSize)
+		copy(padded, plainText)
+		padded[len(plainText)] = 0x80
+		xorBytes(t, padded)
+	}
+	return s.cmac(t)
+}
+
+// cmac is AES-CMAC defined in RFC 4493.
+func (s *aesSIV) cmac(msg []byte) []byte {
+	l := make([]byte, aes.BlockSize)
+	s.mac.Encrypt(l, l)
+	k1 := dbl(l)
+
+	last := make([]byte, aes.BlockSize)
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	if n > 0 && len(msg)%aes.BlockSize == 0 {
+		copy(last, msg[(n-1)*aes.BlockSize:])
+		xorBytes(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*aes.BlockSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBytes(last, dbl(k1))
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		s.mac.Encrypt(x, x)
+	}
+	xorBytes(x, last)
+	s.mac.Encrypt(x, x)
+	return x
+}
+
+// dbl is the doubling in GF(2^128).
+func dbl(b []byte) []byte {
+	out := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		out[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if carry != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+	return out
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
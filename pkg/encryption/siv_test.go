@@ -0,0 +1,47 @@
+package encryption
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESSIVVectors(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		require.NoError(t, err)
+		return b
+	}
+	// RFC 5297, A.1. Deterministic Authenticated Encryption Example
+	siv, err := newAESSIV(unhex("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+	require.NoError(t, err)
+	ad := unhex("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plainText := unhex("112233445566778899aabbccddee")
+	cipherText := siv.Seal(plainText, ad)
+	require.Equal(t, "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c", hex.EncodeToString(cipherText))
+
+	opened, err := siv.Open(cipherText, ad)
+	require.NoError(t, err)
+	require.Equal(t, plainText, opened)
+
+	// RFC 5297, A.2. Nonce-Based Authenticated Encryption Example
+	siv, err = newAESSIV(unhex("7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f"))
+	require.NoError(t, err)
+	ads := [][]byte{
+		unhex("00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100"),
+		unhex("102030405060708090a0"),
+		unhex("09f911029d74e35bd84156c5635688c0"),
+	}
+	plainText = unhex("7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553")
+	cipherText = siv.Seal(plainText, ads...)
+	require.Equal(t, "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17"+
+		"dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d", hex.EncodeToString(cipherText))
+	opened, err = siv.Open(cipherText, ads...)
+	require.NoError(t, err)
+	require.Equal(t, plainText, opened)
+
+	cipherText[len(cipherText)-1] ^= 1
+	_, err = siv.Open(cipherText, ads...)
+	require.ErrorIs(t, err, errSIVAuthFailed)
+}
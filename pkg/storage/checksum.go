@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ChecksumSuffix is the suffix of the sidecar file, which stores the sha256
+// digest of a file in the format of sha256sum.
+const ChecksumSuffix = ".sha256"
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumPath returns the path of the sidecar file of rpath.
+func ChecksumPath(rpath string) string {
+	return rpath + ChecksumSuffix
+}
+
+// WriteChecksum stores the sha256 digest of rpath in the sidecar file.
+func WriteChecksum(ctx context.Context, st Storage, rpath string, digest string) error {
+	content := fmt.Sprintf("%s  %s\n", digest, path.Base(rpath))
+	err := st.Push(ctx, strings.NewReader(content), ChecksumPath(rpath))
+	if err != nil {
+		return fmt.Errorf("write checksum of %q error: %w", rpath, err)
+	}
+	return nil
+}
+
+// ReadChecksum returns the sha256 digest of rpath stored in the sidecar file.
+// It returns ErrObjectNotFound if the sidecar file doesn't exist.
+func ReadChecksum(ctx context.Context, st Storage, rpath string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := st.Pull(ctx, ChecksumPath(rpath), buf); err != nil {
+		return "", err
+	}
+	fields := strings.Fields(buf.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("invalid checksum file %q", ChecksumPath(rpath))
+	}
+	digest := strings.ToLower(fields[0])
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid checksum file %q", ChecksumPath(rpath))
+	}
+	return digest, nil
+}
+
+// LookupChecksum returns the sha256 digest of rpath stored in the sidecar
+// file, or "" if there is none. The sidecar file is only read if a stat
+// finds it, so a file without one costs a single stat.
+func LookupChecksum(ctx context.Context, st Storage, rpath string) (string, error) {
+	exists, err := FileExists(ctx, st, ChecksumPath(rpath))
+	if err != nil || !exists {
+		return "", err
+	}
+	return ReadChecksum(ctx, st, rpath)
+}
+
+// IsChecksumFile returns true if name is the name of a sidecar file.
+func IsChecksumFile(name string) bool {
+	return strings.HasSuffix(name, ChecksumSuffix)
+}
+
+// RemoveChecksum removes the sidecar file of rpath if it exists.
+func RemoveChecksum(ctx context.Context, st Storage, rpath string) error {
+	err := st.Remove(ctx, ChecksumPath(rpath), false)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("remove checksum of %q error: %w", rpath, err)
+	}
+	return nil
+}
+
+// VerifyChecksum computes the digest of the file in st, and compares it with
+// the expected one. It returns an error wrapping ErrChecksumMismatch if they
+// are different.
+func VerifyChecksum(ctx context.Context, st Storage, rpath string, expected string) error {
+	var entry DirEntry
+	err := st.List(ctx, rpath, &ListOptions{PathIsFile: true, Hashes: true}, func(de DirEntry) error {
+		entry = de
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return ErrObjectNotFound
+	}
+	actual, err := FileHash(ctx, st, entry, HashSHA256)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: %q has sha256 %s, expected %s", ErrChecksumMismatch, rpath, actual, expected)
+	}
+	return nil
+}
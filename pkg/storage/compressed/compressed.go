@@ -0,0 +1,438 @@
+package compressed
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kopia/kopia/repo/compression"
+
+	"github.com/apecloud/datasafed/pkg/logging"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/sanitized"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+const (
+	compressedFileSuffix = ".z"
+
+	// trailerMagic starts the trailer at the end of a compressed object,
+	// which is followed by the size of the uncompressed data (uint64).
+	trailerMagic = "DSFDZSIZ"
+	trailerSize  = len(trailerMagic) + 8
+	// headerSize is the size of the kopia compressor header, which
+	// identifies the compression algorithm.
+	headerSize = 4
+)
+
+var (
+	errInvalidHeader  = errors.New("invalid compression header")
+	errInvalidTrailer = errors.New("invalid compression trailer")
+)
+
+var log = logging.Module("storage/compressed")
+
+// compressedStorage compresses files on Push, and stores them with the
+// suffix ".z". The layout of a compressed object is:
+//
+//	compressor header (4 bytes) | compressed data | trailer
+//
+// The compressor header is written by the kopia compressor, so the algorithm
+// is detected automatically on Pull, no matter which algorithm is configured.
+// The trailer records the uncompressed size, which is reported by List and
+// Stat for a single file. Files without the suffix are treated as
+// uncompressed files.
+type compressedStorage struct {
+	compressor compression.Compressor
+	underlying storage.Storage
+}
+
+var _ storage.Storage = (*compressedStorage)(nil)
+
+// SupportedAlgorithms returns the names of the supported compression algorithms.
+func SupportedAlgorithms() []string {
+	var names []string
+	for name := range compression.ByName {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func New(ctx context.Context, algorithm string, underlying storage.Storage) (storage.Storage, error) {
+	c, ok := compression.ByName[compression.Name(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression algorithm %q, choices: %q", algorithm, SupportedAlgorithms())
+	}
+	cs := &compressedStorage{
+		compressor: c,
+		underlying: underlying,
+	}
+	return sanitized.New(ctx, "", cs)
+}
+
+func (s *compressedStorage) Unwrap() storage.Storage {
+	return s.underlying
+}
+
+// Sequential returns true since a compressed file has to be decompressed from
+// the beginning to read any range.
+func (s *compressedStorage) Sequential() bool {
+	return true
+}
+
+func (s *compressedStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	return s.push(ctx, r, rpath, func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error {
+		return st.Push(ctx, r, rpath)
+	})
+}
+
+func (s *compressedStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	// the file may be stored uncompressed
+	exists, err := storage.FileExists(ctx, s.underlying, rpath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %q exists", storage.ErrPreconditionFailed, rpath)
+	}
+	return s.push(ctx, r, rpath, storage.PushIfNotExists)
+}
+
+// PushIfMatch checks the ETag of the compressed object, so it fails if the
+// file is stored uncompressed.
+func (s *compressedStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	return s.push(ctx, r, rpath, func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error {
+		return storage.PushIfMatch(ctx, st, r, rpath, etag)
+	})
+}
+
+// ETag returns the ETag of the compressed object, or the uncompressed one if
+// the file is stored uncompressed.
+func (s *compressedStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	etag, err := storage.FileETag(ctx, s.underlying, rpath+compressedFileSuffix)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return storage.FileETag(ctx, s.underlying, rpath)
+	}
+	return etag, err
+}
+
+func (s *compressedStorage) push(ctx context.Context, r io.Reader, rpath string,
+	pushFn func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		cr := &util.CountingReader{R: r}
+		err := s.compressor.Compress(pw, cr)
+		if err == nil {
+			err = writeTrailer(pw, cr.N)
+		}
+		pw.CloseWithError(err)
+	}()
+	err := pushFn(ctx, s.underlying, pr, rpath+compressedFileSuffix)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	// remove the uncompressed file with the same name, if any
+	if err := s.underlying.Remove(ctx, rpath, false); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		log(ctx).Debugf("[COMPRESSED] remove uncompressed file %q: %v", rpath, err)
+	}
+	return nil
+}
+
+func (s *compressedStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	errCh := make(chan error, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		err := decompress(w, pr)
+		// interrupt underlying.Pull(), and drain it if it's not interrupted
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+	err := s.underlying.Pull(ctx, rpath+compressedFileSuffix, pw)
+	pw.CloseWithError(err)
+	decErr := <-errCh
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		// an uncompressed file
+		return s.underlying.Pull(ctx, rpath, w)
+	}
+	if err != nil {
+		return err
+	}
+	return notCompressed(rpath, decErr)
+}
+
+func (s *compressedStorage) OpenFile(ctx context.Context, rpath string, offset int64, length int64) (io.ReadCloser, error) {
+	rc, err := s.underlying.OpenFile(ctx, rpath+compressedFileSuffix, 0, -1)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		// an uncompressed file
+		return s.underlying.OpenFile(ctx, rpath, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(notCompressed(rpath, decompress(pw, rc)))
+	}()
+	var rd io.Reader = pr
+	if offset > 0 {
+		log(ctx).Debugf("[COMPRESSED] OpenFile(): decompress and discard %d bytes", offset)
+		rd = util.DiscardNReader(rd, int(offset))
+	}
+	if length > 0 {
+		rd = io.LimitReader(rd, length)
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: rd,
+		Closer: util.CloserFunc(func() error {
+			pr.Close()
+			return rc.Close()
+		}),
+	}, nil
+}
+
+func (s *compressedStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
+	if recursive {
+		return s.underlying.Remove(ctx, rpath, true)
+	}
+	err := s.underlying.Remove(ctx, rpath+compressedFileSuffix, false)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return s.underlying.Remove(ctx, rpath, false)
+	}
+	return err
+}
+
+func (s *compressedStorage) Copy(ctx context.Context, src, dst string) error {
+	return s.transfer(ctx, src, dst, s.underlying.Copy)
+}
+
+func (s *compressedStorage) Move(ctx context.Context, src, dst string) error {
+	return s.transfer(ctx, src, dst, s.underlying.Move)
+}
+
+// transfer copies or moves the compressed file, or the uncompressed one if
+// it doesn't exist, and removes the other variant of the destination.
+func (s *compressedStorage) transfer(ctx context.Context, src, dst string, fn func(ctx context.Context, src, dst string) error) error {
+	stale := dst
+	err := fn(ctx, src+compressedFileSuffix, dst+compressedFileSuffix)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		stale = dst + compressedFileSuffix
+		err = fn(ctx, src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.underlying.Remove(ctx, stale, false); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		log(ctx).Debugf("[COMPRESSED] remove stale file %q: %v", stale, err)
+	}
+	return nil
+}
+
+func (s *compressedStorage) Rmdir(ctx context.Context, rpath string) error {
+	return s.underlying.Rmdir(ctx, rpath)
+}
+
+func (s *compressedStorage) Mkdir(ctx context.Context, rpath string) error {
+	return s.underlying.Mkdir(ctx, rpath)
+}
+
+// List lists the files with their uncompressed sizes when listing a single
+// file, which are read from the trailers with a ranged read, and files
+// without a valid trailer are listed with their full names. When listing a
+// directory, the objects are not read, so every object with the suffix is
+// assumed to be compressed by this layer, and its size is the size of the
+// stored object, which is usually smaller than the uncompressed size.
+func (s *compressedStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	fileCb := s.listCallback(ctx, cb, true)
+	dirCb := s.listCallback(ctx, cb, false)
+	if opt.PathIsFile {
+		return s.listFile(ctx, rpath, opt, fileCb)
+	} else if strings.HasSuffix(rpath, "/") || rpath == "." {
+		// rpath is a folder
+		return s.underlying.List(ctx, rpath, opt, dirCb)
+	} else {
+		// try list single compressed file first
+		cloneOpt := *opt
+		cloneOpt.PathIsFile = true
+		err := s.underlying.List(ctx, rpath+compressedFileSuffix, &cloneOpt, fileCb)
+		if err != nil {
+			// ignore ErrObjectNotFound
+			if !errors.Is(err, storage.ErrObjectNotFound) {
+				return err
+			}
+		} else {
+			return nil
+		}
+
+		// try list an uncompressed file or a folder
+		return s.underlying.List(ctx, rpath, opt, dirCb)
+	}
+}
+
+// listCallback translates the entries of the underlying storage. If exact is
+// true, the sizes of compressed files are read from their trailers.
+func (s *compressedStorage) listCallback(ctx context.Context, cb storage.ListCallback, exact bool) storage.ListCallback {
+	return func(de storage.DirEntry) error {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), compressedFileSuffix) {
+			return cb(de)
+		}
+		size := de.Size()
+		if exact {
+			var err error
+			size, err = s.logicalSize(ctx, de.Path(), de.Size())
+			if errors.Is(err, errInvalidTrailer) {
+				// not written by this layer
+				return cb(de)
+			}
+			if err != nil {
+				// list it with the compressed size, the error is reported when it's read
+				log(ctx).Warnf("[COMPRESSED] failed to read size of %q: %v", de.Path(), err)
+				size = de.Size()
+			}
+		}
+		name := strings.TrimSuffix(de.Name(), compressedFileSuffix)
+		path := strings.TrimSuffix(de.Path(), compressedFileSuffix)
+		return cb(storage.NewStaticDirEntry(false, name, path, size, de.MTime()))
+	}
+}
+
+// listFile lists the compressed file, or the uncompressed one if it doesn't exist.
+func (s *compressedStorage) listFile(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	err := s.underlying.List(ctx, rpath+compressedFileSuffix, opt, cb)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return s.underlying.List(ctx, rpath, opt, cb)
+	}
+	return err
+}
+
+func (s *compressedStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
+	result := storage.StatResult{}
+	statFunc := func(de storage.DirEntry) error {
+		if de.IsDir() {
+			result.Dirs++
+		} else {
+			result.Files++
+			result.TotalSize += de.Size()
+		}
+		return nil
+	}
+	err := s.List(ctx, rpath, &storage.ListOptions{Recursive: true}, statFunc)
+	result.Entries = result.Dirs + result.Files
+	return result, err
+}
+
+// logicalSize reads the uncompressed size from the trailer.
+func (s *compressedStorage) logicalSize(ctx context.Context, upath string, size int64) (int64, error) {
+	if size < int64(headerSize+trailerSize) {
+		return 0, errInvalidTrailer
+	}
+	rc, err := s.underlying.OpenFile(ctx, upath, size-int64(trailerSize), int64(trailerSize))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	trailer := make([]byte, trailerSize)
+	if _, err := io.ReadFull(rc, trailer); err != nil {
+		return 0, err
+	}
+	return parseTrailer(trailer)
+}
+
+func writeTrailer(w io.Writer, size int64) error {
+	trailer := make([]byte, trailerSize)
+	copy(trailer, trailerMagic)
+	binary.BigEndian.PutUint64(trailer[len(trailerMagic):], uint64(size))
+	_, err := w.Write(trailer)
+	return err
+}
+
+func parseTrailer(trailer []byte) (int64, error) {
+	if len(trailer) != trailerSize || !bytes.Equal(trailer[:len(trailerMagic)], []byte(trailerMagic)) {
+		return 0, errInvalidTrailer
+	}
+	return int64(binary.BigEndian.Uint64(trailer[len(trailerMagic):])), nil
+}
+
+// notCompressed tells the real name of the object, if it isn't written by
+// this layer, e.g. a foreign file whose name ends with the suffix.
+func notCompressed(rpath string, err error) error {
+	if errors.Is(err, errInvalidHeader) || errors.Is(err, errInvalidTrailer) {
+		return fmt.Errorf("%q is not compressed, read it by its full name: %w", rpath+compressedFileSuffix, err)
+	}
+	return err
+}
+
+// decompress decompresses the object, and verifies the size in the trailer.
+func decompress(w io.Writer, r io.Reader) error {
+	tr := &trailerReader{r: r}
+	cw := &util.CountingWriter{W: w}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errInvalidHeader
+		}
+		return err
+	}
+	if compression.ByHeaderID[compression.HeaderID(binary.BigEndian.Uint32(header))] == nil {
+		return errInvalidHeader
+	}
+	if err := compression.DecompressByHeader(cw, io.MultiReader(bytes.NewReader(header), tr)); err != nil {
+		return err
+	}
+	// consume the rest, so that the trailer is read
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return err
+	}
+	size, err := parseTrailer(tr.trailer)
+	if err != nil {
+		return err
+	}
+	if size != cw.N {
+		return fmt.Errorf("size mismatch, expected %d, got %d", size, cw.N)
+	}
+	return nil
+}
+
+// trailerReader reads everything except the trailer at the end.
+type trailerReader struct {
+	r       io.Reader
+	buf     []byte
+	trailer []byte // set at EOF
+	eof     bool
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	for !t.eof && len(t.buf) <= trailerSize {
+		chunk := make([]byte, 32*1024)
+		n, err := t.r.Read(chunk)
+		t.buf = append(t.buf, chunk[:n]...)
+		if errors.Is(err, io.EOF) {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	available := len(t.buf) - trailerSize
+	if available <= 0 {
+		if t.eof {
+			t.trailer = t.buf
+			return 0, io.EOF
+		}
+		return 0, nil
+	}
+	n := copy(p, t.buf[:available])
+	t.buf = t.buf[n:]
+	if t.eof && len(t.buf) == trailerSize {
+		t.trailer = t.buf
+	}
+	return n, nil
+}
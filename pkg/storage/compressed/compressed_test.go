@@ -0,0 +1,213 @@
+package compressed_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/compressed"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+const trailerMagic = "DSFDZSIZ"
+
+// countingStorage counts the files opened in the underlying storage.
+type countingStorage struct {
+	storage.Storage
+	opened atomic.Int32
+}
+
+func (s *countingStorage) OpenFile(ctx context.Context, rpath string, offset int64, length int64) (io.ReadCloser, error) {
+	s.opened.Add(1)
+	return s.Storage.OpenFile(ctx, rpath, offset, length)
+}
+
+func newStorage(t *testing.T, algorithm string) (storage.Storage, *countingStorage, string) {
+	dir := t.TempDir()
+	local, err := rclone.New(context.Background(), map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	underlying := &countingStorage{Storage: local}
+	st, err := compressed.New(context.Background(), algorithm, underlying)
+	require.NoError(t, err)
+	return st, underlying, dir
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range data {
+		// compressible
+		data[i] = byte('a' + rnd.Intn(4))
+	}
+	return data
+}
+
+func pull(t *testing.T, st storage.Storage, rpath string) []byte {
+	buf := &bytes.Buffer{}
+	require.NoError(t, st.Pull(context.Background(), rpath, buf))
+	return buf.Bytes()
+}
+
+func list(t *testing.T, st storage.Storage, rpath string, opt *storage.ListOptions) map[string]int64 {
+	entries := map[string]int64{}
+	err := st.List(context.Background(), rpath, opt, func(de storage.DirEntry) error {
+		entries[de.Path()] = de.Size()
+		return nil
+	})
+	require.NoError(t, err)
+	return entries
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for _, algorithm := range compressed.SupportedAlgorithms() {
+		t.Run(algorithm, func(t *testing.T) {
+			st, _, dir := newStorage(t, algorithm)
+			for _, n := range []int{0, 1, 100 * 1024} {
+				data := testData(n)
+				require.NoError(t, st.Push(ctx, bytes.NewReader(data), "f"))
+				require.True(t, bytes.Equal(data, pull(t, st, "f")))
+				require.FileExists(t, filepath.Join(dir, "f.z"))
+			}
+		})
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	ctx := context.Background()
+	st, _, dir := newStorage(t, "zstd")
+	data := testData(10000)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(data), "f"))
+
+	raw, err := os.ReadFile(filepath.Join(dir, "f.z"))
+	require.NoError(t, err)
+	trailer := raw[len(raw)-len(trailerMagic)-8:]
+	require.Equal(t, trailerMagic, string(trailer[:len(trailerMagic)]))
+	require.EqualValues(t, len(data), binary.BigEndian.Uint64(trailer[len(trailerMagic):]))
+	require.Less(t, len(raw), len(data))
+
+	// a wrong size in the trailer fails the pull
+	binary.BigEndian.PutUint64(trailer[len(trailerMagic):], uint64(len(data)+1))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "f.z"), raw, 0644))
+	err = st.Pull(ctx, "f", io.Discard)
+	require.ErrorContains(t, err, "size mismatch")
+}
+
+func TestOpenFileRange(t *testing.T) {
+	ctx := context.Background()
+	st, _, _ := newStorage(t, "gzip")
+	data := testData(100 * 1024)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(data), "f"))
+
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 0},
+		{0, 10},
+		{1000, 0},
+		{1000, 5000},
+		{int64(len(data)) - 10, 100},
+	} {
+		rc, err := st.OpenFile(ctx, "f", r.offset, r.length)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		end := int64(len(data))
+		if r.length > 0 {
+			end = min(end, r.offset+r.length)
+		}
+		require.Equal(t, data[r.offset:end], got, "offset %d, length %d", r.offset, r.length)
+	}
+}
+
+func TestSuffixTranslation(t *testing.T) {
+	ctx := context.Background()
+	st, underlying, dir := newStorage(t, "zstd")
+	data := testData(1000)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(data), "dir/compressed"))
+	// files written without compression are read as is
+	require.NoError(t, underlying.Push(ctx, bytes.NewReader(data), "dir/plain"))
+
+	require.Equal(t, data, pull(t, st, "dir/compressed"))
+	require.Equal(t, data, pull(t, st, "dir/plain"))
+	entries := list(t, st, "dir/", &storage.ListOptions{})
+	require.Contains(t, entries, "dir/compressed")
+	require.Contains(t, entries, "dir/plain")
+	require.Len(t, entries, 2)
+
+	// pushing a file replaces its uncompressed variant
+	require.NoError(t, st.Push(ctx, bytes.NewReader(data[:10]), "dir/plain"))
+	require.NoFileExists(t, filepath.Join(dir, "dir/plain"))
+	require.Equal(t, data[:10], pull(t, st, "dir/plain"))
+
+	// copy and move translate the suffix
+	require.NoError(t, st.Copy(ctx, "dir/compressed", "copied"))
+	require.NoError(t, st.Move(ctx, "copied", "moved"))
+	require.FileExists(t, filepath.Join(dir, "moved.z"))
+	require.NoFileExists(t, filepath.Join(dir, "copied.z"))
+	require.Equal(t, data, pull(t, st, "moved"))
+
+	require.NoError(t, st.Remove(ctx, "moved", false))
+	require.NoFileExists(t, filepath.Join(dir, "moved.z"))
+	err := st.Pull(ctx, "moved", io.Discard)
+	require.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func TestListSizes(t *testing.T) {
+	ctx := context.Background()
+	st, underlying, dir := newStorage(t, "zstd")
+	data := testData(100 * 1024)
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, st.Push(ctx, bytes.NewReader(data), "dir/"+name))
+	}
+	fi, err := os.Stat(filepath.Join(dir, "dir/a.z"))
+	require.NoError(t, err)
+
+	// the trailer is read only for a single file
+	underlying.opened.Store(0)
+	require.Equal(t, map[string]int64{"dir/a": int64(len(data))}, list(t, st, "dir/a", &storage.ListOptions{}))
+	require.Equal(t, map[string]int64{"dir/a": int64(len(data))}, list(t, st, "dir/a", &storage.ListOptions{PathIsFile: true}))
+	require.EqualValues(t, 2, underlying.opened.Load())
+
+	underlying.opened.Store(0)
+	entries := list(t, st, "dir/", &storage.ListOptions{})
+	require.Len(t, entries, 3)
+	require.Equal(t, fi.Size(), entries["dir/a"])
+	require.Zero(t, underlying.opened.Load())
+
+	result, err := st.Stat(ctx, "dir/a")
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), result.TotalSize)
+}
+
+func TestForeignSuffix(t *testing.T) {
+	ctx := context.Background()
+	st, underlying, _ := newStorage(t, "zstd")
+	// a file ending with the suffix, which isn't written by the layer
+	foreign := []byte("not compressed by datasafed")
+	require.NoError(t, underlying.Push(ctx, bytes.NewReader(foreign), "dir/x.z"))
+
+	// it's listed with its full name if it's listed exactly
+	require.Equal(t, map[string]int64{"dir/x.z": int64(len(foreign))}, list(t, st, "dir/x", &storage.ListOptions{}))
+	require.Equal(t, map[string]int64{"dir/x.z": int64(len(foreign))}, list(t, st, "dir/x", &storage.ListOptions{PathIsFile: true}))
+	// and in a directory listing, it's assumed to be compressed
+	require.Equal(t, map[string]int64{"dir/x": int64(len(foreign))}, list(t, st, "dir/", &storage.ListOptions{}))
+
+	// the full name is reported when it's read by the other name
+	err := st.Pull(ctx, "dir/x", io.Discard)
+	require.ErrorContains(t, err, `"dir/x.z" is not compressed`)
+	rc, err := st.OpenFile(ctx, "dir/x", 0, 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.ErrorContains(t, err, `"dir/x.z" is not compressed`)
+	require.NoError(t, rc.Close())
+	require.Equal(t, foreign, pull(t, st, "dir/x.z"))
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by conditional pushes if the condition
+// is not met, e.g. another writer has pushed the file.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrETagUnsupported is returned if the backend doesn't identify the versions
+// of files by ETags.
+var ErrETagUnsupported = errors.New("ETags are not supported by the backend")
+
+// NoClobberStorage is implemented by storages that can push a file only if it
+// doesn't exist, atomically if the backend supports conditional writes.
+type NoClobberStorage interface {
+	PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error
+}
+
+// PushIfNotExists pushes the file only if rpath doesn't exist, otherwise it
+// returns an error wrapping ErrPreconditionFailed. If st doesn't implement
+// NoClobberStorage, the existence is checked before pushing, which is only
+// best-effort.
+func PushIfNotExists(ctx context.Context, st Storage, r io.Reader, rpath string) error {
+	if s, ok := st.(NoClobberStorage); ok {
+		return s.PushIfNotExists(ctx, r, rpath)
+	}
+	exists, err := FileExists(ctx, st, rpath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %q exists", ErrPreconditionFailed, rpath)
+	}
+	return st.Push(ctx, r, rpath)
+}
+
+// ConditionalWriteStorage is implemented by storages that know whether the
+// conditions of PushIfNotExists and PushIfMatch are checked atomically by
+// the backend, or only before writing.
+type ConditionalWriteStorage interface {
+	ConditionalWrites() bool
+}
+
+// AtomicConditions returns true if the conditions of the pushes to st are
+// checked atomically by the backend, i.e. st, or the first storage wrapped
+// by it that implements ConditionalWriteStorage, returns true.
+func AtomicConditions(st Storage) bool {
+	for {
+		if c, ok := st.(ConditionalWriteStorage); ok {
+			return c.ConditionalWrites()
+		}
+		u, ok := st.(interface{ Unwrap() Storage })
+		if !ok {
+			return false
+		}
+		st = u.Unwrap()
+	}
+}
+
+// ETagStorage is implemented by storages whose backend identifies the
+// versions of files by ETags, e.g. S3, and can push a file only if the
+// existing one has the ETag, which is atomic if AtomicConditions returns
+// true.
+type ETagStorage interface {
+	// ETag returns the ETag of the stored file, without quotes.
+	ETag(ctx context.Context, rpath string) (string, error)
+	// PushIfMatch pushes the file only if rpath exists and has the ETag.
+	PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error
+}
+
+// FileETag returns the ETag of the file, or an error wrapping
+// ErrETagUnsupported if st doesn't implement ETagStorage.
+func FileETag(ctx context.Context, st Storage, rpath string) (string, error) {
+	if s, ok := st.(ETagStorage); ok {
+		return s.ETag(ctx, rpath)
+	}
+	return "", ErrETagUnsupported
+}
+
+// PushIfMatch pushes the file only if rpath exists and has the ETag,
+// otherwise it returns an error wrapping ErrPreconditionFailed. It returns an
+// error wrapping ErrETagUnsupported if st doesn't implement ETagStorage.
+func PushIfMatch(ctx context.Context, st Storage, r io.Reader, rpath string, etag string) error {
+	if s, ok := st.(ETagStorage); ok {
+		return s.PushIfMatch(ctx, r, rpath, etag)
+	}
+	return ErrETagUnsupported
+}
+
+// FileExists returns true if the file exists.
+func FileExists(ctx context.Context, st Storage, rpath string) (bool, error) {
+	_, err := fileSize(ctx, st, rpath)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FileVersion identifies the content of a file for conditional pushes.
+type FileVersion struct {
+	// Size is not checked if it's negative.
+	Size int64
+	// MTime is compared in seconds, it's not checked if it's zero.
+	MTime time.Time
+	// Hashes are keyed by the hash types in SupportedHashTypes().
+	Hashes map[string]string
+	// ETag is not checked if it's empty, otherwise the push should be done
+	// by PushIfMatch, which checks it atomically if the backend supports
+	// conditional writes.
+	ETag string
+}
+
+// ParseFileVersion parses the version from the key-value pairs, the keys are
+// "size", "mtime" (in unix seconds or RFC3339), "etag" and the hash types.
+func ParseFileVersion(kvs map[string]string) (FileVersion, error) {
+	v := FileVersion{Size: -1, Hashes: map[string]string{}}
+	for key, value := range kvs {
+		value = strings.TrimSpace(value)
+		switch key {
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return v, fmt.Errorf("invalid size %q", value)
+			}
+			v.Size = size
+		case "mtime":
+			if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+				v.MTime = time.Unix(sec, 0)
+			} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+				v.MTime = t
+			} else {
+				return v, fmt.Errorf("invalid mtime %q, expected unix seconds or RFC3339", value)
+			}
+		case "etag":
+			v.ETag = strings.Trim(value, `"`)
+			if v.ETag == "" {
+				return v, fmt.Errorf("invalid etag %q", value)
+			}
+		default:
+			if _, err := NewHash(key); err != nil {
+				return v, fmt.Errorf("invalid key %q, expected \"size\", \"mtime\", \"etag\" or one of the hash types %q",
+					key, SupportedHashTypes())
+			}
+			v.Hashes[key] = strings.ToLower(value)
+		}
+	}
+	return v, nil
+}
+
+// CheckVersion returns an error wrapping ErrPreconditionFailed if the file
+// doesn't exist or doesn't match the version. The file may be changed after
+// it's checked, unless it's pushed by PushIfMatch with the ETag to a backend
+// supporting conditional writes.
+func CheckVersion(ctx context.Context, st Storage, rpath string, v FileVersion) error {
+	var entry DirEntry
+	err := st.List(ctx, rpath, &ListOptions{PathIsFile: true, Hashes: len(v.Hashes) > 0}, func(de DirEntry) error {
+		entry = de
+		return nil
+	})
+	if errors.Is(err, ErrObjectNotFound) || (err == nil && entry == nil) {
+		return fmt.Errorf("%w: %q doesn't exist", ErrPreconditionFailed, rpath)
+	}
+	if err != nil {
+		return err
+	}
+	if v.Size >= 0 && entry.Size() != v.Size {
+		return fmt.Errorf("%w: %q has size %d, expected %d", ErrPreconditionFailed, rpath, entry.Size(), v.Size)
+	}
+	if !v.MTime.IsZero() && entry.MTime().Unix() != v.MTime.Unix() {
+		return fmt.Errorf("%w: %q has mtime %s, expected %s", ErrPreconditionFailed, rpath,
+			entry.MTime().Format(time.RFC3339), v.MTime.Format(time.RFC3339))
+	}
+	if v.ETag != "" {
+		etag, err := FileETag(ctx, st, rpath)
+		if err != nil {
+			return err
+		}
+		if etag != v.ETag {
+			return fmt.Errorf("%w: %q has etag %s, expected %s", ErrPreconditionFailed, rpath, etag, v.ETag)
+		}
+	}
+	for hashType, expected := range v.Hashes {
+		actual, err := FileHash(ctx, st, entry, hashType)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return fmt.Errorf("%w: %q has %s %s, expected %s", ErrPreconditionFailed, rpath, hashType, actual, expected)
+		}
+	}
+	return nil
+}
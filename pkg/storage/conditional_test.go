@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+func TestParseFileVersion(t *testing.T) {
+	v, err := storage.ParseFileVersion(map[string]string{
+		"size":   "5",
+		"mtime":  "2024-01-02T03:04:05Z",
+		"sha256": "ABCD",
+		"etag":   `"0123"`,
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, v.Size)
+	require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), v.MTime.UTC())
+	require.Equal(t, map[string]string{"sha256": "abcd"}, v.Hashes)
+	require.Equal(t, "0123", v.ETag)
+
+	v, err = storage.ParseFileVersion(map[string]string{"mtime": "1704164645"})
+	require.NoError(t, err)
+	require.EqualValues(t, -1, v.Size)
+	require.EqualValues(t, 1704164645, v.MTime.Unix())
+
+	for _, kvs := range []map[string]string{
+		{"size": "-1"},
+		{"mtime": "yesterday"},
+		{"etag": `""`},
+		{"crc32": "0"},
+	} {
+		_, err := storage.ParseFileVersion(kvs)
+		require.Error(t, err, kvs)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+	err := storage.CheckVersion(ctx, st, "a", storage.FileVersion{Size: -1})
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+	require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "a"))
+
+	hashes := map[string]string{
+		"md5":    "5d41402abc4b2a76b9719d911017c592",
+		"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	require.NoError(t, storage.CheckVersion(ctx, st, "a", storage.FileVersion{Size: 5, Hashes: hashes}))
+	for _, v := range []storage.FileVersion{
+		{Size: 4},
+		{Size: -1, MTime: time.Now().Add(-time.Hour)},
+		{Size: -1, Hashes: map[string]string{"sha256": strings.Repeat("0", 64)}},
+	} {
+		err := storage.CheckVersion(ctx, st, "a", v)
+		require.ErrorIs(t, err, storage.ErrPreconditionFailed, v)
+	}
+	// ETags are only supported on S3
+	err = storage.CheckVersion(ctx, st, "a", storage.FileVersion{Size: -1, ETag: "0123"})
+	require.ErrorIs(t, err, storage.ErrETagUnsupported)
+}
+
+func TestCheckVersionETag(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(ctx, srv.Config("dir"), "")
+	require.NoError(t, err)
+	require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "a"))
+	etag, err := storage.FileETag(ctx, st, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.CheckVersion(ctx, st, "a", storage.FileVersion{Size: -1, ETag: etag}))
+	err = storage.CheckVersion(ctx, st, "a", storage.FileVersion{Size: -1, ETag: "0123"})
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+}
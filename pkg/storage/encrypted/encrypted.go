@@ -1,10 +1,13 @@
 package encrypted
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/apecloud/datasafed/pkg/encryption"
 	"github.com/apecloud/datasafed/pkg/logging"
@@ -13,28 +16,320 @@ import (
 	"github.com/apecloud/datasafed/pkg/util"
 )
 
-const encryptedFileSuffix = ".enc"
+const (
+	encryptedFileSuffix = ".enc"
+
+	// keyCheckFile is a small encrypted object at the root of the storage,
+	// used to detect a wrong key before touching any other objects.
+	// It doesn't end with encryptedFileSuffix, so it's hidden from List().
+	keyCheckFile = ".datasafed-keycheck"
+)
+
+// maxKeyCheckListings is the max number of directories listed to look for
+// an existing object to check the key with.
+const maxKeyCheckListings = 16
+
+var keyCheckContent = []byte("datasafed key check")
 
 var log = logging.Module("storage/encrypted")
 
 type encryptedStorage struct {
 	encryptor  encryption.StreamEncryptor
 	underlying storage.Storage
+	// names encrypts the path components, nil if filename encryption is
+	// disabled. It's created by prepare().
+	names            encryption.NameEncryptor
+	encryptFilenames bool
+
+	keyOnce sync.Once
+	keyErr  error
+	// keyCheckMissing is set if the key check object doesn't exist
+	keyCheckMissing bool
+	// probed is set after the key is checked with an existing object
+	probeMu    sync.Mutex
+	probed     bool
+	markerOnce sync.Once
+	markerErr  error
 }
 
 var _ storage.Storage = (*encryptedStorage)(nil)
 
+type Options struct {
+	// EncryptFilenames encrypts every component of the paths, so that the
+	// names of files and directories are not revealed to the storage.
+	EncryptFilenames bool
+}
+
 func New(ctx context.Context,
 	encryptor encryption.StreamEncryptor,
 	underlying storage.Storage) (storage.Storage, error) {
+	return NewWithOptions(ctx, encryptor, underlying, Options{})
+}
+
+func NewWithOptions(ctx context.Context,
+	encryptor encryption.StreamEncryptor,
+	underlying storage.Storage,
+	opts Options) (storage.Storage, error) {
 	es := &encryptedStorage{
-		encryptor:  encryptor,
-		underlying: underlying,
+		encryptor:        encryptor,
+		underlying:       underlying,
+		encryptFilenames: opts.EncryptFilenames,
 	}
 	return sanitized.New(ctx, "", es)
 }
 
+func (s *encryptedStorage) Unwrap() storage.Storage {
+	return s.underlying
+}
+
+// prepare checks the key on the first call, and creates the name encryptor.
+// If write is true, the key check object is created if it doesn't exist, so
+// that it's only written by the operations writing new objects.
+func (s *encryptedStorage) prepare(ctx context.Context, write bool) error {
+	s.keyOnce.Do(func() {
+		s.keyErr = s.checkKey(ctx)
+	})
+	if s.keyErr != nil || !write {
+		return s.keyErr
+	}
+	s.markerOnce.Do(func() {
+		s.markerErr = s.createKeyCheck(ctx)
+	})
+	return s.markerErr
+}
+
+// encryptPath encrypts every component of rpath with names. The root ("",
+// "." and "/") and the trailing slash are kept as is.
+func encryptPath(names encryption.NameEncryptor, rpath string) (string, error) {
+	if names == nil {
+		return rpath, nil
+	}
+	parts := strings.Split(rpath, "/")
+	for i, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		encrypted, err := names.EncryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = encrypted
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// decryptPath is the reverse of encryptPath.
+func decryptPath(names encryption.NameEncryptor, upath string) (string, error) {
+	if names == nil {
+		return upath, nil
+	}
+	parts := strings.Split(upath, "/")
+	for i, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		name, err := names.DecryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// dirPath returns the path of the directory in the underlying storage.
+func (s *encryptedStorage) dirPath(rpath string) (string, error) {
+	return encryptPath(s.names, rpath)
+}
+
+// filePath returns the path of the file in the underlying storage.
+func (s *encryptedStorage) filePath(rpath string) (string, error) {
+	upath, err := encryptPath(s.names, rpath)
+	if err != nil {
+		return "", err
+	}
+	return upath + encryptedFileSuffix, nil
+}
+
+// checkKey verifies the key with the key check object. It returns
+// encryption.ErrWrongKey if the key is wrong. If the object doesn't exist,
+// the key is checked with an existing object only if filename encryption is
+// enabled, which needs the key of the existing names. Otherwise listings
+// check it with the first listed object, and other operations fail on their
+// own with a wrong key.
+func (s *encryptedStorage) checkKey(ctx context.Context) error {
+	if err := s.verifyKeyCheck(ctx); err != nil {
+		return err
+	}
+	if s.encryptFilenames {
+		if s.keyCheckMissing {
+			if err := s.probeKey(ctx); err != nil {
+				return err
+			}
+		}
+		// create it after the key check, which determines the key
+		names, err := encryption.CreateNameEncryptor(s.encryptor)
+		if err != nil {
+			return err
+		}
+		s.names = names
+	}
+	return nil
+}
+
+func (s *encryptedStorage) verifyKeyCheck(ctx context.Context) error {
+	buf := bytes.NewBuffer(nil)
+	err := s.underlying.Pull(ctx, keyCheckFile, buf)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		s.keyCheckMissing = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to pull %q: %w", keyCheckFile, err)
+	}
+	plainText := bytes.NewBuffer(nil)
+	err = s.encryptor.DecryptStream(buf, plainText)
+	if errors.Is(err, encryption.ErrNoIdentity) {
+		// encrypting with public keys only, the key can't be verified
+		return nil
+	}
+	if err == nil && !bytes.Equal(plainText.Bytes(), keyCheckContent) {
+		err = errors.New("content mismatch")
+	}
+	if err != nil && !errors.Is(err, encryption.ErrWrongKey) {
+		err = fmt.Errorf("%w: unable to decrypt %q: %v", encryption.ErrWrongKey, keyCheckFile, err)
+	}
+	return util.WrappedErrOrNil(err, "key check failed, remove %q if the key is changed on purpose", keyCheckFile)
+}
+
+// createKeyCheck creates the key check object if it doesn't exist. An
+// existing object is checked before, to avoid recording a wrong key.
+func (s *encryptedStorage) createKeyCheck(ctx context.Context) error {
+	if !s.keyCheckMissing {
+		return nil
+	}
+	if err := s.probeKey(ctx); err != nil {
+		return err
+	}
+	cipherText := bytes.NewBuffer(nil)
+	if err := s.encryptor.EncryptStream(bytes.NewReader(keyCheckContent), cipherText); err != nil {
+		return fmt.Errorf("unable to encrypt %q: %w", keyCheckFile, err)
+	}
+	if err := s.underlying.Push(ctx, cipherText, keyCheckFile); err != nil {
+		// the storage may not allow writing the root, don't stop working
+		log(ctx).Warnf("[ENCRYPTED] unable to create %q: %v", keyCheckFile, err)
+		return nil
+	}
+	s.keyCheckMissing = false
+	return nil
+}
+
+// probeKey checks the key with an existing object, only once.
+func (s *encryptedStorage) probeKey(ctx context.Context) error {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.probed {
+		return nil
+	}
+	found, err := s.findExistingObject(ctx)
+	if err != nil || found == "" {
+		return err
+	}
+	return s.checkKeyWithObjectLocked(ctx, found)
+}
+
+// probeKeyWithObject checks the key with the object in the underlying
+// storage, if the key check object doesn't exist and no object is checked
+// yet.
+func (s *encryptedStorage) probeKeyWithObject(ctx context.Context, upath string) error {
+	if !s.keyCheckMissing {
+		return nil
+	}
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.probed {
+		return nil
+	}
+	return s.checkKeyWithObjectLocked(ctx, upath)
+}
+
+// findExistingObject looks for an encrypted object level by level, within a
+// limited number of directories. It returns "" if none is found.
+func (s *encryptedStorage) findExistingObject(ctx context.Context) (string, error) {
+	found := ""
+	dirs := []string{""}
+	for i := 0; i < maxKeyCheckListings && len(dirs) > 0 && found == ""; i++ {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		err := s.underlying.List(ctx, dir+"/", &storage.ListOptions{}, func(de storage.DirEntry) error {
+			if de.IsDir() {
+				dirs = append(dirs, de.Path())
+			} else if found == "" && strings.HasSuffix(de.Name(), encryptedFileSuffix) {
+				found = de.Path()
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, storage.ErrDirNotFound) {
+			return "", fmt.Errorf("unable to list %q for key check: %w", dir, err)
+		}
+	}
+	return found, nil
+}
+
+// checkKeyWithObjectLocked decrypts the beginning of the object, whose
+// header records the key ID, and sets probed if the key is not wrong. It's
+// called with probeMu held.
+func (s *encryptedStorage) checkKeyWithObjectLocked(ctx context.Context, upath string) error {
+	rc, err := s.openUnderlying(ctx, upath, 0, 1)
+	if err == nil {
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+	if errors.Is(err, encryption.ErrWrongKey) {
+		return fmt.Errorf("key check failed on %q: %w", upath, err)
+	}
+	if err != nil && !errors.Is(err, encryption.ErrNoIdentity) {
+		log(ctx).Warnf("[ENCRYPTED] unable to check the key with %q: %v", upath, err)
+	}
+	s.probed = true
+	return nil
+}
+
 func (s *encryptedStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	return s.push(ctx, r, rpath, func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error {
+		return st.Push(ctx, r, rpath)
+	})
+}
+
+func (s *encryptedStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	return s.push(ctx, r, rpath, storage.PushIfNotExists)
+}
+
+// PushIfMatch checks the ETag of the encrypted object.
+func (s *encryptedStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	return s.push(ctx, r, rpath, func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error {
+		return storage.PushIfMatch(ctx, st, r, rpath, etag)
+	})
+}
+
+// ETag returns the ETag of the encrypted object.
+func (s *encryptedStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	upath, err := s.filePath(rpath)
+	if err != nil {
+		return "", err
+	}
+	return storage.FileETag(ctx, s.underlying, upath)
+}
+
+func (s *encryptedStorage) push(ctx context.Context, r io.Reader, rpath string,
+	pushFn func(ctx context.Context, st storage.Storage, r io.Reader, rpath string) error) error {
+	if err := s.prepare(ctx, true); err != nil {
+		return err
+	}
+	upath, err := s.filePath(rpath)
+	if err != nil {
+		return err
+	}
 	pr, pw := io.Pipe()
 	go func() {
 		err := s.encryptor.EncryptStream(r, pw)
@@ -44,10 +339,19 @@ func (s *encryptedStorage) Push(ctx context.Context, r io.Reader, rpath string)
 			pw.Close() // EOF
 		}
 	}()
-	return s.underlying.Push(ctx, pr, rpath+encryptedFileSuffix)
+	err = pushFn(ctx, s.underlying, pr, upath)
+	pr.CloseWithError(err)
+	return err
 }
 
 func (s *encryptedStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	upath, err := s.filePath(rpath)
+	if err != nil {
+		return err
+	}
 	errCh := make(chan error, 1)
 	pr, pw := io.Pipe()
 	go func() {
@@ -58,7 +362,7 @@ func (s *encryptedStorage) Pull(ctx context.Context, rpath string, w io.Writer)
 		}
 		errCh <- err
 	}()
-	err := s.underlying.Pull(ctx, rpath+encryptedFileSuffix, pw)
+	err = s.underlying.Pull(ctx, upath, pw)
 	if err != nil {
 		pw.CloseWithError(err)
 	} else {
@@ -72,7 +376,26 @@ func (s *encryptedStorage) Pull(ctx context.Context, rpath string, w io.Writer)
 }
 
 func (s *encryptedStorage) OpenFile(ctx context.Context, rpath string, offset int64, length int64) (io.ReadCloser, error) {
-	rc, err := s.underlying.OpenFile(ctx, rpath+encryptedFileSuffix, 0, 0)
+	if err := s.prepare(ctx, false); err != nil {
+		return nil, err
+	}
+	upath, err := s.filePath(rpath)
+	if err != nil {
+		return nil, err
+	}
+	return s.openUnderlying(ctx, upath, offset, length)
+}
+
+// openUnderlying opens the file in the underlying storage, and decrypts the range.
+func (s *encryptedStorage) openUnderlying(ctx context.Context, upath string, offset int64, length int64) (io.ReadCloser, error) {
+	if rd, ok := s.encryptor.(encryption.RangeDecryptor); ok {
+		open := func(offset, length int64) (io.ReadCloser, error) {
+			return s.underlying.OpenFile(ctx, upath, offset, length)
+		}
+		return rd.DecryptRange(open, offset, length)
+	}
+
+	rc, err := s.underlying.OpenFile(ctx, upath, 0, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -103,49 +426,106 @@ func (s *encryptedStorage) OpenFile(ctx context.Context, rpath string, offset in
 }
 
 func (s *encryptedStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
 	if !recursive {
-		return s.underlying.Remove(ctx, rpath+encryptedFileSuffix, false)
+		upath, err := s.filePath(rpath)
+		if err != nil {
+			return err
+		}
+		return s.underlying.Remove(ctx, upath, false)
 	} else {
-		return s.underlying.Remove(ctx, rpath, true)
+		upath, err := s.dirPath(rpath)
+		if err != nil {
+			return err
+		}
+		return s.underlying.Remove(ctx, upath, true)
 	}
 }
 
+// Copy copies the ciphertext as is, since it doesn't depend on the path.
+func (s *encryptedStorage) Copy(ctx context.Context, src, dst string) error {
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	usrc, udst, err := s.filePathPair(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Copy(ctx, usrc, udst)
+}
+
+func (s *encryptedStorage) Move(ctx context.Context, src, dst string) error {
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	usrc, udst, err := s.filePathPair(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Move(ctx, usrc, udst)
+}
+
+func (s *encryptedStorage) filePathPair(src, dst string) (string, string, error) {
+	usrc, err := s.filePath(src)
+	if err != nil {
+		return "", "", err
+	}
+	udst, err := s.filePath(dst)
+	if err != nil {
+		return "", "", err
+	}
+	return usrc, udst, nil
+}
+
 func (s *encryptedStorage) Rmdir(ctx context.Context, rpath string) error {
-	return s.underlying.Rmdir(ctx, rpath)
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	upath, err := s.dirPath(rpath)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Rmdir(ctx, upath)
 }
 
 func (s *encryptedStorage) Mkdir(ctx context.Context, rpath string) error {
-	return s.underlying.Mkdir(ctx, rpath)
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	upath, err := s.dirPath(rpath)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Mkdir(ctx, upath)
 }
 
+// List lists the files with the sizes of their plaintext, which are
+// calculated from the headers stored in the objects, so that they are exact
+// for objects encrypted differently, e.g. legacy header-less objects or
+// objects written with another algorithm or key. It costs a ranged read of
+// every listed file.
 func (s *encryptedStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
-	myCb := func(de storage.DirEntry) error {
-		var err error
-		if !de.IsDir() {
-			if strings.HasSuffix(de.Name(), encryptedFileSuffix) {
-				name := strings.TrimSuffix(de.Name(), encryptedFileSuffix)
-				path := strings.TrimSuffix(de.Path(), encryptedFileSuffix)
-				size := de.Size() - int64(s.encryptor.Overhead())
-				newEntry := storage.NewStaticDirEntry(de.IsDir(), name, path, size, de.MTime())
-				err = cb(newEntry)
-			}
-			// ignore files that doesn't end with encryptedFileSuffix
-		} else {
-			err = cb(de)
-		}
+	if err := s.prepare(ctx, false); err != nil {
+		return err
+	}
+	listCb := s.listCallback(ctx, cb)
+	dirPath, err := s.dirPath(rpath)
+	if err != nil {
 		return err
 	}
 	if opt.PathIsFile {
 		// list a file
-		return s.underlying.List(ctx, rpath+encryptedFileSuffix, opt, myCb)
+		return s.underlying.List(ctx, dirPath+encryptedFileSuffix, opt, listCb)
 	} else if strings.HasSuffix(rpath, "/") || rpath == "." {
 		// rpath is a folder
-		return s.underlying.List(ctx, rpath, opt, myCb)
+		return s.underlying.List(ctx, dirPath, opt, listCb)
 	} else {
 		// try list single file first
 		cloneOpt := *opt
 		cloneOpt.PathIsFile = true
-		err := s.underlying.List(ctx, rpath+encryptedFileSuffix, &cloneOpt, myCb)
+		err := s.underlying.List(ctx, dirPath+encryptedFileSuffix, &cloneOpt, listCb)
 		if err != nil {
 			// ignore ErrObjectNotFound
 			if !errors.Is(err, storage.ErrObjectNotFound) {
@@ -156,8 +536,74 @@ func (s *encryptedStorage) List(ctx context.Context, rpath string, opt *storage.
 		}
 
 		// try list a folder
-		return s.underlying.List(ctx, rpath, opt, myCb)
+		return s.underlying.List(ctx, dirPath, opt, listCb)
+	}
+}
+
+// listCallback translates the entries of the underlying storage.
+func (s *encryptedStorage) listCallback(ctx context.Context, cb storage.ListCallback) storage.ListCallback {
+	return func(de storage.DirEntry) error {
+		var err error
+		if !de.IsDir() {
+			if strings.HasSuffix(de.Name(), encryptedFileSuffix) {
+				name := strings.TrimSuffix(de.Name(), encryptedFileSuffix)
+				path := strings.TrimSuffix(de.Path(), encryptedFileSuffix)
+				if name, path, err = s.decryptEntry(name, path); err != nil {
+					log(ctx).Debugf("[ENCRYPTED] ignore %q: %v", de.Path(), err)
+					return nil
+				}
+				// the listing isn't returned with a wrong key
+				if err := s.probeKeyWithObject(ctx, de.Path()); err != nil {
+					return err
+				}
+				size := de.Size()
+				if size >= 0 {
+					if size, err = s.objectSize(ctx, de.Path(), de.Size()); err != nil {
+						return fmt.Errorf("unable to get the size of %q: %w", path, err)
+					}
+				}
+				newEntry := storage.NewStaticDirEntry(de.IsDir(), name, path, size, de.MTime())
+				err = cb(newEntry)
+			}
+			// ignore files that doesn't end with encryptedFileSuffix
+		} else if s.names != nil {
+			name, path, err := s.decryptEntry(de.Name(), de.Path())
+			if err != nil {
+				log(ctx).Debugf("[ENCRYPTED] ignore %q: %v", de.Path(), err)
+				return nil
+			}
+			return cb(storage.NewStaticDirEntry(de.IsDir(), name, path, de.Size(), de.MTime()))
+		} else {
+			err = cb(de)
+		}
+		return err
+	}
+}
+
+// objectSize returns the size of the plaintext of the object in the
+// underlying storage, according to its header.
+func (s *encryptedStorage) objectSize(ctx context.Context, upath string, cipherTextSize int64) (int64, error) {
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		return s.underlying.OpenFile(ctx, upath, offset, length)
+	}
+	return encryption.ObjectPlainTextSize(s.encryptor, open, cipherTextSize)
+}
+
+// decryptEntry decrypts the name and the path of an entry in the underlying
+// storage, if filename encryption is enabled.
+func (s *encryptedStorage) decryptEntry(name, path string) (string, string, error) {
+	if s.names == nil {
+		return name, path, nil
+	}
+	name, err := s.names.DecryptName(name)
+	if err != nil {
+		return "", "", err
+	}
+	path, err = decryptPath(s.names, path)
+	if err != nil {
+		return "", "", err
 	}
+	return name, path, nil
 }
 
 func (s *encryptedStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
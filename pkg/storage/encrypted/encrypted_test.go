@@ -0,0 +1,156 @@
+package encrypted_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+const keyCheckFile = ".datasafed-keycheck"
+
+func newLocalStorage(t *testing.T, dir string) storage.Storage {
+	st, err := rclone.New(context.Background(), map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	return st
+}
+
+func newEncryptedStorage(t *testing.T, dir, passPhrase string, filenames bool) storage.Storage {
+	e, err := encryption.CreateEncryptor("AES-256-GCM", []byte(passPhrase))
+	require.NoError(t, err)
+	st, err := encrypted.NewWithOptions(context.Background(), e, newLocalStorage(t, dir),
+		encrypted.Options{EncryptFilenames: filenames})
+	require.NoError(t, err)
+	return st
+}
+
+func listFiles(t *testing.T, st storage.Storage) []string {
+	var paths []string
+	err := st.List(context.Background(), "/", &storage.ListOptions{Recursive: true, FilesOnly: true},
+		func(de storage.DirEntry) error {
+			paths = append(paths, de.Path())
+			return nil
+		})
+	require.NoError(t, err)
+	return paths
+}
+
+func TestKeyCheck(t *testing.T) {
+	ctx := context.Background()
+	for _, filenames := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain names", true: "encrypted names"}[filenames], func(t *testing.T) {
+			dir := t.TempDir()
+			marker := filepath.Join(dir, keyCheckFile)
+
+			// read-only operations never create the key check object
+			st := newEncryptedStorage(t, dir, "abc", filenames)
+			require.Empty(t, listFiles(t, st))
+			_, err := st.Stat(ctx, "/")
+			require.NoError(t, err)
+			err = st.Pull(ctx, "missing", &bytes.Buffer{})
+			require.ErrorIs(t, err, storage.ErrObjectNotFound)
+			require.NoFileExists(t, marker)
+
+			// it's created by the first push
+			require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "a/b.txt"))
+			require.FileExists(t, marker)
+
+			// a wrong key is detected by the key check object
+			wrong := newEncryptedStorage(t, dir, "xyz", filenames)
+			err = wrong.Push(ctx, strings.NewReader("hello"), "c.txt")
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+			_, err = wrong.Stat(ctx, "/")
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+
+			// without the key check object, a read-only operation still
+			// works with the right key, and doesn't write
+			require.NoError(t, os.Remove(marker))
+			st = newEncryptedStorage(t, dir, "abc", filenames)
+			require.Equal(t, []string{"a/b.txt"}, listFiles(t, st))
+			buf := &bytes.Buffer{}
+			require.NoError(t, st.Pull(ctx, "a/b.txt", buf))
+			require.Equal(t, "hello", buf.String())
+			require.NoFileExists(t, marker)
+
+			// a push with a wrong key is refused after checking an existing
+			// object, and the wrong key is not recorded
+			wrong = newEncryptedStorage(t, dir, "xyz", filenames)
+			err = wrong.Push(ctx, strings.NewReader("hello"), "c.txt")
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+			require.NoFileExists(t, marker)
+
+			// listings are not returned with a wrong key
+			wrong = newEncryptedStorage(t, dir, "xyz", filenames)
+			err = wrong.List(ctx, "/", &storage.ListOptions{Recursive: true}, func(storage.DirEntry) error { return nil })
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+			_, err = wrong.Stat(ctx, "/")
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+		})
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	ctx := context.Background()
+	for _, filenames := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain names", true: "encrypted names"}[filenames], func(t *testing.T) {
+			dir := t.TempDir()
+			st := newEncryptedStorage(t, dir, "abc", filenames)
+			require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "a/b.txt"))
+
+			require.NoError(t, st.Copy(ctx, "a/b.txt", "c/d.txt"))
+			require.NoError(t, st.Move(ctx, "a/b.txt", "e.txt"))
+			require.ElementsMatch(t, []string{"c/d.txt", "e.txt"}, listFiles(t, st))
+			for _, rpath := range []string{"c/d.txt", "e.txt"} {
+				buf := &bytes.Buffer{}
+				require.NoError(t, st.Pull(ctx, rpath, buf))
+				require.Equal(t, "hello", buf.String())
+			}
+
+			// the objects are stored with the suffix, and the names are
+			// encrypted if enabled
+			_, err := os.Stat(filepath.Join(dir, "e.txt.enc"))
+			if filenames {
+				require.ErrorIs(t, err, os.ErrNotExist)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestListSizes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// a legacy header-less object, from TestCiphertextSamples
+	legacy, err := hex.DecodeString("9456421484adb715d7f6b52663908dd1acf16848077df01942847cc0e835a627c8b5c704b465ea86f47afd4e359c097582e81a544fdbd1")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.enc"), legacy, 0644))
+	e, err := encryption.CreateEncryptor("AES-256-CFB", []byte("abcdefghijklmnopqrstuvwxyzabcdef"))
+	require.NoError(t, err)
+	st, err := encrypted.New(ctx, e, newLocalStorage(t, dir))
+	require.NoError(t, err)
+	require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "current"))
+
+	// the sizes are exact in directory listings too
+	sizes := map[string]int64{}
+	err = st.List(ctx, "/", &storage.ListOptions{}, func(de storage.DirEntry) error {
+		sizes[de.Path()] = de.Size()
+		return nil
+	})
+	require.NoError(t, err)
+	payload := "quick brown fox jumps over the lazy dog"
+	require.Equal(t, map[string]int64{"legacy": int64(len(payload)), "current": 5}, sizes)
+	stat, err := st.Stat(ctx, "/")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(payload)+5), stat.TotalSize)
+}
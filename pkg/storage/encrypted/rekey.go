@@ -0,0 +1,282 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+type unwrap interface {
+	Unwrap() storage.Storage
+}
+
+func asEncryptedStorage(st storage.Storage) (*encryptedStorage, bool) {
+	for {
+		if es, ok := st.(*encryptedStorage); ok {
+			return es, true
+		}
+		if u, ok := st.(unwrap); ok {
+			st = u.Unwrap()
+			continue
+		}
+		return nil, false
+	}
+}
+
+type RekeyOptions struct {
+	// DryRun only reports the objects to be rekeyed.
+	DryRun bool
+	// Concurrency is the number of objects rekeyed at the same time.
+	Concurrency int
+	// TempDir is the directory for the temporary files holding the new
+	// ciphertext before it is uploaded.
+	TempDir string
+	// Progress is called after an object is processed, if it's not nil.
+	Progress func(rpath string, action encryption.RekeyAction, err error)
+}
+
+type RekeyFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type RekeySummary struct {
+	Total       int            `json:"total"`
+	Reencrypted int            `json:"reencrypted"`
+	Rewrapped   int            `json:"rewrapped"`
+	Skipped     int            `json:"skipped"`
+	Failed      []RekeyFailure `json:"failed,omitempty"`
+}
+
+// Rekey moves the objects under rpath to the encryptor `to`. Each object is
+// rewrapped if both encryptors use envelope encryption, and re-encrypted
+// otherwise. The new ciphertext is written to a temporary file and verified,
+// then it's uploaded to a temporary object which is moved over the object,
+// so an object is either fully rekeyed or left untouched. Objects already
+// encrypted with `to` are skipped, so an interrupted rekey can be resumed by
+// running it again. With filename encryption, the objects are moved to the
+// names encrypted with `to`.
+//
+// The key check object covers the whole storage, so it's replaced only if
+// the whole storage is rekeyed without failures. After rekeying sub-paths,
+// the storage is still checked with the current key until the whole storage
+// is rekeyed, which skips the objects rekeyed before.
+func Rekey(ctx context.Context, st storage.Storage, rpath string,
+	to encryption.StreamEncryptor, opts RekeyOptions) (*RekeySummary, error) {
+	es, ok := asEncryptedStorage(st)
+	if !ok {
+		return nil, fmt.Errorf("requires *encryptedStorage, got %T, is encryption enabled?", st)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if err := es.prepare(ctx, false); err != nil {
+		return nil, err
+	}
+	var toNames encryption.NameEncryptor
+	if es.names != nil {
+		var err error
+		if toNames, err = encryption.CreateNameEncryptor(to); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	err := es.List(ctx, sanitizePath(rpath), &storage.ListOptions{Recursive: true, FilesOnly: true},
+		func(de storage.DirEntry) error {
+			if !de.IsDir() {
+				paths = append(paths, de.Path())
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("list %q error: %w", rpath, err)
+	}
+
+	summary := &RekeySummary{Total: len(paths)}
+	var mu sync.Mutex
+	ch := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				action, err := es.rekeyObject(ctx, p, to, toNames, &opts)
+				mu.Lock()
+				switch {
+				case err != nil:
+					summary.Failed = append(summary.Failed, RekeyFailure{Path: p, Error: err.Error()})
+				case action == encryption.RekeyNone:
+					summary.Skipped++
+				case action == encryption.RekeyRewrap:
+					summary.Rewrapped++
+				default:
+					summary.Reencrypted++
+				}
+				if opts.Progress != nil {
+					opts.Progress(p, action, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		ch <- p
+	}
+	close(ch)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+
+	if !opts.DryRun && len(summary.Failed) == 0 && isRoot(rpath) {
+		if err := es.replaceKeyCheck(ctx, to); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+func sanitizePath(rpath string) string {
+	if isRoot(rpath) {
+		return "/"
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+rpath), "/")
+	if strings.HasSuffix(rpath, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func isRoot(rpath string) bool {
+	cleaned := path.Clean("/" + rpath)
+	return cleaned == "/"
+}
+
+func (s *encryptedStorage) rekeyObject(ctx context.Context, rpath string,
+	to encryption.StreamEncryptor, toNames encryption.NameEncryptor,
+	opts *RekeyOptions) (encryption.RekeyAction, error) {
+	upath, err := s.filePath(rpath)
+	if err != nil {
+		return encryption.RekeyNone, err
+	}
+	// with filename encryption, the names are encrypted with the new key as well
+	newUpath, err := encryptPath(toNames, rpath)
+	if err != nil {
+		return encryption.RekeyNone, err
+	}
+	newUpath += encryptedFileSuffix
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		return s.underlying.OpenFile(ctx, upath, offset, length)
+	}
+	action, err := encryption.PlanRekey(s.encryptor, to, open)
+	if err != nil || action == encryption.RekeyNone || opts.DryRun {
+		return action, err
+	}
+
+	tmp, err := os.CreateTemp(opts.TempDir, "datasafed-rekey-*")
+	if err != nil {
+		return action, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	rc, err := s.underlying.OpenFile(ctx, upath, 0, -1)
+	if err != nil {
+		return action, err
+	}
+	defer rc.Close()
+	plainHash := sha256.New()
+	if action == encryption.RekeyRewrap {
+		err = encryption.Rewrap(s.encryptor, to, rc, tmp)
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(s.encryptor.DecryptStream(rc, io.MultiWriter(pw, plainHash)))
+		}()
+		err = to.EncryptStream(pr, tmp)
+		pr.CloseWithError(err)
+	}
+	if err != nil {
+		return action, err
+	}
+
+	// verify the new ciphertext before replacing the object
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return action, err
+	}
+	verifyHash := sha256.New()
+	if err := to.DecryptStream(tmp, verifyHash); err != nil {
+		return action, fmt.Errorf("verify new ciphertext error: %w", err)
+	}
+	if action == encryption.RekeyReencrypt && !bytes.Equal(plainHash.Sum(nil), verifyHash.Sum(nil)) {
+		return action, errors.New("verify new ciphertext error: content mismatch")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return action, err
+	}
+	if err := s.replaceObject(ctx, tmp, newUpath); err != nil {
+		return action, err
+	}
+	if newUpath != upath {
+		// the object is complete at the new name, the old one is removed
+		// only after that
+		if err := s.underlying.Remove(ctx, upath, false); err != nil {
+			return action, fmt.Errorf("remove %q error: %w", upath, err)
+		}
+	}
+	return action, nil
+}
+
+// replaceObject uploads the new ciphertext to a temporary object, and then
+// moves it to upath, so that the object at upath is never left partially
+// written if the upload fails.
+func (s *encryptedStorage) replaceObject(ctx context.Context, r io.Reader, upath string) error {
+	tmpPath, err := storage.TempObjectPath(upath)
+	if err != nil {
+		return err
+	}
+	if err := s.underlying.Push(ctx, r, tmpPath); err != nil {
+		s.removeTempObject(ctx, tmpPath)
+		return err
+	}
+	if err := s.underlying.Move(ctx, tmpPath, upath); err != nil {
+		s.removeTempObject(ctx, tmpPath)
+		return fmt.Errorf("move %q to %q error: %w", tmpPath, upath, err)
+	}
+	return nil
+}
+
+func (s *encryptedStorage) removeTempObject(ctx context.Context, tmpPath string) {
+	err := s.underlying.Remove(ctx, tmpPath, false)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		log(ctx).Warnf("[ENCRYPTED] failed to remove temporary object %q: %v", tmpPath, err)
+	}
+}
+
+func (s *encryptedStorage) replaceKeyCheck(ctx context.Context, to encryption.StreamEncryptor) error {
+	cipherText := bytes.NewBuffer(nil)
+	if err := to.EncryptStream(bytes.NewReader(keyCheckContent), cipherText); err != nil {
+		return fmt.Errorf("unable to encrypt %q: %w", keyCheckFile, err)
+	}
+	if err := s.underlying.Push(ctx, cipherText, keyCheckFile); err != nil {
+		return fmt.Errorf("unable to replace %q: %w", keyCheckFile, err)
+	}
+	return nil
+}
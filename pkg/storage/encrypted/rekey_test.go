@@ -0,0 +1,145 @@
+package encrypted_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+)
+
+var rekeyFiles = map[string]string{
+	"a.txt":     "hello",
+	"dir/b.txt": "world",
+	"dir/c/d":   strings.Repeat("0123456789", 1000),
+}
+
+func pushFiles(t *testing.T, st storage.Storage, files map[string]string) {
+	for rpath, content := range files {
+		require.NoError(t, st.Push(context.Background(), strings.NewReader(content), rpath))
+	}
+}
+
+func requireFiles(t *testing.T, st storage.Storage, files map[string]string) {
+	for rpath, content := range files {
+		buf := &bytes.Buffer{}
+		require.NoError(t, st.Pull(context.Background(), rpath, buf), rpath)
+		require.Equal(t, content, buf.String(), rpath)
+	}
+}
+
+// tempObjects returns the temporary objects left in dir.
+func tempObjects(t *testing.T, dir string) []string {
+	var found []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && storage.IsTempObject(d.Name()) {
+			found = append(found, p)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return found
+}
+
+func newEncryptor(t *testing.T, passPhrase string) encryption.StreamEncryptor {
+	e, err := encryption.CreateEncryptor("AES-256-GCM", []byte(passPhrase))
+	require.NoError(t, err)
+	return e
+}
+
+func TestRekey(t *testing.T) {
+	ctx := context.Background()
+	for _, filenames := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain names", true: "encrypted names"}[filenames], func(t *testing.T) {
+			dir := t.TempDir()
+			st := newEncryptedStorage(t, dir, "old", filenames)
+			pushFiles(t, st, rekeyFiles)
+
+			// a dry run changes nothing
+			summary, err := encrypted.Rekey(ctx, st, "/", newEncryptor(t, "new"), encrypted.RekeyOptions{DryRun: true})
+			require.NoError(t, err)
+			require.Equal(t, &encrypted.RekeySummary{Total: 3, Reencrypted: 3}, summary)
+			requireFiles(t, newEncryptedStorage(t, dir, "old", filenames), rekeyFiles)
+
+			summary, err = encrypted.Rekey(ctx, st, "/", newEncryptor(t, "new"), encrypted.RekeyOptions{Concurrency: 2})
+			require.NoError(t, err)
+			require.Equal(t, &encrypted.RekeySummary{Total: 3, Reencrypted: 3}, summary)
+			require.Empty(t, tempObjects(t, dir))
+
+			// the files and the key check object are moved to the new key
+			newSt := newEncryptedStorage(t, dir, "new", filenames)
+			requireFiles(t, newSt, rekeyFiles)
+			require.ElementsMatch(t, []string{"a.txt", "dir/b.txt", "dir/c/d"}, listFiles(t, newSt))
+			_, err = newEncryptedStorage(t, dir, "old", filenames).Stat(ctx, "/")
+			require.ErrorIs(t, err, encryption.ErrWrongKey)
+
+			// rekeyed files are skipped when it's run again
+			summary, err = encrypted.Rekey(ctx, newSt, "/", newEncryptor(t, "new"), encrypted.RekeyOptions{})
+			require.NoError(t, err)
+			require.Equal(t, &encrypted.RekeySummary{Total: 3, Skipped: 3}, summary)
+		})
+	}
+}
+
+func TestRekeySubPath(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st := newEncryptedStorage(t, dir, "old", false)
+	pushFiles(t, st, rekeyFiles)
+
+	summary, err := encrypted.Rekey(ctx, st, "dir/", newEncryptor(t, "new"), encrypted.RekeyOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, &encrypted.RekeySummary{Total: 2, Reencrypted: 2}, summary)
+	requireFiles(t, newEncryptedStorage(t, dir, "old", false), rekeyFiles)
+
+	summary, err = encrypted.Rekey(ctx, st, "dir/", newEncryptor(t, "new"), encrypted.RekeyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &encrypted.RekeySummary{Total: 2, Reencrypted: 2}, summary)
+	// the key check object is left with the old key
+	requireFiles(t, newEncryptedStorage(t, dir, "old", false), map[string]string{"a.txt": "hello"})
+	_, err = newEncryptedStorage(t, dir, "new", false).Stat(ctx, "/")
+	require.ErrorIs(t, err, encryption.ErrWrongKey)
+
+	// rekeying the whole storage skips the files rekeyed before
+	summary, err = encrypted.Rekey(ctx, st, "/", newEncryptor(t, "new"), encrypted.RekeyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &encrypted.RekeySummary{Total: 3, Reencrypted: 1, Skipped: 2}, summary)
+	requireFiles(t, newEncryptedStorage(t, dir, "new", false), rekeyFiles)
+}
+
+// failingMoveStorage fails to move objects, to interrupt rekeying.
+type failingMoveStorage struct {
+	storage.Storage
+}
+
+func (s failingMoveStorage) Move(ctx context.Context, src, dst string) error {
+	return errors.New("move failed")
+}
+
+func TestRekeyFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pushFiles(t, newEncryptedStorage(t, dir, "old", false), rekeyFiles)
+
+	st, err := encrypted.New(ctx, newEncryptor(t, "old"), failingMoveStorage{newLocalStorage(t, dir)})
+	require.NoError(t, err)
+	summary, err := encrypted.Rekey(ctx, st, "/", newEncryptor(t, "new"), encrypted.RekeyOptions{})
+	require.NoError(t, err)
+	require.Len(t, summary.Failed, 3)
+	for _, f := range summary.Failed {
+		require.Contains(t, f.Error, "move failed")
+	}
+
+	// the files are left untouched, without temporary objects, and the key
+	// check object is not replaced
+	require.Empty(t, tempObjects(t, dir))
+	requireFiles(t, newEncryptedStorage(t, dir, "old", false), rekeyFiles)
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+const (
+	HashMD5    = "md5"
+	HashSHA256 = "sha256"
+)
+
+var hashFactories = map[string]func() hash.Hash{
+	HashMD5:    md5.New,
+	HashSHA256: sha256.New,
+}
+
+// SupportedHashTypes returns the hash types supported by FileHash.
+func SupportedHashTypes() []string {
+	var types []string
+	for t := range hashFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewHash creates a hash.Hash of the hash type.
+func NewHash(hashType string) (hash.Hash, error) {
+	factory, ok := hashFactories[hashType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash type %q, choices: %q", hashType, SupportedHashTypes())
+	}
+	return factory(), nil
+}
+
+// FileHash returns the hash of the file in hex. The hash provided by the
+// backend is used if the entry carries it, otherwise the hash is computed by
+// streaming the content of the file from st.
+func FileHash(ctx context.Context, st Storage, entry DirEntry, hashType string) (string, error) {
+	if h := entry.Hashes()[hashType]; h != "" {
+		return strings.ToLower(h), nil
+	}
+	hasher, err := NewHash(hashType)
+	if err != nil {
+		return "", err
+	}
+	if err := st.Pull(ctx, entry.Path(), hasher); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/compressed"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func newLocalStorage(t *testing.T) storage.Storage {
+	st, err := rclone.New(context.Background(), map[string]string{"type": "local", "root": t.TempDir()}, "")
+	require.NoError(t, err)
+	return st
+}
+
+// noPullStorage fails to read files, to make sure the hashes are provided by
+// the backend.
+type noPullStorage struct {
+	storage.Storage
+}
+
+func (s noPullStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	return errors.New("unexpected pull")
+}
+
+func listEntry(t *testing.T, st storage.Storage, rpath string) storage.DirEntry {
+	var entry storage.DirEntry
+	err := st.List(context.Background(), rpath, &storage.ListOptions{PathIsFile: true, Hashes: true},
+		func(de storage.DirEntry) error {
+			entry = de
+			return nil
+		})
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	return entry
+}
+
+func expectedHashes(content string) map[string]string {
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	return map[string]string{
+		storage.HashMD5:    hex.EncodeToString(md5Sum[:]),
+		storage.HashSHA256: hex.EncodeToString(sha256Sum[:]),
+	}
+}
+
+func TestFileHashFromBackend(t *testing.T) {
+	ctx := context.Background()
+	// the memory backend provides md5 hashes without reading the content
+	st, err := rclone.New(ctx, map[string]string{"type": "memory", "root": t.Name()}, "")
+	require.NoError(t, err)
+	content := strings.Repeat("datasafed", 100)
+	require.NoError(t, st.Push(ctx, strings.NewReader(content), "a.txt"))
+	expected := expectedHashes(content)
+
+	entry := listEntry(t, st, "a.txt")
+	require.Equal(t, expected[storage.HashMD5], entry.Hashes()[storage.HashMD5])
+	h, err := storage.FileHash(ctx, noPullStorage{st}, entry, storage.HashMD5)
+	require.NoError(t, err)
+	require.Equal(t, expected[storage.HashMD5], h)
+
+	// other hashes are computed from the content
+	require.Empty(t, entry.Hashes()[storage.HashSHA256])
+	h, err = storage.FileHash(ctx, st, entry, storage.HashSHA256)
+	require.NoError(t, err)
+	require.Equal(t, expected[storage.HashSHA256], h)
+}
+
+func TestFileHashOfOriginalContent(t *testing.T) {
+	ctx := context.Background()
+	e, err := encryption.CreateEncryptor("AES-256-GCM", []byte("secret"))
+	require.NoError(t, err)
+	for name, create := range map[string]func(st storage.Storage) (storage.Storage, error){
+		"encrypted": func(st storage.Storage) (storage.Storage, error) {
+			return encrypted.New(ctx, e, st)
+		},
+		"compressed": func(st storage.Storage) (storage.Storage, error) {
+			return compressed.New(ctx, "zstd", st)
+		},
+		"compressed and encrypted": func(st storage.Storage) (storage.Storage, error) {
+			st, err := encrypted.New(ctx, e, st)
+			if err != nil {
+				return nil, err
+			}
+			return compressed.New(ctx, "zstd", st)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			st, err := create(newLocalStorage(t))
+			require.NoError(t, err)
+			content := strings.Repeat("datasafed", 100)
+			require.NoError(t, st.Push(ctx, strings.NewReader(content), "a.txt"))
+
+			// the hashes of the stored objects are not reported
+			entry := listEntry(t, st, "a.txt")
+			require.Empty(t, entry.Hashes())
+			for hashType, expected := range expectedHashes(content) {
+				h, err := storage.FileHash(ctx, st, entry, hashType)
+				require.NoError(t, err)
+				require.Equal(t, expected, h, hashType)
+			}
+		})
+	}
+}
+
+func TestFileHashUnsupported(t *testing.T) {
+	_, err := storage.FileHash(context.Background(), newLocalStorage(t),
+		storage.NewStaticDirEntry(false, "a", "a", 0, time.Time{}), "crc32")
+	require.ErrorContains(t, err, "unsupported hash type")
+}
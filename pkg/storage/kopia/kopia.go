@@ -28,6 +28,9 @@ const (
 	RepoRootKey     = "kopia.repo_root"
 	PasswordKey     = "kopia.password"
 	DisableCacheKey = "kopia.disable_cache"
+	// DisableWriteLockKey skips the shared lock of the repository held by
+	// writes, if maintenance never runs at the same time.
+	DisableWriteLockKey = "kopia.disable_write_lock"
 
 	metaSuffix = ".meta"
 	tmpSuffix  = ".tmp"
@@ -45,6 +48,10 @@ type meta struct {
 type kopiaStorage struct {
 	rep        repo.Repository
 	underlying storage.Storage
+	// locks is the storage of the locks, e.g. the lock of the repository
+	locks storage.Storage
+	// noWriteLock skips the lock of the repository in writes
+	noWriteLock bool
 }
 
 var _ storage.Storage = (*kopiaStorage)(nil)
@@ -63,7 +70,11 @@ func New(ctx context.Context, cfg map[string]string, basePath string) (storage.S
 
 	// after filepath.Clean(), repoRootPath should not contain '/' at the end
 	repoMetaPath := repoRootPath + metaSuffix
-	underlying, err := sanitized.New(ctx, repoMetaPath, underlying)
+	locks, err := sanitized.New(ctx, repoRootPath+lockSuffix, underlying)
+	if err != nil {
+		return nil, fmt.Errorf("sanitized.New error: %w", err)
+	}
+	underlying, err = sanitized.New(ctx, repoMetaPath, underlying)
 	if err != nil {
 		return nil, fmt.Errorf("sanitized.New error: %w", err)
 	}
@@ -73,14 +84,18 @@ func New(ctx context.Context, cfg map[string]string, basePath string) (storage.S
 		cacheID = generateUniqueID(cfg, basePath)
 	}
 
+	noWriteLock, _ := strconv.ParseBool(cfg[DisableWriteLockKey])
+
 	password := cfg[PasswordKey]
 	rep, err := getInitedRepository(ctx, repoRootPath, password, cacheID)
 	if err != nil {
 		return nil, fmt.Errorf("getInitedRepository error: %w", err)
 	}
 	s := &kopiaStorage{
-		rep:        rep,
-		underlying: underlying,
+		rep:         rep,
+		underlying:  underlying,
+		locks:       locks,
+		noWriteLock: noWriteLock,
 	}
 	return sanitized.New(ctx, basePath, s)
 }
@@ -95,7 +110,12 @@ func generateUniqueID(cfg map[string]string, basePath string) string {
 
 func (s *kopiaStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
 	log(ctx).Infof("[KOPIA] Push %s", rpath)
+	return s.withWriteLock(ctx, func(ctx context.Context) error {
+		return s.push(ctx, r, rpath)
+	})
+}
 
+func (s *kopiaStorage) push(ctx context.Context, r io.Reader, rpath string) error {
 	fileName := filepath.Base(rpath)
 	if fileName == "" || fileName == "." {
 		return fmt.Errorf("invalid file name: %q", fileName)
@@ -137,13 +157,7 @@ func (s *kopiaStorage) Push(ctx context.Context, r io.Reader, rpath string) erro
 		ModTime:    manifest.EndTime.ToTime(),
 		SnapshotID: string(manifest.ID),
 	}
-	buf := bytes.NewBuffer(nil)
-	enc := json.NewEncoder(buf)
-	if err = enc.Encode(meta); err != nil {
-		return fmt.Errorf("marshal meta json failed, meta: %+v, err: %w", meta, err)
-	}
-	err = s.underlying.Push(ctx, buf, rpath+metaSuffix)
-	if err != nil {
+	if err = s.saveMeta(ctx, rpath, meta); err != nil {
 		return err
 	}
 
@@ -179,7 +193,7 @@ func (s *kopiaStorage) OpenFile(ctx context.Context, rpath string, offset, lengt
 	}
 	rc, err := dumpSingleFile(ctx, s.rep, meta.SnapshotID, meta.Name, offset, length)
 	if err != nil {
-		return nil, fmt.Errorf("dumpSingleFile error: %w", err)
+		return nil, fmt.Errorf("dumpSingleFile %q error: %w", rpath, err)
 	}
 	return rc, err
 }
@@ -200,19 +214,19 @@ func (s *kopiaStorage) loadMeta(ctx context.Context, rpath string) (*meta, error
 
 func (s *kopiaStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
 	log(ctx).Infof("[KOPIA] Remove %s, recursive: %v", rpath, recursive)
+	return s.withWriteLock(ctx, func(ctx context.Context) error {
+		return s.remove(ctx, rpath, recursive)
+	})
+}
 
+func (s *kopiaStorage) remove(ctx context.Context, rpath string, recursive bool) error {
 	if !recursive {
 		meta, err := s.loadMeta(ctx, rpath)
 		if err != nil {
 			return err
 		}
-		err = repo.WriteSession(ctx, s.rep, repo.WriteSessionOptions{
-			Purpose: "datasafed:remove",
-		}, func(ctx context.Context, w repo.RepositoryWriter) error {
-			return w.DeleteManifest(ctx, manifest.ID(meta.SnapshotID))
-		})
-		if err != nil {
-			return fmt.Errorf("fail to remove kopia snapshot %s, error: %w", meta.SnapshotID, err)
+		if err = s.deleteSnapshot(ctx, meta.SnapshotID); err != nil {
+			return err
 		}
 		err = s.underlying.Remove(ctx, rpath+metaSuffix, false)
 		return util.WrappedErrOrNil(err, "fail to remove underlying %q", rpath+metaSuffix)
@@ -252,6 +266,112 @@ func (s *kopiaStorage) Remove(ctx context.Context, rpath string, recursive bool)
 	return nil
 }
 
+// Copy saves a new snapshot manifest for the same content, so that the
+// copies can be removed independently.
+func (s *kopiaStorage) Copy(ctx context.Context, src, dst string) error {
+	log(ctx).Infof("[KOPIA] Copy %s to %s", src, dst)
+	return s.withWriteLock(ctx, func(ctx context.Context) error {
+		return s.copy(ctx, src, dst)
+	})
+}
+
+func (s *kopiaStorage) copy(ctx context.Context, src, dst string) error {
+	srcMeta, err := s.loadMeta(ctx, src)
+	if err != nil {
+		return err
+	}
+	oldMeta, err := s.loadMetaIfExists(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	var newID manifest.ID
+	err = repo.WriteSession(ctx, s.rep, repo.WriteSessionOptions{
+		Purpose: "datasafed:copy",
+	}, func(ctx context.Context, w repo.RepositoryWriter) error {
+		man, err := snapshot.LoadSnapshot(ctx, w, manifest.ID(srcMeta.SnapshotID))
+		if err != nil {
+			return fmt.Errorf("unable to load kopia snapshot %s: %w", srcMeta.SnapshotID, err)
+		}
+		man.ID = ""
+		newID, err = snapshot.SaveSnapshot(ctx, w, man)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	dstMeta := *srcMeta
+	dstMeta.SnapshotID = string(newID)
+	if err = s.saveMeta(ctx, dst, &dstMeta); err != nil {
+		return err
+	}
+	s.removeShadowedSnapshot(ctx, oldMeta)
+	return nil
+}
+
+// Move only moves the meta file, the snapshot is unchanged.
+func (s *kopiaStorage) Move(ctx context.Context, src, dst string) error {
+	log(ctx).Infof("[KOPIA] Move %s to %s", src, dst)
+	return s.withWriteLock(ctx, func(ctx context.Context) error {
+		return s.move(ctx, src, dst)
+	})
+}
+
+func (s *kopiaStorage) move(ctx context.Context, src, dst string) error {
+	oldMeta, err := s.loadMetaIfExists(ctx, dst)
+	if err != nil {
+		return err
+	}
+	err = s.underlying.Move(ctx, src+metaSuffix, dst+metaSuffix)
+	if err != nil {
+		return err
+	}
+	s.removeShadowedSnapshot(ctx, oldMeta)
+	return nil
+}
+
+// loadMetaIfExists returns nil if the meta file doesn't exist.
+func (s *kopiaStorage) loadMetaIfExists(ctx context.Context, rpath string) (*meta, error) {
+	meta, err := s.loadMeta(ctx, rpath)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+func (s *kopiaStorage) saveMeta(ctx context.Context, rpath string, meta *meta) error {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(meta); err != nil {
+		return fmt.Errorf("marshal meta json failed, meta: %+v, err: %w", meta, err)
+	}
+	return s.underlying.Push(ctx, buf, rpath+metaSuffix)
+}
+
+// removeShadowedSnapshot removes the snapshot of an overwritten file.
+func (s *kopiaStorage) removeShadowedSnapshot(ctx context.Context, meta *meta) {
+	if meta == nil {
+		return
+	}
+	err := s.deleteSnapshot(ctx, meta.SnapshotID)
+	if err != nil {
+		log(ctx).Warnf("unable to remove the shadowed file: %v", err)
+	}
+}
+
+func (s *kopiaStorage) deleteSnapshot(ctx context.Context, snapshotID string) error {
+	err := repo.WriteSession(ctx, s.rep, repo.WriteSessionOptions{
+		Purpose: "datasafed:remove",
+	}, func(ctx context.Context, w repo.RepositoryWriter) error {
+		return w.DeleteManifest(ctx, manifest.ID(snapshotID))
+	})
+	if err != nil {
+		return fmt.Errorf("fail to remove kopia snapshot %s, error: %w", snapshotID, err)
+	}
+	return nil
+}
+
 func (s *kopiaStorage) Rmdir(ctx context.Context, rpath string) error {
 	log(ctx).Infof("[KOPIA] Rmdir %s", rpath)
 	return s.underlying.Rmdir(ctx, rpath)
@@ -0,0 +1,98 @@
+package kopia_test
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/kopia"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func newStorage(t *testing.T, kvs ...string) storage.Storage {
+	ctx := context.Background()
+	underlying, err := rclone.New(ctx, map[string]string{"type": "local", "root": t.TempDir()}, "")
+	require.NoError(t, err)
+	kopia.SetUnderlyingStorage(underlying)
+	cfg := map[string]string{
+		kopia.RepoRootKey:     "repo",
+		kopia.DisableCacheKey: "true",
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		cfg[kvs[i]] = kvs[i+1]
+	}
+	st, err := kopia.New(ctx, cfg, "")
+	require.NoError(t, err)
+	return st
+}
+
+func pull(t *testing.T, st storage.Storage, rpath string) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, st.Pull(context.Background(), rpath, buf))
+	return buf.String()
+}
+
+func listFiles(t *testing.T, st storage.Storage) []string {
+	var paths []string
+	err := st.List(context.Background(), "/", &storage.ListOptions{Recursive: true, FilesOnly: true},
+		func(de storage.DirEntry) error {
+			paths = append(paths, de.Path())
+			return nil
+		})
+	require.NoError(t, err)
+	return paths
+}
+
+func TestCopyMove(t *testing.T) {
+	ctx := context.Background()
+	st := newStorage(t)
+	content := strings.Repeat("datasafed", 1000)
+	require.NoError(t, st.Push(ctx, strings.NewReader(content), "a"))
+
+	require.NoError(t, st.Copy(ctx, "a", "dir/b"))
+	require.Equal(t, content, pull(t, st, "a"))
+	require.Equal(t, content, pull(t, st, "dir/b"))
+
+	// the copy has its own snapshot, so it survives removing the source
+	require.NoError(t, st.Remove(ctx, "a", false))
+	require.Equal(t, content, pull(t, st, "dir/b"))
+
+	// moving over an existing file replaces it
+	require.NoError(t, st.Push(ctx, strings.NewReader("old"), "c"))
+	require.NoError(t, st.Move(ctx, "dir/b", "c"))
+	require.Equal(t, content, pull(t, st, "c"))
+	require.Equal(t, []string{"c"}, listFiles(t, st))
+
+	err := st.Move(ctx, "dir/b", "d")
+	require.ErrorIs(t, err, storage.ErrObjectNotFound)
+	err = st.Copy(ctx, "dir/b", "d")
+	require.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func TestWriteLock(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		st := newStorage(t, kopia.DisableWriteLockKey, strconv.FormatBool(disabled))
+		locks, err := kopia.LockStorage(st)
+		require.NoError(t, err)
+		lock, err := storage.AcquireLock(context.Background(), locks, kopia.RepoLockName, storage.LockOptions{})
+		require.NoError(t, err)
+
+		// writes wait for the exclusive lock, e.g. of maintenance
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err = st.Push(ctx, strings.NewReader("hello"), "a")
+		cancel()
+		if disabled {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		}
+		require.NoError(t, lock.Release(context.Background()))
+		require.NoError(t, st.Push(context.Background(), strings.NewReader("hello"), "a"))
+	}
+}
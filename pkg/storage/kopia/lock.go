@@ -0,0 +1,73 @@
+package kopia
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+const (
+	// RepoLockName is the name of the lock of the repository. Writes hold
+	// it in shared mode, and maintenance holds it in exclusive mode.
+	RepoLockName = "repository"
+
+	lockSuffix     = ".locks"
+	repoLockTTL    = 2 * time.Minute
+	writeLockWait  = 10 * time.Minute
+	lockOwnerWrite = "datasafed:write"
+	lockOwnerMaint = "datasafed:maintenance"
+)
+
+type repoLockKey struct{}
+
+// LockStorage returns the storage of the locks of the kopia repository.
+func LockStorage(st storage.Storage) (storage.Storage, error) {
+	ks, ok := asKopiaStorage(st)
+	if !ok {
+		return nil, fmt.Errorf("requires *kopiaStorage, got %T", st)
+	}
+	return ks.locks, nil
+}
+
+// withWriteLock calls fn while holding the shared lock of the repository,
+// so that writes don't race with maintenance. The lock is not acquired
+// again by nested calls, or if it's disabled by DisableWriteLockKey. It
+// costs several requests, i.e. listing the locks twice, and writing, reading
+// and removing the lock object.
+func (s *kopiaStorage) withWriteLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.noWriteLock || ctx.Value(repoLockKey{}) != nil {
+		return fn(ctx)
+	}
+	ctx, release, err := s.lockRepo(ctx, storage.LockShared, lockOwnerWrite, writeLockWait)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn(ctx)
+}
+
+// lockRepo acquires the lock of the repository and keeps it alive until
+// release is called. The returned context is canceled if the lock is lost.
+func (s *kopiaStorage) lockRepo(ctx context.Context, mode storage.LockMode, owner string,
+	wait time.Duration) (context.Context, func(), error) {
+	lock, err := storage.AcquireLock(ctx, s.locks, RepoLockName, storage.LockOptions{
+		Mode:  mode,
+		Owner: owner,
+		TTL:   repoLockTTL,
+		Wait:  wait,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("acquire the lock of the repository: %w", err)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	lock.KeepAlive(ctx, cancel)
+	release := func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			log(ctx).Warnf("[KOPIA] %v", err)
+		}
+		cancel(nil)
+	}
+	return context.WithValue(ctx, repoLockKey{}, lock), release, nil
+}
@@ -2,6 +2,7 @@ package kopia
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/kopia/kopia/repo"
@@ -39,6 +40,19 @@ func RunMaintenance(ctx context.Context, st storage.Storage, safety string) erro
 		return fmt.Errorf("requires repo.DirectRepository, got %T", ks.rep)
 	}
 
+	// the maintenance is forced, so it must not run with writes or other
+	// maintenance, it's skipped if the repository is locked
+	lockCtx, release, err := ks.lockRepo(ctx, storage.LockExclusive, lockOwnerMaint, 0)
+	if errors.Is(err, storage.ErrLocked) {
+		log(ctx).Warnf("[KOPIA] skip maintenance: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx = lockCtx
+
 	return repo.DirectWriteSession(ctx, directRep, repo.WriteSessionOptions{
 		Purpose: "datasafed:maintenance",
 	}, func(ctx context.Context, dw repo.DirectRepositoryWriter) error {
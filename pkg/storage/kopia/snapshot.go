@@ -2,6 +2,7 @@ package kopia
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,9 +12,12 @@ import (
 	"github.com/kopia/kopia/fs"
 	"github.com/kopia/kopia/fs/virtualfs"
 	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/manifest"
 	"github.com/kopia/kopia/snapshot"
 	"github.com/kopia/kopia/snapshot/policy"
 	"github.com/kopia/kopia/snapshot/snapshotfs"
+
+	"github.com/apecloud/datasafed/pkg/storage"
 )
 
 func snapshotSingleFile(ctx context.Context, fileName string, r io.Reader, rep repo.RepositoryWriter, tags map[string]string) (*snapshot.Manifest, error) {
@@ -164,8 +168,21 @@ func onCtrlC(f func()) {
 	}()
 }
 
+// dumpSingleFile opens the file in the snapshot. It returns an error wrapping
+// storage.ErrObjectNotFound if the snapshot doesn't exist.
 func dumpSingleFile(ctx context.Context, rep repo.Repository, snapshotID string, fileName string, offset, length int64) (io.ReadCloser, error) {
-	rootEntry, err := snapshotfs.FilesystemEntryFromIDWithPath(ctx, rep, snapshotID+"/"+fileName, true)
+	man, err := snapshot.LoadSnapshot(ctx, rep, manifest.ID(snapshotID))
+	if err != nil {
+		if errors.Is(err, snapshot.ErrSnapshotNotFound) {
+			return nil, fmt.Errorf("%w: snapshot %s", storage.ErrObjectNotFound, snapshotID)
+		}
+		return nil, fmt.Errorf("unable to load kopia snapshot %s: %w", snapshotID, err)
+	}
+	root, err := snapshotfs.SnapshotRoot(rep, man)
+	if err != nil {
+		return nil, err
+	}
+	rootEntry, err := snapshotfs.GetNestedEntry(ctx, root, []string{fileName})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockDir is the directory of the locks in a storage, if they are not
+// stored elsewhere, e.g. along with a kopia repository.
+const LockDir = ".datasafed-locks"
+
+var (
+	// ErrLocked is returned if the lock is held by others.
+	ErrLocked = errors.New("locked")
+	// ErrLockLost is returned if the lock object is removed by others,
+	// e.g. after the lease is expired.
+	ErrLockLost = errors.New("lock lost")
+)
+
+type LockMode string
+
+const (
+	// LockExclusive conflicts with any other lock.
+	LockExclusive LockMode = "exclusive"
+	// LockShared only conflicts with exclusive locks.
+	LockShared LockMode = "shared"
+)
+
+const (
+	lockObjectSuffix  = ".json"
+	defaultLockTTL    = time.Minute
+	lockRetryInterval = 2 * time.Second
+	// a lock object being rewritten may be read partially from the backends
+	// without atomic writes, e.g. the local file system, then it's read again
+	lockReadAttempts = 3
+	lockReadInterval = 20 * time.Millisecond
+)
+
+// LockInfo is the content of a lock object.
+type LockInfo struct {
+	Name     string    `json:"name"`
+	Token    string    `json:"token"`
+	Mode     LockMode  `json:"mode"`
+	Owner    string    `json:"owner"`
+	Hostname string    `json:"hostname"`
+	PID      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Expired returns true if the lease is expired at the time.
+func (i *LockInfo) Expired(now time.Time) bool {
+	return !now.Before(i.Expires)
+}
+
+func (i *LockInfo) String() string {
+	return fmt.Sprintf("%s lock by %q on %s (pid %d), expires at %s",
+		i.Mode, i.Owner, i.Hostname, i.PID, i.Expires.Format(time.RFC3339))
+}
+
+type LockOptions struct {
+	// Mode is LockExclusive if empty.
+	Mode LockMode
+	// Owner describes the holder of the lock.
+	Owner string
+	// TTL is the duration of the lease, it's extended by Refresh().
+	TTL time.Duration
+	// Wait is the max duration to wait for the lock, it fails immediately
+	// with ErrLocked if it's 0.
+	Wait time.Duration
+}
+
+// Lock is an advisory lock stored in a storage. Each holder writes the
+// object "<name>/<token>.json", and the lock is acquired if there are no
+// conflicting objects with unexpired leases after the object is written.
+type Lock struct {
+	st   Storage
+	info LockInfo
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	stop func()
+}
+
+// AcquireLock acquires the lock of the name in st.
+func AcquireLock(ctx context.Context, st Storage, name string, opts LockOptions) (*Lock, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid lock name %q", name)
+	}
+	if opts.Mode == "" {
+		opts.Mode = LockExclusive
+	}
+	if opts.Mode != LockExclusive && opts.Mode != LockShared {
+		return nil, fmt.Errorf("invalid lock mode %q", opts.Mode)
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultLockTTL
+	}
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	l := &Lock{
+		st: st,
+		info: LockInfo{
+			Name:     name,
+			Token:    token,
+			Mode:     opts.Mode,
+			Owner:    opts.Owner,
+			Hostname: hostname,
+			PID:      os.Getpid(),
+		},
+		ttl: opts.TTL,
+	}
+
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		conflicts, err := l.conflicts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) == 0 {
+			l.info.Acquired = time.Now()
+			if err := l.write(ctx, ""); err != nil {
+				return nil, err
+			}
+			// check again, another holder may write its object meanwhile
+			conflicts, err = l.conflicts(ctx)
+			if err != nil {
+				l.remove(ctx)
+				return nil, err
+			}
+			if len(conflicts) == 0 {
+				log(ctx).Infof("[LOCK] acquired %s", l.info.String())
+				return l, nil
+			}
+			l.remove(ctx)
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, fmt.Errorf("%w: %q is held by %s", ErrLocked, name, conflicts[0].String())
+		}
+		// add jitter to avoid retrying in lockstep with other contenders
+		wait = min(wait, lockRetryInterval+time.Duration(mrand.Int63n(int64(lockRetryInterval))))
+		log(ctx).Debugf("[LOCK] %q is held by %s, retry in %s", name, conflicts[0].String(), wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Info returns the content of the lock object.
+func (l *Lock) Info() LockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.info
+}
+
+// Refresh extends the lease. It returns ErrLockLost if the lock object is
+// removed by others, e.g. after the lease is expired. If the backend of st
+// checks ETags atomically, the lock object is only written if it's not
+// changed or removed meanwhile. Otherwise, it's checked after writing whether
+// the lock is taken over.
+func (l *Lock) Refresh(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !AtomicConditions(l.st) {
+		return l.refreshAndCheck(ctx)
+	}
+	etag, err := FileETag(ctx, l.st, l.objectPath())
+	if errors.Is(err, ErrETagUnsupported) {
+		return l.refreshAndCheck(ctx)
+	}
+	if errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("%w: %q", ErrLockLost, l.info.Name)
+	}
+	if err != nil {
+		return err
+	}
+	err = l.write(ctx, etag)
+	if errors.Is(err, ErrPreconditionFailed) {
+		return fmt.Errorf("%w: %q: %v", ErrLockLost, l.info.Name, err)
+	}
+	return err
+}
+
+// refreshAndCheck extends the lease without conditional writes. The lock
+// object may be removed after it's read, and the lock may be taken over by
+// another holder, then the written object is removed again.
+func (l *Lock) refreshAndCheck(ctx context.Context) error {
+	if _, err := readLockInfo(ctx, l.st, l.objectPath()); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("%w: %q", ErrLockLost, l.info.Name)
+		}
+		return err
+	}
+	if err := l.write(ctx, ""); err != nil {
+		return err
+	}
+	conflicts, err := l.conflicts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		l.remove(ctx)
+		return fmt.Errorf("%w: %q is taken over by %s", ErrLockLost, l.info.Name, conflicts[0].String())
+	}
+	return nil
+}
+
+// KeepAlive refreshes the lease in the background until Release() is called.
+// onLost is called if the lock is lost, e.g. to cancel the guarded operation.
+func (l *Lock) KeepAlive(ctx context.Context, onLost func(err error)) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	l.mu.Lock()
+	l.stop = func() {
+		cancel()
+		<-done
+	}
+	l.mu.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := l.Refresh(ctx)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			if errors.Is(err, ErrLockLost) {
+				log(ctx).Errorf("[LOCK] %v", err)
+				if onLost != nil {
+					onLost(err)
+				}
+				return
+			}
+			log(ctx).Warnf("[LOCK] failed to refresh %q: %v", l.info.Name, err)
+		}
+	}()
+}
+
+// Release stops refreshing the lease, and removes the lock object.
+func (l *Lock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	stop := l.stop
+	l.stop = nil
+	l.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	err := l.st.Remove(ctx, l.objectPath(), false)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("release lock %q error: %w", l.info.Name, err)
+	}
+	log(ctx).Infof("[LOCK] released %s", l.info.String())
+	return nil
+}
+
+func (l *Lock) objectPath() string {
+	return lockObjectPath(l.info.Name, l.info.Token)
+}
+
+// write writes the lock object, only if it has the ETag if etag is not
+// empty.
+func (l *Lock) write(ctx context.Context, etag string) error {
+	l.info.Expires = time.Now().Add(l.ttl)
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		err = PushIfMatch(ctx, l.st, bytes.NewReader(data), l.objectPath(), etag)
+	} else {
+		err = l.st.Push(ctx, bytes.NewReader(data), l.objectPath())
+	}
+	if err != nil {
+		return fmt.Errorf("write lock %q error: %w", l.info.Name, err)
+	}
+	return nil
+}
+
+func (l *Lock) remove(ctx context.Context) {
+	if err := l.st.Remove(ctx, l.objectPath(), false); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		log(ctx).Warnf("[LOCK] failed to remove %q: %v", l.objectPath(), err)
+	}
+}
+
+// conflicts returns the unexpired locks of other holders conflicting with l.
+func (l *Lock) conflicts(ctx context.Context) ([]LockInfo, error) {
+	infos, err := ListLocks(ctx, l.st, l.info.Name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var conflicts []LockInfo
+	for _, info := range infos {
+		if info.Token == l.info.Token {
+			continue
+		}
+		if info.Expired(now) {
+			// clean up the lock left by a crashed holder
+			log(ctx).Infof("[LOCK] remove expired %s", info.String())
+			if err := RemoveLock(ctx, l.st, info.Name, info.Token); err != nil {
+				log(ctx).Warnf("[LOCK] %v", err)
+			}
+			continue
+		}
+		if l.info.Mode == LockExclusive || info.Mode == LockExclusive {
+			conflicts = append(conflicts, info)
+		}
+	}
+	return conflicts, nil
+}
+
+// ListLocks returns the locks of the name, or all locks if name is empty.
+func ListLocks(ctx context.Context, st Storage, name string) ([]LockInfo, error) {
+	var paths []string
+	opts := &ListOptions{FilesOnly: true, Recursive: name == "", MaxDepth: 2}
+	err := st.List(ctx, name+"/", opts, func(de DirEntry) error {
+		if strings.HasSuffix(de.Name(), lockObjectSuffix) {
+			paths = append(paths, de.Path())
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrDirNotFound) {
+		return nil, err
+	}
+	var infos []LockInfo
+	for _, p := range paths {
+		info, err := readLockInfo(ctx, st, p)
+		if errors.Is(err, ErrObjectNotFound) {
+			// released meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Acquired.Before(infos[j].Acquired)
+	})
+	return infos, nil
+}
+
+// RemoveLock removes the lock object of the holder regardless of its lease.
+func RemoveLock(ctx context.Context, st Storage, name, token string) error {
+	err := st.Remove(ctx, lockObjectPath(name, token), false)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("remove lock %q of %s error: %w", name, token, err)
+	}
+	return nil
+}
+
+func readLockInfo(ctx context.Context, st Storage, p string) (*LockInfo, error) {
+	for attempt := 1; ; attempt++ {
+		buf := bytes.NewBuffer(nil)
+		if err := st.Pull(ctx, p, buf); err != nil {
+			return nil, err
+		}
+		info := &LockInfo{}
+		err := json.Unmarshal(buf.Bytes(), info)
+		if err == nil {
+			return info, nil
+		}
+		if attempt >= lockReadAttempts {
+			return nil, fmt.Errorf("invalid lock object %q: %w", p, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockReadInterval):
+		}
+	}
+}
+
+func lockObjectPath(name, token string) string {
+	return path.Join(name, token+lockObjectSuffix)
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
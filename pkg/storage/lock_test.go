@@ -0,0 +1,194 @@
+package storage_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+func acquire(t *testing.T, st storage.Storage, mode storage.LockMode, ttl time.Duration) (*storage.Lock, error) {
+	return storage.AcquireLock(context.Background(), st, "a", storage.LockOptions{Mode: mode, Owner: t.Name(), TTL: ttl})
+}
+
+func TestLockConflicts(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+
+	shared1, err := acquire(t, st, storage.LockShared, time.Minute)
+	require.NoError(t, err)
+	shared2, err := acquire(t, st, storage.LockShared, time.Minute)
+	require.NoError(t, err)
+	_, err = acquire(t, st, storage.LockExclusive, time.Minute)
+	require.ErrorIs(t, err, storage.ErrLocked)
+
+	infos, err := storage.ListLocks(ctx, st, "")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, shared1.Info().Token, infos[0].Token)
+	require.Equal(t, t.Name(), infos[0].Owner)
+
+	require.NoError(t, shared1.Release(ctx))
+	require.NoError(t, shared2.Release(ctx))
+	excl, err := acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+	_, err = acquire(t, st, storage.LockShared, time.Minute)
+	require.ErrorIs(t, err, storage.ErrLocked)
+
+	// the lock is acquired after it's released by the holder
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		excl.Release(ctx)
+	}()
+	_, err = storage.AcquireLock(ctx, st, "a", storage.LockOptions{Wait: 10 * time.Second})
+	require.NoError(t, err)
+
+	_, err = storage.AcquireLock(ctx, st, "a/b", storage.LockOptions{})
+	require.ErrorContains(t, err, "invalid lock name")
+}
+
+func TestLockExpired(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+
+	// the holder crashes without releasing the lock
+	crashed, err := acquire(t, st, storage.LockExclusive, 100*time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	lock, err := acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+	infos, err := storage.ListLocks(ctx, st, "a")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, lock.Info().Token, infos[0].Token)
+
+	// the crashed holder finds the lock taken over, and doesn't write its
+	// lock object again
+	err = crashed.Refresh(ctx)
+	require.ErrorIs(t, err, storage.ErrLockLost)
+	infos, err = storage.ListLocks(ctx, st, "a")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+}
+
+// takeOverStorage removes the lock object and writes the one of another
+// holder after the lock object is read, as if the lease expired meanwhile.
+type takeOverStorage struct {
+	storage.Storage
+	t       *testing.T
+	enabled atomic.Bool
+}
+
+func (s *takeOverStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	err := s.Storage.Pull(ctx, rpath, w)
+	if s.enabled.CompareAndSwap(true, false) {
+		require.NoError(s.t, s.Storage.Remove(ctx, rpath, false))
+		_, err := acquire(s.t, s.Storage, storage.LockExclusive, time.Minute)
+		require.NoError(s.t, err)
+	}
+	return err
+}
+
+func TestLockRefreshTakenOver(t *testing.T) {
+	ctx := context.Background()
+	st := &takeOverStorage{Storage: newLocalStorage(t), t: t}
+	lock, err := acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, lock.Refresh(ctx))
+
+	st.enabled.Store(true)
+	err = lock.Refresh(ctx)
+	require.ErrorIs(t, err, storage.ErrLockLost)
+	require.ErrorContains(t, err, "taken over")
+	infos, err := storage.ListLocks(ctx, st, "a")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.NotEqual(t, lock.Info().Token, infos[0].Token)
+}
+
+func TestLockRefreshConditional(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("locks")
+	cfg[rclone.ConditionalWritesKey] = "true"
+	st, err := rclone.New(ctx, cfg, "")
+	require.NoError(t, err)
+	lock, err := acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+	key := "locks/a/" + lock.Info().Token + ".json"
+	expires := lock.Info().Expires
+	require.NoError(t, lock.Refresh(ctx))
+	require.True(t, lock.Info().Expires.After(expires))
+
+	// the lock object is removed after its ETag is read
+	srv.BeforeRequest(func(name, k string) {
+		if name == "PutObject" && k == key {
+			srv.DeleteObject(key)
+		}
+	})
+	defer srv.BeforeRequest(nil)
+	err = lock.Refresh(ctx)
+	require.ErrorIs(t, err, storage.ErrLockLost)
+	_, ok := srv.Object(key)
+	require.False(t, ok)
+}
+
+func TestLockRefreshCheckThenWrite(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(ctx, srv.Config("locks"), "")
+	require.NoError(t, err)
+	require.False(t, storage.AtomicConditions(st))
+	lock, err := acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+	key := "locks/a/" + lock.Info().Token + ".json"
+
+	// the ETag isn't sent if the provider may ignore it, the lock object is
+	// written again and checked for the holders that took the lock over
+	srv.BeforeRequest(func(name, k string) {
+		if name == "PutObject" && k == key {
+			srv.DeleteObject(key)
+		}
+	})
+	defer srv.BeforeRequest(nil)
+	require.NoError(t, lock.Refresh(ctx))
+	_, ok := srv.Object(key)
+	require.True(t, ok)
+}
+
+func TestLockKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+	lock, err := acquire(t, st, storage.LockExclusive, 300*time.Millisecond)
+	require.NoError(t, err)
+	var lost atomic.Value
+	lock.KeepAlive(ctx, func(err error) { lost.Store(err) })
+
+	// the lease is extended beyond the TTL
+	time.Sleep(time.Second)
+	_, err = acquire(t, st, storage.LockExclusive, time.Minute)
+	require.ErrorIs(t, err, storage.ErrLocked)
+	require.Nil(t, lost.Load())
+
+	// the lock is lost if it's removed by others
+	require.NoError(t, storage.RemoveLock(ctx, st, "a", lock.Info().Token))
+	require.Eventually(t, func() bool { return lost.Load() != nil }, 2*time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, lost.Load().(error), storage.ErrLockLost)
+	require.NoError(t, lock.Release(ctx))
+	_, err = acquire(t, st, storage.LockExclusive, time.Minute)
+	require.NoError(t, err)
+}
+
+func TestLockInfoString(t *testing.T) {
+	info := storage.LockInfo{Mode: storage.LockShared, Owner: "me", Hostname: "host", PID: 1,
+		Expires: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	require.True(t, strings.HasPrefix(info.String(), `shared lock by "me" on host (pid 1)`))
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const namespace = "datasafed"
+
+// Metrics holds the metrics of the storage operations in dedicated
+// registries, which are exported when the process exits.
+type Metrics struct {
+	// registry is pushed to the Pushgateway, which adds the labels of the
+	// grouping key to the metrics
+	registry *prometheus.Registry
+	// labeled has the labels in the metrics, it's written to the textfile
+	labeled    *prometheus.Registry
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	bytes      *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+}
+
+// NewMetrics creates the metrics, the labels are added to all of them when
+// they are written to the textfile, e.g. to identify the backup. They should
+// be passed to Push() as the grouping key.
+func NewMetrics(labels map[string]string) (*Metrics, error) {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		labeled:  prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operations_total",
+			Help:      "Number of storage operations.",
+		}, []string{"operation", "backend"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "errors_total",
+			Help:      "Number of failed storage operations, excluding the files not found.",
+		}, []string{"operation", "backend"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "bytes_total",
+			Help:      "Number of bytes pushed and pulled.",
+		}, []string{"operation", "backend"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of storage operations.",
+			// from 10ms to about 43 minutes
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"operation", "backend"}),
+	}
+	labeled := prometheus.WrapRegistererWith(labels, m.labeled)
+	for _, c := range []prometheus.Collector{m.operations, m.errors, m.bytes, m.duration} {
+		if err := m.registry.Register(c); err != nil {
+			return nil, fmt.Errorf("register metrics error: %w", err)
+		}
+		if err := labeled.Register(c); err != nil {
+			return nil, fmt.Errorf("register metrics error: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// WriteTextfile writes the metrics to the file in the text format, which
+// can be collected by the textfile collector of the node exporter. The file
+// is replaced atomically.
+func (m *Metrics) WriteTextfile(path string) error {
+	if err := prometheus.WriteToTextfile(path, m.labeled); err != nil {
+		return fmt.Errorf("write metrics to %q error: %w", path, err)
+	}
+	return nil
+}
+
+// Push pushes the metrics to the Pushgateway at the url, replacing the
+// metrics of the same job and grouping labels.
+func (m *Metrics) Push(ctx context.Context, url, job string, grouping map[string]string) error {
+	pusher := push.New(url, job).Gatherer(m.registry)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if err := pusher.PushContext(ctx); err != nil {
+		return fmt.Errorf("push metrics to %q error: %w", url, err)
+	}
+	return nil
+}
+
+// ParseLabels parses the labels in the format "name=value,name=value".
+func ParseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", item)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func newStorage(t *testing.T, m *Metrics) storage.Storage {
+	ctx := context.Background()
+	underlying, err := rclone.New(ctx, map[string]string{"type": "local", "root": t.TempDir()}, "")
+	require.NoError(t, err)
+	st, err := New(ctx, underlying, m, "local")
+	require.NoError(t, err)
+	return st
+}
+
+func counterValue(t *testing.T, c *prometheus.CounterVec, op string) float64 {
+	metric := &dto.Metric{}
+	require.NoError(t, c.WithLabelValues(op, "local").Write(metric))
+	return metric.GetCounter().GetValue()
+}
+
+func TestMetricsStorage(t *testing.T) {
+	ctx := context.Background()
+	m, err := NewMetrics(nil)
+	require.NoError(t, err)
+	st := newStorage(t, m)
+
+	require.NoError(t, st.Push(ctx, strings.NewReader("0123456789"), "a"))
+	require.NoError(t, storage.PushIfNotExists(ctx, st, strings.NewReader("01234"), "b"))
+	require.NoError(t, st.Pull(ctx, "a", io.Discard))
+	rc, err := st.OpenFile(ctx, "a", 2, 5)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	// the files not found are not errors
+	require.ErrorIs(t, st.Pull(ctx, "missing", io.Discard), storage.ErrObjectNotFound)
+	require.Error(t, storage.PushIfNotExists(ctx, st, strings.NewReader("x"), "a"))
+
+	require.Equal(t, 3.0, counterValue(t, m.operations, "push"))
+	require.Equal(t, 2.0, counterValue(t, m.operations, "pull"))
+	require.Equal(t, 1.0, counterValue(t, m.operations, "open_file"))
+	require.Equal(t, 15.0, counterValue(t, m.bytes, "push"))
+	require.Equal(t, 10.0, counterValue(t, m.bytes, "pull"))
+	require.Equal(t, 5.0, counterValue(t, m.bytes, "open_file"))
+	require.Equal(t, 1.0, counterValue(t, m.errors, "push"))
+	require.Equal(t, 0.0, counterValue(t, m.errors, "pull"))
+
+	metric := &dto.Metric{}
+	observer, err := m.duration.GetMetricWithLabelValues("push", "local")
+	require.NoError(t, err)
+	require.NoError(t, observer.(prometheus.Histogram).Write(metric))
+	require.Equal(t, uint64(3), metric.GetHistogram().GetSampleCount())
+}
+
+func TestWriteTextfile(t *testing.T) {
+	m, err := NewMetrics(map[string]string{"backup": "b1"})
+	require.NoError(t, err)
+	st := newStorage(t, m)
+	require.NoError(t, st.Push(context.Background(), strings.NewReader("data"), "a"))
+
+	path := filepath.Join(t.TempDir(), "datasafed.prom")
+	require.NoError(t, m.WriteTextfile(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `datasafed_storage_operations_total{backend="local",backup="b1",operation="push"} 1`)
+	require.Contains(t, string(data), `datasafed_storage_bytes_total{backend="local",backup="b1",operation="push"} 4`)
+}
+
+func TestPush(t *testing.T) {
+	var method, path string
+	body := &bytes.Buffer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		_, _ = io.Copy(body, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	m, err := NewMetrics(map[string]string{"backup": "b1"})
+	require.NoError(t, err)
+	st := newStorage(t, m)
+	require.NoError(t, st.Push(context.Background(), strings.NewReader("data"), "a"))
+	require.NoError(t, m.Push(context.Background(), srv.URL, "datasafed", map[string]string{"backup": "b1"}))
+	require.Equal(t, http.MethodPut, method)
+	require.Equal(t, "/metrics/job/datasafed/backup/b1", path)
+	// the labels of the grouping key are added by the Pushgateway
+	require.Contains(t, body.String(), "datasafed_storage_operations_total")
+	require.NotContains(t, body.String(), "b1")
+
+	srv.Close()
+	require.ErrorContains(t, m.Push(context.Background(), srv.URL, "datasafed", nil), "push metrics")
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" backup = b1, ,namespace=default")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"backup": "b1", "namespace": "default"}, labels)
+
+	for _, s := range []string{"backup", "=b1"} {
+		_, err := ParseLabels(s)
+		require.Error(t, err, s)
+	}
+}
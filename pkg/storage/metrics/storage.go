@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/sanitized"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+// metricsStorage records the count, duration, bytes and errors of the
+// operations of the underlying storage.
+type metricsStorage struct {
+	m          *Metrics
+	backend    string
+	underlying storage.Storage
+}
+
+var _ storage.Storage = (*metricsStorage)(nil)
+
+// New wraps the storage to record the metrics of its operations, labeled
+// with the backend type, e.g. "s3".
+func New(ctx context.Context, underlying storage.Storage, m *Metrics, backend string) (storage.Storage, error) {
+	ms := &metricsStorage{
+		m:          m,
+		backend:    backend,
+		underlying: underlying,
+	}
+	return sanitized.New(ctx, "", ms)
+}
+
+func (s *metricsStorage) Unwrap() storage.Storage {
+	return s.underlying
+}
+
+func (s *metricsStorage) MultipartUploader(ctx context.Context, rpath string) (storage.MultipartUploader, error) {
+	return storage.NewMultipartUploader(ctx, s.underlying, rpath)
+}
+
+// observe records the operation started at the time.
+func (s *metricsStorage) observe(op string, start time.Time, n int64, err error) {
+	s.m.operations.WithLabelValues(op, s.backend).Inc()
+	s.m.duration.WithLabelValues(op, s.backend).Observe(time.Since(start).Seconds())
+	if n > 0 {
+		s.m.bytes.WithLabelValues(op, s.backend).Add(float64(n))
+	}
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) && !errors.Is(err, storage.ErrDirNotFound) {
+		s.m.errors.WithLabelValues(op, s.backend).Inc()
+	}
+}
+
+func (s *metricsStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	start := time.Now()
+	cr := &util.CountingReader{R: r}
+	err := s.underlying.Push(ctx, cr, rpath)
+	s.observe("push", start, cr.N, err)
+	return err
+}
+
+func (s *metricsStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	start := time.Now()
+	cr := &util.CountingReader{R: r}
+	err := storage.PushIfNotExists(ctx, s.underlying, cr, rpath)
+	s.observe("push", start, cr.N, err)
+	return err
+}
+
+func (s *metricsStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	start := time.Now()
+	cr := &util.CountingReader{R: r}
+	err := storage.PushIfMatch(ctx, s.underlying, cr, rpath, etag)
+	s.observe("push", start, cr.N, err)
+	return err
+}
+
+func (s *metricsStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	start := time.Now()
+	etag, err := storage.FileETag(ctx, s.underlying, rpath)
+	s.observe("etag", start, 0, err)
+	return etag, err
+}
+
+func (s *metricsStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	start := time.Now()
+	cw := &util.CountingWriter{W: w}
+	err := s.underlying.Pull(ctx, rpath, cw)
+	s.observe("pull", start, cw.N, err)
+	return err
+}
+
+// OpenFile records the duration of opening the file, and the bytes read
+// from it when it's closed.
+func (s *metricsStorage) OpenFile(ctx context.Context, rpath string, offset, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := s.underlying.OpenFile(ctx, rpath, offset, length)
+	s.observe("open_file", start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReadCloser{
+		CountingReader: util.CountingReader{R: rc},
+		c:              rc,
+		onClose: func(n int64) {
+			s.m.bytes.WithLabelValues("open_file", s.backend).Add(float64(n))
+		},
+	}, nil
+}
+
+func (s *metricsStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
+	start := time.Now()
+	err := s.underlying.Remove(ctx, rpath, recursive)
+	s.observe("remove", start, 0, err)
+	return err
+}
+
+func (s *metricsStorage) Rmdir(ctx context.Context, rpath string) error {
+	start := time.Now()
+	err := s.underlying.Rmdir(ctx, rpath)
+	s.observe("rmdir", start, 0, err)
+	return err
+}
+
+func (s *metricsStorage) Mkdir(ctx context.Context, rpath string) error {
+	start := time.Now()
+	err := s.underlying.Mkdir(ctx, rpath)
+	s.observe("mkdir", start, 0, err)
+	return err
+}
+
+func (s *metricsStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	start := time.Now()
+	err := s.underlying.List(ctx, rpath, opt, cb)
+	s.observe("list", start, 0, err)
+	return err
+}
+
+func (s *metricsStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
+	start := time.Now()
+	result, err := s.underlying.Stat(ctx, rpath)
+	s.observe("stat", start, 0, err)
+	return result, err
+}
+
+func (s *metricsStorage) Copy(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := s.underlying.Copy(ctx, src, dst)
+	s.observe("copy", start, 0, err)
+	return err
+}
+
+func (s *metricsStorage) Move(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := s.underlying.Move(ctx, src, dst)
+	s.observe("move", start, 0, err)
+	return err
+}
+
+type countingReadCloser struct {
+	util.CountingReader
+	c       io.Closer
+	onClose func(n int64)
+}
+
+func (c *countingReadCloser) Close() error {
+	if c.onClose != nil {
+		c.onClose(c.N)
+		c.onClose = nil
+	}
+	return c.c.Close()
+}
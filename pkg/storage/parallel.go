@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// SequentialStorage is implemented by storages which have to read a file
+// from the beginning for any range, e.g. compressed storages, so ranged
+// reads don't help to pull a file in parallel.
+type SequentialStorage interface {
+	Sequential() bool
+}
+
+// IsSequential returns true if st, or any storage wrapped by it, reads
+// files sequentially.
+func IsSequential(st Storage) bool {
+	for {
+		if s, ok := st.(SequentialStorage); ok && s.Sequential() {
+			return true
+		}
+		u, ok := st.(interface{ Unwrap() Storage })
+		if !ok {
+			return false
+		}
+		st = u.Unwrap()
+	}
+}
+
+type ParallelPullOptions struct {
+	// Streams is the number of ranges fetched at the same time.
+	Streams int
+	// ChunkSize is the size of each range.
+	ChunkSize int64
+}
+
+func (o *ParallelPullOptions) enabled() bool {
+	return o.Streams > 1 && o.ChunkSize > 0
+}
+
+// errLongerThanListed is returned if the file doesn't end at its listed size,
+// e.g. because it was overwritten after it had been listed.
+var errLongerThanListed = errors.New("file is longer than listed")
+
+// ParallelPull pulls the file with concurrent ranged reads, and writes the
+// ranges to w in order. At most Streams+1 chunks are held in memory at the
+// same time. It falls back to Pull if the file is small or st reads
+// sequentially.
+//
+// The last range is fetched first and read to the end of the file, so nothing
+// is written to w if the file is longer than listed, and it's pulled again
+// with a single stream.
+func ParallelPull(ctx context.Context, st Storage, rpath string, w io.Writer, opts ParallelPullOptions) error {
+	size, ok, err := parallelPullSize(ctx, st, rpath, &opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return st.Pull(ctx, rpath, w)
+	}
+	err = parallelPull(ctx, st, rpath, size, w, opts)
+	if errors.Is(err, errLongerThanListed) {
+		log(ctx).Warnf("[PULL] %v, pull it with a single stream", err)
+		return st.Pull(ctx, rpath, w)
+	}
+	return err
+}
+
+func parallelPull(ctx context.Context, st Storage, rpath string, size int64, w io.Writer, opts ParallelPullOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := (size + opts.ChunkSize - 1) / opts.ChunkSize
+	results := make([]chan []byte, chunks)
+	for i := range results {
+		results[i] = make(chan []byte, 1)
+	}
+	// limits the number of chunks being fetched or waiting to be written
+	slots := make(chan struct{}, opts.Streams)
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	go func() {
+		for k := int64(0); k < chunks; k++ {
+			i := rangeIndex(k, chunks)
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int64) {
+				buf, err := readRange(ctx, st, rpath, i*opts.ChunkSize, chunkLength(i, size, opts.ChunkSize), i == chunks-1)
+				if err != nil {
+					fail(err)
+					return
+				}
+				results[i] <- buf
+			}(i)
+		}
+	}()
+
+	var last []byte
+	for k := int64(0); k < chunks; k++ {
+		i := rangeIndex(k, chunks)
+		select {
+		case buf := <-results[i]:
+			if i == chunks-1 {
+				// held until the other ranges are written
+				last = buf
+			} else if _, err := w.Write(buf); err != nil {
+				fail(err)
+				return err
+			}
+			<-slots
+		case <-ctx.Done():
+			if firstErr != nil {
+				return firstErr
+			}
+			return ctx.Err()
+		}
+	}
+	_, err := w.Write(last)
+	return err
+}
+
+// ParallelPullTo pulls the file with concurrent ranged reads, and writes each
+// range to w at its offset. It falls back to Pull if the file is small or st
+// reads sequentially, and pulls the file again with a single stream if it's
+// longer than listed.
+func ParallelPullTo(ctx context.Context, st Storage, rpath string, w io.WriterAt, opts ParallelPullOptions) error {
+	size, ok, err := parallelPullSize(ctx, st, rpath, &opts)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = parallelPullTo(ctx, st, rpath, size, w, opts)
+		if !errors.Is(err, errLongerThanListed) {
+			return err
+		}
+		log(ctx).Warnf("[PULL] %v, pull it with a single stream", err)
+	}
+	return st.Pull(ctx, rpath, io.NewOffsetWriter(w, 0))
+}
+
+func parallelPullTo(ctx context.Context, st Storage, rpath string, size int64, w io.WriterAt, opts ParallelPullOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := (size + opts.ChunkSize - 1) / opts.ChunkSize
+	next := make(chan int64)
+	errCh := make(chan error, opts.Streams)
+	var wg sync.WaitGroup
+	for j := 0; j < opts.Streams; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				offset := i * opts.ChunkSize
+				length := chunkLength(i, size, opts.ChunkSize)
+				last := i == chunks-1
+				if err := copyRange(ctx, st, rpath, offset, length, last, io.NewOffsetWriter(w, offset)); err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+loop:
+	for k := int64(0); k < chunks; k++ {
+		select {
+		case next <- rangeIndex(k, chunks):
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(next)
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// parallelPullSize returns the size of the file, and whether it should be
+// pulled in parallel.
+func parallelPullSize(ctx context.Context, st Storage, rpath string, opts *ParallelPullOptions) (int64, bool, error) {
+	if !opts.enabled() || IsSequential(st) {
+		return 0, false, nil
+	}
+	size, err := fileSize(ctx, st, rpath)
+	if err != nil {
+		return 0, false, err
+	}
+	return size, size > opts.ChunkSize, nil
+}
+
+// fileSize returns the listed size of the file.
+func fileSize(ctx context.Context, st Storage, rpath string) (int64, error) {
+	var size int64 = -1
+	err := st.List(ctx, rpath, &ListOptions{PathIsFile: true}, func(de DirEntry) error {
+		size = de.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, ErrObjectNotFound
+	}
+	return size, nil
+}
+
+// rangeIndex returns the index of the k-th range to fetch. The last range is
+// fetched first, because it checks where the file ends.
+func rangeIndex(k, chunks int64) int64 {
+	return (k + chunks - 1) % chunks
+}
+
+func chunkLength(i, size, chunkSize int64) int64 {
+	return min(chunkSize, size-i*chunkSize)
+}
+
+func readRange(ctx context.Context, st Storage, rpath string, offset, length int64, last bool) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, length+1))
+	if err := copyRange(ctx, st, rpath, offset, length, last, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// copyRange copies length bytes at offset of the file to w. If last is true,
+// the range is read to the end of the file instead of stopping at the listed
+// size, which makes the storage check the end of the file, e.g. the final
+// chunk of an encrypted file, and one more byte is read to detect trailing
+// data.
+func copyRange(ctx context.Context, st Storage, rpath string, offset, length int64, last bool, w io.Writer) error {
+	openLength, limit := length, length
+	if last {
+		openLength, limit = -1, length+1
+	}
+	rc, err := st.OpenFile(ctx, rpath, offset, openLength)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(w, io.LimitReader(rc, limit))
+	if err != nil {
+		return err
+	}
+	if n > length {
+		return fmt.Errorf("%w: %q has more than %d bytes", errLongerThanListed, rpath, offset+length)
+	}
+	if n != length {
+		return fmt.Errorf("short read of %q at offset %d, expected %d bytes, got %d", rpath, offset, length, n)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+// rangeStorage records the ranges opened, and fails the range at failOffset
+// after some bytes are read.
+type rangeStorage struct {
+	storage.Storage
+	failOffset int64
+
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (s *rangeStorage) OpenFile(ctx context.Context, rpath string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, [2]int64{offset, length})
+	s.mu.Unlock()
+	rc, err := s.Storage.OpenFile(ctx, rpath, offset, length)
+	if err != nil || offset != s.failOffset {
+		return rc, err
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(io.LimitReader(rc, 10), failingReader{}),
+		Closer: rc,
+	}, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// shrunkStorage lists files smaller than they are, as if they were
+// overwritten after being listed.
+type shrunkStorage struct {
+	storage.Storage
+	by int64
+}
+
+func (s shrunkStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	return s.Storage.List(ctx, rpath, opt, func(de storage.DirEntry) error {
+		return cb(storage.NewStaticDirEntry(de.IsDir(), de.Name(), de.Path(), de.Size()-s.by, de.MTime()))
+	})
+}
+
+func randomContent(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// pullBoth pulls the file with ParallelPull and ParallelPullTo, and checks
+// that both get the same content.
+func pullBoth(t *testing.T, st storage.Storage, rpath string, opts storage.ParallelPullOptions) ([]byte, error) {
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	err := storage.ParallelPull(ctx, st, rpath, buf, opts)
+
+	f, err2 := os.Create(filepath.Join(t.TempDir(), "pulled"))
+	require.NoError(t, err2)
+	defer f.Close()
+	err2 = storage.ParallelPullTo(ctx, st, rpath, f, opts)
+	if err != nil || err2 != nil {
+		require.Error(t, err)
+		require.Error(t, err2)
+		return nil, err
+	}
+	data, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(buf.Bytes(), data))
+	return data, nil
+}
+
+func TestParallelPull(t *testing.T) {
+	ctx := context.Background()
+	content := randomContent(10000)
+	local := newLocalStorage(t)
+	require.NoError(t, local.Push(ctx, bytes.NewReader(content), "a"))
+
+	for _, tc := range []struct {
+		opts   storage.ParallelPullOptions
+		ranges int
+	}{
+		{storage.ParallelPullOptions{Streams: 2, ChunkSize: 1000}, 10},
+		{storage.ParallelPullOptions{Streams: 3, ChunkSize: 999}, 11},
+		{storage.ParallelPullOptions{Streams: 8, ChunkSize: 4096}, 3},
+		// not split
+		{storage.ParallelPullOptions{Streams: 2, ChunkSize: 10000}, 0},
+		{storage.ParallelPullOptions{Streams: 1, ChunkSize: 1000}, 0},
+	} {
+		st := &rangeStorage{Storage: local, failOffset: -1}
+		data, err := pullBoth(t, st, "a", tc.opts)
+		require.NoError(t, err, tc.opts)
+		require.True(t, bytes.Equal(content, data), tc.opts)
+		// twice, for both functions
+		require.Len(t, st.ranges, tc.ranges*2, tc.opts)
+		for _, r := range st.ranges {
+			if r[0]+tc.opts.ChunkSize >= int64(len(content)) {
+				// the last range is read to the end of the file
+				require.EqualValues(t, -1, r[1], tc.opts)
+			} else {
+				require.Equal(t, tc.opts.ChunkSize, r[1], tc.opts)
+			}
+		}
+	}
+}
+
+func TestParallelPullEncrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local, err := rclone.New(ctx, map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	e, err := encryption.CreateEncryptor("AES-256-GCM", []byte("secret"))
+	require.NoError(t, err)
+	st, err := encrypted.New(ctx, e, local)
+	require.NoError(t, err)
+	// more than two chunks of the encryption format
+	content := randomContent(200000)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(content), "a"))
+	opts := storage.ParallelPullOptions{Streams: 3, ChunkSize: 50000}
+
+	data, err := pullBoth(t, st, "a", opts)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, data))
+
+	// drop the final chunk, so the file ends at a chunk boundary
+	upath := filepath.Join(dir, "a.enc")
+	sealed, err := os.ReadFile(upath)
+	require.NoError(t, err)
+	lastSealed := len(content) - 3*65536 + 16
+	require.NoError(t, os.WriteFile(upath, sealed[:len(sealed)-lastSealed], 0644))
+	_, err = pullBoth(t, st, "a", opts)
+	require.Error(t, err)
+}
+
+func TestParallelPullLongerThanListed(t *testing.T) {
+	ctx := context.Background()
+	content := randomContent(10000)
+	local := newLocalStorage(t)
+	require.NoError(t, local.Push(ctx, bytes.NewReader(content), "a"))
+
+	// the file is pulled again with a single stream
+	st := &rangeStorage{Storage: shrunkStorage{Storage: local, by: 500}, failOffset: -1}
+	data, err := pullBoth(t, st, "a", storage.ParallelPullOptions{Streams: 2, ChunkSize: 1000})
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, data))
+	// the last range is read to the end of the file
+	require.Contains(t, st.ranges, [2]int64{9000, -1})
+}
+
+func TestParallelPullFailingStream(t *testing.T) {
+	ctx := context.Background()
+	content := randomContent(10000)
+	local := newLocalStorage(t)
+	require.NoError(t, local.Push(ctx, bytes.NewReader(content), "a"))
+
+	for _, offset := range []int64{0, 3000, 9000} {
+		st := &rangeStorage{Storage: local, failOffset: offset}
+		_, err := pullBoth(t, st, "a", storage.ParallelPullOptions{Streams: 2, ChunkSize: 1000})
+		require.ErrorContains(t, err, "connection reset", offset)
+	}
+
+	// a short range is an error, not a truncated file
+	st := shrunkStorage{Storage: local, by: -500}
+	_, err := pullBoth(t, st, "a", storage.ParallelPullOptions{Streams: 2, ChunkSize: 1000})
+	require.ErrorContains(t, err, "short read")
+}
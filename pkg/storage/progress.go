@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The phases of transfers reported by Progress.
+const (
+	PhaseUploading   = "uploading"
+	PhaseDownloading = "downloading"
+	// PhaseJoining is joining the uploaded parts of a resumable push.
+	PhaseJoining = "joining"
+	// PhaseVerifying is verifying the pushed file against its digest.
+	PhaseVerifying = "verifying"
+	PhaseCompleted = "completed"
+	PhaseFailed    = "failed"
+)
+
+// rateSmoothing is the weight of the latest interval in the reported rate.
+const rateSmoothing = 0.3
+
+// ProgressEvent is a progress report of a transfer, which is written as a
+// line of JSON. The bytes are of the current phase.
+type ProgressEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	Phase     string    `json:"phase"`
+	Bytes     int64     `json:"bytes"`
+	// TotalBytes is omitted if the size is unknown, e.g. pushing from a pipe.
+	TotalBytes int64   `json:"total_bytes,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	// Rate is the smoothed rate in bytes per second, or the average rate of
+	// the transfer after it's done.
+	Rate       float64  `json:"rate"`
+	ETASeconds *float64 `json:"eta_seconds,omitempty"`
+	// ElapsedSeconds is the time since the transfer started.
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// Progress reports the progress of a transfer periodically as ProgressEvent
+// lines. The methods of a nil Progress do nothing, so it can be used without
+// checking whether the progress is reported.
+type Progress struct {
+	w         io.Writer
+	operation string
+	path      string
+	interval  time.Duration
+	started   time.Time
+
+	mu         sync.Mutex
+	phase      string
+	phaseStart time.Time
+	// skipped is the bytes transferred before the phase started, e.g. by
+	// an interrupted push, they don't count in the rate
+	skipped   int64
+	bytes     int64
+	total     int64
+	rate      float64
+	lastBytes int64
+	lastTime  time.Time
+	// settled is set when the bytes are all transferred, and the rate is
+	// the average of the transfer
+	settled  bool
+	finished bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewProgress starts reporting the progress of the operation, e.g. "push",
+// on rpath to w every interval. The first phase is started with the total
+// bytes, which is -1 if unknown.
+func NewProgress(w io.Writer, operation, rpath string, interval time.Duration, phase string, total int64) *Progress {
+	p := &Progress{
+		w:         w,
+		operation: operation,
+		path:      rpath,
+		interval:  interval,
+		started:   time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	p.StartPhase(phase, 0, total)
+	go p.run()
+	return p
+}
+
+func (p *Progress) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.updateRate(time.Now())
+			p.emit(nil)
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// StartPhase starts a new phase, whose bytes are counted from done, e.g. the
+// bytes transferred before a resumed transfer, to total. The total is -1 if
+// it's unknown.
+func (p *Progress) StartPhase(phase string, done, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	now := time.Now()
+	p.phase = phase
+	p.phaseStart = now
+	p.skipped = done
+	p.bytes = done
+	p.total = total
+	p.rate = 0
+	p.lastBytes = done
+	p.lastTime = now
+	p.settled = false
+	p.emit(nil)
+}
+
+// SetPhase switches to the phase after the bytes are transferred, e.g.
+// verifying the pushed file, which keeps the bytes and the average rate of
+// the transfer.
+func (p *Progress) SetPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	p.settle()
+	p.phase = phase
+	p.emit(nil)
+}
+
+// Add adds n bytes transferred in the current phase.
+func (p *Progress) Add(n int64) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.bytes += n
+	p.mu.Unlock()
+}
+
+// Finish stops reporting, and writes the final event, with phase "completed",
+// or "failed" and the error if err is not nil. Only the first call takes
+// effect.
+func (p *Progress) Finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.finished {
+		p.mu.Unlock()
+		return
+	}
+	p.finished = true
+	p.mu.Unlock()
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settle()
+	if err != nil {
+		p.phase = PhaseFailed
+	} else {
+		p.phase = PhaseCompleted
+	}
+	p.emit(err)
+}
+
+// settle sets the rate to the average of the phase, p.mu must be held.
+func (p *Progress) settle() {
+	if p.settled {
+		return
+	}
+	p.settled = true
+	if elapsed := time.Since(p.phaseStart).Seconds(); elapsed > 0 {
+		p.rate = float64(p.bytes-p.skipped) / elapsed
+	}
+}
+
+// updateRate updates the smoothed rate with the bytes since the last update.
+func (p *Progress) updateRate(now time.Time) {
+	if p.settled {
+		return
+	}
+	elapsed := now.Sub(p.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(p.bytes-p.lastBytes) / elapsed
+	if p.lastBytes == p.skipped {
+		p.rate = rate
+	} else {
+		p.rate = rateSmoothing*rate + (1-rateSmoothing)*p.rate
+	}
+	p.lastBytes = p.bytes
+	p.lastTime = now
+}
+
+// emit writes the event of the current state, p.mu must be held.
+func (p *Progress) emit(err error) {
+	now := time.Now()
+	ev := ProgressEvent{
+		Time:           now.UTC(),
+		Operation:      p.operation,
+		Path:           p.path,
+		Phase:          p.phase,
+		Bytes:          p.bytes,
+		Rate:           p.rate,
+		ElapsedSeconds: now.Sub(p.started).Seconds(),
+	}
+	if p.total >= 0 {
+		ev.TotalBytes = p.total
+		if p.total > 0 {
+			ev.Percent = min(100, float64(p.bytes)*100/float64(p.total))
+		}
+		if p.rate > 0 && !p.settled {
+			eta := float64(max(0, p.total-p.bytes)) / p.rate
+			ev.ETASeconds = &eta
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	data, _ := json.Marshal(ev)
+	// the progress is best effort, failing to write it doesn't fail the transfer
+	_, _ = p.w.Write(append(data, '\n'))
+}
+
+// Reader counts the bytes read from r.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+// Writer counts the bytes written to w.
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, p: p}
+}
+
+// WriterAt counts the bytes written to w.
+func (p *Progress) WriterAt(w io.WriterAt) io.WriterAt {
+	if p == nil {
+		return w
+	}
+	return &progressWriterAt{w: w, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.Add(int64(n))
+	return n, err
+}
+
+type progressWriterAt struct {
+	w io.WriterAt
+	p *Progress
+}
+
+func (w *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(b, off)
+	w.p.Add(int64(n))
+	return n, err
+}
+
+const progressKey contextKey = "progress"
+
+// WithProgress returns a context carrying the progress, which is updated by
+// the transfers made with it that have their own phases, e.g. ResumablePush.
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey, p)
+}
+
+// ProgressFromContext returns the progress carried by ctx, or nil if there
+// is none.
+func ProgressFromContext(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey).(*Progress)
+	return p
+}
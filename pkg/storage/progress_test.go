@@ -0,0 +1,173 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+// eventBuffer collects the lines written by the progress.
+type eventBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *eventBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// events parses the lines as NDJSON, each line is an event.
+func (b *eventBuffer) events(t *testing.T) []storage.ProgressEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []storage.ProgressEvent
+	for _, line := range strings.SplitAfter(b.buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		require.True(t, strings.HasSuffix(line, "\n"), "incomplete line %q", line)
+		var ev storage.ProgressEvent
+		require.NoError(t, json.Unmarshal([]byte(line), &ev), line)
+		events = append(events, ev)
+	}
+	return events
+}
+
+func phases(events []storage.ProgressEvent) []string {
+	var phases []string
+	for _, ev := range events {
+		phases = append(phases, ev.Phase)
+	}
+	return phases
+}
+
+func TestProgressEvents(t *testing.T) {
+	w := &eventBuffer{}
+	p := storage.NewProgress(w, "push", "a", time.Hour, storage.PhaseUploading, 100)
+	_, err := io.Copy(io.Discard, p.Reader(bytes.NewReader(make([]byte, 100))))
+	require.NoError(t, err)
+	p.SetPhase(storage.PhaseVerifying)
+	p.Finish(nil)
+	// ignored after the progress is finished
+	p.Add(10)
+	p.SetPhase(storage.PhaseJoining)
+	p.Finish(errors.New("late"))
+
+	events := w.events(t)
+	require.Equal(t, []string{storage.PhaseUploading, storage.PhaseVerifying, storage.PhaseCompleted}, phases(events))
+	for i, ev := range events {
+		require.Equal(t, "push", ev.Operation)
+		require.Equal(t, "a", ev.Path)
+		require.Equal(t, int64(100), ev.TotalBytes)
+		require.Empty(t, ev.Error)
+		if i > 0 {
+			require.False(t, ev.Time.Before(events[i-1].Time))
+			require.GreaterOrEqual(t, ev.ElapsedSeconds, events[i-1].ElapsedSeconds)
+		}
+	}
+	require.Zero(t, events[0].Bytes)
+	require.Nil(t, events[0].ETASeconds)
+	// the bytes and the average rate are kept after the transfer
+	for _, ev := range events[1:] {
+		require.Equal(t, int64(100), ev.Bytes)
+		require.Equal(t, 100.0, ev.Percent)
+		require.Positive(t, ev.Rate)
+		require.Nil(t, ev.ETASeconds)
+	}
+}
+
+func TestProgressFailed(t *testing.T) {
+	w := &eventBuffer{}
+	p := storage.NewProgress(w, "pull", "a", time.Hour, storage.PhaseDownloading, -1)
+	_, err := p.Writer(io.Discard).Write(make([]byte, 10))
+	require.NoError(t, err)
+	p.Finish(errors.New("connection reset"))
+
+	events := w.events(t)
+	require.Equal(t, []string{storage.PhaseDownloading, storage.PhaseFailed}, phases(events))
+	last := events[1]
+	require.Equal(t, "connection reset", last.Error)
+	require.Equal(t, int64(10), last.Bytes)
+
+	// the total, percent and ETA are omitted if the size is unknown
+	line := strings.Split(w.buf.String(), "\n")[1]
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal([]byte(line), &fields))
+	for _, key := range []string{"total_bytes", "percent", "eta_seconds"} {
+		require.NotContains(t, fields, key)
+	}
+}
+
+func TestProgressPeriodic(t *testing.T) {
+	w := &eventBuffer{}
+	p := storage.NewProgress(w, "push", "a", 10*time.Millisecond, storage.PhaseUploading, 1000)
+	p.Add(100)
+	require.Eventually(t, func() bool {
+		return len(w.events(t)) >= 3
+	}, time.Second, 5*time.Millisecond)
+	p.Finish(nil)
+
+	events := w.events(t)
+	require.Equal(t, storage.PhaseCompleted, events[len(events)-1].Phase)
+	periodic := events[1]
+	require.Equal(t, storage.PhaseUploading, periodic.Phase)
+	require.Equal(t, int64(100), periodic.Bytes)
+	require.Equal(t, 10.0, periodic.Percent)
+	require.Positive(t, periodic.Rate)
+	require.NotNil(t, periodic.ETASeconds)
+	require.Positive(t, *periodic.ETASeconds)
+	// no events after the progress is finished
+	n := len(events)
+	time.Sleep(30 * time.Millisecond)
+	require.Len(t, w.events(t), n)
+}
+
+func TestProgressNil(t *testing.T) {
+	var p *storage.Progress
+	p.StartPhase(storage.PhaseUploading, 0, 10)
+	p.Add(10)
+	p.SetPhase(storage.PhaseVerifying)
+	p.Finish(nil)
+	r := strings.NewReader("data")
+	require.Equal(t, io.Reader(r), p.Reader(r))
+	require.Nil(t, storage.ProgressFromContext(context.Background()))
+}
+
+func TestProgressResumablePush(t *testing.T) {
+	local := newLocalStorage(t)
+	f := writeLocalFile(t, randomContent(10000))
+	opts := storage.ResumablePushOptions{PartSize: 1000}
+	st := &partStorage{Storage: local, failPart: "part-00000003"}
+	require.Error(t, storage.ResumablePush(context.Background(), st, f, "a", opts))
+
+	// the resumed push starts from the bytes pushed before, and joins the parts
+	w := &eventBuffer{}
+	p := storage.NewProgress(w, "push", "a", time.Hour, storage.PhaseUploading, 10000)
+	ctx := storage.WithProgress(context.Background(), p)
+	require.NoError(t, storage.ResumablePush(ctx, local, f, "a", opts))
+	p.Finish(nil)
+
+	events := w.events(t)
+	require.Equal(t, []string{
+		storage.PhaseUploading, storage.PhaseUploading, storage.PhaseJoining, storage.PhaseCompleted,
+	}, phases(events))
+	require.Equal(t, int64(3000), events[1].Bytes)
+	require.Equal(t, int64(10000), events[1].TotalBytes)
+	// the parts are joined by reading them again
+	require.Zero(t, events[2].Bytes)
+	require.Equal(t, int64(10000), events[2].TotalBytes)
+	require.Equal(t, int64(10000), events[3].Bytes)
+	require.Equal(t, 100.0, events[3].Percent)
+}
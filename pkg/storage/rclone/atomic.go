@@ -0,0 +1,116 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+// atomicPush uploads the content to a temporary object in the same
+// directory, verifies its size and hash (only the size if the backend has no
+// hash of the object, see verifyTempObject), and then renames it to rpath,
+// so a crashed push never leaves a truncated object at rpath. If cond is not
+// nil, the temporary object is copied to rpath with the conditional header
+// on S3 if conditional writes are enabled, which is atomic. Otherwise, the
+// condition is checked again before renaming, If-Match is only supported on
+// S3.
+func (s *rcloneStorage) atomicPush(ctx context.Context, r io.Reader, rpath string, cond *fs.HTTPOption) error {
+	tmp, err := storage.TempObjectPath(rpath)
+	if err != nil {
+		return err
+	}
+	ht := s.f.Hashes().GetOne()
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(ht))
+	if err != nil {
+		return err
+	}
+	size := regularFileSize(r)
+	if err := s.upload(ctx, io.TeeReader(r, hasher), size, tmp); err != nil {
+		s.removeTempObject(ctx, tmp)
+		return err
+	}
+	tmpObj, err := s.f.NewObject(ctx, tmp)
+	if err != nil {
+		return fmt.Errorf("find temporary object %q: %w", tmp, err)
+	}
+	if err := verifyTempObject(ctx, tmpObj, hasher, ht); err != nil {
+		s.removeTempObject(ctx, tmp)
+		return err
+	}
+
+	if cond != nil && s.conditionalWrites && s.s3 != nil {
+		log(ctx).Infof("[RCLONE] Copy temporary object %s to %s with %s: %s", tmp, rpath, cond.Key, cond.Value)
+		err := s.s3.copy(ctx, s.f, tmpObj, rpath, cond)
+		s.removeTempObject(ctx, tmp)
+		if conditionFailed(err, cond) {
+			return conditionError(err, rpath, cond)
+		}
+		return err
+	}
+	if cond != nil && strings.EqualFold(cond.Key, "If-Match") {
+		if err := s.checkETag(ctx, rpath, cond); err != nil {
+			s.removeTempObject(ctx, tmp)
+			return err
+		}
+	}
+	dstObj, err := s.f.NewObject(ctx, rpath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			s.removeTempObject(ctx, tmp)
+			return err
+		}
+		dstObj = nil
+	} else if cond != nil && strings.EqualFold(cond.Key, "If-None-Match") {
+		s.removeTempObject(ctx, tmp)
+		return fmt.Errorf("%w: %q is created by another writer", storage.ErrPreconditionFailed, rpath)
+	}
+	log(ctx).Infof("[RCLONE] Rename temporary object %s to %s", tmp, rpath)
+	if err := s.transfer(ctx, dstObj, rpath, tmpObj, true); err != nil {
+		s.removeTempObject(ctx, tmp)
+		return err
+	}
+	return nil
+}
+
+// verifyTempObject checks the size and the hash of the uploaded object
+// against the content read by hasher. Some objects have no hash, e.g. the
+// objects uploaded in multipart on S3, whose ETags are not MD5 digests, and
+// then only the size is checked.
+func verifyTempObject(ctx context.Context, obj fs.Object, hasher *hash.MultiHasher, ht hash.Type) error {
+	if obj.Size() != hasher.Size() {
+		return fmt.Errorf("size mismatch of %q, uploaded %d bytes, got %d", obj.Remote(), hasher.Size(), obj.Size())
+	}
+	if ht == hash.None {
+		log(ctx).Debugf("[RCLONE] The backend has no hash, only the size of %s is verified", obj.Remote())
+		return nil
+	}
+	remote, err := obj.Hash(ctx, ht)
+	if err != nil {
+		return fmt.Errorf("read %s hash of %q: %w", ht, obj.Remote(), err)
+	}
+	if remote == "" {
+		log(ctx).Infof("[RCLONE] %s has no %s hash, only its size is verified", obj.Remote(), ht)
+		return nil
+	}
+	if local, _ := hasher.SumString(ht, false); local != remote {
+		return fmt.Errorf("%w: %q has %s %s, uploaded %s", storage.ErrChecksumMismatch, obj.Remote(), ht, remote, local)
+	}
+	return nil
+}
+
+func (s *rcloneStorage) removeTempObject(ctx context.Context, tmp string) {
+	obj, err := s.f.NewObject(ctx, tmp)
+	if err == nil {
+		err = obj.Remove(ctx)
+	}
+	if err != nil && !errors.Is(err, fs.ErrorObjectNotFound) {
+		log(ctx).Warnf("[RCLONE] failed to remove temporary object %q: %v", tmp, err)
+	}
+}
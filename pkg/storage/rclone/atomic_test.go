@@ -0,0 +1,120 @@
+package rclone_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+// listAll returns the paths of all files, including the temporary objects.
+func listAll(t *testing.T, st storage.Storage) []string {
+	var paths []string
+	opt := &storage.ListOptions{FilesOnly: true, Recursive: true, ShowTemp: true}
+	require.NoError(t, st.List(context.Background(), "/", opt, func(de storage.DirEntry) error {
+		paths = append(paths, de.Path())
+		return nil
+	}))
+	return paths
+}
+
+func TestAtomicPush(t *testing.T) {
+	ctx := context.Background()
+	st := newStorage(t, ctx, map[string]string{"type": "local", rclone.AtomicPushKey: "true"})
+	require.NoError(t, st.Push(ctx, strings.NewReader("old"), "dir/a"))
+	require.Equal(t, "old", pull(t, st, "dir/a"))
+	require.Equal(t, []string{"dir/a"}, listAll(t, st))
+
+	// a failed push leaves neither a truncated file nor the temporary object
+	r := io.MultiReader(strings.NewReader("new content"), failingReader{})
+	require.ErrorContains(t, st.Push(ctx, r, "dir/a"), "connection reset")
+	require.Equal(t, "old", pull(t, st, "dir/a"))
+	require.Equal(t, []string{"dir/a"}, listAll(t, st))
+
+	require.NoError(t, st.Push(ctx, strings.NewReader("new"), "dir/a"))
+	require.Equal(t, "new", pull(t, st, "dir/a"))
+
+	// the temporary object is removed if the file is created meanwhile
+	err := storage.PushIfNotExists(ctx, st, strings.NewReader("other"), "dir/a")
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+	require.Equal(t, "new", pull(t, st, "dir/a"))
+	require.Equal(t, []string{"dir/a"}, listAll(t, st))
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestAtomicPushVerify(t *testing.T) {
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.AtomicPushKey] = "true"
+	st := newStorage(t, context.Background(), cfg)
+	srv.PutObject("dir/a", []byte("old"))
+
+	for _, tc := range []struct {
+		name    string
+		changed string
+		err     error
+		msg     string
+	}{
+		{name: "hash mismatch", changed: "HELLO", err: storage.ErrChecksumMismatch},
+		{name: "size mismatch", changed: "hello world", msg: "size mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the temporary object is changed after it's uploaded
+			srv.BeforeRequest(func(name, key string) {
+				if name == "HeadObject" && strings.Contains(key, storage.TempObjectPrefix) {
+					srv.PutObject(key, []byte(tc.changed))
+				}
+			})
+			defer srv.BeforeRequest(nil)
+			err := st.Push(context.Background(), strings.NewReader("hello"), "a")
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+			} else {
+				require.ErrorContains(t, err, tc.msg)
+			}
+			data, _ := srv.Object("dir/a")
+			require.Equal(t, "old", string(data))
+			require.Equal(t, []string{"a"}, listAll(t, st))
+		})
+	}
+}
+
+func TestAtomicPushMultipart(t *testing.T) {
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.AtomicPushKey] = "true"
+	st := newStorage(t, context.Background(), cfg)
+	ctx := storage.WithUploadOptions(context.Background(), storage.UploadOptions{PartSize: 5 * mib})
+
+	// the object uploaded in multipart has no MD5 hash, only its size is
+	// verified
+	content := randomContent(12 * mib)
+	require.NoError(t, st.Push(ctx, stream(content), "a"))
+	require.Equal(t, 1, srv.Count("CompleteMultipartUpload"))
+	data, ok := srv.Object("dir/a")
+	require.True(t, ok)
+	require.True(t, bytes.Equal(content, data))
+	require.Equal(t, []string{"a"}, listAll(t, st))
+
+	srv.BeforeRequest(func(name, key string) {
+		if name == "HeadObject" && strings.Contains(key, storage.TempObjectPrefix) {
+			srv.PutObject(key, content[:len(content)-1])
+		}
+	})
+	err := st.Push(ctx, stream(randomContent(11*mib)), "a")
+	require.ErrorContains(t, err, "size mismatch")
+	require.Equal(t, []string{"a"}, listAll(t, st))
+}
@@ -0,0 +1,176 @@
+package rclone_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+func TestPushIfMatch(t *testing.T) {
+	for _, atomic := range []string{"false", "true"} {
+		t.Run("atomic="+atomic, func(t *testing.T) {
+			ctx := context.Background()
+			srv := s3test.NewServer(t)
+			cfg := srv.Config("dir")
+			cfg[rclone.AtomicPushKey] = atomic
+			cfg[rclone.ConditionalWritesKey] = "true"
+			st := newStorage(t, ctx, cfg)
+
+			err := storage.PushIfMatch(ctx, st, strings.NewReader("v1"), "a", "0123")
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			require.ErrorContains(t, err, "doesn't exist")
+			_, err = storage.FileETag(ctx, st, "a")
+			require.ErrorIs(t, err, storage.ErrObjectNotFound)
+
+			require.NoError(t, st.Push(ctx, strings.NewReader("v1"), "a"))
+			etag, err := storage.FileETag(ctx, st, "a")
+			require.NoError(t, err)
+			require.NotContains(t, etag, `"`)
+			require.NoError(t, storage.PushIfMatch(ctx, st, strings.NewReader("v2"), "a", etag))
+			require.Equal(t, "v2", pull(t, st, "a"))
+
+			// the etag is changed by the push
+			err = storage.PushIfMatch(ctx, st, strings.NewReader("v3"), "a", etag)
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			require.Equal(t, "v2", pull(t, st, "a"))
+
+			// another writer changes the file after it's checked
+			etag, err = storage.FileETag(ctx, st, "a")
+			require.NoError(t, err)
+			srv.BeforeRequest(func(name, key string) {
+				if key == "dir/a" && (name == "PutObject" || name == "CopyObject") {
+					srv.PutObject(key, []byte("other"))
+				}
+			})
+			defer srv.BeforeRequest(nil)
+			err = storage.PushIfMatch(ctx, st, strings.NewReader("v3"), "a", etag)
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			require.Equal(t, "other", pull(t, st, "a"))
+			require.Equal(t, []string{"a"}, listAll(t, st))
+		})
+	}
+}
+
+func TestPushIfNotExistsAtomic(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.AtomicPushKey] = "true"
+	cfg[rclone.ConditionalWritesKey] = "true"
+	st := newStorage(t, ctx, cfg)
+
+	// the temporary object is copied with If-None-Match
+	require.NoError(t, storage.PushIfNotExists(ctx, st, strings.NewReader("v1"), "a"))
+	require.Equal(t, "v1", pull(t, st, "a"))
+	require.Equal(t, 1, srv.Count("CopyObject"))
+
+	// another writer creates the file after the temporary object is uploaded
+	srv.BeforeRequest(func(name, key string) {
+		if name == "CopyObject" && key == "dir/b" {
+			srv.PutObject(key, []byte("other"))
+		}
+	})
+	defer srv.BeforeRequest(nil)
+	err := storage.PushIfNotExists(ctx, st, strings.NewReader("v1"), "b")
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+	require.Equal(t, "other", pull(t, st, "b"))
+	require.ElementsMatch(t, []string{"a", "b"}, listAll(t, st))
+}
+
+func TestPushIfMatchCopyInParts(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.AtomicPushKey] = "true"
+	cfg[rclone.ConditionalWritesKey] = "true"
+	cfg["copy_cutoff"] = "5M"
+	st := newStorage(t, ctx, cfg)
+	require.NoError(t, st.Push(ctx, strings.NewReader("v1"), "a"))
+	etag, err := storage.FileETag(ctx, st, "a")
+	require.NoError(t, err)
+
+	// the temporary object larger than the copy cutoff is copied in parts
+	content := randomContent(12 * mib)
+	require.NoError(t, storage.PushIfMatch(ctx, st, bytes.NewReader(content), "a", etag))
+	require.Equal(t, 3, srv.Count("UploadPartCopy"))
+	// one for the upload of the temporary object, one for the copy
+	require.Equal(t, 2, srv.Count("CompleteMultipartUpload"))
+	data, ok := srv.Object("dir/a")
+	require.True(t, ok)
+	require.True(t, bytes.Equal(content, data))
+	require.Equal(t, []string{"a"}, listAll(t, st))
+
+	err = storage.PushIfMatch(ctx, st, bytes.NewReader(content), "a", etag)
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+	require.Zero(t, srv.Uploads())
+	require.Equal(t, []string{"a"}, listAll(t, st))
+}
+
+func TestCheckThenWrite(t *testing.T) {
+	for _, atomic := range []string{"false", "true"} {
+		t.Run("atomic="+atomic, func(t *testing.T) {
+			ctx := context.Background()
+			srv := s3test.NewServer(t)
+			cfg := srv.Config("dir")
+			cfg[rclone.AtomicPushKey] = atomic
+			st := newStorage(t, ctx, cfg)
+			// the headers are not sent by default, since the provider may
+			// ignore them
+			require.False(t, storage.AtomicConditions(st))
+
+			require.NoError(t, storage.PushIfNotExists(ctx, st, strings.NewReader("v1"), "a"))
+			err := storage.PushIfNotExists(ctx, st, strings.NewReader("v2"), "a")
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			etag, err := storage.FileETag(ctx, st, "a")
+			require.NoError(t, err)
+			err = storage.PushIfMatch(ctx, st, strings.NewReader("v2"), "b", etag)
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			require.ErrorContains(t, err, "doesn't exist")
+			require.NoError(t, storage.PushIfMatch(ctx, st, strings.NewReader("v2"), "a", etag))
+			err = storage.PushIfMatch(ctx, st, strings.NewReader("v3"), "a", etag)
+			require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+			require.Equal(t, "v2", pull(t, st, "a"))
+
+			// the conditions are only checked before writing, so the change
+			// of another writer after the check is overwritten
+			etag, err = storage.FileETag(ctx, st, "a")
+			require.NoError(t, err)
+			srv.BeforeRequest(func(name, key string) {
+				if key == "dir/a" && (name == "PutObject" || name == "CopyObject") {
+					srv.PutObject(key, []byte("other"))
+				}
+			})
+			defer srv.BeforeRequest(nil)
+			require.NoError(t, storage.PushIfMatch(ctx, st, strings.NewReader("v3"), "a", etag))
+			require.Equal(t, "v3", pull(t, st, "a"))
+		})
+	}
+}
+
+func TestConditionalWritesUnsupported(t *testing.T) {
+	ctx := context.Background()
+	_, err := rclone.New(ctx, map[string]string{
+		"type": "local", "root": t.TempDir(), rclone.ConditionalWritesKey: "true",
+	}, "")
+	require.ErrorContains(t, err, "only supported by s3")
+	st := newStorage(t, ctx, map[string]string{"type": "local", rclone.ConditionalWritesKey: "false"})
+	require.False(t, storage.AtomicConditions(st))
+}
+
+func TestETagUnsupported(t *testing.T) {
+	ctx := context.Background()
+	st := newStorage(t, ctx, map[string]string{"type": "local"})
+	require.NoError(t, st.Push(ctx, strings.NewReader("v1"), "a"))
+	_, err := storage.FileETag(ctx, st, "a")
+	require.ErrorIs(t, err, storage.ErrETagUnsupported)
+	err = storage.PushIfMatch(ctx, st, strings.NewReader("v2"), "a", "0123")
+	require.ErrorIs(t, err, storage.ErrETagUnsupported)
+	require.Equal(t, "v1", pull(t, st, "a"))
+}
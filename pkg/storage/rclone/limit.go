@@ -0,0 +1,182 @@
+package rclone
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// BwLimitKey is the bandwidth limit of uploads and downloads, e.g. "10M",
+	// "10M:100M" (upload:download), or a timetable like "08:00,10M 19:00,off"
+	// to limit the bandwidth in business hours, as the --bwlimit of rclone.
+	BwLimitKey = "bwlimit"
+	// TPSLimitKey is the max number of HTTP requests per second.
+	TPSLimitKey = "tpslimit"
+	// TPSLimitBurstKey is the max burst of HTTP requests.
+	TPSLimitBurstKey = "tpslimit_burst"
+
+	minLimiterBurst = 32 << 10
+)
+
+// parseLimits starts the limiter of HTTP requests, and returns the limiter of
+// bandwidth, which is nil if the bandwidth is not limited. The keys are
+// removed from cfg.
+func parseLimits(ctx context.Context, cfg map[string]string) (*bandwidthLimiter, error) {
+	defer func() {
+		delete(cfg, BwLimitKey)
+		delete(cfg, TPSLimitKey)
+		delete(cfg, TPSLimitBurstKey)
+	}()
+	var limiter *bandwidthLimiter
+	if v := strings.TrimSpace(cfg[BwLimitKey]); v != "" {
+		var timetable fs.BwTimetable
+		if err := timetable.Set(v); err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", BwLimitKey, err)
+		}
+		limiter = &bandwidthLimiter{timetable: timetable}
+	}
+	if v := strings.TrimSpace(cfg[TPSLimitKey]); v != "" {
+		tps, err := strconv.ParseFloat(v, 64)
+		if err != nil || tps < 0 {
+			return nil, fmt.Errorf("invalid value of %s %q", TPSLimitKey, v)
+		}
+		burst := 1
+		if v := strings.TrimSpace(cfg[TPSLimitBurstKey]); v != "" {
+			if burst, err = strconv.Atoi(v); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid value of %s %q", TPSLimitBurstKey, v)
+			}
+		}
+		// the limiter is global, and applied to the HTTP transport of rclone
+		ctx, ci := fs.AddConfig(ctx)
+		ci.TPSLimit = tps
+		ci.TPSLimitBurst = burst
+		accounting.StartLimitTPS(ctx)
+	}
+	return limiter, nil
+}
+
+// bandwidthLimiter limits the total bandwidth of the transfers by the
+// timetable, the limit is switched when the time slot changes.
+type bandwidthLimiter struct {
+	timetable fs.BwTimetable
+
+	mu     sync.Mutex
+	slot   *fs.BwTimeSlot
+	tx, rx *rate.Limiter
+}
+
+// limiter returns the limiter of uploads or downloads at the time, or nil
+// if it's unlimited.
+func (l *bandwidthLimiter) limiter(ctx context.Context, upload bool) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot := l.timetable.LimitAt(time.Now())
+	if l.slot == nil || slot.DayOfTheWeek != l.slot.DayOfTheWeek || slot.HHMM != l.slot.HHMM {
+		l.slot = &slot
+		l.tx = newBandwidthRateLimiter(slot.Bandwidth.Tx)
+		l.rx = newBandwidthRateLimiter(slot.Bandwidth.Rx)
+		log(ctx).Infof("[RCLONE] bandwidth limit: %s", slot.Bandwidth.String())
+	}
+	if upload {
+		return l.tx
+	}
+	return l.rx
+}
+
+func newBandwidthRateLimiter(bandwidth fs.SizeSuffix) *rate.Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bandwidth), max(int(bandwidth), minLimiterBurst))
+}
+
+// reader limits the bandwidth of reading from r.
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.Reader, upload bool) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l, upload: upload}
+}
+
+// readCloser limits the bandwidth of reading from rc.
+func (l *bandwidthLimiter) readCloser(ctx context.Context, rc io.ReadCloser, upload bool) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{l.reader(ctx, rc, upload), rc}
+}
+
+type limitedReader struct {
+	ctx    context.Context
+	r      io.Reader
+	l      *bandwidthLimiter
+	upload bool
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	lim := r.l.limiter(r.ctx, r.upload)
+	if lim == nil {
+		return r.r.Read(p)
+	}
+	if len(p) > lim.Burst() {
+		p = p[:lim.Burst()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := lim.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// transfer copies or moves srcObj to remote, dstObj is the existing object at
+// remote or nil. The server-side copy or move is used if the backend supports
+// it, otherwise the content is streamed by transfer itself instead of
+// operations.Copy(), so that the bandwidth limits of both the download and the
+// upload are applied.
+func (s *rcloneStorage) transfer(ctx context.Context, dstObj fs.Object, remote string, srcObj fs.Object, move bool) error {
+	features := s.f.Features()
+	if s.bwLimiter == nil || features.Copy != nil || (move && features.Move != nil) {
+		var err error
+		if move {
+			_, err = operations.Move(ctx, s.f, dstObj, remote, srcObj)
+		} else {
+			_, err = operations.Copy(ctx, s.f, dstObj, remote, srcObj)
+		}
+		return err
+	}
+	rc, err := srcObj.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	info := object.NewStaticObjectInfo(remote, srcObj.ModTime(ctx), srcObj.Size(), true, nil, s.f)
+	r := s.bwLimiter.reader(ctx, s.bwLimiter.reader(ctx, rc, false), true)
+	if dstObj != nil {
+		err = dstObj.Update(ctx, r, info)
+	} else {
+		_, err = s.f.Put(ctx, r, info)
+	}
+	if err != nil {
+		return err
+	}
+	if move {
+		return srcObj.Remove(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package rclone_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func TestParseLimits(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{key: rclone.BwLimitKey, value: "10M", valid: true},
+		{key: rclone.BwLimitKey, value: "10M:off", valid: true},
+		{key: rclone.BwLimitKey, value: "08:00,10M 19:00,off", valid: true},
+		{key: rclone.BwLimitKey, value: "Mon-08:00,10M:100M Sat-00:00,off", valid: true},
+		{key: rclone.BwLimitKey, value: "10X"},
+		{key: rclone.BwLimitKey, value: "08:00,10M 25:00,off"},
+		{key: rclone.BwLimitKey, value: "08:00,10Z 19:00,off"},
+		{key: rclone.TPSLimitKey, value: "10", valid: true},
+		{key: rclone.TPSLimitKey, value: "-1"},
+		{key: rclone.TPSLimitKey, value: "x"},
+		{key: rclone.TPSLimitBurstKey, value: "0"},
+	} {
+		cfg := map[string]string{"type": "memory", "root": "limits", tc.key: tc.value}
+		if tc.key == rclone.TPSLimitBurstKey {
+			cfg[rclone.TPSLimitKey] = "10"
+		}
+		_, err := rclone.New(ctx, cfg, "")
+		if tc.valid {
+			require.NoError(t, err, "%s=%s", tc.key, tc.value)
+		} else {
+			require.ErrorContains(t, err, tc.key, "%s=%s", tc.key, tc.value)
+		}
+	}
+}
+
+// elapsed returns the duration of fn.
+func elapsed(t *testing.T, fn func() error) time.Duration {
+	start := time.Now()
+	require.NoError(t, fn())
+	return time.Since(start)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	ctx := context.Background()
+	// the burst is as large as the limit per second, so transferring 512KiB
+	// at 256KiB/s takes about 1s
+	st := newStorage(t, ctx, map[string]string{"type": "local", rclone.BwLimitKey: "00:00,256K:off 12:00,256K:off"})
+	content := randomContent(mib / 2)
+	require.Greater(t, elapsed(t, func() error {
+		return st.Push(ctx, bytes.NewReader(content), "a")
+	}), 700*time.Millisecond)
+	require.Less(t, elapsed(t, func() error {
+		return st.Pull(ctx, "a", io.Discard)
+	}), 500*time.Millisecond)
+
+	// the local backend has no server-side copy, the streamed copy is limited
+	require.Greater(t, elapsed(t, func() error {
+		return st.Copy(ctx, "a", "b")
+	}), 700*time.Millisecond)
+	require.Equal(t, string(content), pull(t, st, "b"))
+	// the server-side move isn't limited
+	require.Less(t, elapsed(t, func() error {
+		return st.Move(ctx, "b", "c")
+	}), 500*time.Millisecond)
+
+	st = newStorage(t, ctx, map[string]string{"type": "local", rclone.BwLimitKey: "off:256K"})
+	require.NoError(t, st.Push(ctx, bytes.NewReader(content), "a"))
+	require.Greater(t, elapsed(t, func() error {
+		return st.Pull(ctx, "a", io.Discard)
+	}), 700*time.Millisecond)
+	require.Greater(t, elapsed(t, func() error {
+		rc, err := st.OpenFile(ctx, "a", 0, -1)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	}), 700*time.Millisecond)
+}
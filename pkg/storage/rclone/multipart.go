@@ -0,0 +1,131 @@
+package rclone
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/lib/multipart"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+// maxUploadParts is the max number of parts of a multipart upload of
+// most object storages, e.g. S3.
+const maxUploadParts = 10000
+
+// minPartSizes are the minimum part sizes of multipart uploads by the backend
+// types, all parts except the last one have to be at least that large.
+var minPartSizes = map[string]int64{
+	"s3": 5 * int64(fs.Mebi),
+}
+
+// parseUploadOptions parses and removes the upload options from cfg.
+func parseUploadOptions(cfg map[string]string) (storage.UploadOptions, error) {
+	var opts storage.UploadOptions
+	parseSize := func(key string) (int64, error) {
+		v := strings.TrimSpace(cfg[key])
+		delete(cfg, key)
+		if v == "" {
+			return 0, nil
+		}
+		var size fs.SizeSuffix
+		if err := size.Set(v); err != nil {
+			return 0, fmt.Errorf("invalid value of %s: %w", key, err)
+		}
+		return int64(size), nil
+	}
+	var err error
+	if opts.PartSize, err = parseSize(UploadPartSizeKey); err != nil {
+		return opts, err
+	}
+	if opts.MemoryLimit, err = parseSize(UploadMemoryLimitKey); err != nil {
+		return opts, err
+	}
+	if v := strings.TrimSpace(cfg[UploadConcurrencyKey]); v != "" {
+		if opts.Concurrency, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("invalid value of %s: %w", UploadConcurrencyKey, err)
+		}
+	}
+	delete(cfg, UploadConcurrencyKey)
+	return opts, nil
+}
+
+// MinPartSize returns the minimum part size of multipart uploads of the
+// backend, 0 if there is no limit.
+func (s *rcloneStorage) MinPartSize() int64 {
+	return s.minPartSize
+}
+
+// multipartUpload uploads the stream in parts concurrently, each part is
+// buffered in memory, so the content is never spooled to a temporary file.
+func (s *rcloneStorage) multipartUpload(ctx context.Context, r io.Reader, rpath string, options ...fs.OpenOption) error {
+	opts := s.uploadOpts.Merge(storage.UploadOptionsFromContext(ctx))
+	if err := storage.CheckPartSize(s, opts.PartSize); err != nil {
+		return err
+	}
+	// upload small streams with a single request
+	buf := make([]byte, fs.GetConfig(ctx).StreamingUploadCutoff)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return s.put(ctx, bytes.NewReader(buf[:n]), int64(n), rpath, options...)
+	} else if err != nil {
+		return err
+	}
+	opener := &chunkWriterOpener{
+		open: s.f.Features().OpenChunkWriter,
+		opts: opts,
+	}
+	src := object.NewStaticObjectInfo(rpath, time.Now(), -1, true, nil, s.f)
+	_, err = multipart.UploadMultipart(ctx, src, io.MultiReader(bytes.NewReader(buf), r), multipart.UploadMultipartOptions{
+		Open:        opener,
+		OpenOptions: options,
+	})
+	return err
+}
+
+// chunkWriterOpener overrides the part size and the concurrency of the
+// chunk writers opened by the backend.
+type chunkWriterOpener struct {
+	open fs.OpenChunkWriterFn
+	opts storage.UploadOptions
+}
+
+var _ fs.OpenChunkWriter = (*chunkWriterOpener)(nil)
+
+func (o *chunkWriterOpener) OpenChunkWriter(ctx context.Context, remote string, src fs.ObjectInfo, options ...fs.OpenOption) (fs.ChunkWriterInfo, fs.ChunkWriter, error) {
+	info, w, err := o.open(ctx, remote, src, options...)
+	if err != nil {
+		return info, w, err
+	}
+	if o.opts.PartSize > 0 {
+		info.ChunkSize = o.opts.PartSize
+	}
+	if o.opts.ExpectedSize > 0 {
+		// leave a quarter of headroom, since the size is only a hint
+		minSize := o.opts.ExpectedSize / maxUploadParts * 5 / 4
+		minSize = (minSize + int64(fs.Mebi) - 1) / int64(fs.Mebi) * int64(fs.Mebi)
+		if info.ChunkSize < minSize {
+			info.ChunkSize = minSize
+		}
+	}
+	if o.opts.Concurrency > 0 {
+		info.Concurrency = o.opts.Concurrency
+	}
+	if o.opts.MemoryLimit > 0 && info.ChunkSize > 0 {
+		limit := int(max(o.opts.MemoryLimit/info.ChunkSize, 1))
+		if info.Concurrency > limit {
+			info.Concurrency = limit
+		}
+	}
+	log(ctx).Infof("[RCLONE] Multipart upload %s with part size %v and concurrency %d",
+		remote, fs.SizeSuffix(info.ChunkSize), info.Concurrency)
+	return info, w, nil
+}
@@ -0,0 +1,105 @@
+package rclone_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+const mib = 1 << 20
+
+// stream hides the type of the reader, so the size is unknown to Push.
+func stream(data []byte) io.Reader {
+	return io.MultiReader(bytes.NewReader(data))
+}
+
+func randomContent(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := s3test.NewServer(t)
+	st := newStorage(t, context.Background(), srv.Config("dir"))
+	ctx := storage.WithUploadOptions(context.Background(), storage.UploadOptions{
+		PartSize:    5 * mib,
+		Concurrency: 2,
+	})
+
+	content := randomContent(12 * mib)
+	require.NoError(t, st.Push(ctx, stream(content), "big"))
+	data, ok := srv.Object("dir/big")
+	require.True(t, ok)
+	require.True(t, bytes.Equal(content, data))
+	require.Equal(t, 1, srv.Count("CreateMultipartUpload"))
+	require.Equal(t, 3, srv.Count("UploadPart"))
+	require.Equal(t, 1, srv.Count("CompleteMultipartUpload"))
+	require.Zero(t, srv.Uploads())
+
+	// small streams are uploaded with a single request
+	require.NoError(t, st.Push(ctx, stream([]byte("hello")), "small"))
+	require.Equal(t, 1, srv.Count("CreateMultipartUpload"))
+	require.Equal(t, 1, srv.Count("PutObject"))
+	require.Equal(t, "hello", pull(t, st, "small"))
+}
+
+func TestMultipartUploadFallback(t *testing.T) {
+	content := randomContent(3 * mib)
+	for _, tc := range []struct {
+		name    string
+		cfg     map[string]string
+		disable []string
+	}{
+		{name: "memory", cfg: map[string]string{"type": "memory"}},
+		{name: "local", cfg: map[string]string{"type": "local"}},
+		{name: "s3 without chunk writer", disable: []string{"OpenChunkWriter"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if len(tc.disable) > 0 {
+				ctx = withoutFeatures(ctx, tc.disable...)
+			}
+			if tc.cfg == nil {
+				tc.cfg = s3test.NewServer(t).Config("dir")
+			}
+			st := newStorage(t, ctx, tc.cfg)
+			ctx = storage.WithUploadOptions(ctx, storage.UploadOptions{PartSize: 5 * mib})
+			require.NoError(t, st.Push(ctx, stream(content), "a"))
+			require.True(t, bytes.Equal(content, []byte(pull(t, st, "a"))))
+		})
+	}
+}
+
+func TestMinPartSize(t *testing.T) {
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.UploadPartSizeKey] = "1M"
+	_, err := rclone.New(context.Background(), cfg, "")
+	require.ErrorContains(t, err, "less than the minimum part size")
+
+	st := newStorage(t, context.Background(), srv.Config("dir"))
+	require.Error(t, storage.CheckPartSize(st, mib))
+	require.NoError(t, storage.CheckPartSize(st, 5*mib))
+	require.NoError(t, storage.CheckPartSize(st, 0))
+
+	// the part size is checked before reading the stream
+	ctx := storage.WithUploadOptions(context.Background(), storage.UploadOptions{PartSize: mib})
+	r := bytes.NewReader(randomContent(mib))
+	err = st.Push(ctx, io.MultiReader(r), "a")
+	require.ErrorContains(t, err, "less than the minimum part size")
+	require.EqualValues(t, mib, r.Len())
+	require.Zero(t, srv.Count("CreateMultipartUpload"))
+
+	// other backends have no limit
+	local := newStorage(t, context.Background(), map[string]string{"type": "local"})
+	require.NoError(t, storage.CheckPartSize(local, 1))
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	_ "github.com/rclone/rclone/backend/all"
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/object"
 	"github.com/rclone/rclone/fs/operations"
 
 	"github.com/apecloud/datasafed/pkg/logging"
@@ -25,12 +27,38 @@ import (
 const (
 	remoteName = "backend"
 	rootKey    = "root"
+
+	// options of datasafed, they are not passed to rclone
+	UploadPartSizeKey    = "datasafed.upload_part_size"
+	UploadConcurrencyKey = "datasafed.upload_concurrency"
+	UploadMemoryLimitKey = "datasafed.upload_memory_limit"
+	AtomicPushKey        = "datasafed.atomic_push"
+
+	// ConditionalWritesKey enables the conditional headers of writes on s3,
+	// i.e. If-None-Match and If-Match, which make conditional pushes atomic.
+	// It's enabled by default only for AWS, since other providers may ignore
+	// the headers. If it's disabled, the conditions are checked before
+	// writing.
+	ConditionalWritesKey = "conditional_writes"
 )
 
 var log = logging.Module("storage/rclone")
 
 type rcloneStorage struct {
-	f fs.Fs
+	f          fs.Fs
+	uploadOpts storage.UploadOptions
+	// minPartSize is the minimum part size of multipart uploads, 0 if there
+	// is no limit
+	minPartSize int64
+	// atomic makes pushes upload to temporary objects first
+	atomic bool
+	// conditionalWrites is true if the backend honours the If-None-Match and
+	// If-Match headers of writes
+	conditionalWrites bool
+	// bwLimiter is nil if the bandwidth is not limited
+	bwLimiter *bandwidthLimiter
+	// s3 is nil if the backend isn't s3
+	s3 *s3Conn
 }
 
 var _ storage.Storage = (*rcloneStorage)(nil)
@@ -43,6 +71,30 @@ func New(ctx context.Context, cfg map[string]string, basePath string) (storage.S
 		ci.InsecureSkipVerify = true
 		delete(cfg, "no_check_certificate")
 	}
+	upload, err := parseUploadOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	minPartSize := minPartSizes[cfg["type"]]
+	if upload.PartSize > 0 && upload.PartSize < minPartSize {
+		return nil, fmt.Errorf("invalid value of %s: %v is less than the minimum part size %v of %s",
+			UploadPartSizeKey, fs.SizeSuffix(upload.PartSize), fs.SizeSuffix(minPartSize), cfg["type"])
+	}
+	var atomic bool
+	if v := strings.TrimSpace(cfg[AtomicPushKey]); v != "" {
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", AtomicPushKey, err)
+		}
+	}
+	delete(cfg, AtomicPushKey)
+	conditionalWrites, err := parseConditionalWrites(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bwLimiter, err := parseLimits(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	rcloneCfg := config.Data()
 	for k, v := range cfg {
@@ -54,11 +106,40 @@ func New(ctx context.Context, cfg map[string]string, basePath string) (storage.S
 		return nil, err
 	}
 	s := &rcloneStorage{
-		f: f,
+		f:                 f,
+		uploadOpts:        upload,
+		minPartSize:       minPartSize,
+		atomic:            atomic,
+		conditionalWrites: conditionalWrites,
+		bwLimiter:         bwLimiter,
+		s3:                newS3Conn(ctx, f),
 	}
 	return sanitized.New(ctx, basePath, s)
 }
 
+// ConditionalWrites returns true if the conditional headers are sent, so the
+// conditions are checked atomically by the backend.
+func (s *rcloneStorage) ConditionalWrites() bool {
+	return s.conditionalWrites
+}
+
+// parseConditionalWrites returns whether the conditional headers are sent,
+// the key is removed from cfg.
+func parseConditionalWrites(cfg map[string]string) (bool, error) {
+	defer delete(cfg, ConditionalWritesKey)
+	enabled := cfg["type"] == "s3" && cfg["provider"] == "AWS"
+	if v := strings.TrimSpace(cfg[ConditionalWritesKey]); v != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(v); err != nil {
+			return false, fmt.Errorf("invalid value of %s: %w", ConditionalWritesKey, err)
+		}
+		if enabled && cfg["type"] != "s3" {
+			return false, fmt.Errorf("%s is only supported by s3", ConditionalWritesKey)
+		}
+	}
+	return enabled, nil
+}
+
 func (s *rcloneStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
 	rpath = normalizeRemotePath(rpath)
 	// check if rpath is a directory
@@ -66,23 +147,166 @@ func (s *rcloneStorage) Push(ctx context.Context, r io.Reader, rpath string) err
 	if errors.Is(err, fs.ErrorIsDir) {
 		return err
 	}
-	// use RcatSize() to upload if it's a regular file
-	if f, ok := r.(*os.File); ok {
-		fi, err := f.Stat()
-		if err == nil && fi.Mode().IsRegular() {
-			_, err = operations.RcatSize(ctx, s.f, rpath, io.NopCloser(r), fi.Size(), time.Now(), nil)
+	if s.atomic {
+		return s.atomicPush(ctx, r, rpath, nil)
+	}
+	return s.upload(ctx, r, regularFileSize(r), rpath)
+}
+
+// PushIfNotExists sends the If-None-Match header if conditional writes are
+// enabled, so the upload fails if another writer creates the object
+// meanwhile. Otherwise, the existence is only checked before uploading.
+func (s *rcloneStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	rpath = normalizeRemotePath(rpath)
+	_, err := s.f.NewObject(ctx, rpath)
+	if err == nil {
+		return fmt.Errorf("%w: %q exists", storage.ErrPreconditionFailed, rpath)
+	}
+	if !errors.Is(err, fs.ErrorObjectNotFound) {
+		return err
+	}
+	cond := &fs.HTTPOption{Key: "If-None-Match", Value: "*"}
+	if s.atomic {
+		return s.atomicPush(ctx, r, rpath, cond)
+	}
+	var options []fs.OpenOption
+	if s.conditionalWrites {
+		options = append(options, cond)
+	}
+	err = s.upload(ctx, r, regularFileSize(r), rpath, options...)
+	if isConflict(err) {
+		return conditionError(err, rpath, cond)
+	}
+	return err
+}
+
+// ETag returns the ETag of the object on S3.
+func (s *rcloneStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	if s.s3 == nil {
+		return "", storage.ErrETagUnsupported
+	}
+	bucketName, key, err := s.s3.split(s.f, rpath)
+	if err != nil {
+		return "", err
+	}
+	return s.s3.etag(ctx, bucketName, key)
+}
+
+// PushIfMatch sends the If-Match header on S3 if conditional writes are
+// enabled, so the upload fails if another writer changes or removes the
+// object meanwhile. Otherwise, the ETag is only checked before uploading.
+func (s *rcloneStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	if s.s3 == nil {
+		return storage.ErrETagUnsupported
+	}
+	rpath = normalizeRemotePath(rpath)
+	cond := &fs.HTTPOption{Key: "If-Match", Value: `"` + strings.Trim(etag, `"`) + `"`}
+	if !s.conditionalWrites {
+		if err := s.checkETag(ctx, rpath, cond); err != nil {
+			return err
+		}
+	}
+	if s.atomic {
+		return s.atomicPush(ctx, r, rpath, cond)
+	}
+	var options []fs.OpenOption
+	if s.conditionalWrites {
+		options = append(options, cond)
+	}
+	err := s.upload(ctx, r, regularFileSize(r), rpath, options...)
+	if s.conditionalWrites && conditionFailed(err, cond) {
+		return conditionError(err, rpath, cond)
+	}
+	return err
+}
+
+// checkETag returns an error wrapping storage.ErrPreconditionFailed if the
+// object doesn't have the ETag of the If-Match header.
+func (s *rcloneStorage) checkETag(ctx context.Context, rpath string, cond *fs.HTTPOption) error {
+	etag, err := s.ETag(ctx, rpath)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return fmt.Errorf("%w: %q doesn't exist", storage.ErrPreconditionFailed, rpath)
+	}
+	if err != nil {
+		return err
+	}
+	if `"`+etag+`"` != cond.Value {
+		return fmt.Errorf("%w: %q doesn't have etag %s", storage.ErrPreconditionFailed, rpath, cond.Value)
+	}
+	return nil
+}
+
+// isConflict returns true if the upload is rejected by the conditional
+// headers.
+func isConflict(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code == http.StatusPreconditionFailed || code == http.StatusConflict
+	}
+	return false
+}
+
+// conditionFailed returns true if the write is rejected by the conditional
+// header, S3 returns 404 for If-Match if the object doesn't exist.
+func conditionFailed(err error, cond *fs.HTTPOption) bool {
+	return isConflict(err) || (isNotFound(err) && strings.EqualFold(cond.Key, "If-Match"))
+}
+
+// conditionError wraps storage.ErrPreconditionFailed in err, which is
+// returned by a write with the conditional header.
+func conditionError(err error, rpath string, cond *fs.HTTPOption) error {
+	if strings.EqualFold(cond.Key, "If-None-Match") {
+		return fmt.Errorf("%w: %q is created by another writer: %v", storage.ErrPreconditionFailed, rpath, err)
+	}
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %q doesn't exist: %v", storage.ErrPreconditionFailed, rpath, err)
+	}
+	return fmt.Errorf("%w: %q doesn't have etag %s: %v", storage.ErrPreconditionFailed, rpath, cond.Value, err)
+}
+
+// upload uploads the content to remote with the bandwidth limit, size is -1
+// if it's unknown.
+func (s *rcloneStorage) upload(ctx context.Context, r io.Reader, size int64, remote string, options ...fs.OpenOption) error {
+	return s.put(ctx, s.bwLimiter.reader(ctx, r, true), size, remote, options...)
+}
+
+// put uploads the content to remote, size is -1 if it's unknown.
+func (s *rcloneStorage) put(ctx context.Context, r io.Reader, size int64, remote string, options ...fs.OpenOption) error {
+	if size >= 0 {
+		if len(options) > 0 {
+			info := object.NewStaticObjectInfo(remote, time.Now(), size, true, nil, s.f)
+			_, err := s.f.Put(ctx, r, info, options...)
 			return err
 		}
+		// use RcatSize() to upload if the size is known
+		_, err := operations.RcatSize(ctx, s.f, remote, io.NopCloser(r), size, time.Now(), nil)
+		return err
+	}
+	// upload the parts concurrently if the backend supports multipart uploads
+	if s.f.Features().OpenChunkWriter != nil {
+		return s.multipartUpload(ctx, r, remote, options...)
 	}
 	// streaming upload with Rcat()
 	if s.f.Features().PutStream == nil {
 		fmt.Fprintln(os.Stderr, "Warning: target remote doesn't support streaming uploads,"+
 			" may save the content to a temporary file before uploading")
 	}
-	_, err = operations.Rcat(ctx, s.f, rpath, io.NopCloser(r), time.Now(), nil)
+	_, err := operations.Rcat(ctx, s.f, remote, io.NopCloser(r), time.Now(), nil)
 	return err
 }
 
+// regularFileSize returns the size of r if it's a regular file, otherwise -1.
+func regularFileSize(r io.Reader) int64 {
+	if f, ok := r.(*os.File); ok {
+		fi, err := f.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
 func (s *rcloneStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
 	rpath = normalizeRemotePath(rpath)
 	obj, err := s.f.NewObject(ctx, rpath)
@@ -97,7 +321,8 @@ func (s *rcloneStorage) Pull(ctx context.Context, rpath string, w io.Writer) err
 		return err
 	}
 	defer rc.Close()
-	_, err = io.Copy(w, rc)
+	s.reportVersion(ctx, obj)
+	_, err = io.Copy(w, s.bwLimiter.reader(ctx, rc, false))
 	return err
 }
 
@@ -117,7 +342,57 @@ func (s *rcloneStorage) OpenFile(ctx context.Context, rpath string, offset, leng
 	if length > 0 {
 		rangeOpt.End = offset + (length - 1)
 	}
-	return obj.Open(ctx, &rangeOpt)
+	rc, err := obj.Open(ctx, &rangeOpt)
+	if err != nil {
+		return nil, err
+	}
+	s.reportVersion(ctx, obj)
+	return s.bwLimiter.readCloser(ctx, rc, false), nil
+}
+
+// Copy uses the server-side copy if the backend supports it, otherwise
+// the content is streamed from the source to the destination.
+func (s *rcloneStorage) Copy(ctx context.Context, src, dst string) error {
+	log(ctx).Infof("[RCLONE] Copy %s to %s", src, dst)
+	srcObj, dstObj, err := s.objectsForTransfer(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	return s.transfer(ctx, dstObj, normalizeRemotePath(dst), srcObj, false)
+}
+
+// Move uses the server-side move if the backend supports it, otherwise
+// the file is copied and then removed.
+func (s *rcloneStorage) Move(ctx context.Context, src, dst string) error {
+	log(ctx).Infof("[RCLONE] Move %s to %s", src, dst)
+	srcObj, dstObj, err := s.objectsForTransfer(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	return s.transfer(ctx, dstObj, normalizeRemotePath(dst), srcObj, true)
+}
+
+// objectsForTransfer returns the source object and the existing destination
+// object, which is nil if the destination doesn't exist.
+func (s *rcloneStorage) objectsForTransfer(ctx context.Context, src, dst string) (fs.Object, fs.Object, error) {
+	srcObj, err := s.f.NewObject(ctx, normalizeRemotePath(src))
+	if err != nil {
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			return nil, nil, storage.ErrObjectNotFound
+		}
+		return nil, nil, err
+	}
+	dstObj, err := s.f.NewObject(ctx, normalizeRemotePath(dst))
+	if err != nil {
+		if errors.Is(err, fs.ErrorIsDir) {
+			return nil, nil, storage.ErrIsDir
+		}
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			return nil, nil, err
+		}
+		dstObj = nil
+	}
+	return srcObj, dstObj, nil
 }
 
 func (s *rcloneStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
@@ -156,6 +431,7 @@ func (s *rcloneStorage) list(ctx context.Context, rpath string, opt *storage.Lis
 		ljOpt.Recurse = opt.Recursive
 		ljOpt.DirsOnly = opt.DirsOnly
 		ljOpt.FilesOnly = opt.FilesOnly
+		ljOpt.ShowHash = opt.Hashes && !s.f.Features().SlowHash
 		if opt.MaxDepth > 0 {
 			var ci *fs.ConfigInfo
 			ctx, ci = fs.AddConfig(ctx)
@@ -180,8 +456,12 @@ func (s *rcloneStorage) List(ctx context.Context, rpath string, opt *storage.Lis
 		var obj fs.Object
 		obj, err = s.f.NewObject(ctx, rpath)
 		if err == nil {
-			entry := storage.NewStaticDirEntry(false, filepath.Base(obj.Remote()),
-				obj.Remote(), obj.Size(), obj.ModTime(ctx))
+			var hashes map[string]string
+			if opt.Hashes {
+				hashes = s.objectHashes(ctx, obj)
+			}
+			entry := storage.NewStaticDirEntryWithHashes(false, filepath.Base(obj.Remote()),
+				obj.Remote(), obj.Size(), obj.ModTime(ctx), hashes)
 			return cb(entry)
 		}
 	}
@@ -197,7 +477,10 @@ func (s *rcloneStorage) List(ctx context.Context, rpath string, opt *storage.Lis
 	}
 
 	err = s.list(ctx, rpath, opt, func(item *operations.ListJSONItem) error {
-		en := storage.NewStaticDirEntry(item.IsDir, item.Name, item.Path, item.Size, item.ModTime.When)
+		if !item.IsDir && storage.IsTempObject(item.Name) && !opt.ShowTemp {
+			return nil
+		}
+		en := storage.NewStaticDirEntryWithHashes(item.IsDir, item.Name, item.Path, item.Size, item.ModTime.When, item.Hashes)
 		return cb(en)
 	})
 	if errors.Is(err, fs.ErrorDirNotFound) || os.IsNotExist(err) {
@@ -206,6 +489,43 @@ func (s *rcloneStorage) List(ctx context.Context, rpath string, opt *storage.Lis
 	return err
 }
 
+// objectHashes returns the hashes of the object, if the backend can provide
+// them without reading the content.
+func (s *rcloneStorage) objectHashes(ctx context.Context, obj fs.Object) map[string]string {
+	if s.f.Features().SlowHash {
+		return nil
+	}
+	hashes := make(map[string]string)
+	for _, ht := range s.f.Hashes().Array() {
+		h, err := obj.Hash(ctx, ht)
+		if err != nil {
+			log(ctx).Debugf("[RCLONE] failed to read %s hash of %q: %v", ht, obj.Remote(), err)
+		} else if h != "" {
+			hashes[ht.String()] = h
+		}
+	}
+	return hashes
+}
+
+// reportVersion reports the version of the opened object by its size,
+// modification time and hashes. It's called after the object is opened,
+// since backends like s3 update the metadata of the object from the
+// response, so the version is of the content read.
+func (s *rcloneStorage) reportVersion(ctx context.Context, obj fs.Object) {
+	report := storage.FileVersionFromContext(ctx)
+	if report == nil {
+		return
+	}
+	version := fmt.Sprintf("size %d, mtime %s", obj.Size(), obj.ModTime(ctx).UTC().Format(time.RFC3339Nano))
+	hashes := s.objectHashes(ctx, obj)
+	for _, ht := range s.f.Hashes().Array() {
+		if h := hashes[ht.String()]; h != "" {
+			version += fmt.Sprintf(", %s %s", ht, h)
+		}
+	}
+	report(version)
+}
+
 func (s *rcloneStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
 	rpath = normalizeRemotePath(rpath)
 	if !strings.HasSuffix(rpath, "/") {
@@ -230,6 +550,8 @@ func (s *rcloneStorage) Stat(ctx context.Context, rpath string) (storage.StatRes
 		}
 		if item.IsDir {
 			result.Dirs++
+		} else if storage.IsTempObject(item.Name) {
+			return nil
 		} else {
 			result.Files++
 			result.TotalSize += item.Size
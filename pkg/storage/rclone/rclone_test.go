@@ -0,0 +1,98 @@
+package rclone_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func newStorage(t *testing.T, ctx context.Context, cfg map[string]string) storage.Storage {
+	if cfg["type"] == "local" {
+		cfg["root"] = t.TempDir()
+	} else if cfg["root"] == "" {
+		// the memory backend is shared by the process
+		cfg["root"] = strings.ReplaceAll(t.Name(), "/", "-")
+	}
+	st, err := rclone.New(ctx, cfg, "")
+	require.NoError(t, err)
+	return st
+}
+
+// withoutFeatures returns a context which disables the server-side
+// features of the backends created with it.
+func withoutFeatures(ctx context.Context, features ...string) context.Context {
+	ctx, ci := fs.AddConfig(ctx)
+	ci.DisableFeatures = features
+	return ctx
+}
+
+func pull(t *testing.T, st storage.Storage, rpath string) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, st.Pull(context.Background(), rpath, buf))
+	return buf.String()
+}
+
+// serverSide returns true if fn copies or moves the file on the server side.
+func serverSide(t *testing.T, ctx context.Context, fn func(ctx context.Context) error) bool {
+	ctx = accounting.WithStatsGroup(ctx, t.Name())
+	stats := accounting.Stats(ctx)
+	stats.ResetCounters()
+	require.NoError(t, fn(ctx))
+	out, err := stats.RemoteStats(false)
+	require.NoError(t, err)
+	return out["serverSideCopies"].(int64)+out["serverSideMoves"].(int64) > 0
+}
+
+func TestCopyMove(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cfg        map[string]string
+		disable    []string
+		serverCopy bool
+		serverMove bool
+	}{
+		{name: "memory", cfg: map[string]string{"type": "memory"}, serverCopy: true},
+		{name: "local", cfg: map[string]string{"type": "local"}, serverMove: true},
+		{name: "memory without server-side copy", cfg: map[string]string{"type": "memory"}, disable: []string{"Copy"}},
+		{name: "local without server-side move", cfg: map[string]string{"type": "local"}, disable: []string{"Move"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if len(tc.disable) > 0 {
+				ctx = withoutFeatures(ctx, tc.disable...)
+			}
+			st := newStorage(t, ctx, tc.cfg)
+			content := strings.Repeat("datasafed", 100)
+			require.NoError(t, st.Push(ctx, strings.NewReader(content), "src/a.txt"))
+			require.NoError(t, st.Push(ctx, strings.NewReader("old"), "dst/b.txt"))
+
+			require.Equal(t, tc.serverCopy, serverSide(t, ctx, func(ctx context.Context) error {
+				return st.Copy(ctx, "src/a.txt", "dst/a.txt")
+			}))
+			require.Equal(t, content, pull(t, st, "src/a.txt"))
+			require.Equal(t, content, pull(t, st, "dst/a.txt"))
+
+			// the destination is overwritten, and the file is copied and then
+			// removed without server-side move
+			require.Equal(t, tc.serverMove || tc.serverCopy, serverSide(t, ctx, func(ctx context.Context) error {
+				return st.Move(ctx, "src/a.txt", "dst/b.txt")
+			}))
+			require.Equal(t, content, pull(t, st, "dst/b.txt"))
+			err := st.Pull(ctx, "src/a.txt", &bytes.Buffer{})
+			require.ErrorIs(t, err, storage.ErrObjectNotFound)
+
+			err = st.Copy(ctx, "src/a.txt", "dst/c.txt")
+			require.ErrorIs(t, err, storage.ErrObjectNotFound)
+			err = st.Move(ctx, "src/a.txt", "dst/c.txt")
+			require.ErrorIs(t, err, storage.ErrObjectNotFound)
+		})
+	}
+}
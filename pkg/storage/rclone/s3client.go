@@ -0,0 +1,242 @@
+package rclone
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3backend "github.com/rclone/rclone/backend/s3"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/fshttp"
+)
+
+// s3Conn is a connection to the bucket of the rclone s3 backend, which is
+// used for the requests that rclone doesn't expose, i.e. the multipart
+// uploads of resumable pushes, ETags and conditional copies. The client is
+// built from the same options as the backend, since the client of rclone is
+// not exported.
+type s3Conn struct {
+	client *s3.Client
+	opt    *s3backend.Options
+	// sse is the customer key of the objects, nil if it's not set
+	sse *sseCustomerKey
+}
+
+// sseCustomerKey is the headers of the customer key of server-side
+// encryption, which are sent with every request reading or writing the
+// content of objects.
+type sseCustomerKey struct {
+	algorithm *string
+	key       *string
+	keyMD5    *string
+}
+
+// s3Quirks are the quirks of the providers that rclone applies to its own
+// client, which are needed to build the same client.
+type s3Quirks struct {
+	// virtualHost means the provider needs virtual-hosted-style requests,
+	// otherwise the force_path_style option is used
+	virtualHost bool
+	// noPartCopy means objects of any size are copied in a single request
+	noPartCopy bool
+	// unsupported means the requests need the signing fixups of rclone
+	unsupported bool
+}
+
+// s3Providers are the quirks of the providers of the rclone s3 backend,
+// which must be updated with rclone. The providers not listed here are
+// handled as "Other" by rclone.
+var s3Providers = map[string]s3Quirks{
+	"AWS":          {virtualHost: true},
+	"Alibaba":      {virtualHost: true},
+	"ArvanCloud":   {},
+	"Ceph":         {},
+	"ChinaMobile":  {},
+	"Cloudflare":   {},
+	"Cubbit":       {virtualHost: true},
+	"DigitalOcean": {virtualHost: true},
+	"Dreamhost":    {virtualHost: true},
+	"Exaba":        {},
+	"FileLu":       {},
+	"FlashBlade":   {},
+	"GCS":          {virtualHost: true, noPartCopy: true, unsupported: true},
+	"Hetzner":      {virtualHost: true},
+	"HuaweiOBS":    {virtualHost: true},
+	"IBMCOS":       {},
+	"IDrive":       {},
+	"IONOS":        {},
+	"Intercolo":    {virtualHost: true},
+	"Leviia":       {virtualHost: true},
+	"Liara":        {},
+	"Linode":       {virtualHost: true},
+	"LyveCloud":    {virtualHost: true},
+	"Magalu":       {},
+	"Mega":         {noPartCopy: true},
+	"Minio":        {},
+	"Netease":      {virtualHost: true},
+	"OVHcloud":     {virtualHost: true},
+	"Other":        {},
+	"Outscale":     {},
+	"Petabox":      {virtualHost: true},
+	"Qiniu":        {},
+	"Rabata":       {virtualHost: true},
+	"RackCorp":     {virtualHost: true},
+	"Rclone":       {noPartCopy: true},
+	"Scaleway":     {virtualHost: true},
+	"SeaweedFS":    {},
+	"Selectel":     {virtualHost: true},
+	"Servercore":   {virtualHost: true},
+	"SpectraLogic": {},
+	"StackPath":    {},
+	"Storj":        {virtualHost: true, noPartCopy: true},
+	"Synology":     {virtualHost: true},
+	"TencentCOS":   {virtualHost: true},
+	"Wasabi":       {virtualHost: true},
+	"Zata":         {virtualHost: true},
+}
+
+// newS3Conn returns the connection of f, or nil if f isn't an s3 backend or
+// its options are not supported.
+func newS3Conn(ctx context.Context, f fs.Fs) *s3Conn {
+	if _, ok := f.(*s3backend.Fs); !ok {
+		return nil
+	}
+	c, err := dialS3(ctx, f.Name())
+	if err != nil {
+		log(ctx).Warnf("[RCLONE] S3 requests not exposed by rclone are unavailable: %v", err)
+		return nil
+	}
+	return c
+}
+
+// dialS3 builds the client from the options of the remote as rclone does,
+// see s3Connection() of the s3 backend.
+func dialS3(ctx context.Context, name string) (*s3Conn, error) {
+	ri, err := fs.Find("s3")
+	if err != nil {
+		return nil, err
+	}
+	m := fs.ConfigMap(ri.Prefix, ri.Options, name, nil)
+	opt := new(s3backend.Options)
+	if err := configstruct.Set(m, opt); err != nil {
+		return nil, err
+	}
+	quirks := s3Providers[opt.Provider]
+	switch {
+	case quirks.unsupported:
+		return nil, fmt.Errorf("provider %s is not supported", opt.Provider)
+	case opt.V2Auth || opt.Region == "other-v2-signature":
+		return nil, errors.New("v2 auth is not supported")
+	case opt.STSEndpoint != "":
+		return nil, errors.New("sts_endpoint is not supported")
+	case (opt.UseXID.Valid && !opt.UseXID.Value) || (opt.SignAcceptEncoding.Valid && !opt.SignAcceptEncoding.Value):
+		return nil, errors.New("use_x_id and sign_accept_encoding can't be false")
+	}
+	if _, ok := ri.Options.NonDefault(m)["copy_cutoff"]; quirks.noPartCopy && !ok {
+		opt.CopyCutoff = math.MaxInt64
+	}
+
+	var awsConfig aws.Config
+	switch {
+	case opt.EnvAuth && opt.AccessKeyID == "" && opt.SecretAccessKey == "":
+		var configOpts []func(*awsconfig.LoadOptions) error
+		if opt.Profile != "" {
+			configOpts = append(configOpts, awsconfig.WithSharedConfigProfile(opt.Profile))
+		}
+		if opt.SharedCredentialsFile != "" {
+			configOpts = append(configOpts, awsconfig.WithSharedConfigFiles([]string{opt.SharedCredentialsFile}))
+		}
+		if awsConfig, err = awsconfig.LoadDefaultConfig(ctx, configOpts...); err != nil {
+			return nil, fmt.Errorf("load configuration with env_auth=true: %w", err)
+		}
+	case opt.AccessKeyID == "" && opt.SecretAccessKey == "":
+		awsConfig.Credentials = aws.AnonymousCredentials{}
+	default:
+		awsConfig.Credentials = credentials.NewStaticCredentialsProvider(opt.AccessKeyID, opt.SecretAccessKey, opt.SessionToken)
+	}
+	awsConfig.Region = opt.Region
+	if awsConfig.Region == "" {
+		awsConfig.Region = "us-east-1"
+	}
+	awsConfig.RetryMaxAttempts = fs.GetConfig(ctx).LowLevelRetries
+	awsConfig.HTTPClient = fshttp.NewClientCustom(ctx, func(t *http.Transport) {
+		if opt.DisableHTTP2 {
+			t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+	})
+	endpoint := opt.Endpoint
+	if endpoint != "" && !strings.HasPrefix(endpoint, "http") {
+		endpoint = "https://" + endpoint
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = opt.ForcePathStyle && !quirks.virtualHost && !opt.UseAccelerateEndpoint
+		o.UseAccelerate = opt.UseAccelerateEndpoint
+		o.UseARNRegion = opt.UseARNRegion
+		o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateDisabled
+		if opt.UseDualStack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+		if !opt.UseDataIntegrityProtections.Valid || !opt.UseDataIntegrityProtections.Value {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+		if endpoint != "" {
+			o.BaseEndpoint = &endpoint
+		}
+	})
+
+	sse, err := newSSECustomerKey(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Conn{client: client, opt: opt, sse: sse}, nil
+}
+
+// newSSECustomerKey returns the customer key of the options, which is given
+// in raw or in base64, nil if it's not set.
+func newSSECustomerKey(opt *s3backend.Options) (*sseCustomerKey, error) {
+	key := opt.SSECustomerKey
+	if opt.SSECustomerKeyBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(opt.SSECustomerKeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("decode sse_customer_key_base64: %w", err)
+		}
+		key = string(decoded)
+	}
+	if key == "" && opt.SSECustomerAlgorithm == "" {
+		return nil, nil
+	}
+	sse := &sseCustomerKey{}
+	if opt.SSECustomerAlgorithm != "" {
+		sse.algorithm = aws.String(opt.SSECustomerAlgorithm)
+	}
+	if key != "" {
+		keyMD5 := opt.SSECustomerKeyMD5
+		if keyMD5 == "" {
+			sum := md5.Sum([]byte(key))
+			keyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+		}
+		sse.key = aws.String(base64.StdEncoding.EncodeToString([]byte(key)))
+		sse.keyMD5 = aws.String(keyMD5)
+	}
+	return sse, nil
+}
+
+// headers returns the values of the headers, which are nil if k is nil.
+func (k *sseCustomerKey) headers() (algorithm, key, keyMD5 *string) {
+	if k == nil {
+		return nil, nil, nil
+	}
+	return k.algorithm, k.key, k.keyMD5
+}
@@ -0,0 +1,121 @@
+package rclone
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+// TestS3Providers fails if rclone is upgraded with a provider whose quirks
+// are not known.
+func TestS3Providers(t *testing.T) {
+	ri, err := fs.Find("s3")
+	require.NoError(t, err)
+	for _, example := range ri.Options.Get("provider").Examples {
+		require.Contains(t, s3Providers, example.Value)
+	}
+}
+
+func TestDialS3PathStyle(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		cfg       map[string]string
+		pathStyle bool
+	}{
+		{cfg: map[string]string{"provider": "Other"}, pathStyle: true},
+		{cfg: map[string]string{"provider": "Minio", "force_path_style": "false"}},
+		{cfg: map[string]string{"provider": "AWS", "force_path_style": "true"}},
+		{cfg: map[string]string{"provider": "Ceph", "use_accelerate_endpoint": "true"}},
+	} {
+		name := "dial-" + strings.ReplaceAll(t.Name(), "/", "-")
+		config.Data().DeleteSection(name)
+		for k, v := range tc.cfg {
+			config.Data().SetValue(name, k, v)
+		}
+		c, err := dialS3(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, tc.pathStyle, c.client.Options().UsePathStyle, tc.cfg)
+	}
+
+	config.Data().SetValue("dial-gcs", "provider", "GCS")
+	_, err := dialS3(ctx, "dial-gcs")
+	require.ErrorContains(t, err, "not supported")
+}
+
+func TestSSECustomerKey(t *testing.T) {
+	ctx := context.Background()
+	key := "0123456789abcdef0123456789abcdef"
+	sum := md5.Sum([]byte(key))
+	srv := s3test.NewServer(t)
+	srv.RequireSSECustomerKey(base64.StdEncoding.EncodeToString(sum[:]))
+	cfg := srv.Config("dir")
+	// the key is passed in base64 to check that it's decoded
+	cfg["sse_customer_algorithm"] = "AES256"
+	cfg["sse_customer_key_base64"] = base64.StdEncoding.EncodeToString([]byte(key))
+	cfg[AtomicPushKey] = "true"
+	// the config of the remote is shared by the storages of the process
+	t.Cleanup(func() {
+		config.Data().DeleteKey(remoteName, "sse_customer_algorithm")
+		config.Data().DeleteKey(remoteName, "sse_customer_key_base64")
+	})
+	st, err := New(ctx, cfg, "")
+	require.NoError(t, err)
+
+	// the etag, the conditional copy and the multipart upload send the key
+	require.NoError(t, st.Push(ctx, strings.NewReader("v1"), "a"))
+	etag, err := storage.FileETag(ctx, st, "a")
+	require.NoError(t, err)
+	require.NoError(t, storage.PushIfMatch(ctx, st, strings.NewReader("v2"), "a", etag))
+	data, ok := srv.Object("dir/a")
+	require.True(t, ok)
+	require.Equal(t, "v2", string(data))
+
+	u, err := storage.NewMultipartUploader(ctx, st, "b")
+	require.NoError(t, err)
+	uploadID, err := u.Create(ctx)
+	require.NoError(t, err)
+	partETag, err := u.UploadPart(ctx, uploadID, 1, bytes.NewReader([]byte("v1")), 2)
+	require.NoError(t, err)
+	require.NoError(t, u.Complete(ctx, uploadID, []string{partETag}, true))
+	data, ok = srv.Object("dir/b")
+	require.True(t, ok)
+	require.Equal(t, "v1", string(data))
+
+	// the requests without the key are rejected
+	config.Data().SetValue(remoteName, "sse_customer_key_base64", "")
+	c, err := dialS3(ctx, remoteName)
+	require.NoError(t, err)
+	require.Nil(t, c.sse.key)
+	_, err = c.etag(ctx, s3test.Bucket, "dir/a")
+	require.ErrorContains(t, err, "StatusCode: 400")
+}
+
+func TestParseConditionalWrites(t *testing.T) {
+	for _, tc := range []struct {
+		cfg     map[string]string
+		enabled bool
+	}{
+		{cfg: map[string]string{"type": "s3", "provider": "AWS"}, enabled: true},
+		{cfg: map[string]string{"type": "s3", "provider": "Minio"}},
+		{cfg: map[string]string{"type": "s3", "provider": "Minio", ConditionalWritesKey: "true"}, enabled: true},
+		{cfg: map[string]string{"type": "s3", "provider": "AWS", ConditionalWritesKey: "false"}},
+		{cfg: map[string]string{"type": "local"}},
+	} {
+		enabled, err := parseConditionalWrites(tc.cfg)
+		require.NoError(t, err)
+		require.Equal(t, tc.enabled, enabled, tc.cfg)
+		require.NotContains(t, tc.cfg, ConditionalWritesKey)
+	}
+	_, err := parseConditionalWrites(map[string]string{"type": "s3", ConditionalWritesKey: "maybe"})
+	require.ErrorContains(t, err, "invalid value")
+}
@@ -0,0 +1,559 @@
+// Package s3test provides an in-memory S3 server for testing the rclone
+// storage with the s3 backend, e.g. multipart uploads and conditional
+// writes, which the local and memory backends don't support.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const Bucket = "bucket"
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+	header  http.Header
+}
+
+type upload struct {
+	key    string
+	header http.Header
+	parts  map[int]*object
+}
+
+// Server is an S3 server which supports the requests made by the rclone s3
+// backend, it keeps the objects of a single bucket in memory.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*object
+	uploads map[string]*upload
+	nextID  int
+	// requests counts the requests by their names, e.g. "UploadPart"
+	requests      map[string]int
+	beforeRequest func(name, key string)
+	// sseKeyMD5 is the MD5 of the customer key required by the requests
+	// reading or writing objects, empty if it's not required
+	sseKeyMD5 string
+}
+
+// NewServer starts a server, which is closed when the test finishes.
+func NewServer(t *testing.T) *Server {
+	s := &Server{
+		objects:  map[string]*object{},
+		uploads:  map[string]*upload{},
+		requests: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config returns the config of the rclone s3 backend to access root in the
+// bucket.
+func (s *Server) Config(root string) map[string]string {
+	return map[string]string{
+		"type":              "s3",
+		"provider":          "Other",
+		"endpoint":          s.URL,
+		"access_key_id":     "test",
+		"secret_access_key": "test",
+		"region":            "us-east-1",
+		"force_path_style":  "true",
+		"no_check_bucket":   "true",
+		"list_version":      "2",
+		"root":              Bucket + "/" + root,
+	}
+}
+
+// Object returns the content of the object, and whether it exists.
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// PutObject creates or replaces the object.
+func (s *Server) PutObject(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = newObject(data, http.Header{})
+}
+
+// DeleteObject removes the object.
+func (s *Server) DeleteObject(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+}
+
+// BeforeRequest sets the function called before each request is handled,
+// which may change the objects to simulate concurrent writers.
+func (s *Server) BeforeRequest(fn func(name, key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeRequest = fn
+}
+
+// RequireSSECustomerKey makes the requests reading or writing objects fail
+// unless they have the customer key with the base64 MD5 keyMD5, as S3 does
+// for the objects encrypted with the key.
+func (s *Server) RequireSSECustomerKey(keyMD5 string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sseKeyMD5 = keyMD5
+}
+
+// Uploads returns the number of multipart uploads in progress.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// AbortUploads aborts all multipart uploads, as the lifecycle rules of a
+// bucket may do.
+func (s *Server) AbortUploads() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads = map[string]*upload{}
+}
+
+// Count returns the number of the requests with the name.
+func (s *Server) Count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[name]
+}
+
+func newObject(data []byte, header http.Header) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:    data,
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		modTime: time.Now().UTC().Truncate(time.Second),
+		header:  metadata(header),
+	}
+}
+
+// metadata returns the user metadata of the request.
+func metadata(header http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	data, _ := xml.Marshal(v)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// requestName returns the name of the S3 operation of the request.
+func requestName(r *http.Request, key string) string {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodHead:
+		return "HeadObject"
+	case http.MethodGet:
+		if key == "" {
+			return "ListObjects"
+		}
+		return "GetObject"
+	case http.MethodPut:
+		if q.Has("uploadId") {
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				return "UploadPartCopy"
+			}
+			return "UploadPart"
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodPost:
+		if q.Has("uploads") {
+			return "CreateMultipartUpload"
+		}
+		if q.Has("uploadId") {
+			return "CompleteMultipartUpload"
+		}
+		if q.Has("delete") {
+			return "DeleteObjects"
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			return "AbortMultipartUpload"
+		}
+		return "DeleteObject"
+	}
+	return r.Method
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	name := requestName(r, key)
+	s.mu.Lock()
+	s.requests[name]++
+	before := s.beforeRequest
+	sseKeyMD5 := s.sseKeyMD5
+	s.mu.Unlock()
+	if before != nil {
+		before(name, key)
+	}
+	if sseKeyMD5 != "" && !hasSSECustomerKey(r, name, sseKeyMD5) {
+		writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	switch name {
+	case "HeadObject", "GetObject":
+		s.getObject(w, r, key)
+	case "ListObjects":
+		s.listObjects(w, r)
+	case "PutObject":
+		s.putObject(w, r, key)
+	case "CopyObject":
+		s.copyObject(w, r, key)
+	case "DeleteObject":
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "CreateMultipartUpload":
+		s.createMultipartUpload(w, r, key)
+	case "UploadPart":
+		s.uploadPart(w, r)
+	case "UploadPartCopy":
+		s.uploadPartCopy(w, r)
+	case "CompleteMultipartUpload":
+		s.completeMultipartUpload(w, r, key)
+	case "AbortMultipartUpload":
+		s.mu.Lock()
+		delete(s.uploads, r.URL.Query().Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// hasSSECustomerKey returns true if the request has the customer key of
+// keyMD5, or it doesn't need the key.
+func hasSSECustomerKey(r *http.Request, name, keyMD5 string) bool {
+	switch name {
+	case "HeadObject", "GetObject", "PutObject", "CreateMultipartUpload", "UploadPart":
+		return r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == keyMD5
+	case "CopyObject", "UploadPartCopy":
+		return r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == keyMD5 &&
+			r.Header.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-Md5") == keyMD5
+	}
+	return true
+}
+
+// checkConditions checks the If-Match and If-None-Match headers of a write
+// against the existing object, it's called with s.mu held.
+func (s *Server) checkConditions(w http.ResponseWriter, r *http.Request, key string) bool {
+	o := s.objects[key]
+	if v := r.Header.Get("If-None-Match"); v == "*" && o != nil {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return false
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		if o == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return false
+		}
+		if v != "*" && v != o.etag && `"`+v+`"` != o.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	o := s.objects[key]
+	s.mu.Unlock()
+	if o == nil {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+		}
+		return
+	}
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.data))
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkConditions(w, r, key) {
+		return
+	}
+	o := newObject(data, r.Header)
+	s.objects[key] = o
+	w.Header().Set("ETag", o.etag)
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.copySource(r)
+	if src == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if !s.checkConditions(w, r, key) {
+		return
+	}
+	header := src.header
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		header = r.Header
+	}
+	o := newObject(src.data, header)
+	s.objects[key] = o
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: o.etag, LastModified: o.modTime.Format(time.RFC3339)})
+}
+
+// copySource returns the source object of a copy, or nil if it doesn't
+// exist, it's called with s.mu held.
+func (s *Server) copySource(r *http.Request) *object {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil
+	}
+	_, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	return s.objects[srcKey]
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: Bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: 1000}
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+		o := s.objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			LastModified: o.modTime.Format(time.RFC3339),
+			ETag:         o.etag,
+			Size:         int64(len(o.data)),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &upload{key: key, header: metadata(r.Header), parts: map[int]*object{}}
+	s.mu.Unlock()
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: Bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[q.Get("uploadId")]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	part := newObject(data, nil)
+	u.parts[number] = part
+	w.Header().Set("ETag", part.etag)
+}
+
+func (s *Server) uploadPartCopy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[q.Get("uploadId")]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	src := s.copySource(r)
+	if src == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if start > end || end >= len(src.data) {
+		writeError(w, http.StatusBadRequest, "InvalidRange")
+		return
+	}
+	part := newObject(src.data[start:end+1], nil)
+	u.parts[number] = part
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{ETag: part.etag, LastModified: part.modTime.Format(time.RFC3339)})
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	id := r.URL.Query().Get("uploadId")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[id]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if !s.checkConditions(w, r, key) {
+		return
+	}
+	var data []byte
+	sums := md5.New()
+	for _, p := range req.Parts {
+		part := u.parts[p.PartNumber]
+		if part == nil || part.etag != p.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, part.data...)
+		sum, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		sums.Write(sum)
+	}
+	o := newObject(data, u.header)
+	o.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(req.Parts))
+	s.objects[key] = o
+	delete(s.uploads, id)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: Bucket, Key: key, ETag: o.etag})
+}
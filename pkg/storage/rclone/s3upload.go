@@ -0,0 +1,317 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/bucket"
+	"github.com/rclone/rclone/lib/rest"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+)
+
+// split returns the bucket and the key of rpath in f, the same as the
+// split() of the s3 backend.
+func (c *s3Conn) split(f fs.Fs, rpath string) (string, string, error) {
+	bucketName, key := bucket.Split(bucket.Join(f.Root(), normalizeRemotePath(rpath)))
+	if bucketName == "" || key == "" {
+		return "", "", fmt.Errorf("invalid path %q of s3", rpath)
+	}
+	return c.opt.Enc.FromStandardName(bucketName), c.opt.Enc.FromStandardPath(key), nil
+}
+
+func (c *s3Conn) requestPayer() types.RequestPayer {
+	if c.opt.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// etag returns the ETag of the object without quotes.
+func (c *s3Conn) etag(ctx context.Context, bucketName, key string) (string, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       &bucketName,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.sse.headers()
+	out, err := c.client.HeadObject(ctx, input)
+	if isNotFound(err) {
+		return "", storage.ErrObjectNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("head object %q: %w", key, err)
+	}
+	return strings.Trim(aws.ToString(out.ETag), `"`), nil
+}
+
+// copy copies the object on the server side with the conditional header of
+// the destination. The objects larger than the copy cutoff are copied in
+// parts of the cutoff size, as rclone does.
+func (c *s3Conn) copy(ctx context.Context, f fs.Fs, src fs.Object, dst string, cond *fs.HTTPOption) error {
+	srcBucket, srcKey, err := c.split(f, src.Remote())
+	if err != nil {
+		return err
+	}
+	dstBucket, dstKey, err := c.split(f, dst)
+	if err != nil {
+		return err
+	}
+	source := strings.ReplaceAll(rest.URLPathEscape(bucket.Join(srcBucket, srcKey)), "+", "%2B")
+	if src.Size() <= int64(c.opt.CopyCutoff) {
+		input := &s3.CopyObjectInput{
+			Bucket:       &dstBucket,
+			Key:          &dstKey,
+			CopySource:   &source,
+			RequestPayer: c.requestPayer(),
+		}
+		if c.opt.ACL != "" {
+			input.ACL = types.ObjectCannedACL(c.opt.ACL)
+		}
+		if c.opt.StorageClass != "" {
+			input.StorageClass = types.StorageClass(c.opt.StorageClass)
+		}
+		if c.opt.ServerSideEncryption != "" {
+			input.ServerSideEncryption = types.ServerSideEncryption(c.opt.ServerSideEncryption)
+		}
+		if c.opt.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = &c.opt.SSEKMSKeyID
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.sse.headers()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = c.sse.headers()
+		input.IfMatch, input.IfNoneMatch = conditionHeaders(cond)
+		_, err = c.client.CopyObject(ctx, input)
+		if err != nil {
+			return fmt.Errorf("copy %q to %q: %w", srcKey, dstKey, err)
+		}
+		return nil
+	}
+
+	headInput := &s3.HeadObjectInput{
+		Bucket:       &srcBucket,
+		Key:          &srcKey,
+		RequestPayer: c.requestPayer(),
+	}
+	headInput.SSECustomerAlgorithm, headInput.SSECustomerKey, headInput.SSECustomerKeyMD5 = c.sse.headers()
+	head, err := c.client.HeadObject(ctx, headInput)
+	if err != nil {
+		return fmt.Errorf("head object %q: %w", srcKey, err)
+	}
+	u := &s3Uploader{conn: c, bucket: dstBucket, key: dstKey}
+	uploadID, err := u.create(ctx, head.Metadata, head.ContentType)
+	if err != nil {
+		return err
+	}
+	partSize := int64(c.opt.CopyCutoff)
+	var etags []string
+	for offset := int64(0); offset < src.Size(); offset += partSize {
+		end := min(offset+partSize, src.Size()) - 1
+		input := &s3.UploadPartCopyInput{
+			Bucket:          &dstBucket,
+			Key:             &dstKey,
+			UploadId:        &uploadID,
+			PartNumber:      aws.Int32(int32(len(etags) + 1)),
+			CopySource:      &source,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			RequestPayer:    c.requestPayer(),
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.sse.headers()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = c.sse.headers()
+		out, err := c.client.UploadPartCopy(ctx, input)
+		if err != nil {
+			_ = u.Abort(ctx, uploadID)
+			return fmt.Errorf("copy part %d of %q to %q: %w", len(etags)+1, srcKey, dstKey, err)
+		}
+		etags = append(etags, aws.ToString(out.CopyPartResult.ETag))
+	}
+	if err := u.complete(ctx, uploadID, etags, cond); err != nil {
+		_ = u.Abort(ctx, uploadID)
+		return err
+	}
+	return nil
+}
+
+// conditionHeaders returns the If-Match and If-None-Match headers of cond.
+func conditionHeaders(cond *fs.HTTPOption) (ifMatch, ifNoneMatch *string) {
+	if cond == nil {
+		return nil, nil
+	}
+	switch strings.ToLower(cond.Key) {
+	case "if-match":
+		return aws.String(cond.Value), nil
+	case "if-none-match":
+		return nil, aws.String(cond.Value)
+	}
+	return nil, nil
+}
+
+// isNotFound returns true if the object doesn't exist.
+func isNotFound(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+func (s *rcloneStorage) MultipartUploader(ctx context.Context, rpath string) (storage.MultipartUploader, error) {
+	if s.s3 == nil {
+		return nil, nil
+	}
+	bucketName, key, err := s.s3.split(s.f, rpath)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Uploader{
+		conn:        s.s3,
+		bucket:      bucketName,
+		key:         key,
+		bwLimiter:   s.bwLimiter,
+		conditional: s.conditionalWrites,
+	}, nil
+}
+
+// s3Uploader uploads a file with the multipart upload API of S3.
+type s3Uploader struct {
+	conn      *s3Conn
+	bucket    string
+	key       string
+	bwLimiter *bandwidthLimiter
+	// conditional is true if the upload is completed with If-None-Match
+	// for no-clobber pushes, otherwise the existence is checked before
+	conditional bool
+}
+
+var _ storage.MultipartUploader = (*s3Uploader)(nil)
+
+func (u *s3Uploader) Create(ctx context.Context) (string, error) {
+	return u.create(ctx, nil, nil)
+}
+
+// create creates the upload with the metadata and the content type, which
+// are optional.
+func (u *s3Uploader) create(ctx context.Context, metadata map[string]string, contentType *string) (string, error) {
+	opt := u.conn.opt
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      &u.bucket,
+		Key:         &u.key,
+		Metadata:    metadata,
+		ContentType: contentType,
+	}
+	if opt.ACL != "" {
+		input.ACL = types.ObjectCannedACL(opt.ACL)
+	}
+	if opt.StorageClass != "" {
+		input.StorageClass = types.StorageClass(opt.StorageClass)
+	}
+	if opt.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(opt.ServerSideEncryption)
+	}
+	if opt.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = &opt.SSEKMSKeyID
+	}
+	input.RequestPayer = u.conn.requestPayer()
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = u.conn.sse.headers()
+	out, err := u.conn.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("create multipart upload of %q: %w", u.key, err)
+	}
+	log(ctx).Infof("[RCLONE] created multipart upload %s of %s", aws.ToString(out.UploadId), u.key)
+	return aws.ToString(out.UploadId), nil
+}
+
+func (u *s3Uploader) UploadPart(ctx context.Context, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	// the body may be read more than once, e.g. to sign it
+	body := struct {
+		io.Reader
+		io.Seeker
+	}{
+		Reader: u.bwLimiter.reader(ctx, r, true),
+		Seeker: r,
+	}
+	input := &s3.UploadPartInput{
+		Bucket:        &u.bucket,
+		Key:           &u.key,
+		UploadId:      &uploadID,
+		PartNumber:    aws.Int32(int32(number)),
+		Body:          body,
+		ContentLength: &size,
+		RequestPayer:  u.conn.requestPayer(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = u.conn.sse.headers()
+	out, err := u.conn.client.UploadPart(ctx, input)
+	if err != nil {
+		return "", u.uploadError(fmt.Sprintf("upload part %d of %q", number, u.key), err)
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (u *s3Uploader) Complete(ctx context.Context, uploadID string, etags []string, noClobber bool) error {
+	var cond *fs.HTTPOption
+	if noClobber && u.conditional {
+		cond = &fs.HTTPOption{Key: "If-None-Match", Value: "*"}
+	} else if noClobber {
+		_, err := u.conn.etag(ctx, u.bucket, u.key)
+		if err == nil {
+			return fmt.Errorf("%w: %q exists", storage.ErrPreconditionFailed, u.key)
+		}
+		if !errors.Is(err, storage.ErrObjectNotFound) {
+			return err
+		}
+	}
+	return u.complete(ctx, uploadID, etags, cond)
+}
+
+// complete completes the upload with the conditional header, which is
+// optional.
+func (u *s3Uploader) complete(ctx context.Context, uploadID string, etags []string, cond *fs.HTTPOption) error {
+	parts := make([]types.CompletedPart, len(etags))
+	for i := range etags {
+		parts[i] = types.CompletedPart{PartNumber: aws.Int32(int32(i + 1)), ETag: &etags[i]}
+	}
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          &u.bucket,
+		Key:             &u.key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:    u.conn.requestPayer(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = u.conn.sse.headers()
+	input.IfMatch, input.IfNoneMatch = conditionHeaders(cond)
+	_, err := u.conn.client.CompleteMultipartUpload(ctx, input)
+	if cond != nil && conditionFailed(err, cond) {
+		return conditionError(err, u.key, cond)
+	}
+	if err != nil {
+		return u.uploadError(fmt.Sprintf("complete multipart upload of %q", u.key), err)
+	}
+	return nil
+}
+
+func (u *s3Uploader) Abort(ctx context.Context, uploadID string) error {
+	_, err := u.conn.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:       &u.bucket,
+		Key:          &u.key,
+		UploadId:     &uploadID,
+		RequestPayer: u.conn.requestPayer(),
+	})
+	if err != nil {
+		return u.uploadError(fmt.Sprintf("abort multipart upload of %q", u.key), err)
+	}
+	return nil
+}
+
+// uploadError wraps storage.ErrUploadNotFound if the upload doesn't exist.
+func (u *s3Uploader) uploadError(op string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+		return fmt.Errorf("%s: %w: %v", op, storage.ErrUploadNotFound, err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apecloud/datasafed/pkg/logging"
+)
+
+var log = logging.Module("storage")
+
+// PartialSuffix is the suffix of the directory holding the uploaded parts
+// of an unfinished resumable push.
+const PartialSuffix = ".partial"
+
+const (
+	partialManifestName = "manifest.json"
+	// DefaultResumablePartSize is the default size of the parts of
+	// resumable pushes.
+	DefaultResumablePartSize = 64 << 20
+)
+
+// PartialPath returns the path of the directory holding the uploaded parts
+// of the resumable push to rpath.
+func PartialPath(rpath string) string {
+	return rpath + PartialSuffix
+}
+
+// PartialManifest records the progress of a resumable push.
+type PartialManifest struct {
+	// Size and ModTime identify the version of the local file, the push
+	// is restarted if the file is changed.
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	PartSize int64     `json:"partSize"`
+	// UploadID is the ID of the multipart upload, if the backend supports
+	// multipart uploads.
+	UploadID string `json:"uploadId,omitempty"`
+	// Parts are the ETags of the uploaded parts of the multipart upload, or
+	// the sha256 digests of the parts stored in the partial directory.
+	Parts   []string  `json:"parts"`
+	Updated time.Time `json:"updated"`
+}
+
+type ResumablePushOptions struct {
+	// PartSize is the size of each part, DefaultResumablePartSize if 0.
+	PartSize int64
+	// Progress is called after each part is uploaded.
+	Progress func(uploaded, total int64)
+	// Output receives the content of the file after the parts are
+	// uploaded, e.g. to compute its digest.
+	Output io.Writer
+	// NoClobber fails the push if rpath exists when the parts are joined.
+	NoClobber bool
+}
+
+// ResumablePush pushes the local file to rpath in parts, and records them in
+// a manifest in the directory PartialPath(rpath). If the push is interrupted,
+// it continues from the uploaded parts when called again with the same file.
+//
+// If st supports multipart uploads, the parts are uploaded to a multipart
+// upload of rpath, whose ID is recorded in the manifest, and joined on the
+// server side. Otherwise, they are stored in the partial directory, and read
+// back to be joined into rpath, which transfers the file three times. After
+// the parts are joined, the partial directory is removed.
+func ResumablePush(ctx context.Context, st Storage, f *os.File, rpath string, opts ResumablePushOptions) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("resumable push requires a regular file, %q is not", f.Name())
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultResumablePartSize
+	}
+	if err := CheckPartSize(st, opts.PartSize); err != nil {
+		return err
+	}
+	uploader, err := NewMultipartUploader(ctx, st, rpath)
+	if err != nil {
+		return err
+	}
+	partial := PartialPath(rpath)
+	man, err := ReadPartialManifest(ctx, st, partial)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if man != nil && (man.Size != fi.Size() || !man.ModTime.Equal(fi.ModTime()) || man.PartSize != opts.PartSize ||
+		(man.UploadID != "") != (uploader != nil)) {
+		log(ctx).Infof("[RESUMABLE] %q is changed since the last push, restart it", f.Name())
+		if err := removePartial(ctx, st, partial, man); err != nil {
+			return err
+		}
+		man = nil
+	}
+	if man != nil {
+		log(ctx).Infof("[RESUMABLE] resume pushing %q from part %d", rpath, len(man.Parts))
+		err = pushParts(ctx, st, uploader, f, rpath, man, opts)
+		if !errors.Is(err, ErrUploadNotFound) {
+			return err
+		}
+		// e.g. aborted by the lifecycle rules of the bucket
+		log(ctx).Infof("[RESUMABLE] the multipart upload of %q is gone, restart it: %v", rpath, err)
+		if err := st.Remove(ctx, partial, true); err != nil {
+			return fmt.Errorf("remove %q error: %w", partial, err)
+		}
+	}
+	man = &PartialManifest{
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		PartSize: opts.PartSize,
+	}
+	if uploader != nil {
+		if man.UploadID, err = uploader.Create(ctx); err != nil {
+			return err
+		}
+		// record the upload before uploading parts, so it can be aborted
+		if err := writePartialManifest(ctx, st, partial, man); err != nil {
+			return err
+		}
+	}
+	return pushParts(ctx, st, uploader, f, rpath, man, opts)
+}
+
+// pushParts uploads the parts missing in the manifest, and joins them into
+// rpath.
+func pushParts(ctx context.Context, st Storage, uploader MultipartUploader, f *os.File, rpath string,
+	man *PartialManifest, opts ResumablePushOptions) error {
+	partial := PartialPath(rpath)
+	progress := ProgressFromContext(ctx)
+	progress.StartPhase(PhaseUploading, min(int64(len(man.Parts))*man.PartSize, man.Size), man.Size)
+	numParts := int((man.Size + man.PartSize - 1) / man.PartSize)
+	for i := len(man.Parts); i < numParts; i++ {
+		offset := int64(i) * man.PartSize
+		length := min(man.PartSize, man.Size-offset)
+		var part string
+		if uploader != nil {
+			etag, err := uploader.UploadPart(ctx, man.UploadID, i+1, io.NewSectionReader(f, offset, length), length)
+			if err != nil {
+				return err
+			}
+			progress.Add(length)
+			part = etag
+		} else {
+			hasher, _ := NewHash(HashSHA256)
+			r := progress.Reader(io.TeeReader(io.NewSectionReader(f, offset, length), hasher))
+			if err := st.Push(ctx, r, partPath(partial, i)); err != nil {
+				return fmt.Errorf("push part %d error: %w", i, err)
+			}
+			part = hex.EncodeToString(hasher.Sum(nil))
+		}
+		man.Parts = append(man.Parts, part)
+		if err := writePartialManifest(ctx, st, partial, man); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(offset+length, man.Size)
+		}
+	}
+
+	if uploader != nil {
+		progress.SetPhase(PhaseJoining)
+		if err := uploader.Complete(ctx, man.UploadID, man.Parts, opts.NoClobber); err != nil {
+			return fmt.Errorf("join parts error: %w", err)
+		}
+		// the parts have been uploaded from the unchanged file
+		if opts.Output != nil {
+			if _, err := io.Copy(opts.Output, io.NewSectionReader(f, 0, man.Size)); err != nil {
+				return err
+			}
+		}
+	} else if err := joinParts(ctx, st, partial, man, rpath, opts); err != nil {
+		return fmt.Errorf("join parts error: %w", err)
+	}
+	if err := st.Remove(ctx, partial, true); err != nil {
+		return fmt.Errorf("remove %q error: %w", partial, err)
+	}
+	return nil
+}
+
+// ResumePull pulls rpath to the local file, continuing from the end of its
+// existing content, which is assumed to be a prefix of rpath. The file is
+// pulled from the beginning if it's larger than rpath.
+func ResumePull(ctx context.Context, st Storage, rpath string, f *os.File) error {
+	size, err := fileSize(ctx, st, rpath)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	if offset > size {
+		log(ctx).Infof("[RESUMABLE] %q is larger than %q, pull it from the beginning", f.Name(), rpath)
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	progress := ProgressFromContext(ctx)
+	progress.StartPhase(PhaseDownloading, offset, size)
+	if offset == size {
+		return nil
+	}
+	if offset > 0 {
+		log(ctx).Infof("[RESUMABLE] resume pulling %q from offset %d", rpath, offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return copyRange(ctx, st, rpath, offset, size-offset, true, progress.Writer(f))
+}
+
+// joinParts pushes the content of the parts to rpath, the parts are
+// verified against their digests while they are read.
+func joinParts(ctx context.Context, st Storage, partial string, man *PartialManifest, rpath string, opts ResumablePushOptions) error {
+	progress := ProgressFromContext(ctx)
+	progress.StartPhase(PhaseJoining, 0, man.Size)
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		if opts.Output != nil {
+			w = io.MultiWriter(pw, opts.Output)
+		}
+		for i, expected := range man.Parts {
+			hasher, _ := NewHash(HashSHA256)
+			if err := st.Pull(ctx, partPath(partial, i), io.MultiWriter(w, hasher)); err != nil {
+				pw.CloseWithError(fmt.Errorf("pull part %d error: %w", i, err))
+				return
+			}
+			if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+				pw.CloseWithError(fmt.Errorf("%w: part %d has sha256 %s, expected %s",
+					ErrChecksumMismatch, i, actual, expected))
+				return
+			}
+		}
+		pw.Close()
+	}()
+	var err error
+	r := progress.Reader(pr)
+	if opts.NoClobber {
+		err = PushIfNotExists(ctx, st, r, rpath)
+	} else {
+		err = st.Push(ctx, r, rpath)
+	}
+	pr.CloseWithError(err)
+	return err
+}
+
+func partPath(partial string, i int) string {
+	return path.Join(partial, fmt.Sprintf("part-%08d", i))
+}
+
+// ReadPartialManifest reads the manifest in the partial directory. It returns
+// ErrObjectNotFound if the manifest doesn't exist.
+func ReadPartialManifest(ctx context.Context, st Storage, partial string) (*PartialManifest, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := st.Pull(ctx, path.Join(partial, partialManifestName), buf); err != nil {
+		return nil, err
+	}
+	man := &PartialManifest{}
+	if err := json.Unmarshal(buf.Bytes(), man); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %q: %w", partial, err)
+	}
+	return man, nil
+}
+
+func writePartialManifest(ctx context.Context, st Storage, partial string, man *PartialManifest) error {
+	man.Updated = time.Now()
+	data, err := json.Marshal(man)
+	if err != nil {
+		return err
+	}
+	err = st.Push(ctx, bytes.NewReader(data), path.Join(partial, partialManifestName))
+	if err != nil {
+		return fmt.Errorf("write manifest in %q error: %w", partial, err)
+	}
+	return nil
+}
+
+// PartialUpload is an unfinished resumable push found by ListPartialUploads.
+type PartialUpload struct {
+	// Path is the path of the partial directory.
+	Path string
+	// Updated is the time of the last uploaded part. If the manifest is
+	// missing or invalid, it's the latest modification time of the files in
+	// the directory, so that a push which has just started isn't taken as
+	// abandoned.
+	Updated time.Time
+	// Manifest is nil if it's missing or invalid.
+	Manifest *PartialManifest
+}
+
+// ListPartialUploads finds the partial directories of unfinished resumable
+// pushes in rpath recursively.
+func ListPartialUploads(ctx context.Context, st Storage, rpath string) ([]PartialUpload, error) {
+	var dirs []string
+	err := st.List(ctx, rpath, &ListOptions{DirsOnly: true, Recursive: true}, func(de DirEntry) error {
+		if strings.HasSuffix(strings.TrimSuffix(de.Path(), "/"), PartialSuffix) {
+			dirs = append(dirs, strings.TrimSuffix(de.Path(), "/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var uploads []PartialUpload
+	for _, dir := range dirs {
+		upload := PartialUpload{Path: dir}
+		man, err := ReadPartialManifest(ctx, st, dir)
+		if err == nil {
+			upload.Updated = man.Updated
+			upload.Manifest = man
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else {
+			log(ctx).Warnf("[RESUMABLE] failed to read the manifest in %q: %v", dir, err)
+			if upload.Updated, err = latestModTime(ctx, st, dir); err != nil {
+				return nil, err
+			}
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// latestModTime returns the latest modification time of the files in dir.
+func latestModTime(ctx context.Context, st Storage, dir string) (time.Time, error) {
+	var latest time.Time
+	err := st.List(ctx, dir+"/", &ListOptions{FilesOnly: true, Recursive: true}, func(de DirEntry) error {
+		if de.MTime().After(latest) {
+			latest = de.MTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// RemovePartialUpload aborts the multipart upload of the partial upload if
+// any, and removes its directory.
+func RemovePartialUpload(ctx context.Context, st Storage, upload PartialUpload) error {
+	return removePartial(ctx, st, upload.Path, upload.Manifest)
+}
+
+func removePartial(ctx context.Context, st Storage, partial string, man *PartialManifest) error {
+	if man != nil && man.UploadID != "" {
+		uploader, err := NewMultipartUploader(ctx, st, strings.TrimSuffix(partial, PartialSuffix))
+		if err != nil {
+			return err
+		}
+		if uploader != nil {
+			err := uploader.Abort(ctx, man.UploadID)
+			if err != nil && !errors.Is(err, ErrUploadNotFound) {
+				return err
+			}
+		}
+	}
+	if err := st.Remove(ctx, partial, true); err != nil {
+		return fmt.Errorf("remove %q error: %w", partial, err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+const mib = 1 << 20
+
+func writeLocalFile(t *testing.T, data []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "local")
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// partStorage counts the pushed and pulled parts, and fails the push of the
+// part failPart.
+type partStorage struct {
+	storage.Storage
+	failPart string
+
+	mu     sync.Mutex
+	pushed []string
+	pulled int
+}
+
+func (s *partStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	if strings.Contains(rpath, "/part-") {
+		if s.failPart != "" && strings.HasSuffix(rpath, s.failPart) {
+			return errors.New("interrupted")
+		}
+		s.mu.Lock()
+		s.pushed = append(s.pushed, rpath)
+		s.mu.Unlock()
+	}
+	return s.Storage.Push(ctx, r, rpath)
+}
+
+func (s *partStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	if strings.Contains(rpath, "/part-") {
+		s.mu.Lock()
+		s.pulled++
+		s.mu.Unlock()
+	}
+	return s.Storage.Pull(ctx, rpath, w)
+}
+
+func TestResumablePushParts(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local, err := rclone.New(ctx, map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	content := randomContent(10000)
+	f := writeLocalFile(t, content)
+	opts := storage.ResumablePushOptions{PartSize: 1000}
+
+	// interrupted at the 4th part
+	st := &partStorage{Storage: local, failPart: "part-00000003"}
+	err = storage.ResumablePush(ctx, st, f, "a", opts)
+	require.ErrorContains(t, err, "interrupted")
+	require.Len(t, st.pushed, 3)
+	man, err := storage.ReadPartialManifest(ctx, local, storage.PartialPath("a"))
+	require.NoError(t, err)
+	require.Len(t, man.Parts, 3)
+	require.Empty(t, man.UploadID)
+
+	// resumed from the 4th part
+	st = &partStorage{Storage: local}
+	output := &bytes.Buffer{}
+	opts.Output = output
+	require.NoError(t, storage.ResumablePush(ctx, st, f, "a", opts))
+	require.Len(t, st.pushed, 7)
+	require.Equal(t, "a.partial/part-00000003", st.pushed[0])
+	require.Equal(t, 10, st.pulled)
+	require.True(t, bytes.Equal(content, pullContent(t, local, "a")))
+	require.True(t, bytes.Equal(content, output.Bytes()))
+	require.NoDirExists(t, filepath.Join(dir, "a.partial"))
+}
+
+func TestResumablePushRestart(t *testing.T) {
+	ctx := context.Background()
+	local := newLocalStorage(t)
+	f := writeLocalFile(t, randomContent(10000))
+	st := &partStorage{Storage: local, failPart: "part-00000003"}
+	require.Error(t, storage.ResumablePush(ctx, st, f, "a", storage.ResumablePushOptions{PartSize: 1000}))
+
+	// the parts are pushed again if the part size is changed
+	st = &partStorage{Storage: local}
+	require.NoError(t, storage.ResumablePush(ctx, st, f, "a", storage.ResumablePushOptions{PartSize: 2000}))
+	require.Len(t, st.pushed, 5)
+	require.Equal(t, "a.partial/part-00000000", st.pushed[0])
+}
+
+func pullContent(t *testing.T, st storage.Storage, rpath string) []byte {
+	buf := &bytes.Buffer{}
+	require.NoError(t, st.Pull(context.Background(), rpath, buf))
+	return buf.Bytes()
+}
+
+// interruptAt returns a context which is canceled by the n-th request with
+// the name to the server.
+func interruptAt(t *testing.T, srv *s3test.Server, name string, n int) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv.BeforeRequest(func(reqName, key string) {
+		if reqName == name && srv.Count(name) == n {
+			cancel()
+		}
+	})
+	return ctx
+}
+
+func TestResumablePushMultipart(t *testing.T) {
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(context.Background(), srv.Config("dir"), "")
+	require.NoError(t, err)
+	content := randomContent(12 * mib)
+	f := writeLocalFile(t, content)
+	opts := storage.ResumablePushOptions{PartSize: 5 * mib}
+
+	ctx := interruptAt(t, srv, "UploadPart", 2)
+	require.Error(t, storage.ResumablePush(ctx, st, f, "a", opts))
+	man, err := storage.ReadPartialManifest(context.Background(), st, storage.PartialPath("a"))
+	require.NoError(t, err)
+	require.NotEmpty(t, man.UploadID)
+	require.Len(t, man.Parts, 1)
+	require.Equal(t, 1, srv.Uploads())
+
+	// the upload continues from the 2nd part, and the parts are joined on
+	// the server side
+	srv.BeforeRequest(nil)
+	output := &bytes.Buffer{}
+	opts.Output = output
+	require.NoError(t, storage.ResumablePush(context.Background(), st, f, "a", opts))
+	data, ok := srv.Object("dir/a")
+	require.True(t, ok)
+	require.True(t, bytes.Equal(content, data))
+	require.True(t, bytes.Equal(content, output.Bytes()))
+	require.Equal(t, 1, srv.Count("CreateMultipartUpload"))
+	require.Equal(t, 4, srv.Count("UploadPart"))
+	require.Equal(t, 1, srv.Count("CompleteMultipartUpload"))
+	require.Zero(t, srv.Uploads())
+	_, ok = srv.Object("dir/a.partial/manifest.json")
+	require.False(t, ok)
+}
+
+func TestResumablePushMultipartGone(t *testing.T) {
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(context.Background(), srv.Config("dir"), "")
+	require.NoError(t, err)
+	content := randomContent(12 * mib)
+	f := writeLocalFile(t, content)
+	opts := storage.ResumablePushOptions{PartSize: 5 * mib}
+
+	ctx := interruptAt(t, srv, "UploadPart", 2)
+	require.Error(t, storage.ResumablePush(ctx, st, f, "a", opts))
+	srv.BeforeRequest(nil)
+	srv.AbortUploads()
+
+	// the push is restarted with a new upload
+	require.NoError(t, storage.ResumablePush(context.Background(), st, f, "a", opts))
+	data, ok := srv.Object("dir/a")
+	require.True(t, ok)
+	require.True(t, bytes.Equal(content, data))
+	require.Equal(t, 2, srv.Count("CreateMultipartUpload"))
+}
+
+func TestResumablePushMultipartNoClobber(t *testing.T) {
+	srv := s3test.NewServer(t)
+	cfg := srv.Config("dir")
+	cfg[rclone.ConditionalWritesKey] = "true"
+	st, err := rclone.New(context.Background(), cfg, "")
+	require.NoError(t, err)
+	f := writeLocalFile(t, randomContent(6*mib))
+
+	// another writer creates the file before the parts are joined
+	srv.BeforeRequest(func(name, key string) {
+		if name == "CompleteMultipartUpload" {
+			srv.PutObject("dir/a", []byte("other"))
+		}
+	})
+	err = storage.ResumablePush(context.Background(), st, f, "a",
+		storage.ResumablePushOptions{PartSize: 5 * mib, NoClobber: true})
+	require.ErrorIs(t, err, storage.ErrPreconditionFailed)
+	data, _ := srv.Object("dir/a")
+	require.Equal(t, "other", string(data))
+}
+
+func TestResumablePushPartSize(t *testing.T) {
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(context.Background(), srv.Config("dir"), "")
+	require.NoError(t, err)
+	f := writeLocalFile(t, randomContent(3*mib))
+	err = storage.ResumablePush(context.Background(), st, f, "a", storage.ResumablePushOptions{PartSize: mib})
+	require.ErrorContains(t, err, "minimum part size")
+	require.Zero(t, srv.Count("CreateMultipartUpload"))
+}
+
+func TestCleanupPartialUploads(t *testing.T) {
+	srv := s3test.NewServer(t)
+	st, err := rclone.New(context.Background(), srv.Config("dir"), "")
+	require.NoError(t, err)
+	f := writeLocalFile(t, randomContent(12*mib))
+	ctx := interruptAt(t, srv, "UploadPart", 2)
+	require.Error(t, storage.ResumablePush(ctx, st, f, "sub/a", storage.ResumablePushOptions{PartSize: 5 * mib}))
+	srv.BeforeRequest(nil)
+	// a push which has just started, and has no manifest yet
+	srv.PutObject("dir/b.partial/part-00000000", []byte("part"))
+
+	ctx = context.Background()
+	uploads, err := storage.ListPartialUploads(ctx, st, "/")
+	require.NoError(t, err)
+	require.Len(t, uploads, 2)
+	for _, upload := range uploads {
+		require.WithinDuration(t, time.Now(), upload.Updated, time.Minute, upload.Path)
+	}
+	require.Equal(t, "b.partial", uploads[0].Path)
+	require.Nil(t, uploads[0].Manifest)
+	require.Equal(t, "sub/a.partial", uploads[1].Path)
+	require.NotNil(t, uploads[1].Manifest)
+
+	// the multipart upload is aborted
+	require.NoError(t, storage.RemovePartialUpload(ctx, st, uploads[1]))
+	require.Zero(t, srv.Uploads())
+	_, ok := srv.Object("dir/sub/a.partial/manifest.json")
+	require.False(t, ok)
+}
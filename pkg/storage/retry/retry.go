@@ -0,0 +1,428 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs/fserrors"
+
+	"github.com/apecloud/datasafed/pkg/logging"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/sanitized"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+const (
+	// MaxRetriesKey is the max number of retries of a failed operation,
+	// retries are disabled if it's 0.
+	MaxRetriesKey = "max_retries"
+	// InitialBackoffKey is the backoff before the first retry, it's doubled
+	// for each retry.
+	InitialBackoffKey = "retry_initial_backoff"
+	// MaxBackoffKey is the upper bound of the backoff.
+	MaxBackoffKey = "retry_max_backoff"
+
+	defaultMaxRetries     = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+var log = logging.Module("storage/retry")
+
+// ErrFileChanged is returned if a read is resumed but the file is changed
+// since it's opened.
+var ErrFileChanged = errors.New("file changed")
+
+type Options struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultOptions returns the options used if they are not configured.
+func DefaultOptions() Options {
+	return Options{
+		MaxRetries:     defaultMaxRetries,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+	}
+}
+
+// ParseOptions parses the options from the config, the missing keys are
+// set to the defaults.
+func ParseOptions(cfg map[string]string) (Options, error) {
+	opts := DefaultOptions()
+	if v := strings.TrimSpace(cfg[MaxRetriesKey]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q", MaxRetriesKey, v)
+		}
+		opts.MaxRetries = n
+	}
+	for key, d := range map[string]*time.Duration{
+		InitialBackoffKey: &opts.InitialBackoff,
+		MaxBackoffKey:     &opts.MaxBackoff,
+	} {
+		if v := strings.TrimSpace(cfg[key]); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return opts, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*d = parsed
+		}
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = opts.InitialBackoff
+	}
+	return opts, nil
+}
+
+// retryStorage retries the idempotent operations (List, Stat, OpenFile and
+// Remove) if they fail with transient errors, e.g. network errors or HTTP 5xx
+// responses. Pull and the readers returned by OpenFile are resumed from the
+// last delivered offset with ranged reads, if the file is unchanged. Other
+// operations are not retried, since they consume the reader or are not
+// idempotent.
+type retryStorage struct {
+	opts       Options
+	underlying storage.Storage
+}
+
+var _ storage.Storage = (*retryStorage)(nil)
+
+func New(ctx context.Context, underlying storage.Storage, opts Options) (storage.Storage, error) {
+	rs := &retryStorage{
+		opts:       opts,
+		underlying: underlying,
+	}
+	return sanitized.New(ctx, "", rs)
+}
+
+func (s *retryStorage) Unwrap() storage.Storage {
+	return s.underlying
+}
+
+func (s *retryStorage) MultipartUploader(ctx context.Context, rpath string) (storage.MultipartUploader, error) {
+	return storage.NewMultipartUploader(ctx, s.underlying, rpath)
+}
+
+// do calls fn until it succeeds, fails with a permanent error, or the retries
+// are exhausted. The attempt starts from 0. If noRetry is not nil, it's called
+// after a failed attempt, and the error is returned if it returns true.
+func (s *retryStorage) do(ctx context.Context, op, rpath string, fn func(attempt int) error, noRetry func() bool) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= s.opts.MaxRetries || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		if noRetry != nil && noRetry() {
+			return err
+		}
+		backoff := s.backoff(attempt)
+		log(ctx).Warnf("[RETRY] %s %s failed, retry %d/%d in %s: %v",
+			op, rpath, attempt+1, s.opts.MaxRetries, backoff.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// backoff returns a random duration up to the exponential backoff of the
+// attempt, so that clients failed at the same time don't retry together.
+func (s *retryStorage) backoff(attempt int) time.Duration {
+	d := s.opts.MaxBackoff
+	if attempt < 32 {
+		d = min(s.opts.InitialBackoff<<attempt, s.opts.MaxBackoff)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// IsTransient returns true if the operation failed with err may succeed if
+// it's retried.
+func IsTransient(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, storage.ErrObjectNotFound),
+		errors.Is(err, storage.ErrDirNotFound),
+		errors.Is(err, storage.ErrIsDir),
+		errors.Is(err, storage.ErrPreconditionFailed),
+		errors.Is(err, storage.ErrChecksumMismatch),
+		errors.Is(err, ErrFileChanged):
+		return false
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return fserrors.ShouldRetry(err)
+}
+
+func (s *retryStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	return s.underlying.Push(ctx, r, rpath)
+}
+
+func (s *retryStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	return storage.PushIfNotExists(ctx, s.underlying, r, rpath)
+}
+
+func (s *retryStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	var etag string
+	err := s.do(ctx, "ETag", rpath, func(int) error {
+		var err error
+		etag, err = storage.FileETag(ctx, s.underlying, rpath)
+		return err
+	}, nil)
+	return etag, err
+}
+
+func (s *retryStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	return storage.PushIfMatch(ctx, s.underlying, r, rpath, etag)
+}
+
+// Pull resumes from the bytes written to w if the read fails. It fails with
+// ErrFileChanged if the file is changed since the first attempt. The read
+// isn't resumed if the underlying storage doesn't report the versions of
+// files, see storage.WithFileVersion.
+func (s *retryStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	var version string
+	cw := &failedWriter{CountingWriter: util.CountingWriter{W: w}}
+	return s.do(ctx, "Pull", rpath, func(attempt int) error {
+		if attempt == 0 {
+			return s.underlying.Pull(withVersion(ctx, &version), rpath, cw)
+		}
+		log(ctx).Infof("[RETRY] resume Pull %s from offset %d", rpath, cw.N)
+		rc, err := s.reopen(ctx, rpath, &version, cw.N, -1)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(cw, rc)
+		return err
+	}, func() bool {
+		return cw.failed() || (cw.N > 0 && version == "")
+	})
+}
+
+func (s *retryStorage) OpenFile(ctx context.Context, rpath string, offset, length int64) (io.ReadCloser, error) {
+	var version string
+	var rc io.ReadCloser
+	err := s.do(ctx, "OpenFile", rpath, func(int) error {
+		var err error
+		rc, err = s.underlying.OpenFile(withVersion(ctx, &version), rpath, offset, length)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		length = -1
+	}
+	return &resumingReader{
+		ctx:       ctx,
+		s:         s,
+		rpath:     rpath,
+		version:   version,
+		rc:        rc,
+		offset:    max(offset, 0),
+		remaining: length,
+	}, nil
+}
+
+func (s *retryStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
+	return s.do(ctx, "Remove", rpath, func(attempt int) error {
+		err := s.underlying.Remove(ctx, rpath, recursive)
+		// the file may be removed by the failed attempt
+		if attempt > 0 && !recursive && errors.Is(err, storage.ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}, nil)
+}
+
+func (s *retryStorage) Rmdir(ctx context.Context, rpath string) error {
+	return s.underlying.Rmdir(ctx, rpath)
+}
+
+func (s *retryStorage) Mkdir(ctx context.Context, rpath string) error {
+	return s.underlying.Mkdir(ctx, rpath)
+}
+
+// List is retried only if no entry is passed to cb, otherwise the entries
+// would be passed again.
+func (s *retryStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	listed := false
+	var cbErr error
+	return s.do(ctx, "List", rpath, func(int) error {
+		return s.underlying.List(ctx, rpath, opt, func(de storage.DirEntry) error {
+			listed = true
+			cbErr = cb(de)
+			return cbErr
+		})
+	}, func() bool {
+		return listed || cbErr != nil
+	})
+}
+
+func (s *retryStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
+	var result storage.StatResult
+	err := s.do(ctx, "Stat", rpath, func(int) error {
+		var err error
+		result, err = s.underlying.Stat(ctx, rpath)
+		return err
+	}, nil)
+	return result, err
+}
+
+func (s *retryStorage) Copy(ctx context.Context, src, dst string) error {
+	return s.underlying.Copy(ctx, src, dst)
+}
+
+func (s *retryStorage) Move(ctx context.Context, src, dst string) error {
+	return s.underlying.Move(ctx, src, dst)
+}
+
+// withVersion returns a context in which the version of the file opened by
+// the underlying storage is saved to version.
+func withVersion(ctx context.Context, version *string) context.Context {
+	return storage.WithFileVersion(ctx, func(v string) {
+		*version = v
+	})
+}
+
+// reopen opens the file from the offset, and fails with ErrFileChanged if
+// the version of the opened file isn't version. The version is reported by
+// the underlying storage when the file is opened, so the data read is never
+// of another version, and no extra request is made. If version is empty,
+// i.e. nothing is read yet, it's set to the version of the opened file.
+func (s *retryStorage) reopen(ctx context.Context, rpath string, version *string, offset, length int64) (io.ReadCloser, error) {
+	var current string
+	rc, err := s.underlying.OpenFile(withVersion(ctx, &current), rpath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if *version == "" {
+		*version = current
+	} else if current != *version {
+		rc.Close()
+		return nil, fmt.Errorf("%w: %q has %s, expected %s", ErrFileChanged, rpath, current, *version)
+	}
+	return rc, nil
+}
+
+// failedWriter records the error of the underlying writer, which must not be
+// retried.
+type failedWriter struct {
+	util.CountingWriter
+	err error
+}
+
+func (w *failedWriter) Write(p []byte) (int, error) {
+	n, err := w.CountingWriter.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *failedWriter) failed() bool {
+	return w.err != nil
+}
+
+// resumingReader reopens the file from the current offset if the read fails.
+type resumingReader struct {
+	ctx   context.Context
+	s     *retryStorage
+	rpath string
+	// version is empty if the underlying storage doesn't report it, then
+	// the read isn't resumed
+	version string
+	rc      io.ReadCloser
+	offset  int64
+	// remaining is the number of bytes to read, or negative to read to the end
+	remaining int64
+	// err is the error of the last read, the file is reopened by the next read
+	err error
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if r.err == nil {
+		n, err := r.read(p)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.err = err
+		if n > 0 {
+			return n, nil
+		}
+	}
+	var n int
+	eof := false
+	err := r.s.do(r.ctx, "Read", r.rpath, func(attempt int) error {
+		if attempt == 0 {
+			return r.err
+		}
+		log(r.ctx).Infof("[RETRY] resume reading %s from offset %d", r.rpath, r.offset)
+		rc, err := r.s.reopen(r.ctx, r.rpath, &r.version, r.offset, r.remaining)
+		if err != nil {
+			return err
+		}
+		r.rc.Close()
+		r.rc, r.err = rc, nil
+		n, err = r.read(p)
+		switch {
+		case err == io.EOF:
+			eof = true
+			return nil
+		case err != nil && n > 0:
+			// return the data read, and reopen the file by the next read
+			r.err = err
+			return nil
+		case err != nil:
+			r.err = err
+		}
+		return err
+	}, func() bool {
+		return r.version == ""
+	})
+	if err != nil {
+		return 0, err
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *resumingReader) read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+	return n, err
+}
+
+func (r *resumingReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,316 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/rclone/s3test"
+)
+
+type httpError int
+
+func (e httpError) Error() string {
+	return fmt.Sprintf("HTTP %d", int(e))
+}
+
+func (e httpError) HTTPStatusCode() int {
+	return int(e)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{err: nil},
+		{err: context.Canceled},
+		{err: fmt.Errorf("%w: %q", storage.ErrObjectNotFound, "a")},
+		{err: fmt.Errorf("%w: %q", storage.ErrPreconditionFailed, "a")},
+		{err: storage.ErrChecksumMismatch},
+		{err: ErrFileChanged},
+		{err: errors.New("invalid argument")},
+		{err: httpError(404)},
+		{err: httpError(429), transient: true},
+		{err: fmt.Errorf("put: %w", httpError(503)), transient: true},
+		{err: io.ErrUnexpectedEOF, transient: true},
+		{err: context.DeadlineExceeded, transient: true},
+		{err: &net.OpError{Op: "read", Err: errors.New("connection reset")}, transient: true},
+	} {
+		require.Equal(t, tc.transient, IsTransient(tc.err), "%v", tc.err)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions(nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultOptions(), opts)
+
+	opts, err = ParseOptions(map[string]string{MaxRetriesKey: "5", InitialBackoffKey: "2m"})
+	require.NoError(t, err)
+	require.Equal(t, Options{MaxRetries: 5, InitialBackoff: 2 * time.Minute, MaxBackoff: 2 * time.Minute}, opts)
+
+	for _, cfg := range []map[string]string{
+		{MaxRetriesKey: "-1"},
+		{MaxRetriesKey: "x"},
+		{InitialBackoffKey: "0s"},
+		{MaxBackoffKey: "1"},
+	} {
+		_, err := ParseOptions(cfg)
+		require.Error(t, err, cfg)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &retryStorage{opts: Options{MaxRetries: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 0, max: 100 * time.Millisecond},
+		{attempt: 3, max: 800 * time.Millisecond},
+		{attempt: 4, max: time.Second},
+		{attempt: 100, max: time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			d := s.backoff(tc.attempt)
+			require.GreaterOrEqual(t, d, tc.max/2, "attempt %d", tc.attempt)
+			require.LessOrEqual(t, d, tc.max, "attempt %d", tc.attempt)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	s := &retryStorage{opts: Options{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		noRetry  bool
+		attempts int
+		err      error
+	}{
+		{name: "succeeded", errs: []error{nil}, attempts: 1},
+		{name: "retried", errs: []error{httpError(500), io.ErrUnexpectedEOF, nil}, attempts: 3},
+		{name: "exhausted", errs: []error{httpError(500)}, attempts: 4, err: httpError(500)},
+		{name: "permanent", errs: []error{httpError(500), storage.ErrObjectNotFound}, attempts: 2, err: storage.ErrObjectNotFound},
+		{name: "no retry", errs: []error{httpError(500)}, noRetry: true, attempts: 1, err: httpError(500)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			var noRetry func() bool
+			if tc.noRetry {
+				noRetry = func() bool { return true }
+			}
+			err := s.do(ctx, "Op", "a", func(attempt int) error {
+				require.Equal(t, attempts, attempt)
+				attempts++
+				return tc.errs[min(attempt, len(tc.errs)-1)]
+			}, noRetry)
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.attempts, attempts)
+		})
+	}
+
+	// the backoff is interrupted by the context
+	s.opts.InitialBackoff, s.opts.MaxBackoff = time.Hour, time.Hour
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := s.do(ctx, "Op", "a", func(int) error { return httpError(500) }, nil)
+	require.Equal(t, httpError(500), err)
+}
+
+// flakyStorage fails the reads with a transient error after failAfter bytes
+// are read from a file, for the first failures opens. onFail is called
+// before a read fails.
+type flakyStorage struct {
+	storage.Storage
+	failAfter int64
+	failures  int
+	onFail    func()
+	// noVersion hides the versions of the opened files
+	noVersion bool
+	// offsets are the offsets of the opened files
+	offsets []int64
+	// lookups is the number of ETag and List calls
+	lookups int
+}
+
+func (s *flakyStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	rc, err := s.OpenFile(ctx, rpath, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func (s *flakyStorage) OpenFile(ctx context.Context, rpath string, offset, length int64) (io.ReadCloser, error) {
+	if s.noVersion {
+		ctx = storage.WithFileVersion(ctx, nil)
+	}
+	rc, err := s.Storage.OpenFile(ctx, rpath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	s.offsets = append(s.offsets, offset)
+	if s.failures == 0 {
+		return rc, nil
+	}
+	s.failures--
+	return &flakyReader{ReadCloser: rc, s: s, remaining: s.failAfter}, nil
+}
+
+func (s *flakyStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	s.lookups++
+	return s.Storage.List(ctx, rpath, opt, cb)
+}
+
+func (s *flakyStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	s.lookups++
+	return storage.FileETag(ctx, s.Storage, rpath)
+}
+
+func (s *flakyStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	return storage.PushIfMatch(ctx, s.Storage, r, rpath, etag)
+}
+
+type flakyReader struct {
+	io.ReadCloser
+	s         *flakyStorage
+	remaining int64
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		if r.s.onFail != nil {
+			r.s.onFail()
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func newFlakyStorage(t *testing.T, cfg map[string]string) (storage.Storage, *flakyStorage) {
+	ctx := context.Background()
+	if cfg == nil {
+		cfg = map[string]string{"type": "local", "root": t.TempDir()}
+	}
+	underlying, err := rclone.New(ctx, cfg, "")
+	require.NoError(t, err)
+	flaky := &flakyStorage{Storage: underlying}
+	st, err := New(ctx, flaky, Options{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	require.NoError(t, err)
+	return st, flaky
+}
+
+func randomContent(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+func TestPullResume(t *testing.T) {
+	ctx := context.Background()
+	st, flaky := newFlakyStorage(t, nil)
+	content := randomContent(10000)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(content), "a"))
+
+	flaky.failAfter, flaky.failures = 3000, 2
+	buf := &bytes.Buffer{}
+	require.NoError(t, st.Pull(ctx, "a", buf))
+	require.True(t, bytes.Equal(content, buf.Bytes()))
+	require.Equal(t, []int64{0, 3000, 6000}, flaky.offsets)
+	// the versions are reported by the opens, without extra requests
+	require.Zero(t, flaky.lookups)
+
+	// the retries are exhausted
+	flaky.failAfter, flaky.failures, flaky.offsets = 1000, 5, nil
+	require.ErrorIs(t, st.Pull(ctx, "a", &bytes.Buffer{}), io.ErrUnexpectedEOF)
+	require.Equal(t, []int64{0, 1000, 2000, 3000}, flaky.offsets)
+
+	// the read isn't resumed if the version of the file is unknown
+	flaky.failAfter, flaky.failures, flaky.offsets = 1000, 1, nil
+	flaky.noVersion = true
+	require.ErrorIs(t, st.Pull(ctx, "a", &bytes.Buffer{}), io.ErrUnexpectedEOF)
+	require.Equal(t, []int64{0}, flaky.offsets)
+	flaky.failures = 1
+	rc, err := st.OpenFile(ctx, "a", 0, -1)
+	require.NoError(t, err)
+	defer rc.Close()
+	_, err = io.ReadAll(rc)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestOpenFileResume(t *testing.T) {
+	ctx := context.Background()
+	st, flaky := newFlakyStorage(t, nil)
+	content := randomContent(10000)
+	require.NoError(t, st.Push(ctx, bytes.NewReader(content), "a"))
+
+	flaky.failAfter, flaky.failures = 1000, 2
+	rc, err := st.OpenFile(ctx, "a", 2000, 5000)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content[2000:7000], data))
+	require.Equal(t, []int64{2000, 3000, 4000}, flaky.offsets)
+}
+
+func TestResumeChanged(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s3   bool
+	}{
+		{name: "local"},
+		// the content of the same size is detected by the etag
+		{name: "s3", s3: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			var cfg map[string]string
+			if tc.s3 {
+				cfg = s3test.NewServer(t).Config("dir")
+			}
+			st, flaky := newFlakyStorage(t, cfg)
+			content := randomContent(10000)
+			require.NoError(t, st.Push(ctx, bytes.NewReader(content), "a"))
+
+			// another writer replaces the file before the read is resumed
+			size := 9000
+			if tc.s3 {
+				size = len(content)
+			}
+			flaky.failAfter, flaky.failures = 3000, 1
+			flaky.onFail = func() {
+				require.NoError(t, flaky.Storage.Push(ctx, bytes.NewReader(randomContent(size)), "a"))
+			}
+			err := st.Pull(ctx, "a", &bytes.Buffer{})
+			require.ErrorIs(t, err, ErrFileChanged)
+
+			flaky.failures = 1
+			rc, err := st.OpenFile(ctx, "a", 0, -1)
+			require.NoError(t, err)
+			defer rc.Close()
+			_, err = io.ReadAll(rc)
+			require.ErrorIs(t, err, ErrFileChanged)
+		})
+	}
+}
@@ -77,6 +77,50 @@ func (s *sanitizedStorage) Push(ctx context.Context, r io.Reader, rpath string)
 	return s.underlying.Push(ctx, r, relocatedPath)
 }
 
+func (s *sanitizedStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	if strings.HasSuffix(rpath, "/") {
+		return pathError("rpath %q ends with '/'", rpath)
+	}
+	relocatedPath, err := s.relocate(rpath)
+	if err != nil {
+		return pathError("invalid rpath %q: %s", rpath, err)
+	}
+	return storage.PushIfNotExists(ctx, s.underlying, r, relocatedPath)
+}
+
+func (s *sanitizedStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	if strings.HasSuffix(rpath, "/") {
+		return "", pathError("rpath %q ends with '/'", rpath)
+	}
+	relocatedPath, err := s.relocate(rpath)
+	if err != nil {
+		return "", pathError("invalid rpath %q: %s", rpath, err)
+	}
+	return storage.FileETag(ctx, s.underlying, relocatedPath)
+}
+
+func (s *sanitizedStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	if strings.HasSuffix(rpath, "/") {
+		return pathError("rpath %q ends with '/'", rpath)
+	}
+	relocatedPath, err := s.relocate(rpath)
+	if err != nil {
+		return pathError("invalid rpath %q: %s", rpath, err)
+	}
+	return storage.PushIfMatch(ctx, s.underlying, r, relocatedPath, etag)
+}
+
+func (s *sanitizedStorage) MultipartUploader(ctx context.Context, rpath string) (storage.MultipartUploader, error) {
+	if strings.HasSuffix(rpath, "/") {
+		return nil, pathError("rpath %q ends with '/'", rpath)
+	}
+	relocatedPath, err := s.relocate(rpath)
+	if err != nil {
+		return nil, pathError("invalid rpath %q: %s", rpath, err)
+	}
+	return storage.NewMultipartUploader(ctx, s.underlying, relocatedPath)
+}
+
 func (s *sanitizedStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
 	if strings.HasSuffix(rpath, "/") {
 		return pathError("rpath %q ends with '/'", rpath)
@@ -121,7 +165,7 @@ func (s *sanitizedStorage) adjustPath(ctx context.Context, e storage.DirEntry) s
 		log(ctx).Warnf("[SANITIZED] failed to get relative path %q to %q: %v", e.Path(), s.basePath, err)
 		return e
 	}
-	return storage.NewStaticDirEntry(e.IsDir(), e.Name(), final, e.Size(), e.MTime())
+	return storage.NewStaticDirEntryWithHashes(e.IsDir(), e.Name(), final, e.Size(), e.MTime(), e.Hashes())
 }
 
 func (s *sanitizedStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
@@ -173,6 +217,43 @@ func (s *sanitizedStorage) OpenFile(ctx context.Context, rpath string, offset in
 	return s.underlying.OpenFile(ctx, relocatedPath, offset, length)
 }
 
+func (s *sanitizedStorage) Copy(ctx context.Context, src, dst string) error {
+	relocatedSrc, relocatedDst, err := s.relocatePair(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Copy(ctx, relocatedSrc, relocatedDst)
+}
+
+func (s *sanitizedStorage) Move(ctx context.Context, src, dst string) error {
+	relocatedSrc, relocatedDst, err := s.relocatePair(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.underlying.Move(ctx, relocatedSrc, relocatedDst)
+}
+
+// relocatePair relocates the source and destination file paths of Copy and Move.
+func (s *sanitizedStorage) relocatePair(src, dst string) (string, string, error) {
+	for _, p := range []string{src, dst} {
+		if strings.HasSuffix(p, "/") {
+			return "", "", pathError("rpath %q ends with '/'", p)
+		}
+	}
+	relocatedSrc, err := s.relocate(src)
+	if err != nil {
+		return "", "", pathError("invalid rpath %q: %s", src, err)
+	}
+	relocatedDst, err := s.relocate(dst)
+	if err != nil {
+		return "", "", pathError("invalid rpath %q: %s", dst, err)
+	}
+	if relocatedSrc == relocatedDst {
+		return "", "", pathError("source and destination are the same file %q", src)
+	}
+	return relocatedSrc, relocatedDst, nil
+}
+
 func (s *sanitizedStorage) Unwrap() storage.Storage {
 	return s.underlying
 }
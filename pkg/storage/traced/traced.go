@@ -0,0 +1,203 @@
+package traced
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/sanitized"
+	"github.com/apecloud/datasafed/pkg/util"
+)
+
+const tracerName = "github.com/apecloud/datasafed/pkg/storage/traced"
+
+// tracedStorage creates a span for each operation of the underlying storage,
+// named "<layer>.<operation>", e.g. "rclone.Push". Since the context is
+// passed down, the spans of the lower layers are nested in the upper ones.
+type tracedStorage struct {
+	layer      string
+	tracer     trace.Tracer
+	underlying storage.Storage
+}
+
+var _ storage.Storage = (*tracedStorage)(nil)
+
+// New wraps the storage of the layer, e.g. "kopia", with tracing.
+func New(ctx context.Context, underlying storage.Storage, layer string) (storage.Storage, error) {
+	ts := &tracedStorage{
+		layer:      layer,
+		tracer:     otel.Tracer(tracerName),
+		underlying: underlying,
+	}
+	return sanitized.New(ctx, "", ts)
+}
+
+func (s *tracedStorage) Unwrap() storage.Storage {
+	return s.underlying
+}
+
+func (s *tracedStorage) MultipartUploader(ctx context.Context, rpath string) (storage.MultipartUploader, error) {
+	return storage.NewMultipartUploader(ctx, s.underlying, rpath)
+}
+
+func (s *tracedStorage) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("datasafed.layer", s.layer))
+	return s.tracer.Start(ctx, s.layer+"."+op, trace.WithAttributes(attrs...))
+}
+
+// end records the byte count and the error, and ends the span. A missing
+// file is recorded, but it doesn't mark the span as failed, since it's
+// expected when checking the existence of files.
+func end(span trace.Span, n int64, err error) {
+	if n >= 0 {
+		span.SetAttributes(attribute.Int64("datasafed.bytes", n))
+	}
+	if err != nil {
+		span.RecordError(err)
+		if !errors.Is(err, storage.ErrObjectNotFound) && !errors.Is(err, storage.ErrDirNotFound) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func pathAttr(rpath string) attribute.KeyValue {
+	return attribute.String("datasafed.path", rpath)
+}
+
+func (s *tracedStorage) Push(ctx context.Context, r io.Reader, rpath string) error {
+	ctx, span := s.start(ctx, "Push", pathAttr(rpath))
+	cr := &util.CountingReader{R: r}
+	err := s.underlying.Push(ctx, cr, rpath)
+	end(span, cr.N, err)
+	return err
+}
+
+func (s *tracedStorage) PushIfNotExists(ctx context.Context, r io.Reader, rpath string) error {
+	ctx, span := s.start(ctx, "PushIfNotExists", pathAttr(rpath))
+	cr := &util.CountingReader{R: r}
+	err := storage.PushIfNotExists(ctx, s.underlying, cr, rpath)
+	end(span, cr.N, err)
+	return err
+}
+
+func (s *tracedStorage) PushIfMatch(ctx context.Context, r io.Reader, rpath string, etag string) error {
+	ctx, span := s.start(ctx, "PushIfMatch", pathAttr(rpath))
+	cr := &util.CountingReader{R: r}
+	err := storage.PushIfMatch(ctx, s.underlying, cr, rpath, etag)
+	end(span, cr.N, err)
+	return err
+}
+
+func (s *tracedStorage) ETag(ctx context.Context, rpath string) (string, error) {
+	ctx, span := s.start(ctx, "ETag", pathAttr(rpath))
+	etag, err := storage.FileETag(ctx, s.underlying, rpath)
+	end(span, -1, err)
+	return etag, err
+}
+
+func (s *tracedStorage) Pull(ctx context.Context, rpath string, w io.Writer) error {
+	ctx, span := s.start(ctx, "Pull", pathAttr(rpath))
+	cw := &util.CountingWriter{W: w}
+	err := s.underlying.Pull(ctx, rpath, cw)
+	end(span, cw.N, err)
+	return err
+}
+
+// OpenFile ends the span when the returned reader is closed, so the span
+// covers reading the file.
+func (s *tracedStorage) OpenFile(ctx context.Context, rpath string, offset, length int64) (io.ReadCloser, error) {
+	ctx, span := s.start(ctx, "OpenFile", pathAttr(rpath),
+		attribute.Int64("datasafed.offset", offset), attribute.Int64("datasafed.length", length))
+	rc, err := s.underlying.OpenFile(ctx, rpath, offset, length)
+	if err != nil {
+		end(span, -1, err)
+		return nil, err
+	}
+	return &spanReadCloser{CountingReader: util.CountingReader{R: rc}, c: rc, span: span}, nil
+}
+
+func (s *tracedStorage) Remove(ctx context.Context, rpath string, recursive bool) error {
+	ctx, span := s.start(ctx, "Remove", pathAttr(rpath), attribute.Bool("datasafed.recursive", recursive))
+	err := s.underlying.Remove(ctx, rpath, recursive)
+	end(span, -1, err)
+	return err
+}
+
+func (s *tracedStorage) Rmdir(ctx context.Context, rpath string) error {
+	ctx, span := s.start(ctx, "Rmdir", pathAttr(rpath))
+	err := s.underlying.Rmdir(ctx, rpath)
+	end(span, -1, err)
+	return err
+}
+
+func (s *tracedStorage) Mkdir(ctx context.Context, rpath string) error {
+	ctx, span := s.start(ctx, "Mkdir", pathAttr(rpath))
+	err := s.underlying.Mkdir(ctx, rpath)
+	end(span, -1, err)
+	return err
+}
+
+func (s *tracedStorage) List(ctx context.Context, rpath string, opt *storage.ListOptions, cb storage.ListCallback) error {
+	ctx, span := s.start(ctx, "List", pathAttr(rpath))
+	entries := 0
+	err := s.underlying.List(ctx, rpath, opt, func(de storage.DirEntry) error {
+		entries++
+		return cb(de)
+	})
+	span.SetAttributes(attribute.Int("datasafed.entries", entries))
+	end(span, -1, err)
+	return err
+}
+
+func (s *tracedStorage) Stat(ctx context.Context, rpath string) (storage.StatResult, error) {
+	ctx, span := s.start(ctx, "Stat", pathAttr(rpath))
+	result, err := s.underlying.Stat(ctx, rpath)
+	end(span, result.TotalSize, err)
+	return result, err
+}
+
+func (s *tracedStorage) Copy(ctx context.Context, src, dst string) error {
+	ctx, span := s.start(ctx, "Copy", pathAttr(src), attribute.String("datasafed.dst", dst))
+	err := s.underlying.Copy(ctx, src, dst)
+	end(span, -1, err)
+	return err
+}
+
+func (s *tracedStorage) Move(ctx context.Context, src, dst string) error {
+	ctx, span := s.start(ctx, "Move", pathAttr(src), attribute.String("datasafed.dst", dst))
+	err := s.underlying.Move(ctx, src, dst)
+	end(span, -1, err)
+	return err
+}
+
+type spanReadCloser struct {
+	util.CountingReader
+	c    io.Closer
+	span trace.Span
+	// err is the first read error except io.EOF
+	err error
+}
+
+func (r *spanReadCloser) Read(p []byte) (int, error) {
+	n, err := r.CountingReader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *spanReadCloser) Close() error {
+	err := r.c.Close()
+	if r.span != nil {
+		end(r.span, r.N, errors.Join(r.err, err))
+		r.span = nil
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package traced_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+	"github.com/apecloud/datasafed/pkg/storage/traced"
+)
+
+// newStorage returns the local storage traced as the layers "outer" and
+// "rclone", and the recorder of the spans.
+func newStorage(t *testing.T) (storage.Storage, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(old) })
+
+	ctx := context.Background()
+	st, err := rclone.New(ctx, map[string]string{"type": "local", "root": t.TempDir()}, "")
+	require.NoError(t, err)
+	st, err = traced.New(ctx, st, "rclone")
+	require.NoError(t, err)
+	st, err = traced.New(ctx, st, "outer")
+	require.NoError(t, err)
+	return st, recorder
+}
+
+// findSpan returns the last ended span with the name.
+func findSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	spans := recorder.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == name {
+			return spans[i]
+		}
+	}
+	require.Fail(t, "span not found", name)
+	return nil
+}
+
+func attrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestTracedStorage(t *testing.T) {
+	ctx := context.Background()
+	st, recorder := newStorage(t)
+
+	// the spans of the lower layers are nested in the upper ones
+	require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "dir/a"))
+	outer := findSpan(t, recorder, "outer.Push")
+	inner := findSpan(t, recorder, "rclone.Push")
+	require.Equal(t, outer.SpanContext().SpanID(), inner.Parent().SpanID())
+	require.Equal(t, outer.SpanContext().TraceID(), inner.SpanContext().TraceID())
+	for _, span := range []sdktrace.ReadOnlySpan{outer, inner} {
+		a := attrs(span)
+		require.Equal(t, "dir/a", a["datasafed.path"].AsString())
+		require.Equal(t, int64(5), a["datasafed.bytes"].AsInt64())
+		require.Equal(t, codes.Unset, span.Status().Code)
+	}
+	require.Equal(t, "rclone", attrs(inner)["datasafed.layer"].AsString())
+
+	// the bytes read are recorded when the file is closed
+	rc, err := st.OpenFile(ctx, "dir/a", 1, -1)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, int64(4), attrs(findSpan(t, recorder, "outer.OpenFile"))["datasafed.bytes"].AsInt64())
+
+	// a missing file is recorded, but doesn't fail the span
+	require.ErrorIs(t, st.Pull(ctx, "missing", io.Discard), storage.ErrObjectNotFound)
+	span := findSpan(t, recorder, "outer.Pull")
+	require.Equal(t, codes.Unset, span.Status().Code)
+	require.Len(t, span.Events(), 1)
+	require.Equal(t, "exception", span.Events()[0].Name)
+
+	require.Error(t, st.Push(ctx, failingReader{}, "b"))
+	span = findSpan(t, recorder, "outer.Push")
+	require.Equal(t, codes.Error, span.Status().Code)
+	require.Contains(t, span.Status().Description, "connection reset")
+}
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -19,6 +23,9 @@ type DirEntry interface {
 	Path() string
 	Size() int64
 	MTime() time.Time
+	// Hashes returns the hashes of the file provided by the backend,
+	// keyed by the hash type, e.g. "md5". It may be empty.
+	Hashes() map[string]string
 }
 
 type ListOptions struct {
@@ -27,6 +34,35 @@ type ListOptions struct {
 	MaxDepth   int
 	Recursive  bool
 	PathIsFile bool
+	// Hashes requests the hashes of files, if the backend can provide them
+	// without reading the content.
+	Hashes bool
+	// ShowTemp includes the temporary objects of atomic pushes, which are
+	// hidden by default.
+	ShowTemp bool
+}
+
+// TempObjectPrefix is the name prefix of the temporary objects, which atomic
+// pushes upload to before renaming them to the final names.
+const TempObjectPrefix = ".datasafed-tmp-"
+
+// TempObjectPath returns a random path of a temporary object in the
+// directory of rpath.
+func TempObjectPath(rpath string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := TempObjectPrefix + hex.EncodeToString(b)
+	if dir := path.Dir(rpath); dir != "." && dir != "/" {
+		return path.Join(dir, name), nil
+	}
+	return name, nil
+}
+
+// IsTempObject returns true if name is the name of a temporary object.
+func IsTempObject(name string) bool {
+	return strings.HasPrefix(name, TempObjectPrefix)
 }
 
 type ListCallback func(DirEntry) error
@@ -77,14 +113,23 @@ type Storage interface {
 	// The `offset` and `length` parameters are used to specify the range
 	// of the file to read. If `length` is -1, the entire file will be read.
 	OpenFile(ctx context.Context, rpath string, offset int64, length int64) (io.ReadCloser, error)
+
+	// Copy copies the file in `src` to `dst`. If `dst` exists, it will be
+	// overwritten. The copy is done on the server side if possible.
+	Copy(ctx context.Context, src, dst string) error
+
+	// Move moves the file in `src` to `dst`. If `dst` exists, it will be
+	// overwritten. The move is done on the server side if possible.
+	Move(ctx context.Context, src, dst string) error
 }
 
 type staticDirEntry struct {
-	isDir bool
-	name  string
-	path  string
-	size  int64
-	mtime time.Time
+	isDir  bool
+	name   string
+	path   string
+	size   int64
+	mtime  time.Time
+	hashes map[string]string
 }
 
 func (e *staticDirEntry) IsDir() bool      { return e.isDir }
@@ -92,6 +137,9 @@ func (e *staticDirEntry) Name() string     { return e.name }
 func (e *staticDirEntry) Path() string     { return e.path }
 func (e *staticDirEntry) Size() int64      { return e.size }
 func (e *staticDirEntry) MTime() time.Time { return e.mtime }
+func (e *staticDirEntry) Hashes() map[string]string {
+	return e.hashes
+}
 
 func NewStaticDirEntry(isDir bool, name, path string, size int64, mtime time.Time) DirEntry {
 	return &staticDirEntry{
@@ -102,3 +150,15 @@ func NewStaticDirEntry(isDir bool, name, path string, size int64, mtime time.Tim
 		mtime: mtime,
 	}
 }
+
+func NewStaticDirEntryWithHashes(isDir bool, name, path string, size int64, mtime time.Time,
+	hashes map[string]string) DirEntry {
+	return &staticDirEntry{
+		isDir:  isDir,
+		name:   name,
+		path:   path,
+		size:   size,
+		mtime:  mtime,
+		hashes: hashes,
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// UploadOptions tunes the multipart uploads of streaming pushes. The zero
+// value of a field means the default of the backend.
+type UploadOptions struct {
+	// PartSize is the size of each part.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at the same time.
+	Concurrency int
+	// MemoryLimit limits the memory for buffering the parts, the
+	// concurrency is reduced to fit the parts into it.
+	MemoryLimit int64
+	// ExpectedSize is a hint of the size of the pushed stream, the part
+	// size is increased if needed so that the stream fits into the max
+	// number of parts. It should be an upper bound of the actual size.
+	ExpectedSize int64
+}
+
+// Merge returns the options with the non-zero fields of other overriding
+// the ones of o.
+func (o UploadOptions) Merge(other UploadOptions) UploadOptions {
+	if other.PartSize > 0 {
+		o.PartSize = other.PartSize
+	}
+	if other.Concurrency > 0 {
+		o.Concurrency = other.Concurrency
+	}
+	if other.MemoryLimit > 0 {
+		o.MemoryLimit = other.MemoryLimit
+	}
+	if other.ExpectedSize > 0 {
+		o.ExpectedSize = other.ExpectedSize
+	}
+	return o
+}
+
+type contextKey string
+
+const uploadOptionsKey contextKey = "uploadOptions"
+
+// WithUploadOptions returns a context carrying the upload options for
+// the pushes made with it.
+func WithUploadOptions(ctx context.Context, opts UploadOptions) context.Context {
+	return context.WithValue(ctx, uploadOptionsKey, opts)
+}
+
+// UploadOptionsFromContext returns the upload options carried by ctx,
+// or the zero value if there is none.
+func UploadOptionsFromContext(ctx context.Context) UploadOptions {
+	opts, _ := ctx.Value(uploadOptionsKey).(UploadOptions)
+	return opts
+}
+
+// PartSizeLimiter is implemented by storages whose backend limits the size
+// of the parts of multipart uploads.
+type PartSizeLimiter interface {
+	// MinPartSize returns the minimum part size, 0 if there is no limit.
+	MinPartSize() int64
+}
+
+// CheckPartSize returns an error if partSize is non-zero and less than the
+// minimum part size of st, or any storage wrapped by it, so that an invalid
+// size is rejected before reading the pushed stream.
+func CheckPartSize(st Storage, partSize int64) error {
+	if partSize <= 0 {
+		return nil
+	}
+	for {
+		if l, ok := st.(PartSizeLimiter); ok {
+			if minSize := l.MinPartSize(); partSize < minSize {
+				return fmt.Errorf("part size %d is less than the minimum part size %d of the backend", partSize, minSize)
+			}
+		}
+		u, ok := st.(interface{ Unwrap() Storage })
+		if !ok {
+			return nil
+		}
+		st = u.Unwrap()
+	}
+}
+
+// ErrUploadNotFound is returned by MultipartUploader if the multipart upload
+// doesn't exist, e.g. it has been completed or aborted.
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// MultipartStorage is implemented by storages whose backend can upload a file
+// in parts, which are kept by the backend until the upload is completed or
+// aborted, so that another process can continue the upload with its ID.
+type MultipartStorage interface {
+	// MultipartUploader returns the uploader of rpath, or nil if the
+	// backend doesn't support multipart uploads.
+	MultipartUploader(ctx context.Context, rpath string) (MultipartUploader, error)
+}
+
+// MultipartUploader uploads a file in parts with the multipart upload API of
+// the backend, e.g. S3.
+type MultipartUploader interface {
+	// Create starts a multipart upload, and returns its ID.
+	Create(ctx context.Context) (string, error)
+	// UploadPart uploads the part with the number, which starts from 1, and
+	// returns its ETag.
+	UploadPart(ctx context.Context, uploadID string, number int, r io.ReadSeeker, size int64) (string, error)
+	// Complete joins the parts with the ETags into the file on the server
+	// side. If noClobber is true, it fails with ErrPreconditionFailed if
+	// the file exists.
+	Complete(ctx context.Context, uploadID string, etags []string, noClobber bool) error
+	// Abort aborts the multipart upload and removes the uploaded parts.
+	Abort(ctx context.Context, uploadID string) error
+}
+
+// NewMultipartUploader returns the multipart uploader of rpath, or nil if st
+// doesn't implement MultipartStorage, e.g. the content is transformed by
+// encryption.
+func NewMultipartUploader(ctx context.Context, st Storage, rpath string) (MultipartUploader, error) {
+	if s, ok := st.(MultipartStorage); ok {
+		return s.MultipartUploader(ctx, rpath)
+	}
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ErrVerifyFailed is returned if any object is missing or corrupt.
+var ErrVerifyFailed = errors.New("verification failed")
+
+type VerifyOptions struct {
+	// Concurrency is the number of objects verified at the same time.
+	Concurrency int
+	// Progress is called after an object is verified, if it's not nil.
+	// The error is nil if the object is fine.
+	Progress func(rpath string, err error)
+}
+
+type VerifyIssue struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type VerifyReport struct {
+	Path     string `json:"path"`
+	Total    int    `json:"total"`
+	Verified int    `json:"verified"`
+	// Missing objects are listed, but their content can't be found,
+	// e.g. kopia meta files pointing to snapshots that don't exist.
+	Missing []VerifyIssue `json:"missing"`
+	// Corrupt objects can't be read completely, fail to decrypt or
+	// decompress, or don't match their stored checksums.
+	Corrupt []VerifyIssue `json:"corrupt"`
+	// Orphaned objects don't belong to any object, e.g. checksum sidecar
+	// files of removed objects.
+	Orphaned []VerifyIssue `json:"orphaned"`
+}
+
+// Failed returns true if any object is missing or corrupt.
+func (r *VerifyReport) Failed() bool {
+	return len(r.Missing) > 0 || len(r.Corrupt) > 0
+}
+
+// Verify reads every file under rpath with OpenFile, so that the content is
+// authenticated by the layers of st, e.g. decrypted and decompressed, and
+// checks the size against the listed one and the sha256 digest against the
+// checksum sidecar file if any.
+func Verify(ctx context.Context, st Storage, rpath string, opts VerifyOptions) (*VerifyReport, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	var entries []DirEntry
+	sidecars := make(map[string]bool)
+	err := st.List(ctx, rpath, &ListOptions{Recursive: true, FilesOnly: true}, func(de DirEntry) error {
+		if de.IsDir() {
+			return nil
+		}
+		if IsChecksumFile(de.Path()) {
+			sidecars[strings.TrimSuffix(de.Path(), ChecksumSuffix)] = true
+		} else {
+			entries = append(entries, de)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %q error: %w", rpath, err)
+	}
+
+	report := &VerifyReport{
+		Path:     rpath,
+		Total:    len(entries),
+		Missing:  []VerifyIssue{},
+		Corrupt:  []VerifyIssue{},
+		Orphaned: []VerifyIssue{},
+	}
+	var mu sync.Mutex
+	ch := make(chan DirEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for de := range ch {
+				err := verifyFile(ctx, st, de, sidecars[de.Path()])
+				mu.Lock()
+				switch {
+				case err == nil:
+					report.Verified++
+				case errors.Is(err, ErrObjectNotFound):
+					report.Missing = append(report.Missing, VerifyIssue{Path: de.Path(), Error: err.Error()})
+				default:
+					report.Corrupt = append(report.Corrupt, VerifyIssue{Path: de.Path(), Error: err.Error()})
+				}
+				if opts.Progress != nil {
+					opts.Progress(de.Path(), err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, de := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		ch <- de
+	}
+	close(ch)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	listed := make(map[string]bool, len(entries))
+	for _, de := range entries {
+		listed[de.Path()] = true
+	}
+	for p := range sidecars {
+		if !listed[p] {
+			report.Orphaned = append(report.Orphaned, VerifyIssue{
+				Path:  ChecksumPath(p),
+				Error: fmt.Sprintf("the checksum file of %q which doesn't exist", p),
+			})
+		}
+	}
+	return report, nil
+}
+
+func verifyFile(ctx context.Context, st Storage, de DirEntry, hasChecksum bool) error {
+	var expected string
+	if hasChecksum {
+		var err error
+		if expected, err = ReadChecksum(ctx, st, de.Path()); err != nil {
+			return fmt.Errorf("read checksum error: %v", err)
+		}
+	}
+	rc, err := st.OpenFile(ctx, de.Path(), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	hasher, _ := NewHash(HashSHA256)
+	n, err := io.Copy(hasher, rc)
+	if err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+	if n != de.Size() {
+		// the sizes in directory listings may be estimated, e.g. by the
+		// compressed layer, check the exact size of the file
+		size, err := fileSize(ctx, st, de.Path())
+		if err != nil {
+			return fmt.Errorf("size mismatch, listed %d, read %d, and unable to list the file: %w", de.Size(), n, err)
+		}
+		if n != size {
+			return fmt.Errorf("size mismatch, listed %d, read %d", size, n)
+		}
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); expected != "" && actual != expected {
+		return fmt.Errorf("%w: sha256 %s, expected %s", ErrChecksumMismatch, actual, expected)
+	}
+	return nil
+}
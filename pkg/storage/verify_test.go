@@ -0,0 +1,138 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/apecloud/datasafed/pkg/encryption"
+	"github.com/apecloud/datasafed/pkg/storage"
+	"github.com/apecloud/datasafed/pkg/storage/encrypted"
+	"github.com/apecloud/datasafed/pkg/storage/kopia"
+	"github.com/apecloud/datasafed/pkg/storage/rclone"
+)
+
+func issuePaths(issues []storage.VerifyIssue) []string {
+	paths := []string{}
+	for _, issue := range issues {
+		paths = append(paths, issue.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+	content := strings.Repeat("datasafed", 100)
+	for _, rpath := range []string{"ok", "dir/ok", "dir/mismatch"} {
+		require.NoError(t, st.Push(ctx, strings.NewReader(content), rpath))
+	}
+	expected := expectedHashes(content)[storage.HashSHA256]
+	require.NoError(t, storage.WriteChecksum(ctx, st, "ok", expected))
+	require.NoError(t, storage.WriteChecksum(ctx, st, "dir/mismatch", strings.Repeat("0", 64)))
+	require.NoError(t, storage.WriteChecksum(ctx, st, "dir/removed", expected))
+
+	var progressed []string
+	report, err := storage.Verify(ctx, st, "/", storage.VerifyOptions{
+		Concurrency: 2,
+		Progress: func(rpath string, err error) {
+			progressed = append(progressed, rpath)
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, report.Failed())
+	require.Equal(t, 3, report.Total)
+	require.Equal(t, 2, report.Verified)
+	require.Len(t, progressed, 3)
+	require.Empty(t, report.Missing)
+	require.Equal(t, []string{"dir/mismatch"}, issuePaths(report.Corrupt))
+	require.Contains(t, report.Corrupt[0].Error, "checksum mismatch")
+	require.Equal(t, []string{"dir/removed.sha256"}, issuePaths(report.Orphaned))
+
+	// a sub-directory is verified alone
+	report, err = storage.Verify(ctx, st, "dir/", storage.VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Total)
+}
+
+func TestVerifyCorruptEncrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local, err := rclone.New(ctx, map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	e, err := encryption.CreateEncryptor("AES-256-GCM", []byte("secret"))
+	require.NoError(t, err)
+	st, err := encrypted.New(ctx, e, local)
+	require.NoError(t, err)
+	content := strings.Repeat("datasafed", 100)
+	require.NoError(t, st.Push(ctx, strings.NewReader(content), "ok"))
+	require.NoError(t, st.Push(ctx, strings.NewReader(content), "tampered"))
+
+	// flip a byte of the ciphertext
+	upath := filepath.Join(dir, "tampered.enc")
+	data, err := os.ReadFile(upath)
+	require.NoError(t, err)
+	data[len(data)-20] ^= 0xff
+	require.NoError(t, os.WriteFile(upath, data, 0644))
+
+	report, err := storage.Verify(ctx, st, "/", storage.VerifyOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Failed())
+	require.Equal(t, 1, report.Verified)
+	require.Equal(t, []string{"tampered"}, issuePaths(report.Corrupt))
+}
+
+func TestVerifyMissingSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local, err := rclone.New(ctx, map[string]string{"type": "local", "root": dir}, "")
+	require.NoError(t, err)
+	kopia.SetUnderlyingStorage(local)
+	st, err := kopia.New(ctx, map[string]string{
+		kopia.RepoRootKey:     "repo",
+		kopia.DisableCacheKey: "true",
+	}, "")
+	require.NoError(t, err)
+	for _, rpath := range []string{"ok", "missing"} {
+		require.NoError(t, st.Push(ctx, strings.NewReader("hello"), rpath))
+	}
+
+	// point the meta file to a snapshot which doesn't exist
+	metaPath := filepath.Join(dir, "repo.meta", "missing.meta")
+	data, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	meta := map[string]any{}
+	require.NoError(t, json.Unmarshal(data, &meta))
+	meta["snapshot_id"] = strings.Repeat("ab", 16)
+	data, err = json.Marshal(meta)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metaPath, data, 0644))
+
+	report, err := storage.Verify(ctx, st, "/", storage.VerifyOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Failed())
+	require.Equal(t, 1, report.Verified)
+	require.Equal(t, []string{"missing"}, issuePaths(report.Missing))
+	require.Empty(t, report.Corrupt)
+}
+
+func TestVerifyReportJSON(t *testing.T) {
+	ctx := context.Background()
+	st := newLocalStorage(t)
+	require.NoError(t, st.Push(ctx, strings.NewReader("hello"), "a"))
+
+	report, err := storage.Verify(ctx, st, "/", storage.VerifyOptions{})
+	require.NoError(t, err)
+	require.False(t, report.Failed())
+	data, err := json.Marshal(report)
+	require.NoError(t, err)
+	// the issues are always arrays, so that they are easy to consume
+	require.JSONEq(t, `{"path":"/","total":1,"verified":1,"missing":[],"corrupt":[],"orphaned":[]}`, string(data))
+}
@@ -0,0 +1,20 @@
+package storage
+
+import "context"
+
+const fileVersionKey contextKey = "fileVersion"
+
+// WithFileVersion returns a context in which the storages that know the
+// versions of files, e.g. by the size, the modification time and the hash,
+// call fn with the version of the file opened by Pull or OpenFile. The
+// version is only comparable with the versions of the same storage.
+func WithFileVersion(ctx context.Context, fn func(version string)) context.Context {
+	return context.WithValue(ctx, fileVersionKey, fn)
+}
+
+// FileVersionFromContext returns the function carried by ctx, or nil if
+// there is none.
+func FileVersionFromContext(ctx context.Context) func(version string) {
+	fn, _ := ctx.Value(fileVersionKey).(func(string))
+	return fn
+}
@@ -0,0 +1,32 @@
+package util
+
+import "io"
+
+// CountingReader counts the bytes read from R.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// CountingWriter counts the bytes written to W.
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// CloserFunc adapts a function to io.Closer.
+type CloserFunc func() error
+
+func (f CloserFunc) Close() error { return f() }